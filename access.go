@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// parseNetworks parses CIDR networks, such as 10.0.0.0/8, given as
+// comma-separated lists. A single address is a network of its own.
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, value := range values {
+		for _, cidr := range strings.Split(value, ",") {
+			if ip := net.ParseIP(cidr); ip != nil {
+				bits := 8 * len(ip.To4())
+				if bits == 0 {
+					bits = 8 * net.IPv6len
+				}
+				cidr = fmt.Sprintf("%s/%d", cidr, bits)
+			}
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, err
+			}
+			networks = append(networks, network)
+		}
+	}
+	return networks, nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/afq984/cachingreverseproxy/single"
+)
+
+// stringsFlag is a flag.Value collecting the values of a repeated flag.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// runCommand runs the subcommand named by args[0] on the cache of proxy
+// instead of serving.
+func runCommand(proxy *single.CachingReverseProxy, args []string) {
+	switch args[0] {
+	case "import":
+		runImport(proxy, args[1:])
+	case "export":
+		runExport(proxy, args[1:])
+	case "check":
+		runCheck(proxy, args[1:])
+	case "gc":
+		runGC(proxy, args[1:])
+	case "verify":
+		runVerify(proxy, args[1:])
+	case "top":
+		runTop(proxy, args[1:])
+	case "warm":
+		runWarm(proxy, args[1:])
+	default:
+		log.Fatalf("unknown command %q", args[0])
+	}
+}
+
+func runImport(proxy *single.CachingReverseProxy, args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	var dbs stringsFlag
+	fs.Var(&dbs, "db", "request path of a pacman database to fetch and map files with, such as /core/os/x86_64/core.db; may be repeated")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s [flags] import [-db path]... dir...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	for _, dir := range fs.Args() {
+		imported, err := proxy.Import(dir, dbs)
+		log.Printf("imported %d files from %s", len(imported), dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func runExport(proxy *single.CachingReverseProxy, args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var glob, regex, repos stringsFlag
+	fs.Var(&glob, "glob", "export paths matching this shell pattern, such as /core/os/*/*; may be repeated")
+	fs.Var(&regex, "regex", "export paths matching this regular expression; may be repeated")
+	fs.Var(&repos, "repo", "export paths under /repo/; may be repeated")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s [flags] export [-glob pattern] [-regex expr] [-repo name]... dir\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Without selection flags, every cached object is exported.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var matchers []single.PathMatcher
+	for _, pattern := range glob {
+		m, err := single.GlobMatcher(pattern)
+		if err != nil {
+			log.Fatal(err)
+		}
+		matchers = append(matchers, m)
+	}
+	for _, expr := range regex {
+		m, err := single.RegexpMatcher(expr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		matchers = append(matchers, m)
+	}
+	for _, repo := range repos {
+		prefix := "/" + strings.Trim(repo, "/") + "/"
+		matchers = append(matchers, func(cleanPath string) bool {
+			return strings.HasPrefix(cleanPath, prefix)
+		})
+	}
+	match := func(cleanPath string) bool {
+		for _, m := range matchers {
+			if m(cleanPath) {
+				return true
+			}
+		}
+		return len(matchers) == 0
+	}
+
+	exported, err := proxy.Export(match, fs.Arg(0))
+	log.Printf("exported %d files to %s", len(exported), fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runCheck(proxy *single.CachingReverseProxy, args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	connect := fs.Bool("connect", false, "also verify that the upstream and cold storage are reachable")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s [flags] check [-connect]\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Validates the flags and exits with status 1 if there are problems.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	problems := proxy.Check(context.Background(), *connect)
+	for _, problem := range problems {
+		fmt.Fprintln(os.Stderr, "check:", problem)
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+	fmt.Println("configuration OK")
+}
+
+func runGC(proxy *single.CachingReverseProxy, args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	var opts single.GCOptions
+	fs.DurationVar(&opts.MaxIdle, "max-idle", 0, "also evict objects not accessed for this long, 0 to keep them")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "report what would be removed without removing anything")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s [flags] gc [-max-idle duration] [-dry-run] [-json]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	report, err := proxy.GC(opts)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		verb := "removed"
+		if opts.DryRun {
+			verb = "would remove"
+		}
+		for _, item := range report.Removed {
+			fmt.Printf("%s\t%d\t%s\n", item.Reason, item.Size, item.Path)
+		}
+		fmt.Printf("%s %d files, reclaiming %d bytes\n", verb, len(report.Removed), report.Bytes)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runVerify(proxy *single.CachingReverseProxy, args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	var opts single.VerifyOptions
+	fs.BoolVar(&opts.Upstream, "upstream", false, "also revalidate objects with the upstream, removing those changed upstream and checking the size of those without recorded size or digest")
+	refetch := fs.Bool("refetch", false, "download the corrupt objects again once removed")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "report corrupt objects without removing them")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s [flags] verify [-upstream] [-refetch] [-dry-run] [-json]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	report, err := proxy.Verify(context.Background(), opts)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		verb := "removed"
+		if opts.DryRun {
+			verb = "would remove"
+		}
+		for _, item := range report.Corrupt {
+			fmt.Printf("%s\t%d\t%s\n", item.Reason, item.Size, item.Path)
+		}
+		fmt.Printf("checked %d objects, %s %d corrupt\n", report.Checked, verb, len(report.Corrupt))
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *refetch && !opts.DryRun {
+		// Refetch would prefetch in the background, after the command exits
+		var paths []string
+		for _, item := range report.Corrupt {
+			paths = append(paths, item.Path)
+		}
+		for _, cleanPath := range proxy.Warm(paths, proxy.PrefetchConcurrency) {
+			fmt.Fprintln(os.Stderr, "verify: failed to fetch", cleanPath)
+		}
+	}
+}
+
+func runWarm(proxy *single.CachingReverseProxy, args []string) {
+	fs := flag.NewFlagSet("warm", flag.ExitOnError)
+	concurrency := fs.Int("concurrency", proxy.PrefetchConcurrency, "number of objects downloaded at the same time")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s [flags] warm [-concurrency n] file...\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Downloads the objects listed in the files, as paths or upstream URLs one per line, into the cache. A file named - is read from stdin.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var paths []string
+	for _, name := range fs.Args() {
+		f := os.Stdin
+		if name != "-" {
+			var err error
+			f, err = os.Open(name)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		list, err := proxy.ReadPathList(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+		paths = append(paths, list...)
+	}
+	failed := proxy.Warm(paths, *concurrency)
+	for _, cleanPath := range failed {
+		fmt.Fprintln(os.Stderr, "warm: failed to fetch", cleanPath)
+	}
+	fmt.Printf("fetched %d of %d objects\n", len(paths)-len(failed), len(paths))
+	if len(failed) > 0 {
+		os.Exit(1)
+	}
+}
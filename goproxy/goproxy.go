@@ -0,0 +1,43 @@
+// Package goproxy has the cache rules for a Go module proxy upstream, such
+// as https://proxy.golang.org, speaking the GOPROXY protocol.
+//
+// The .info, .mod and .zip files of a module version never change, so they
+// are cached forever. The lists of versions, @v/list, and the latest
+// version, @latest, change whenever a version is published, so they are
+// revalidated on every request.
+package goproxy
+
+import (
+	"regexp"
+
+	"github.com/afq984/cachingreverseproxy/single"
+)
+
+var (
+	// versionPath matches the paths of the files of module versions.
+	versionPath = regexp.MustCompile(`^/.+/@v/[^/]+\.(?:info|mod|zip)$`)
+	// listPath matches the paths of the version lists and latest versions
+	// of modules.
+	listPath = regexp.MustCompile(`^/.+/(?:@v/list|@latest)$`)
+)
+
+// Immutable is a single.PathMatcher matching the .info, .mod and .zip files
+// of module versions.
+func Immutable(cleanPath string) bool {
+	return versionPath.MatchString(cleanPath)
+}
+
+// Mutable is a single.PathMatcher matching the version lists and latest
+// versions of modules.
+func Mutable(cleanPath string) bool {
+	return listPath.MatchString(cleanPath)
+}
+
+// CacheRules returns the cache rules for a module proxy, to be placed
+// before others.
+func CacheRules() []single.CacheRule {
+	return []single.CacheRule{
+		{Match: Immutable, Policy: single.CacheForever},
+		{Match: Mutable, Policy: single.CacheRevalidate},
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/afq984/cachingreverseproxy/single"
+)
+
+// parseClientGroup parses a client group given as name=cidr[,cidr...][:quota],
+// such as ci=10.1.0.0/16,10.2.0.0/16:50G.
+func parseClientGroup(value string) (*single.ClientGroup, error) {
+	eq := strings.IndexByte(value, '=')
+	if eq <= 0 {
+		return nil, fmt.Errorf("invalid client group %q: expected name=cidr[,cidr...][:quota]", value)
+	}
+	g := &single.ClientGroup{Name: value[:eq]}
+	networks := value[eq+1:]
+	if colon := strings.LastIndexByte(networks, ':'); colon >= 0 && !strings.Contains(networks[colon:], "/") {
+		var quota byteSize
+		if err := quota.Set(networks[colon+1:]); err != nil {
+			return nil, fmt.Errorf("invalid client group %q: %v", value, err)
+		}
+		g.Quota = int64(quota)
+		networks = networks[:colon]
+	}
+	for _, cidr := range strings.Split(networks, ",") {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client group %q: %v", value, err)
+		}
+		g.Networks = append(g.Networks, network)
+	}
+	return g, nil
+}
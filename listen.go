@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd socket
+// activation.
+const listenFdsStart = 3
+
+// listen returns the listeners to serve on: the sockets passed by systemd
+// socket activation if any, or else one listening on each of addrs.
+func listen(addrs []string) ([]net.Listener, error) {
+	listeners, err := systemdListeners()
+	if err != nil || len(listeners) > 0 {
+		return listeners, err
+	}
+	return listenAll(addrs)
+}
+
+// listenAll returns a listener on each of addrs, as listenOn.
+func listenAll(addrs []string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		l, err := listenOn(addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listenOn returns a listener on addr, either a TCP address such as :8000,
+// 0.0.0.0:8000 or [::]:8000, or unix: followed by the path of a Unix socket.
+// Addresses without a host listen on both IPv4 and IPv6, while those with an
+// IP address only listen on its family, so that 0.0.0.0:8000 and [::]:8000
+// can be listened on together.
+func listenOn(addr string) (net.Listener, error) {
+	if socket, ok := strings.CutPrefix(addr, "unix:"); ok {
+		// a socket left behind by an unclean exit would fail the listen
+		if info, err := os.Lstat(socket); err == nil && info.Mode().Type() == os.ModeSocket {
+			os.Remove(socket)
+		}
+		return net.Listen("unix", socket)
+	}
+	network := "tcp"
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			network = "tcp6"
+			if ip.To4() != nil {
+				network = "tcp4"
+			}
+		}
+	}
+	return net.Listen(network, addr)
+}
+
+// systemdListeners returns the sockets passed to this process by systemd
+// socket activation, as described in sd_listen_fds(3).
+func systemdListeners() ([]net.Listener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %v", err)
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	var listeners []net.Listener
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %d passed by systemd: %v", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
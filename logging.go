@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// newLogger returns a logger writing messages of at least level to stderr,
+// formatted as text or json.
+func newLogger(level string, format string) (*slog.Logger, error) {
+	var opts slog.HandlerOptions
+	var minLevel slog.Level
+	if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	opts.Level = minLevel
+	opts.AddSource = true
+	opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+		// the file name is enough to find the source
+		if source, ok := a.Value.Any().(*slog.Source); ok && a.Key == slog.SourceKey {
+			a.Value = slog.StringValue(fmt.Sprintf("%s:%d", filepath.Base(source.File), source.Line))
+		}
+		return a
+	}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, &opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, &opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", format)
+}
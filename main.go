@@ -1,24 +1,897 @@
 package main // import "github.com/afq984/cachingreverseproxy"
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/afq984/cachingreverseproxy/goproxy"
+	"github.com/afq984/cachingreverseproxy/registry"
 	"github.com/afq984/cachingreverseproxy/single"
 )
 
 func main() {
 	var upstream string
+	var mode string
+	var routeFlags stringsFlag
+	var mirrors stringsFlag
+	var mirrorlist string
+	var mirrorlistCountries stringsFlag
+	var mirrorlistProtocols stringsFlag
+	var mirrorlistMax int
+	var mirrorlistRefresh time.Duration
+	var mirrorTimeout time.Duration
+	var healthCheckInterval time.Duration
+	var healthCheckPath string
+	var forwardProxyHosts stringsFlag
+	var upstreamConnectTimeout time.Duration
+	var upstreamHeaderTimeout time.Duration
+	var upstreamIdleTimeout time.Duration
+	var upstreamMaxIdleConns int
+	var upstreamMaxConns int
+	var upstreamKeepAlive time.Duration
+	var downloadTimeout time.Duration
+	var upstreamRetries int
+	var retryBackoff time.Duration
 	var cachedir string
 	var port int
+	var listenAddrs stringsFlag
+	var adminListenAddrs stringsFlag
+	var tlsCert string
+	var tlsKey string
+	var acmeHosts stringsFlag
+	var acmeCacheDir string
+	var acmeDirectory string
+	var acmeEmail string
+	var prefix string
+	var admin bool
+	var adminToken string
+	var adminPasswordFile string
+	var adminAllow stringsFlag
+	var allow stringsFlag
+	var trustedProxies stringsFlag
+	var forwardedFor bool
+	var peers stringsFlag
+	var advertiseToPeers bool
+	var peerToken string
+	var allowHTTPPeers bool
+	var via string
+	var auditLog string
+	var metadata string
+	var memoryCacheSize byteSize
+	var memoryObjectSize byteSize = 1 << 20
+	var openFiles int
+	var stagingDir string
+	var stagingSize byteSize = 256 << 20
+	var stagingObjectSize byteSize = 16 << 20
+	var coldStorage string
+	var demoteAfter time.Duration
+	var coldWriteThrough bool
+	var nfsSafe bool
+	var namespace string
+	var dedupe bool
+	var upstreamUser string
+	var upstreamPassword string
+	var upstreamToken string
+	var upstreamHeaders stringsFlag
+	var routeHeaders stringsFlag
+	var routeMirrors stringsFlag
+	var routeMirrorlists stringsFlag
+	var netrc string
+	var noEnvProxy bool
+	var upstreamProtocol string
+	var prewarmConnections int
+	var prewarmInterval time.Duration
+	var readHeaderTimeout time.Duration
+	var readTimeout time.Duration
+	var writeTimeout time.Duration
+	var idleTimeout time.Duration
+	var minClientRate byteSize
+	var maxBandwidth byteSize
+	var maxDownloadRate byteSize
+	var maxObjectDownloadRate byteSize
+	var clientGroups stringsFlag
+	var cacheRuleFlags stringsFlag
+	var evictionDryRun bool
+	var dryRun bool
+	var decisionLog string
+	var maxCacheSize byteSize
+	var maxObjectSize byteSize
+	var minFreeSpace byteSize
+	var slowClientGrace time.Duration
+	var maxHeaderBytes byteSize = 64 << 10
+	var maxPathLength int
+	var maxPathDepth int
+	var verifyDigests bool
+	var verifyPackages bool
+	var maxRequests int
+	var clientRate float64
+	var clientBurst int
+	var maxClientRequests int
+	var maxClientDownloads int
+	var maxDownloads int
+	var retryAfter time.Duration
+	var shutdownTimeout time.Duration
+	var shutdownDownloadTimeout time.Duration
+	var relayRedirects bool
+	var honorCacheControl bool
+	var redirects string
+	var foldCase bool
+	var pathRewriteFlags stringsFlag
+	var clockSkewTolerance time.Duration
+	var maxStale time.Duration
+	var negativeTTL time.Duration
+	var staleWhileRevalidate bool
+	var deltaTransfer bool
+	var prefetchDBUpdates bool
+	var headFromCache bool
+	var prefetchOnHead bool
+	var compress bool
+	var rewriteListings bool
+	var prefetchConcurrency int
+	var verifyInterval time.Duration
+	var verifyOptions single.VerifyOptions
+	var logLevel string
+	var logFormat string
 	flag.StringVar(&upstream, "upstream", "http://mirror.archlinux.example.org", "upstream mirror URL")
+	flag.StringVar(&mode, "mode", "mirror", "what the upstream is: mirror, a file server such as a distribution mirror; registry, a Docker registry, caching blobs and manifests by digest and relaying other requests; or goproxy, a Go module proxy, caching module versions forever and revalidating version lists")
+	flag.Var(&routeFlags, "route", "serve the upstream URL under a path prefix with its own namespace, as /prefix/=url, instead of --upstream; may be repeated")
+	flag.Var(&mirrors, "mirror", "fallback mirror URL, tried in order when the upstream fails; may be repeated")
+	flag.Var(&routeMirrors, "route-mirror", "fallback mirror of the upstream of a --route, as /prefix/=url, like --mirror; may be repeated")
+	flag.Var(&routeMirrorlists, "route-mirrorlist", "mirrorlist of the upstream of a --route, as /prefix/=list, like --mirrorlist; may be repeated for different routes")
+	flag.StringVar(&mirrorlist, "mirrorlist", "", "file or URL of a pacman mirrorlist or of the Arch Linux mirror status JSON, such as https://archlinux.org/mirrors/status/json/, whose mirrors are used after --mirror ones")
+	flag.Var(&mirrorlistCountries, "mirrorlist-country", "only use mirrors from --mirrorlist in this country, as a name or code; may be repeated")
+	flag.Var(&mirrorlistProtocols, "mirrorlist-protocol", "only use mirrors from --mirrorlist with URLs of this scheme, such as https; may be repeated")
+	flag.IntVar(&mirrorlistMax, "mirrorlist-max", 10, "number of mirrors used from --mirrorlist, 0 for all")
+	flag.DurationVar(&mirrorlistRefresh, "mirrorlist-refresh", time.Hour, "how often to reload --mirrorlist")
+	flag.DurationVar(&mirrorTimeout, "mirror-timeout", 10*time.Second, "time to wait for the upstream or a mirror to respond before trying the next mirror, 0 to wait indefinitely")
+	flag.DurationVar(&healthCheckInterval, "health-check-interval", 0, "how often to check the health of the upstream and mirrors and send requests to the fastest first, 0 to try them in order")
+	flag.StringVar(&healthCheckPath, "health-check-path", "/lastsync", "path requested by health checks; its Last-Modified header is taken as when the upstream last synced")
+	flag.DurationVar(&upstreamConnectTimeout, "upstream-connect-timeout", 30*time.Second, "time allowed to connect to the upstream, including the TLS handshake, 0 for no limit")
+	flag.DurationVar(&upstreamHeaderTimeout, "upstream-header-timeout", time.Minute, "time allowed for the upstream to send response headers, 0 for no limit")
+	flag.DurationVar(&upstreamIdleTimeout, "upstream-idle-timeout", 90*time.Second, "time to keep idle upstream connections open")
+	flag.IntVar(&upstreamMaxIdleConns, "upstream-max-idle-conns", 16, "number of idle connections to each upstream host kept open for reuse")
+	flag.IntVar(&upstreamMaxConns, "upstream-max-conns", 0, "number of connections to each upstream host open at a time, further requests waiting for one, 0 for no limit")
+	flag.DurationVar(&upstreamKeepAlive, "upstream-keepalive", 30*time.Second, "interval of TCP keep-alive probes and HTTP/2 pings on upstream connections, negative to disable")
+	flag.DurationVar(&downloadTimeout, "download-timeout", 0, "time allowed to download an object into the cache, 0 for no limit")
+	flag.IntVar(&upstreamRetries, "upstream-retries", 0, "retry upstream requests failing with a network or server error, and resume interrupted downloads into the cache, up to this many times")
+	flag.DurationVar(&retryBackoff, "retry-backoff", 500*time.Millisecond, "time to wait before the first retry of an upstream request, doubled for each following retry")
 	flag.StringVar(&cachedir, "cachedir", "cache.d", "directory to store the cache")
-	flag.IntVar(&port, "port", 8000, "http port to serve")
+	flag.IntVar(&port, "port", 8000, "http port to serve on all addresses, without --listen")
+	flag.Var(&listenAddrs, "listen", "address to serve on, such as 0.0.0.0:8000, [::]:8000, 127.0.0.1:8000 or unix:/run/crp.sock, instead of --port; ignored under systemd socket activation; may be repeated")
+	flag.Var(&adminListenAddrs, "admin-listen", "address to serve the admin API, the status page, progress events and object stats on, such as 127.0.0.1:8001, over plain HTTP, instead of with the proxy; may be repeated")
+	flag.StringVar(&tlsCert, "tls-cert", "", "certificate file to serve HTTPS with, instead of HTTP; requires --tls-key")
+	flag.StringVar(&tlsKey, "tls-key", "", "private key file of --tls-cert")
+	flag.Var(&acmeHosts, "acme-host", "serve HTTPS with a certificate obtained automatically over ACME for this host name; the proxy must be reachable on port 443; may be repeated")
+	flag.StringVar(&acmeCacheDir, "acme-cache-dir", "", "directory to keep ACME account keys and certificates in, default cachingreverseproxy/acme in the user configuration directory, such as ~/.config")
+	flag.StringVar(&acmeDirectory, "acme-directory", "", "ACME directory URL, default Let's Encrypt")
+	flag.StringVar(&acmeEmail, "acme-email", "", "contact email registered with the ACME account")
+	flag.Var(&forwardProxyHosts, "forward-proxy-host", "also act as a forward proxy for clients setting http_proxy, caching http URLs on hosts matching this pattern, such as *.archlinux.org, and tunneling CONNECT requests to them on port 443; other hosts are refused; may be repeated")
+	flag.StringVar(&prefix, "prefix", "/", "URL path to serve the proxy under, such as /mirror/; it is stripped before mapping to the upstream")
+	flag.BoolVar(&admin, "admin", false, "serve the admin API under /-/admin/")
+	flag.StringVar(&adminToken, "admin-token", "", "token required for admin requests; also enables purging with DELETE")
+	flag.StringVar(&adminPasswordFile, "admin-password-file", "", "file of user:bcrypt-hash lines, as written by htpasswd -B, whose users may make admin requests with basic auth; also enables purging with DELETE")
+	flag.Var(&adminAllow, "admin-allow", "only accept admin requests and the status page from clients in these networks, as comma-separated CIDRs or addresses; may be repeated")
+	flag.Var(&allow, "allow", "only serve clients in these networks, as comma-separated CIDRs or addresses, rejecting others with 403; may be repeated")
+	flag.Var(&trustedProxies, "trusted-proxy", "take the client address of requests from proxies in these networks, such as a load balancer, from X-Forwarded-For, for logging, access control and rate limiting, as comma-separated CIDRs or addresses; may be repeated")
+	flag.Var(&peers, "peer", "https URL of a sibling proxy of the same upstream, serving it under the same --prefix and routes, such as https://cache.site-b.lan, asked for objects missing from the cache before the upstream; may be repeated")
+	flag.BoolVar(&allowHTTPPeers, "allow-http-peers", false, "allow --peer URLs over plain HTTP, for peers on a trusted network")
+	flag.BoolVar(&advertiseToPeers, "advertise-to-peers", false, "queue objects downloaded into the cache for prefetch on --peer proxies with --peer-token, so that they copy them")
+	flag.StringVar(&peerToken, "peer-token", "", "token sent by --advertise-to-peers and accepted from peers for prefetch requests only, without the other admin requests")
+	flag.BoolVar(&forwardedFor, "forwarded-for", false, "send the client address in X-Forwarded-For to the upstream")
+	flag.StringVar(&via, "via", "cachingreverseproxy", "name of the proxy in the Via header of upstream requests and responses, empty to not send it")
+	flag.StringVar(&auditLog, "audit-log", "", "file recording administrative actions, appended to")
+	flag.StringVar(&metadata, "metadata", "", "where to record object metadata: sidecar, xattr, bolt, or empty to disable")
+	flag.Var(&memoryCacheSize, "memory-cache-size", "size of the in-memory tier for small objects, 0 to disable")
+	flag.Var(&memoryObjectSize, "memory-object-size", "maximum size of objects kept in memory")
+	flag.IntVar(&openFiles, "open-files", 0, "number of frequently served cached files kept open, 0 to disable")
+	flag.StringVar(&stagingDir, "staging-dir", "", "directory on tmpfs holding in-progress downloads of small objects until they complete")
+	flag.Var(&stagingSize, "staging-size", "maximum total size of downloads in --staging-dir")
+	flag.Var(&stagingObjectSize, "staging-object-size", "maximum size of objects downloaded to --staging-dir")
+	flag.StringVar(&coldStorage, "cold-storage", "", "object storage URL for the cold tier, such as s3://bucket/prefix or gs://bucket/prefix")
+	flag.BoolVar(&coldWriteThrough, "cold-write-through", false, "upload objects to the cold tier while they are downloaded")
+	flag.DurationVar(&demoteAfter, "demote-after", 30*24*time.Hour, "move objects not accessed for this long to the cold tier")
+	flag.BoolVar(&nfsSafe, "nfs-safe", false, "coordinate with other hosts sharing cachedir over NFS")
+	flag.StringVar(&namespace, "namespace", "", `subdirectory of cachedir for this upstream's objects; "auto" derives it from the upstream URL`)
+	flag.BoolVar(&dedupe, "dedupe", false, "store identical objects once using hard links")
+	flag.StringVar(&upstreamUser, "upstream-user", "", "username for basic auth to the upstream; may also be given in the upstream URL; not with --route, whose URLs take credentials instead")
+	flag.StringVar(&upstreamPassword, "upstream-password", "", "password for basic auth to the upstream; read from $UPSTREAM_PASSWORD if not set")
+	flag.StringVar(&upstreamToken, "upstream-token", "", "bearer token for the upstream; read from $UPSTREAM_TOKEN if not set; not with --route, use --route-header instead")
+	flag.Var(&upstreamHeaders, "upstream-header", "header added to upstream requests, as 'Name: value', with ${VAR} replaced by environment variables; not sent to mirrors; may be repeated")
+	flag.Var(&routeHeaders, "route-header", "header added to requests to the upstream of a --route, as '/prefix/=Name: value', instead of --upstream-header; may be repeated")
+	flag.StringVar(&netrc, "netrc", "", "netrc file to read upstream credentials from, such as ~/.netrc")
+	flag.BoolVar(&noEnvProxy, "no-env-proxy", false, "ignore HTTP_PROXY, HTTPS_PROXY and NO_PROXY for upstream requests")
+	flag.StringVar(&upstreamProtocol, "upstream-protocol", "auto", "HTTP version for upstream requests: auto (HTTP/2 if offered over TLS), http1, or http2 (h2c for http upstreams)")
+	flag.IntVar(&prewarmConnections, "prewarm-connections", 0, "number of idle upstream connections to keep open, up to --upstream-max-idle-conns, 0 to disable")
+	flag.DurationVar(&prewarmInterval, "prewarm-interval", 30*time.Second, "how often to refresh the connections kept open by --prewarm-connections")
+	flag.DurationVar(&readHeaderTimeout, "read-header-timeout", 10*time.Second, "time allowed to read request headers")
+	flag.DurationVar(&readTimeout, "read-timeout", time.Minute, "time allowed to read a whole request, 0 for no limit")
+	flag.DurationVar(&writeTimeout, "write-timeout", 0, "time allowed to write a whole response, 0 for no limit; large downloads need 0")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 2*time.Minute, "time to keep idle client connections open")
+	flag.Var(&minClientRate, "min-client-rate", "disconnect clients reading slower than this many bytes per second, 0 to disable")
+	flag.Var(&maxBandwidth, "max-bandwidth", "total bytes per second served to clients, shared fairly between client addresses, 0 for no limit")
+	flag.Var(&maxDownloadRate, "max-download-rate", "total bytes per second downloaded from upstreams into the cache, 0 for no limit")
+	flag.Var(&maxObjectDownloadRate, "max-object-download-rate", "bytes per second downloaded for each object, 0 for no limit")
+	flag.Var(&clientGroups, "client-group", "name=cidr[,cidr...][:quota] account objects requested by these clients together, evicting their least recently used objects beyond quota; requires --metadata; may be repeated")
+	flag.BoolVar(&evictionDryRun, "eviction-dry-run", false, "log the objects that --client-group quotas or --max-cache-size would evict without evicting them")
+	flag.BoolVar(&dryRun, "dry-run", false, "relay every request to the upstream without serving or writing the cache, recording what would have been cached, revalidated or evicted; implies --eviction-dry-run")
+	flag.StringVar(&decisionLog, "decision-log", "", "file recording the decisions of --dry-run and --eviction-dry-run as JSON lines, appended to, instead of logging them")
+	flag.Var(&cacheRuleFlags, "cache-rule", "cache paths matching a pattern with a policy (bypass, revalidate, forever, default, or fresh:duration to serve objects validated within duration without asking the upstream), as policy=glob or policy=regex:expr; may be repeated, the first match applies")
+	flag.BoolVar(&honorCacheControl, "honor-cache-control", false, "serve objects without asking the upstream until they expire according to its Cache-Control or Expires headers; requires --metadata")
+	flag.Var(&maxCacheSize, "max-cache-size", "evict the least recently accessed objects when the cache, of all routes together, exceeds this size, 0 for no limit")
+	flag.Var(&maxObjectSize, "max-object-size", "pass larger objects through without caching them, 0 for no limit")
+	flag.Var(&minFreeSpace, "min-free-space", "pass objects through without caching them when caching them would leave less than this space free on the cache filesystem")
+	flag.DurationVar(&slowClientGrace, "slow-client-grace", 30*time.Second, "how long a client may stall before it is disconnected by --min-client-rate")
+	flag.Var(&maxHeaderBytes, "max-header-bytes", "maximum size of request headers; larger requests get 431")
+	flag.IntVar(&maxPathLength, "max-path-length", 2048, "maximum length of request paths; longer paths get 414, 0 for no limit")
+	flag.IntVar(&maxPathDepth, "max-path-depth", 32, "maximum number of segments of request paths; deeper paths get 414, 0 for no limit")
+	flag.BoolVar(&verifyDigests, "verify-digests", true, "verify downloads against integrity headers sent by the upstream")
+	flag.BoolVar(&verifyPackages, "verify-packages", false, "verify downloaded packages against the checksums in the cached pacman database of their directory")
+	flag.IntVar(&maxRequests, "max-requests", 0, "maximum number of requests served at the same time; more get 503, 0 for no limit")
+	flag.IntVar(&maxDownloads, "max-downloads", 0, "maximum number of objects downloaded into the cache at the same time; requests starting more get 503, 0 for no limit")
+	flag.Float64Var(&clientRate, "client-rate", 0, "requests per second allowed from each client IP address on average; more get 429, 0 for no limit")
+	flag.IntVar(&clientBurst, "client-burst", 20, "requests a client may make at once above --client-rate")
+	flag.IntVar(&maxClientRequests, "max-client-requests", 0, "maximum number of requests served at the same time for each client IP address; more get 429, 0 for no limit")
+	flag.IntVar(&maxClientDownloads, "max-client-downloads", 0, "maximum number of objects downloaded into the cache at the same time for each client IP address; requests starting more get 429, 0 for no limit")
+	flag.DurationVar(&retryAfter, "retry-after", 5*time.Second, "Retry-After sent with 503 responses when overloaded and 429 responses to clients over --max-client-downloads")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "on SIGINT or SIGTERM, how long to wait for requests to complete while answering new ones with 503")
+	flag.DurationVar(&shutdownDownloadTimeout, "shutdown-download-timeout", 0, "on shutdown, how long to wait for downloads into the cache to complete after requests completed, 0 to not wait")
+	flag.StringVar(&redirects, "redirects", "follow", "how to handle upstream redirects: follow, caching the target under the requested path; relay-upstream, relaying redirects within the upstream to clients, pointing them through the proxy; or relay, relaying all redirects")
+	flag.BoolVar(&relayRedirects, "relay-redirects", false, "same as --redirects=relay-upstream")
+	flag.BoolVar(&foldCase, "fold-case", false, "lowercase request paths so that paths differing in case are cached once; the upstream must be case insensitive")
+	flag.Var(&pathRewriteFlags, "rewrite-path", "cache and request paths under a prefix as the same paths under another, as /prefix/=/replacement/, so that equivalent paths are cached once; may be repeated, the first match applies")
+	flag.DurationVar(&clockSkewTolerance, "clock-skew-tolerance", 0, "keep cached files when the upstream Last-Modified is at most this much later, or earlier, and the size is unchanged")
+	flag.DurationVar(&maxStale, "max-stale", 0, "serve cached objects validated within this long, marked stale, when the upstream fails, 0 to disable")
+	flag.DurationVar(&negativeTTL, "negative-ttl", 0, "remember 404 and 410 responses of the upstream for this long, 0 to disable")
+	flag.BoolVar(&staleWhileRevalidate, "stale-while-revalidate", false, "serve cached objects without waiting for the upstream and validate them in the background; objects older than --max-stale, if set, are validated first")
+	flag.BoolVar(&deltaTransfer, "delta", false, "update stale cached files with zsync when the upstream provides .zsync files, and zchunk (.zck) files from their chunks")
+	flag.BoolVar(&prefetchDBUpdates, "prefetch-db-updates", false, "prefetch packages that are new in a pacman database when it is updated")
+	flag.BoolVar(&headFromCache, "head-from-cache", false, "answer HEAD requests for cached objects without asking the upstream, except for paths with the revalidate cache rule")
+	flag.BoolVar(&prefetchOnHead, "prefetch-on-head", false, "prefetch objects that are not cached when they are requested with HEAD")
+	flag.BoolVar(&compress, "compress", false, "compress cached text, JSON and XML objects with gzip for clients accepting it")
+	flag.BoolVar(&rewriteListings, "rewrite-listings", false, "rewrite links of HTML directory listings that point into the upstream to point through the proxy")
+	flag.IntVar(&prefetchConcurrency, "prefetch-concurrency", 2, "number of objects prefetched at the same time")
+	flag.DurationVar(&verifyInterval, "verify-interval", 0, "how often to look for truncated or corrupt cached objects and remove them, 0 to disable")
+	flag.DurationVar(&verifyOptions.Delay, "verify-delay", 100*time.Millisecond, "pause between objects checked by --verify-interval, to keep the load low")
+	flag.BoolVar(&verifyOptions.Upstream, "verify-upstream", true, "revalidate objects with the upstream in --verify-interval, removing those changed upstream and checking the size of those without recorded size or digest")
+	flag.BoolVar(&verifyOptions.Refetch, "verify-refetch", false, "download the corrupt objects removed by --verify-interval again")
+	flag.StringVar(&logLevel, "log-level", "info", "minimum level of log messages: debug, info, warn or error")
+	flag.StringVar(&logFormat, "log-format", "text", "format of log messages: text or json")
 	flag.Parse()
 
+	logger, err := newLogger(logLevel, logFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+	// fatal errors and the output of commands bypass the log level
+	log.SetOutput(os.Stderr)
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
-	http.Handle("/", single.NewCachingReverseProxy(upstream, cachedir))
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
+	var audit *single.AuditLog
+	if auditLog != "" {
+		audit, err = single.OpenAuditLog(auditLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var decisions *single.DecisionLog
+	if decisionLog != "" {
+		decisions, err = single.OpenDecisionLog(decisionLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if dryRun {
+		evictionDryRun = true
+		verifyOptions.DryRun = true
+	}
+	var adminUsers map[string][]byte
+	if adminPasswordFile != "" {
+		adminUsers, err = single.ReadPasswordFile(adminPasswordFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if admin && adminToken == "" && adminPasswordFile == "" {
+		log.Fatal("--admin requires --admin-token or --admin-password-file")
+	}
+	if advertiseToPeers && peerToken == "" {
+		log.Fatal("--advertise-to-peers requires --peer-token")
+	}
+	adminNetworks, err := parseNetworks(adminAllow)
+	if err != nil {
+		log.Fatalf("invalid --admin-allow: %v", err)
+	}
+	allowedNetworks, err := parseNetworks(allow)
+	if err != nil {
+		log.Fatalf("invalid --allow: %v", err)
+	}
+	trustedNetworks, err := parseNetworks(trustedProxies)
+	if err != nil {
+		log.Fatalf("invalid --trusted-proxy: %v", err)
+	}
+	for _, peer := range peers {
+		if u, err := url.Parse(peer); err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			log.Fatalf("invalid --peer %q: expected an http or https URL", peer)
+		} else if u.Scheme == "http" && !allowHTTPPeers {
+			log.Fatalf("--peer %q is not https; pass --allow-http-peers to send it tokens and objects over plain HTTP", peer)
+		}
+	}
+	if nfsSafe && metadata == "bolt" {
+		log.Fatal("the bolt metadata store relies on flock and cannot be shared over NFS")
+	}
+	metadataStore, err := single.OpenMetadataStore(metadata, cachedir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var groups []*single.ClientGroup
+	for _, value := range clientGroups {
+		group, err := parseClientGroup(value)
+		if err != nil {
+			log.Fatal(err)
+		}
+		groups = append(groups, group)
+	}
+	var cacheRules []single.CacheRule
+	for _, value := range cacheRuleFlags {
+		rule, err := parseCacheRule(value)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cacheRules = append(cacheRules, rule)
+	}
+	var pathRewrites []single.PathRewrite
+	for _, value := range pathRewriteFlags {
+		rewrite, err := parsePathRewrite(value)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pathRewrites = append(pathRewrites, rewrite)
+	}
+	redirectMode, ok := single.ParseRedirectMode(redirects)
+	if !ok {
+		log.Fatalf("invalid --redirects %q", redirects)
+	}
+	if relayRedirects {
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "redirects" && redirectMode != single.RelayUpstreamRedirects {
+				log.Fatalf("--relay-redirects cannot be used with --redirects=%s", redirects)
+			}
+		})
+		redirectMode = single.RelayUpstreamRedirects
+	}
+	var proxyOptions []single.Option
+	switch mode {
+	case "mirror":
+	case "registry":
+		if len(forwardProxyHosts) > 0 {
+			log.Fatal("--forward-proxy-host cannot be used with --mode registry")
+		}
+		proxyOptions = append(proxyOptions, single.WithHeaderFilter(registry.ForwardCredentials))
+	case "goproxy":
+		cacheRules = append(goproxy.CacheRules(), cacheRules...)
+	default:
+		log.Fatalf("invalid --mode %q", mode)
+	}
+	if len(groups) > 0 && metadataStore == nil {
+		log.Fatal("--client-group requires --metadata")
+	}
+	if honorCacheControl && metadataStore == nil {
+		log.Fatal("--honor-cache-control requires --metadata")
+	}
+	var memory *single.MemoryCache
+	if memoryCacheSize > 0 {
+		memory = single.NewMemoryCache(int64(memoryCacheSize), int64(memoryObjectSize))
+	}
+	var files *single.FileCache
+	if openFiles > 0 {
+		if nfsSafe {
+			log.Fatal("--open-files cannot be used with --nfs-safe")
+		}
+		files = single.NewFileCache(openFiles)
+	}
+	var staging *single.StagingArea
+	if stagingDir != "" {
+		staging = single.NewStagingArea(stagingDir, int64(stagingSize), int64(stagingObjectSize))
+	}
+	var downloadLimiter *single.RateLimiter
+	if maxDownloadRate > 0 {
+		downloadLimiter = single.NewRateLimiter(int64(maxDownloadRate))
+	}
+	var cold single.ObjectStorage
+	if coldStorage != "" {
+		cold, err = single.OpenObjectStorage(coldStorage)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(routeFlags) > 0 {
+		// the credentials of one upstream must not be sent to the others
+		if len(mirrors) > 0 {
+			log.Fatal("--mirror cannot be used with --route; use --route-mirror instead")
+		}
+		if mirrorlist != "" {
+			log.Fatal("--mirrorlist cannot be used with --route; use --route-mirrorlist instead")
+		}
+		if upstreamUser != "" || upstreamPassword != "" || upstreamToken != "" {
+			log.Fatal("--upstream-user, --upstream-password and --upstream-token cannot be used with --route; give credentials in the route URLs or with --route-header instead")
+		}
+		if len(upstreamHeaders) > 0 {
+			log.Fatal("--upstream-header cannot be used with --route; use --route-header instead")
+		}
+	} else {
+		if upstreamPassword == "" {
+			upstreamPassword = os.Getenv("UPSTREAM_PASSWORD")
+		}
+		if upstreamToken == "" {
+			upstreamToken = os.Getenv("UPSTREAM_TOKEN")
+		}
+	}
+	extraHeaders := make(http.Header)
+	for _, value := range upstreamHeaders {
+		if err := parseHeader(extraHeaders, value); err != nil {
+			log.Fatal(err)
+		}
+	}
+	routeExtraHeaders := make(map[string]http.Header)
+	for _, value := range routeHeaders {
+		if err := parseRouteHeader(routeExtraHeaders, value); err != nil {
+			log.Fatal(err)
+		}
+	}
+	routeMirrorURLs := make(map[string][]string)
+	for _, value := range routeMirrors {
+		if err := parseRouteMirror(routeMirrorURLs, value); err != nil {
+			log.Fatal(err)
+		}
+	}
+	routeMirrorlistLocations := make(map[string]string)
+	for _, value := range routeMirrorlists {
+		if err := parseRouteMirrorlist(routeMirrorlistLocations, value); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var budget *single.CacheBudget
+	if maxCacheSize > 0 {
+		budget = single.NewCacheBudget(int64(maxCacheSize))
+	}
+	if strings.HasPrefix(netrc, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			log.Fatal(err)
+		}
+		netrc = filepath.Join(home, netrc[2:])
+	}
+
+	// newProxy returns a proxy for upstream keeping its objects in namespace,
+	// configured by the flags applying to every upstream. Proxies share the
+	// stores and caches, and the size limit.
+	newProxy := func(upstream, namespace string) *single.CachingReverseProxy {
+		proxy, err := single.NewCachingReverseProxy(upstream, cachedir, proxyOptions...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		proxy.MirrorTimeout = mirrorTimeout
+		proxy.HealthCheckPath = healthCheckPath
+		proxy.AdminToken = adminToken
+		proxy.AdminUsers = adminUsers
+		proxy.AdminNetworks = adminNetworks
+		// purges are only served on the admin listeners
+		proxy.NoDeletePurge = len(adminListenAddrs) > 0
+		proxy.AuditLog = audit
+		proxy.NFSSafe = nfsSafe
+		proxy.Dedupe = dedupe
+		proxy.IgnoreProxyEnvironment = noEnvProxy
+		if err := proxy.SetUpstreamProtocol(upstreamProtocol); err != nil {
+			log.Fatal(err)
+		}
+		proxy.SetUpstreamTimeouts(upstreamConnectTimeout, upstreamHeaderTimeout, upstreamIdleTimeout)
+		proxy.SetUpstreamConnections(upstreamMaxIdleConns, upstreamMaxConns, upstreamKeepAlive)
+		proxy.DownloadTimeout = downloadTimeout
+		proxy.UpstreamRetries = upstreamRetries
+		proxy.RetryBackoff = retryBackoff
+		proxy.VerifyDigests = verifyDigests
+		proxy.VerifyPackages = verifyPackages
+		proxy.MaxDownloads = maxDownloads
+		proxy.RetryAfter = retryAfter
+		proxy.HonorCacheControl = honorCacheControl
+		proxy.MaxClientDownloads = maxClientDownloads
+		proxy.Redirects = redirectMode
+		proxy.FoldCase = foldCase
+		proxy.PathRewrites = pathRewrites
+		proxy.ClockSkewTolerance = clockSkewTolerance
+		proxy.MaxStale = maxStale
+		proxy.NegativeTTL = negativeTTL
+		proxy.StaleWhileRevalidate = staleWhileRevalidate
+		proxy.DeltaTransfer = deltaTransfer
+		proxy.PrefetchDBUpdates = prefetchDBUpdates
+		proxy.HeadFromCache = headFromCache
+		proxy.PrefetchOnHead = prefetchOnHead
+		proxy.CompressCached = compress
+		proxy.RewriteListings = rewriteListings
+		proxy.ForwardedFor = forwardedFor
+		proxy.Via = via
+		proxy.PrefetchConcurrency = prefetchConcurrency
+		proxy.MaxPathLength = maxPathLength
+		proxy.MaxPathDepth = maxPathDepth
+		if netrc != "" && proxy.UpstreamCredentials == nil {
+			u, err := url.Parse(upstream)
+			if err != nil {
+				log.Fatal(err)
+			}
+			proxy.UpstreamCredentials, err = single.LookupNetrc(netrc, u.Hostname())
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		proxy.Namespace = namespace
+		proxy.Metadata = metadataStore
+		proxy.ClientGroups = groups
+		proxy.CacheRules = cacheRules
+		proxy.EvictionDryRun = evictionDryRun
+		proxy.DryRun = dryRun
+		proxy.DecisionLog = decisions
+		if budget != nil {
+			budget.Add(proxy)
+		}
+		proxy.MaxObjectSize = int64(maxObjectSize)
+		proxy.MinFreeSpace = int64(minFreeSpace)
+		if len(proxy.ClientGroups) > 0 {
+			err = proxy.LoadGroupUsage()
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		proxy.Memory = memory
+		proxy.Files = files
+		proxy.Staging = staging
+		proxy.DownloadLimiter = downloadLimiter
+		proxy.MaxObjectDownloadRate = int64(maxObjectDownloadRate)
+		if cold != nil {
+			proxy.ColdStorage = cold
+			proxy.ColdWriteThrough = coldWriteThrough
+		}
+		return proxy
+	}
+
+	type route struct {
+		prefix   string
+		upstream string
+		proxy    *single.CachingReverseProxy
+		// mirrored is whether the upstream has mirrors given
+		mirrored bool
+		// mirrorlist is the mirrorlist of the upstream, if any
+		mirrorlist string
+	}
+	var routes []route
+	if len(routeFlags) == 0 {
+		switch {
+		case namespace == "auto":
+			namespace = single.UpstreamNamespace(upstream)
+		case namespace != "" && (namespace != path.Base(namespace) || namespace == "." || namespace == ".."):
+			log.Fatalf("invalid namespace %q", namespace)
+		}
+		if len(routeHeaders) > 0 || len(routeMirrors) > 0 || len(routeMirrorlists) > 0 {
+			log.Fatal("--route-header, --route-mirror and --route-mirrorlist require --route")
+		}
+		proxy := newProxy(upstream, namespace)
+		if len(extraHeaders) > 0 {
+			proxy.UpstreamHeaders = extraHeaders.Clone()
+		}
+		for _, mirror := range mirrors {
+			proxy.AddMirror(mirror)
+		}
+		if upstreamUser != "" || upstreamToken != "" {
+			proxy.UpstreamCredentials = &single.Credentials{
+				Username:    upstreamUser,
+				Password:    upstreamPassword,
+				BearerToken: upstreamToken,
+			}
+		}
+		routes = append(routes, route{"/", upstream, proxy, len(mirrors) > 0, mirrorlist})
+	} else {
+		if flag.NArg() > 0 {
+			log.Fatal("commands cannot be used with --route; select the cache with --upstream and --namespace instead")
+		}
+		if namespace != "" {
+			log.Fatal("--namespace cannot be used with --route; each route has its own namespace")
+		}
+		for _, value := range routeFlags {
+			prefix, upstream, err := parseRoute(value)
+			if err != nil {
+				log.Fatal(err)
+			}
+			proxy := newProxy(upstream, single.UpstreamNamespace(prefix))
+			if h := routeExtraHeaders[prefix]; h != nil {
+				proxy.UpstreamHeaders = h
+				delete(routeExtraHeaders, prefix)
+			}
+			for _, mirror := range routeMirrorURLs[prefix] {
+				proxy.AddMirror(mirror)
+			}
+			routes = append(routes, route{prefix, upstream, proxy, len(routeMirrorURLs[prefix]) > 0, routeMirrorlistLocations[prefix]})
+			delete(routeMirrorURLs, prefix)
+			delete(routeMirrorlistLocations, prefix)
+		}
+		for prefix := range routeExtraHeaders {
+			log.Fatalf("--route-header for unknown route %s", prefix)
+		}
+		for prefix := range routeMirrorURLs {
+			log.Fatalf("--route-mirror for unknown route %s", prefix)
+		}
+		for prefix := range routeMirrorlistLocations {
+			log.Fatalf("--route-mirrorlist for unknown route %s", prefix)
+		}
+	}
+	if flag.NArg() > 0 {
+		runCommand(routes[0].proxy, flag.Args())
+		return
+	}
+
+	prefix = "/" + strings.Trim(prefix, "/") + "/"
+	if prefix == "//" {
+		prefix = "/"
+	}
+	routesMux := http.NewServeMux()
+	// start recovers the partial downloads of proxy, unless in a dry run,
+	// with mirrors given if mirrored and those of mirrorlist if set, and
+	// starts its background work.
+	start := func(proxy *single.CachingReverseProxy, mirrored bool, mirrorlist string) {
+		// dry runs leave the cache as it is
+		if !dryRun {
+			if err := proxy.RecoverPartials(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		go proxy.RunUsageScan(context.Background(), time.Hour)
+		if err := proxy.LoadObjectStats(); err != nil {
+			slog.Warn("cannot load object stats", "err", err)
+		}
+		if !dryRun {
+			go proxy.RunObjectStats(context.Background(), 5*time.Minute)
+		}
+		if mirrorlist != "" {
+			go proxy.RunMirrorList(context.Background(), &single.MirrorList{
+				Location:  mirrorlist,
+				Countries: mirrorlistCountries,
+				Protocols: mirrorlistProtocols,
+				Max:       mirrorlistMax,
+			}, mirrorlistRefresh)
+		}
+		if healthCheckInterval > 0 && (mirrored || mirrorlist != "") {
+			go proxy.RunHealthChecks(context.Background(), healthCheckInterval)
+		}
+		if prewarmConnections > 0 {
+			go proxy.RunPrewarming(context.Background(), prewarmInterval, prewarmConnections)
+		}
+		if proxy.ColdStorage != nil && !dryRun {
+			go proxy.RunDemotion(context.Background(), time.Hour, demoteAfter)
+		}
+		if verifyInterval > 0 {
+			go proxy.RunVerification(context.Background(), verifyInterval, verifyOptions)
+		}
+	}
+	// the admin endpoints are served with the proxy, unless on their own
+	// listeners
+	adminMux := http.DefaultServeMux
+	if len(adminListenAddrs) > 0 {
+		adminMux = http.NewServeMux()
+	}
+	for _, route := range routes {
+		proxy := route.proxy
+		start(proxy, route.mirrored, route.mirrorlist)
+		mount := prefix + strings.TrimPrefix(route.prefix, "/")
+		proxy.MountPrefix = strings.TrimSuffix(mount, "/")
+		for _, peer := range peers {
+			// peers serve the route under the same path
+			proxy.Peers = append(proxy.Peers, strings.TrimSuffix(peer, "/")+proxy.MountPrefix)
+		}
+		proxy.AdvertiseToPeers = advertiseToPeers
+		proxy.PeerToken = peerToken
+		var h http.Handler = proxy
+		if mode == "registry" {
+			var err error
+			h, err = registry.New(route.upstream, proxy)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		routesMux.Handle(mount, http.StripPrefix(proxy.MountPrefix, h))
+		adminMux.Handle(mount+"-/status", proxy.StatusPage())
+		adminMux.Handle(mount+"-/progress", proxy.ProgressEvents())
+		adminMux.Handle(mount+"-/stats/objects", proxy.ObjectStatsHandler())
+		if admin || peerToken != "" {
+			adminMux.Handle(mount+"-/admin/", http.StripPrefix(mount+"-/admin", proxy.AdminHandler()))
+		}
+	}
+	if budget != nil {
+		go budget.RunEviction(context.Background(), time.Minute)
+	}
+	var handler http.Handler = routesMux
+	var forward *single.ForwardProxy
+	if len(forwardProxyHosts) > 0 {
+		// origins are not sent the credentials, headers or mirrors of the
+		// upstream
+		forward = single.NewForwardProxy(forwardProxyHosts, func(origin string) *single.CachingReverseProxy {
+			return newProxy(origin, single.UpstreamNamespace(origin))
+		}, func(proxy *single.CachingReverseProxy) {
+			start(proxy, false, "")
+		})
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if single.IsProxyRequest(r) {
+				forward.ServeHTTP(w, r)
+			} else {
+				routesMux.ServeHTTP(w, r)
+			}
+		})
+	}
+	if maxBandwidth > 0 {
+		handler = single.ShareBandwidth(handler, int64(maxBandwidth))
+	}
+	if minClientRate > 0 {
+		handler = single.LimitSlowClients(handler, int64(minClientRate), slowClientGrace)
+	}
+	if maxRequests > 0 {
+		handler = single.LimitConcurrentRequests(handler, maxRequests, retryAfter)
+	}
+	if clientRate > 0 || maxClientRequests > 0 {
+		handler = single.LimitClients(handler, clientRate, clientBurst, maxClientRequests)
+	}
+	http.Handle(prefix, handler)
+	var serverHandler http.Handler = http.DefaultServeMux
+	if forward != nil {
+		// proxy requests are not for paths under prefix
+		serverHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if single.IsProxyRequest(r) {
+				handler.ServeHTTP(w, r)
+			} else {
+				http.DefaultServeMux.ServeHTTP(w, r)
+			}
+		})
+	}
+	if len(allowedNetworks) > 0 {
+		serverHandler = single.AllowClients(serverHandler, allowedNetworks)
+	}
+	if len(trustedNetworks) > 0 {
+		serverHandler = single.TrustProxies(serverHandler, trustedNetworks)
+	}
+	if acmeCacheDir == "" && len(acmeHosts) > 0 {
+		// the account keys and certificates must not be served with the
+		// cache, nor removed with it
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			log.Fatalf("cannot find a directory for ACME certificates, set --acme-cache-dir: %v", err)
+		}
+		acmeCacheDir = filepath.Join(dir, "cachingreverseproxy", "acme")
+	}
+	tlsConf, err := tlsConfig(tlsCert, tlsKey, acmeHosts, acmeCacheDir, acmeDirectory, acmeEmail)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(listenAddrs) == 0 {
+		listenAddrs = stringsFlag{fmt.Sprintf(":%d", port)}
+	}
+	listeners, err := listen(listenAddrs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var adminListeners []net.Listener
+	if len(adminListenAddrs) > 0 {
+		adminListeners, err = listenAll(adminListenAddrs)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	server := &http.Server{
+		Handler:           serverHandler,
+		TLSConfig:         tlsConf,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    int(maxHeaderBytes),
+	}
+	serve(server, listeners, tlsConf != nil)
+	servers := []*http.Server{server}
+	if len(adminListeners) > 0 {
+		var adminHandler http.Handler = adminMux
+		if len(allowedNetworks) > 0 {
+			adminHandler = single.AllowClients(adminHandler, allowedNetworks)
+		}
+		if len(trustedNetworks) > 0 {
+			adminHandler = single.TrustProxies(adminHandler, trustedNetworks)
+		}
+		adminServer := &http.Server{
+			Handler:           adminHandler,
+			ReadHeaderTimeout: readHeaderTimeout,
+			IdleTimeout:       idleTimeout,
+			MaxHeaderBytes:    int(maxHeaderBytes),
+		}
+		serve(adminServer, adminListeners, false)
+		servers = append(servers, adminServer)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	slog.Info("shutting down", "signal", <-signals)
+	signal.Stop(signals)
+	for _, server := range servers {
+		server.SetKeepAlivesEnabled(false)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	proxies := make([]*single.CachingReverseProxy, 0, len(routes))
+	for _, route := range routes {
+		proxies = append(proxies, route.proxy)
+	}
+	if forward != nil {
+		proxies = append(proxies, forward.Proxies()...)
+	}
+	for _, proxy := range proxies {
+		if err := proxy.Shutdown(ctx); err != nil {
+			slog.Error("shutdown failed", "err", err)
+		}
+	}
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Error("shutdown failed", "err", err)
+			server.Close()
+		}
+	}
+	if shutdownDownloadTimeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownDownloadTimeout)
+		defer cancel()
+		for _, proxy := range proxies {
+			if err := proxy.WaitForDownloads(ctx); err != nil {
+				slog.Warn("aborting downloads", "err", err)
+			}
+		}
+	}
+	// clean up the downloads still in progress rather than leaving their
+	// temporary files behind
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, proxy := range proxies {
+		if err := proxy.AbortDownloads(ctx); err != nil {
+			slog.Error("abort downloads failed", "err", err)
+		}
+		if dryRun {
+			continue
+		}
+		if err := proxy.SaveObjectStats(); err != nil {
+			slog.Error("save object stats failed", "err", err)
+		}
+	}
+}
+
+// serve serves requests with server on each of listeners in the background,
+// over TLS with the TLSConfig of server if useTLS is set. Serving sets up a
+// TLSConfig for HTTP/2 even without TLS, so it cannot tell.
+func serve(server *http.Server, listeners []net.Listener, useTLS bool) {
+	for _, l := range listeners {
+		slog.Info("listening", "addr", l.Addr().String())
+		go func() {
+			var err error
+			if useTLS {
+				err = server.ServeTLS(l, "", "")
+			} else {
+				err = server.Serve(l)
+			}
+			if err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
 }
@@ -0,0 +1,146 @@
+// Package registry serves a Docker Registry HTTP API V2 upstream, such as
+// https://registry-1.docker.io, through a CachingReverseProxy, as a
+// pull-through cache for container images.
+//
+// Blobs and manifests requested by SHA-256 digest are immutable, so they are
+// cached forever, once their content is verified against the digest.
+// Everything else, including manifests requested by tag, whose
+// digest changes when the tag is pushed again, is relayed to the upstream
+// without caching it. The clients authenticate with the upstream themselves:
+// its token challenges are passed through to them, and their credentials to
+// it.
+package registry
+
+import (
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/afq984/cachingreverseproxy/single"
+)
+
+// apiVersion is the Docker-Distribution-API-Version sent by registries.
+const apiVersion = "registry/2.0"
+
+// contentPath matches the paths of blobs and manifests requested by digest,
+// capturing the digest.
+var contentPath = regexp.MustCompile(`^/v2/.+/(?:blobs|manifests)/([a-z0-9]+(?:[+._-][a-z0-9]+)*:[a-zA-Z0-9=_-]+)$`)
+
+// digestOf returns the digest of the blob or manifest at cleanPath, or ""
+// if cleanPath is not for a blob or manifest requested by digest.
+func digestOf(cleanPath string) string {
+	m := contentPath.FindStringSubmatch(cleanPath)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// Immutable is a single.PathMatcher matching the blobs and manifests
+// requested by a SHA-256 digest, which the cache can verify.
+func Immutable(cleanPath string) bool {
+	return ContentDigest(cleanPath) != nil
+}
+
+// ContentDigest is a single.PathDigest returning the SHA-256 digest of the
+// blob or manifest at cleanPath, if requested by one.
+func ContentDigest(cleanPath string) []byte {
+	hexSum, ok := strings.CutPrefix(digestOf(cleanPath), "sha256:")
+	if !ok {
+		return nil
+	}
+	sum, err := hex.DecodeString(hexSum)
+	if err != nil || len(sum) != 32 {
+		return nil
+	}
+	return sum
+}
+
+// ForwardCredentials is a single.HeaderFilter sending the credentials and
+// accepted manifest types of clients to the upstream, in place of the
+// UpstreamCredentials of the proxy if clients have their own.
+func ForwardCredentials(upstream http.Header, r *http.Request) {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		upstream.Set("Authorization", auth)
+	}
+	if accept := r.Header.Values("Accept"); len(accept) > 0 {
+		upstream["Accept"] = accept
+	}
+}
+
+// Proxy is a pull-through cache for a registry.
+type Proxy struct {
+	cache *single.CachingReverseProxy
+	relay *httputil.ReverseProxy
+}
+
+// New returns a pull-through cache for the registry at upstream, keeping
+// blobs and manifests in cache, a proxy for upstream created with
+// single.WithHeaderFilter(ForwardCredentials). The CacheRules of cache are
+// extended to cache them forever, and its ContentDigest is set to verify
+// them.
+//
+// Cached blobs and manifests are served to any client without asking the
+// upstream, so a cache of private images must only be reachable by clients
+// allowed to pull them.
+func New(upstream string, cache *single.CachingReverseProxy) (*Proxy, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+	cache.CacheRules = append([]single.CacheRule{{Match: Immutable, Policy: single.CacheForever}}, cache.CacheRules...)
+	cache.ContentDigest = ContentDigest
+	p := &Proxy{cache: cache}
+	p.relay = &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(u)
+		},
+	}
+	return p, nil
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	digest := digestOf(r.URL.Path)
+	if !Immutable(r.URL.Path) || r.Method != http.MethodGet && r.Method != http.MethodHead {
+		slog.Debug("relaying registry request", "method", r.Method, "path", r.URL.Path)
+		p.relay.ServeHTTP(w, r)
+		return
+	}
+	p.cache.ServeHTTP(&registryWriter{ResponseWriter: w, digest: digest}, r)
+}
+
+// registryWriter adds the headers registry clients expect to the responses
+// of the cache.
+type registryWriter struct {
+	http.ResponseWriter
+	digest      string
+	wroteHeader bool
+}
+
+func (w *registryWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		h := w.Header()
+		h.Set("Docker-Distribution-API-Version", apiVersion)
+		if status < http.StatusMultipleChoices {
+			h.Set("Docker-Content-Digest", w.digest)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *registryWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *registryWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,51 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+const sum = "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+
+func TestDigestOf(t *testing.T) {
+	for _, test := range []struct {
+		cleanPath string
+		want      string
+	}{
+		{"/v2/library/alpine/blobs/sha256:" + sum, "sha256:" + sum},
+		{"/v2/library/alpine/manifests/sha256:" + sum, "sha256:" + sum},
+		{"/v2/alpine/manifests/sha512:abc", "sha512:abc"},
+		{"/v2/library/alpine/manifests/latest", ""},
+		{"/v2/library/alpine/tags/list", ""},
+		{"/v2/blobs/sha256:" + sum, ""},
+		{"/v1/library/alpine/blobs/sha256:" + sum, ""},
+	} {
+		if got := digestOf(test.cleanPath); got != test.want {
+			t.Errorf("digestOf(%q) = %q, want %q", test.cleanPath, got, test.want)
+		}
+	}
+}
+
+func TestContentDigest(t *testing.T) {
+	want, _ := hex.DecodeString(sum)
+	for _, test := range []struct {
+		cleanPath string
+		want      []byte
+	}{
+		{"/v2/library/alpine/blobs/sha256:" + sum, want},
+		{"/v2/library/alpine/manifests/sha256:" + sum, want},
+		{"/v2/library/alpine/blobs/sha256:" + sum[:62], nil},
+		{"/v2/library/alpine/blobs/sha256:" + sum[:63] + "z", nil},
+		{"/v2/library/alpine/blobs/sha512:" + sum + sum, nil},
+		{"/v2/library/alpine/manifests/latest", nil},
+	} {
+		got := ContentDigest(test.cleanPath)
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("ContentDigest(%q) = %x, want %x", test.cleanPath, got, test.want)
+		}
+		if immutable := Immutable(test.cleanPath); immutable != (test.want != nil) {
+			t.Errorf("Immutable(%q) = %v, want %v", test.cleanPath, immutable, test.want != nil)
+		}
+	}
+}
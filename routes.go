@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// parseRoute parses a route given as /prefix/=url, such as
+// /archlinux/=https://mirror.example.org/archlinux, and returns the prefix
+// with leading and trailing slashes and the upstream URL.
+func parseRoute(value string) (string, string, error) {
+	eq := strings.IndexByte(value, '=')
+	if eq <= 0 {
+		return "", "", fmt.Errorf("invalid route %q: expected /prefix/=url", value)
+	}
+	prefix := "/" + strings.Trim(value[:eq], "/") + "/"
+	if prefix == "//" {
+		return "", "", fmt.Errorf("invalid route %q: the prefix must not be empty", value)
+	}
+	upstream := value[eq+1:]
+	if u, err := url.Parse(upstream); err != nil || u.Host == "" {
+		return "", "", fmt.Errorf("invalid route %q: bad upstream URL", value)
+	}
+	return prefix, upstream, nil
+}
+
+// parseHeader parses a header given as Name: value and adds it to h. The
+// value is expanded with environment variables, such as ${API_KEY}, so that
+// secrets can be kept out of the process list.
+func parseHeader(h http.Header, value string) error {
+	name, v, ok := strings.Cut(value, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || strings.ContainsAny(name, " \t") {
+		return fmt.Errorf("invalid header %q: expected Name: value", value)
+	}
+	h.Add(name, os.ExpandEnv(strings.TrimSpace(v)))
+	return nil
+}
+
+// parseRouteHeader parses a header for the upstream of a route, given as
+// /prefix/=Name: value, and adds it to the headers of the route in headers.
+func parseRouteHeader(headers map[string]http.Header, value string) error {
+	eq := strings.IndexByte(value, '=')
+	if eq <= 0 {
+		return fmt.Errorf("invalid route header %q: expected /prefix/=Name: value", value)
+	}
+	prefix := "/" + strings.Trim(value[:eq], "/") + "/"
+	if headers[prefix] == nil {
+		headers[prefix] = make(http.Header)
+	}
+	return parseHeader(headers[prefix], value[eq+1:])
+}
+
+// parseRouteMirrorlist parses the mirrorlist of the upstream of a route, given
+// as /prefix/=list, and records it for the route in mirrorlists.
+func parseRouteMirrorlist(mirrorlists map[string]string, value string) error {
+	eq := strings.IndexByte(value, '=')
+	if eq <= 0 || eq == len(value)-1 {
+		return fmt.Errorf("invalid route mirrorlist %q: expected /prefix/=list", value)
+	}
+	prefix := "/" + strings.Trim(value[:eq], "/") + "/"
+	if _, ok := mirrorlists[prefix]; ok {
+		return fmt.Errorf("duplicate route mirrorlist for %s", prefix)
+	}
+	mirrorlists[prefix] = value[eq+1:]
+	return nil
+}
+
+// parseRouteMirror parses a mirror of the upstream of a route, given as
+// /prefix/=url, and adds it to the mirrors of the route in mirrors.
+func parseRouteMirror(mirrors map[string][]string, value string) error {
+	eq := strings.IndexByte(value, '=')
+	if eq <= 0 {
+		return fmt.Errorf("invalid route mirror %q: expected /prefix/=url", value)
+	}
+	prefix := "/" + strings.Trim(value[:eq], "/") + "/"
+	mirror := value[eq+1:]
+	if u, err := url.Parse(mirror); err != nil || u.Host == "" {
+		return fmt.Errorf("invalid route mirror %q: bad mirror URL", value)
+	}
+	mirrors[prefix] = append(mirrors[prefix], mirror)
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/afq984/cachingreverseproxy/single"
+)
+
+// parseCacheRule parses a cache rule given as policy=pattern, such as
+// forever=*.pkg.tar.zst, or fresh:duration=pattern, such as fresh:10m=*.db,
+// for the default policy with a MaxAge. The pattern is a glob, matched
+// against the file name unless it contains a slash, or a regular expression
+// if prefixed with regex:, such as bypass=regex:/lastsync$.
+func parseCacheRule(value string) (single.CacheRule, error) {
+	eq := strings.IndexByte(value, '=')
+	if eq <= 0 {
+		return single.CacheRule{}, fmt.Errorf("invalid cache rule %q: expected policy=pattern", value)
+	}
+	var maxAge time.Duration
+	policy, ok := single.ParseCachePolicy(value[:eq])
+	if maxAgeValue, isFresh := strings.CutPrefix(value[:eq], "fresh:"); isFresh {
+		var err error
+		maxAge, err = time.ParseDuration(maxAgeValue)
+		if err != nil || maxAge <= 0 {
+			return single.CacheRule{}, fmt.Errorf("invalid cache rule %q: bad duration %q", value, maxAgeValue)
+		}
+		policy, ok = single.CacheDefault, true
+	}
+	if !ok {
+		return single.CacheRule{}, fmt.Errorf("invalid cache rule %q: unknown policy %q", value, value[:eq])
+	}
+	pattern := value[eq+1:]
+	var match single.PathMatcher
+	var err error
+	switch {
+	case strings.HasPrefix(pattern, "regex:"):
+		match, err = single.RegexpMatcher(strings.TrimPrefix(pattern, "regex:"))
+	case strings.Contains(pattern, "/"):
+		match, err = single.GlobMatcher(pattern)
+	default:
+		match, err = single.GlobMatcher(pattern)
+		if err == nil {
+			matchName := match
+			match = func(cleanPath string) bool {
+				return matchName(path.Base(cleanPath))
+			}
+		}
+	}
+	if err != nil {
+		return single.CacheRule{}, fmt.Errorf("invalid cache rule %q: %v", value, err)
+	}
+	return single.CacheRule{Match: match, Policy: policy, MaxAge: maxAge}, nil
+}
+
+// parsePathRewrite parses a path rewrite given as /prefix/=/replacement/,
+// such as /archlinux/=/.
+func parsePathRewrite(value string) (single.PathRewrite, error) {
+	prefix, replacement, ok := strings.Cut(value, "=")
+	if !ok || !strings.HasPrefix(prefix, "/") || !strings.HasPrefix(replacement, "/") {
+		return single.PathRewrite{}, fmt.Errorf("invalid path rewrite %q: expected /prefix/=/replacement/", value)
+	}
+	return single.PathRewrite{Prefix: prefix, Replacement: replacement}, nil
+}
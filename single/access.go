@@ -0,0 +1,64 @@
+package single
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// AllowClients returns a handler serving requests with h only for clients
+// whose IP address is in one of networks, and rejecting the others with 403.
+func AllowClients(h http.Handler, networks []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !inNetworks(r, networks) {
+			slog.Warn("client not allowed, rejecting", "remote", clientHost(r), "path", r.URL.Path)
+			statusError(w, r, http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// inNetworks reports whether the client of r has an IP address in one of
+// networks.
+func inNetworks(r *http.Request, networks []*net.IPNet) bool {
+	ip := net.ParseIP(clientHost(r))
+	return ip != nil && containsIP(networks, ip)
+}
+
+// ReadPasswordFile reads user names and bcrypt password hashes, one user:hash
+// pair per line, as written by htpasswd -B, for AdminUsers. Empty lines and
+// lines starting with # are ignored.
+func ReadPasswordFile(name string) (map[string][]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", name, n)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: password of %s is not a bcrypt hash: %v", name, n, user, err)
+		}
+		users[user] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
@@ -0,0 +1,132 @@
+package single
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAllowClients(t *testing.T) {
+	var networks []*net.IPNet
+	for _, cidr := range []string{"192.0.2.0/24", "2001:db8::/32"} {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		networks = append(networks, network)
+	}
+	h := AllowClients(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), networks)
+	for _, test := range []struct {
+		remoteAddr   string
+		forwardedFor string
+		status       int
+	}{
+		{"192.0.2.1:1234", "", http.StatusOK},
+		{"[2001:db8::1]:1234", "", http.StatusOK},
+		{"198.51.100.1:1234", "", http.StatusForbidden},
+		{"[2001:db9::1]:1234", "", http.StatusForbidden},
+		// X-Forwarded-For is not trusted
+		{"198.51.100.1:1234", "192.0.2.1", http.StatusForbidden},
+		{"@", "", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/core.db", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("request from %s forwarded for %q: got %d, want %d", test.remoteAddr, test.forwardedFor, w.Code, test.status)
+		}
+	}
+}
+
+func TestReadPasswordFile(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name  string
+		data  string
+		users []string
+		err   string
+	}{
+		{"users", "# admins\n\nalice:" + string(hash) + "\n  bob:" + string(hash) + "  \n", []string{"alice", "bob"}, ""},
+		{"empty", "", nil, ""},
+		{"no hash", "alice\n", nil, ":1: expected user:hash"},
+		{"no user", ":" + string(hash) + "\n", nil, ":1: expected user:hash"},
+		{"plain password", "alice:" + string(hash) + "\nbob:hunter2\n", nil, ":2: password of bob is not a bcrypt hash"},
+	} {
+		name := filepath.Join(t.TempDir(), "passwords")
+		if err := os.WriteFile(name, []byte(test.data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		users, err := ReadPasswordFile(name)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(users) != len(test.users) {
+			t.Errorf("%s: got %d users, want %d", test.name, len(users), len(test.users))
+		}
+		for _, user := range test.users {
+			if bcrypt.CompareHashAndPassword(users[user], []byte("hunter2")) != nil {
+				t.Errorf("%s: wrong hash for %s", test.name, user)
+			}
+		}
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name   string
+		token  string
+		users  map[string][]byte
+		auth   func(r *http.Request)
+		status int
+	}{
+		{name: "no credentials configured", status: http.StatusForbidden},
+		{name: "no credentials configured with a token", auth: func(r *http.Request) { r.Header.Set("Authorization", "Bearer ") }, status: http.StatusForbidden},
+		{name: "unauthenticated", token: "secret", status: http.StatusUnauthorized},
+		{name: "token", token: "secret", auth: func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }, status: http.StatusOK},
+		{name: "wrong token", token: "secret", auth: func(r *http.Request) { r.Header.Set("Authorization", "Bearer secre") }, status: http.StatusUnauthorized},
+		{name: "user", users: map[string][]byte{"alice": hash}, auth: func(r *http.Request) { r.SetBasicAuth("alice", "hunter2") }, status: http.StatusOK},
+		{name: "unknown user", users: map[string][]byte{"alice": hash}, auth: func(r *http.Request) { r.SetBasicAuth("bob", "hunter2") }, status: http.StatusUnauthorized},
+		// the token does not authenticate users with their own password
+		{name: "user with the token", token: "secret", users: map[string][]byte{"alice": hash}, auth: func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, status: http.StatusUnauthorized},
+	} {
+		p, _ := newMemProxy(t, "http://upstream.example")
+		p.AdminToken = test.token
+		p.AdminUsers = test.users
+		r := httptest.NewRequest(http.MethodGet, "/status", nil)
+		if test.auth != nil {
+			test.auth(r)
+		}
+		w := httptest.NewRecorder()
+		p.AdminHandler().ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: got %d, want %d", test.name, w.Code, test.status)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no WWW-Authenticate challenge", test.name)
+		}
+	}
+}
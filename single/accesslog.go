@@ -0,0 +1,88 @@
+package single
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// Cache states of requests, reported in the access log.
+const (
+	// cacheHit is served from the cache without asking the upstream.
+	cacheHit = "HIT"
+	// cacheRevalidated is served from the cache after the upstream confirmed
+	// it is current.
+	cacheRevalidated = "REVALIDATED"
+	// cacheStale is served from the cache without validating it, with
+	// StaleWhileRevalidate or because the upstream failed.
+	cacheStale = "STALE"
+	// cacheMiss is served from a download into the cache.
+	cacheMiss = "MISS"
+	// cacheBypass is relayed from the upstream without caching it.
+	cacheBypass = "BYPASS"
+)
+
+// accessLogWriter records the status and size of a response for the access
+// log.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom copies r with the io.ReaderFrom of the underlying ResponseWriter,
+// if any, so that cached files are still sent with sendfile.
+func (w *accessLogWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	var n int64
+	var err error
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(w.ResponseWriter, r)
+	}
+	w.bytes += n
+	return n, err
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// logAccess writes the access log line of r, answered through w in the cache
+// state cache, which is empty for requests rejected before the cache lookup
+// or failed.
+func (p *CachingReverseProxy) logAccess(r *http.Request, w *accessLogWriter, cache string, start time.Time) {
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	p.logger().Info("request",
+		"method", r.Method,
+		"path", r.URL.Path,
+		"status", status,
+		"bytes", w.bytes,
+		"cache", cache,
+		"duration", time.Since(start),
+		"remote", r.RemoteAddr,
+	)
+}
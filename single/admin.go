@@ -0,0 +1,304 @@
+package single
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// AdminHandler returns a handler serving the administrative API.
+// Paths are relative to where the handler is mounted:
+//
+//	POST /purge?regex=<expr>[&dry_run=1]
+//	POST /purge?glob=<pattern>[&dry_run=1]
+//
+// removes all cached objects matching the pattern and responds with the list
+// of affected paths as JSON.
+//
+//	POST /prefetch
+//
+// queues the objects listed in the request body, as read by ReadPathList, to
+// be downloaded into the cache in the background, PrefetchConcurrency at a
+// time, and responds with the queued paths and those skipped because they
+// are already queued or the queue is full as JSON. Bodies larger than
+// maxPathListSize are refused with 413.
+//
+//	GET /cache/<path>
+//	DELETE /cache/<path>
+//
+// responds with what is known about the object at path as JSON: its size,
+// modification and access times, metadata and download progress, or removes
+// it from the cache.
+//
+//	GET /status
+//
+// responds with the Status of the proxy as JSON.
+//
+//	GET /metrics
+//
+// responds with the same in the Prometheus text format.
+//
+// Requests are restricted to AdminNetworks, and must be authenticated with
+// AdminToken or as one of AdminUsers; all are refused if neither is set.
+// Prefetch requests may instead carry PeerToken, from any network. Actions
+// changing the cache are recorded to AuditLog if set.
+func (p *CachingReverseProxy) AdminHandler() http.Handler {
+	admin := http.NewServeMux()
+	admin.HandleFunc("/purge", p.handlePurge)
+	admin.HandleFunc("/prefetch", p.handlePrefetch)
+	admin.Handle("/cache/", http.StripPrefix("/cache", http.HandlerFunc(p.handleCache)))
+	admin.HandleFunc("GET /status", p.handleStatus)
+	admin.HandleFunc("GET /metrics", p.handleMetrics)
+	mux := http.NewServeMux()
+	mux.Handle("/prefetch", p.allowPeers(p.requireAdmin(admin), http.HandlerFunc(p.handlePrefetch)))
+	mux.Handle("/", p.requireAdmin(admin))
+	return p.recoverPanics(mux)
+}
+
+// allowPeers serves requests authenticated with PeerToken with peer, and
+// others with h.
+func (p *CachingReverseProxy) allowPeers(h http.Handler, peer http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.isPeer(r) {
+			peer.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requireAdmin rejects requests to h from clients outside AdminNetworks,
+// and requests that are not authenticated with AdminToken or AdminUsers, all
+// of them if neither is set.
+func (p *CachingReverseProxy) requireAdmin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(p.AdminNetworks) > 0 && !inNetworks(r, p.AdminNetworks) {
+			p.logger().Warn("admin request from outside the admin networks, rejecting", "remote", clientHost(r), "path", r.URL.Path)
+			statusError(w, r, http.StatusForbidden)
+			return
+		}
+		if !p.adminAuth() {
+			httpError(w, r, http.StatusForbidden, "admin credentials are not configured")
+			return
+		}
+		if !p.isAdmin(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+			statusError(w, r, http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// adminAuth reports whether administrative requests must be authenticated.
+func (p *CachingReverseProxy) adminAuth() bool {
+	return p.AdminToken != "" || len(p.AdminUsers) > 0
+}
+
+// isPeer reports whether r is authenticated with PeerToken.
+func (p *CachingReverseProxy) isPeer(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && p.PeerToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(p.PeerToken)) == 1
+}
+
+// deletePurges reports whether DELETE requests on object paths purge them.
+func (p *CachingReverseProxy) deletePurges() bool {
+	return p.adminAuth() && !p.NoDeletePurge
+}
+
+func (p *CachingReverseProxy) isAdmin(r *http.Request) bool {
+	var token string
+	if user, password, ok := r.BasicAuth(); ok {
+		if hash, ok := p.AdminUsers[user]; ok {
+			return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+		}
+		token = password
+	} else if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	} else {
+		return false
+	}
+	return p.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(p.AdminToken)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("error writing response", "err", err)
+	}
+}
+
+type purgeResponse struct {
+	DryRun bool     `json:"dry_run"`
+	Purged []string `json:"purged"`
+}
+
+func (p *CachingReverseProxy) handlePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		statusError(w, r, http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	var match PathMatcher
+	var err error
+	switch {
+	case query.Get("regex") != "":
+		match, err = RegexpMatcher(query.Get("regex"))
+	case query.Get("glob") != "":
+		match, err = GlobMatcher(query.Get("glob"))
+	default:
+		httpError(w, r, http.StatusBadRequest, "one of regex or glob is required")
+		return
+	}
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	dryRun, _ := strconv.ParseBool(query.Get("dry_run"))
+
+	purged, err := p.Purge(match, dryRun)
+	p.audit(r, "purge", queryParams(query), purged, err)
+	if err != nil {
+		statusError(w, r, http.StatusInternalServerError)
+		p.logger().Error("purge failed", "err", err)
+		return
+	}
+	if dryRun {
+		p.logger().Info("purge dry run", "matched", len(purged))
+	} else {
+		p.logger().Info("purged objects", "count", len(purged))
+	}
+	writeJSON(w, http.StatusOK, purgeResponse{DryRun: dryRun, Purged: purged})
+}
+
+// maxPathListSize is the largest list of paths accepted by the prefetch
+// endpoint, enough for the packages of a whole Arch Linux repository.
+const maxPathListSize = 4 << 20
+
+type prefetchResponse struct {
+	Queued  []string `json:"queued"`
+	Skipped []string `json:"skipped"`
+}
+
+func (p *CachingReverseProxy) handlePrefetch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		statusError(w, r, http.StatusMethodNotAllowed)
+		return
+	}
+	paths, err := p.ReadPathList(http.MaxBytesReader(w, r.Body, maxPathListSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		httpError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("path list larger than %d bytes", tooLarge.Limit))
+		return
+	}
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	resp := prefetchResponse{Queued: []string{}, Skipped: []string{}}
+	for _, cleanPath := range paths {
+		if p.Prefetch(cleanPath) {
+			resp.Queued = append(resp.Queued, cleanPath)
+		} else {
+			resp.Skipped = append(resp.Skipped, cleanPath)
+		}
+	}
+	p.audit(r, "prefetch", nil, resp.Queued, nil)
+	p.logger().Info("queued objects for prefetch", "queued", len(resp.Queued), "skipped", len(resp.Skipped))
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// queryParams flattens query for the audit log.
+func queryParams(query url.Values) map[string]string {
+	params := make(map[string]string, len(query))
+	for k := range query {
+		params[k] = query.Get(k)
+	}
+	return params
+}
+
+// handleDelete purges the object at the request path, so that cache
+// invalidation tools written for other HTTP caches work against the proxy.
+func (p *CachingReverseProxy) handleDelete(w http.ResponseWriter, r *http.Request) {
+	cleanPath := p.cleanRequestPath(r)
+	ok, err := p.purgeObject(cleanPath)
+	if ok || err != nil {
+		p.audit(r, "delete", nil, []string{cleanPath}, err)
+	}
+	if err != nil {
+		statusError(w, r, http.StatusInternalServerError)
+		p.logger().Error("purge failed", "path", cleanPath, "err", err)
+		return
+	}
+	if !ok {
+		statusError(w, r, http.StatusNotFound)
+		return
+	}
+	p.logger().Info("purged", "path", cleanPath)
+	writeJSON(w, http.StatusOK, purgeResponse{Purged: []string{cleanPath}})
+}
+
+// objectInfo describes a cached object for the admin API.
+type objectInfo struct {
+	Path       string          `json:"path"`
+	Cached     bool            `json:"cached"`
+	Size       int64           `json:"size,omitempty"`
+	ModTime    *time.Time      `json:"mod_time,omitempty"`
+	AccessTime *time.Time      `json:"access_time,omitempty"`
+	InMemory   bool            `json:"in_memory"`
+	Metadata   *Metadata       `json:"metadata,omitempty"`
+	Download   *DownloadStatus `json:"download,omitempty"`
+}
+
+// handleCache inspects or purges the object at the request path.
+func (p *CachingReverseProxy) handleCache(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodDelete:
+		p.handleDelete(w, r)
+		return
+	default:
+		w.Header().Set("Allow", "GET, HEAD, DELETE")
+		statusError(w, r, http.StatusMethodNotAllowed)
+		return
+	}
+	cleanPath := p.cleanRequestPath(r)
+	obj := objectInfo{Path: cleanPath}
+	info, err := p.cacheFS().Stat(path.Join(p.cacheRoot(), cleanPath))
+	if err == nil && info.Mode().IsRegular() && !isInternalFile(info.Name()) {
+		modTime := info.ModTime().UTC()
+		atime := accessTime(info).UTC()
+		obj.Cached = true
+		obj.Size = info.Size()
+		obj.ModTime = &modTime
+		obj.AccessTime = &atime
+	}
+	if p.Memory != nil {
+		obj.InMemory = p.Memory.contains(p.objectKey(cleanPath))
+	}
+	if p.Metadata != nil {
+		obj.Metadata, err = p.Metadata.Get(p.objectKey(cleanPath))
+		if err != nil {
+			p.logger().Warn("cannot read metadata", "path", cleanPath, "err", err)
+		}
+	}
+	obj.Download = p.downloadStatus(cleanPath)
+	if !obj.Cached && obj.Download == nil {
+		writeJSON(w, http.StatusNotFound, obj)
+		return
+	}
+	writeJSON(w, http.StatusOK, obj)
+}
@@ -0,0 +1,106 @@
+package single
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditLog records administrative actions to an append-only file, one JSON
+// object per line.
+type AuditLog struct {
+	jsonLines
+}
+
+// OpenAuditLog opens the audit log at name, creating it if needed.
+func OpenAuditLog(name string) (*AuditLog, error) {
+	f, err := openJSONLines(name)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{jsonLines{file: f}}, nil
+}
+
+// jsonLines is an append-only file of JSON objects, one per line.
+type jsonLines struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// openJSONLines opens the file of JSON lines at name for appending,
+// creating it if needed.
+func openJSONLines(name string) (*os.File, error) {
+	return os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+}
+
+func (l *jsonLines) write(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// a single write keeps lines whole with O_APPEND
+	_, err = l.file.Write(append(data, '\n'))
+	return err
+}
+
+// Close closes the file.
+func (l *jsonLines) Close() error {
+	return l.file.Close()
+}
+
+// auditEntry is a line of the audit log.
+type auditEntry struct {
+	Time time.Time `json:"time"`
+	// Principal is the user name given with basic authentication, "token"
+	// for bearer tokens, or empty if the request was not authenticated.
+	Principal string            `json:"principal"`
+	Remote    string            `json:"remote"`
+	Action    string            `json:"action"`
+	Params    map[string]string `json:"params,omitempty"`
+	Paths     []string          `json:"paths"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// audit records the administrative action requested by r, with its
+// parameters and the paths it affected, to AuditLog if set.
+func (p *CachingReverseProxy) audit(r *http.Request, action string, params map[string]string, paths []string, err error) {
+	if p.AuditLog == nil {
+		return
+	}
+	e := &auditEntry{
+		Time:      p.now().UTC(),
+		Principal: p.principal(r),
+		Remote:    r.RemoteAddr,
+		Action:    action,
+		Params:    params,
+		Paths:     paths,
+	}
+	if e.Paths == nil {
+		e.Paths = []string{}
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if err := p.AuditLog.write(e); err != nil {
+		p.logger().Error("cannot write audit log", "err", err)
+	}
+}
+
+// principal returns who authenticated r.
+func (p *CachingReverseProxy) principal(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok {
+		return user
+	}
+	if p.isPeer(r) {
+		return "peer"
+	}
+	if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		return "token"
+	}
+	return ""
+}
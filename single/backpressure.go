@@ -0,0 +1,74 @@
+package single
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LimitConcurrentRequests returns a handler serving at most max requests at a
+// time with h. Requests beyond that are rejected right away with 503 and a
+// Retry-After header of retryAfter, instead of waiting for a slot.
+func LimitConcurrentRequests(h http.Handler, max int, retryAfter time.Duration) http.Handler {
+	slots := make(chan struct{}, max)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+			h.ServeHTTP(w, r)
+		default:
+			slog.Warn("too many requests, rejecting", "path", r.URL.Path)
+			serviceUnavailable(w, r, retryAfter)
+		}
+	})
+}
+
+// serviceUnavailable replies with 503, asking the client to retry after
+// retryAfter.
+func serviceUnavailable(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	statusError(w, r, http.StatusServiceUnavailable)
+}
+
+// downloadSlots counts the downloads into the cache, from when their
+// objectHandle is stored until it is forgotten, in total and by client
+// address, to keep them within MaxDownloads and MaxClientDownloads.
+type downloadSlots struct {
+	total    int
+	byClient map[string]int
+}
+
+// reserveDownload reserves a download for client within MaxDownloads and
+// MaxClientDownloads, and returns a func releasing it. If either limit is
+// reached, it returns the status to reject the request with instead: 503
+// for MaxDownloads and 429 for MaxClientDownloads.
+func (p *CachingReverseProxy) reserveDownload(client string) (func(), int) {
+	p.downloadsMu.Lock()
+	defer p.downloadsMu.Unlock()
+	slots := &p.downloadSlots
+	switch {
+	case p.MaxDownloads > 0 && slots.total >= p.MaxDownloads:
+		return nil, http.StatusServiceUnavailable
+	case p.MaxClientDownloads > 0 && slots.byClient[client] >= p.MaxClientDownloads:
+		return nil, http.StatusTooManyRequests
+	}
+	if slots.byClient == nil {
+		slots.byClient = make(map[string]int)
+	}
+	slots.total++
+	slots.byClient[client]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.downloadsMu.Lock()
+			defer p.downloadsMu.Unlock()
+			slots.total--
+			if slots.byClient[client]--; slots.byClient[client] == 0 {
+				delete(slots.byClient, client)
+			}
+		})
+	}, 0
+}
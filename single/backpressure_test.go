@@ -0,0 +1,77 @@
+package single
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingUpstream sends the headers of cacheable objects of size bytes
+// right away, and their content once release is closed.
+func blockingUpstream(size int, release chan struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		w.Header().Set("Last-Modified", time.Unix(0, 0).UTC().Format(http.TimeFormat))
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write(make([]byte, size))
+	}))
+}
+
+func TestMaxDownloadsConcurrent(t *testing.T) {
+	release := make(chan struct{})
+	upstream := blockingUpstream(1024, release)
+	defer upstream.Close()
+	p, err := NewCachingReverseProxy(upstream.URL, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.MaxDownloads = 2
+	const requests = 16
+	statuses := make(chan int, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/object"+strconv.Itoa(i), nil))
+			statuses <- w.Code
+		}()
+	}
+	// the rejected requests complete while the others wait for the upstream
+	timeout := time.After(5 * time.Second)
+rejections:
+	for i := 0; i < requests-p.MaxDownloads; i++ {
+		select {
+		case status := <-statuses:
+			if status != http.StatusServiceUnavailable {
+				t.Errorf("got %d, want %d", status, http.StatusServiceUnavailable)
+			}
+		case <-timeout:
+			t.Errorf("%d requests rejected, want %d", i, requests-p.MaxDownloads)
+			break rejections
+		}
+	}
+	close(release)
+	wg.Wait()
+	close(statuses)
+	for status := range statuses {
+		if status != http.StatusOK {
+			t.Errorf("got %d, want %d", status, http.StatusOK)
+		}
+	}
+	if err := p.WaitForDownloads(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	p.downloadsMu.Lock()
+	defer p.downloadsMu.Unlock()
+	if p.downloadSlots.total != 0 {
+		t.Errorf("%d downloads still reserved", p.downloadSlots.total)
+	}
+}
@@ -0,0 +1,182 @@
+package single
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand/v2"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheFS is the filesystem the disk cache is kept in, so that it can be
+// kept elsewhere than in a directory of the operating system, such as in
+// memory with MemFS for tests. Names are slash-separated paths under the
+// cache directory given to NewCachingReverseProxy. The methods behave like
+// the functions of package os of the same name, and report missing files
+// with errors satisfying os.IsNotExist.
+//
+// Dedupe, NFSSafe, MinFreeSpace, the sidecar and xattr metadata stores, the
+// Content-Type kept in extended attributes without metadata, and the
+// commands Check and GC work on directories of the operating system only,
+// and must not be used with other filesystems.
+type CacheFS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (CacheFile, error)
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	// ReadDir returns the entries of the directory name, sorted by name.
+	ReadDir(name string) ([]os.FileInfo, error)
+	MkdirAll(name string, perm os.FileMode) error
+	Rename(oldname, newname string) error
+	Remove(name string) error
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// CacheFile is a file open in a CacheFS. *os.File implements it.
+type CacheFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+}
+
+// osFS is the CacheFS of the operating system.
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (CacheFile, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error)      { return os.Stat(name) }
+func (osFS) Lstat(name string) (os.FileInfo, error)     { return os.Lstat(name) }
+func (osFS) ReadDir(name string) ([]os.FileInfo, error) { return ioutil.ReadDir(name) }
+func (osFS) MkdirAll(name string, perm os.FileMode) error {
+	return os.MkdirAll(name, perm)
+}
+func (osFS) Rename(oldname, newname string) error { return os.Rename(oldname, newname) }
+func (osFS) Remove(name string) error             { return os.Remove(name) }
+func (osFS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+// cacheFS returns the CacheFS of p.
+func (p *CachingReverseProxy) cacheFS() CacheFS {
+	if p.fs != nil {
+		return p.fs
+	}
+	return osFS{}
+}
+
+// openFS opens the file name of fsys for reading.
+func openFS(fsys CacheFS, name string) (CacheFile, error) {
+	return fsys.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// createTemp creates a new file in the directory dir of fsys, open for
+// reading and writing, named after pattern with its last * replaced by a
+// random string, as with ioutil.TempFile.
+func createTemp(fsys CacheFS, dir, pattern string) (CacheFile, error) {
+	prefix, suffix := pattern, ""
+	if i := strings.LastIndex(pattern, "*"); i >= 0 {
+		prefix, suffix = pattern[:i], pattern[i+1:]
+	}
+	for try := 0; ; try++ {
+		name := path.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10)+suffix)
+		f, err := fsys.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) && try < 10000 {
+			continue
+		}
+		return f, err
+	}
+}
+
+// readFileFS returns the content of the file name of fsys.
+func readFileFS(fsys CacheFS, name string) ([]byte, error) {
+	f, err := openFS(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// writeFileFS replaces the file name of fsys with one containing data,
+// atomically with a temporary file.
+func writeFileFS(fsys CacheFS, name string, data []byte) error {
+	tempFile, err := createTemp(fsys, path.Dir(name), path.Base(name)+".part.*")
+	if err != nil {
+		return err
+	}
+	_, err = tempFile.Write(data)
+	if cerr := tempFile.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = fsys.Rename(tempFile.Name(), name)
+	}
+	if err != nil {
+		fsys.Remove(tempFile.Name())
+	}
+	return err
+}
+
+// walkFS walks the tree of fsys rooted at root, as filepath.Walk does.
+func walkFS(fsys CacheFS, root string, fn filepath.WalkFunc) error {
+	info, err := fsys.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkFSEntry(fsys, root, info, fn)
+	}
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+func walkFSEntry(fsys CacheFS, name string, info os.FileInfo, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(name, info, nil)
+	}
+	entries, err := fsys.ReadDir(name)
+	if err1 := fn(name, info, err); err != nil || err1 != nil {
+		return err1
+	}
+	for _, entry := range entries {
+		err := walkFSEntry(fsys, path.Join(name, entry.Name()), entry, fn)
+		if err != nil && (!entry.IsDir() || err != filepath.SkipDir) {
+			return err
+		}
+	}
+	return nil
+}
+
+// accessTime returns the access time of the file described by info, or its
+// modification time if it is unknown.
+func accessTime(info os.FileInfo) time.Time {
+	if info, ok := info.(*memFileInfo); ok {
+		return info.atime
+	}
+	return systemAccessTime(info)
+}
+
+// sameFile reports whether fi1 and fi2 describe the same file, as
+// os.SameFile does.
+func sameFile(fi1, fi2 os.FileInfo) bool {
+	if m1, ok := fi1.(*memFileInfo); ok {
+		m2, ok := fi2.(*memFileInfo)
+		return ok && m1.node == m2.node
+	}
+	return os.SameFile(fi1, fi2)
+}
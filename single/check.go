@@ -0,0 +1,102 @@
+package single
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+)
+
+// errStopWalk stops a Walk early.
+var errStopWalk = errors.New("stop walking")
+
+// Check validates the configuration of p and returns the problems found: the
+// upstream and mirror URLs must be valid http or https URLs and the cache
+// directory must be writable. With connect, it also makes a request to the
+// upstream and each mirror and lists ColdStorage, to verify that they are
+// reachable and the credentials are accepted. Nothing in the cache is
+// modified.
+func (p *CachingReverseProxy) Check(ctx context.Context, connect bool) []error {
+	var problems []error
+	for _, m := range p.upstreams() {
+		prefix := m.prefix
+		u, err := url.Parse(prefix)
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Errorf("invalid upstream URL: %v", err))
+		case u.Scheme != "http" && u.Scheme != "https":
+			problems = append(problems, fmt.Errorf("upstream URL %q must start with http:// or https://", prefix))
+		case u.Host == "":
+			problems = append(problems, fmt.Errorf("upstream URL %q has no host", prefix))
+		case u.RawQuery != "" || u.Fragment != "":
+			problems = append(problems, fmt.Errorf("upstream URL %q must not have a query or fragment", prefix))
+		}
+	}
+
+	if err := checkWritable(p.cacheRoot()); err != nil {
+		problems = append(problems, fmt.Errorf("cache directory is not usable: %v", err))
+	}
+
+	if !connect || len(problems) > 0 {
+		return problems
+	}
+	req, err := p.newUpstreamRequest(http.MethodHead, "/")
+	if err != nil {
+		return append(problems, err)
+	}
+	for _, m := range p.upstreams() {
+		resp, err := p.tryMirror(req.WithContext(ctx), m, m.prefix+"/")
+		if err == nil {
+			resp.Body.Close()
+			switch {
+			case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+				err = fmt.Errorf("upstream rejected the credentials: %s", resp.Status)
+			case resp.StatusCode >= 500:
+				err = fmt.Errorf("upstream returned %s", resp.Status)
+			}
+		}
+		if err != nil {
+			problems = append(problems, fmt.Errorf("cannot reach upstream %s: %v", m.prefix, err))
+		}
+	}
+	if p.ColdStorage != nil {
+		err := p.ColdStorage.Walk(ctx, func(key string) error {
+			return errStopWalk
+		})
+		if err != nil && err != errStopWalk {
+			problems = append(problems, fmt.Errorf("cannot list cold storage: %v", err))
+		}
+	}
+	return problems
+}
+
+// checkWritable verifies that files can be created and renamed in dir, or
+// in the nearest existing parent if dir does not exist yet.
+func checkWritable(dir string) error {
+	info, err := os.Stat(dir)
+	for os.IsNotExist(err) && path.Dir(dir) != dir {
+		dir = path.Dir(dir)
+		info, err = os.Stat(dir)
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	f, err := ioutil.TempFile(dir, internalMarker+"check.part.*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	renamed := f.Name() + ".renamed"
+	if err := os.Rename(f.Name(), renamed); err != nil {
+		return err
+	}
+	return os.Remove(renamed)
+}
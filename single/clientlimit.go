@@ -0,0 +1,120 @@
+package single
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// clientSweepInterval is how often LimitClients forgets idle clients.
+const clientSweepInterval = time.Minute
+
+// clientHost returns the IP address of the client of r.
+func clientHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// LimitClients returns a handler serving requests with h, allowing each
+// client IP address rate requests per second on average, with bursts of up
+// to burst requests, and, if maxConcurrent is positive, at most
+// maxConcurrent requests at a time. Requests beyond that are rejected with
+// 429 and a Retry-After header, so that one client cannot monopolize the
+// proxy. A rate of 0 does not limit the rate.
+func LimitClients(h http.Handler, rate float64, burst int, maxConcurrent int) http.Handler {
+	l := &clientLimiter{
+		rate:          rate,
+		burst:         float64(max(burst, 1)),
+		maxConcurrent: maxConcurrent,
+		clients:       make(map[string]*clientState),
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := clientHost(r)
+		if retryAfter, ok := l.acquire(client); !ok {
+			slog.Warn("client over its limit, rejecting", "remote", client, "path", r.URL.Path)
+			tooManyRequests(w, r, retryAfter)
+			return
+		}
+		defer l.release(client)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// clientLimiter tracks the request rate, with a token bucket, and the
+// requests in progress of each client.
+type clientLimiter struct {
+	rate          float64
+	burst         float64
+	maxConcurrent int
+
+	mu        sync.Mutex
+	clients   map[string]*clientState
+	lastSweep time.Time
+}
+
+type clientState struct {
+	tokens float64
+	last   time.Time
+	active int
+}
+
+// acquire starts a request of client, or returns how long it should wait
+// before retrying if it is over its limits.
+func (l *clientLimiter) acquire(client string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.sweep(now)
+	c, ok := l.clients[client]
+	if !ok {
+		c = &clientState{tokens: l.burst, last: now}
+		l.clients[client] = c
+	}
+	if l.maxConcurrent > 0 && c.active >= l.maxConcurrent {
+		return time.Second, false
+	}
+	if l.rate > 0 {
+		c.tokens = min(c.tokens+now.Sub(c.last).Seconds()*l.rate, l.burst)
+		c.last = now
+		if c.tokens < 1 {
+			return time.Duration((1 - c.tokens) / l.rate * float64(time.Second)), false
+		}
+		c.tokens--
+	}
+	c.active++
+	return 0, true
+}
+
+func (l *clientLimiter) release(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clients[client].active--
+}
+
+// sweep forgets the clients without requests in progress whose bucket has
+// refilled, at most every clientSweepInterval.
+func (l *clientLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < clientSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for client, c := range l.clients {
+		if c.active == 0 && (l.rate <= 0 || c.tokens+now.Sub(c.last).Seconds()*l.rate >= l.burst) {
+			delete(l.clients, client)
+		}
+	}
+}
+
+// tooManyRequests replies with 429, asking the client to retry after
+// retryAfter.
+func tooManyRequests(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	statusError(w, r, http.StatusTooManyRequests)
+}
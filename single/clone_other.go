@@ -0,0 +1,9 @@
+//go:build !linux
+
+package single
+
+import "errors"
+
+func reflink(dst, src string) error {
+	return errors.New("cloning files is not supported on this platform")
+}
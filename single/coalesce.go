@@ -0,0 +1,83 @@
+package single
+
+import (
+	"net/http"
+	"path"
+	"sync"
+)
+
+// fetch is an upstream request for an uncached object. Other requests for the
+// object wait for it, so that they share its download instead of each making
+// an upstream request.
+type fetch struct {
+	done chan struct{}
+	once sync.Once
+}
+
+// activeDownload returns the handle downloading cleanPath into the cache, or
+// nil if it is not being downloaded.
+func (p *CachingReverseProxy) activeDownload(cleanPath string) *objectHandle {
+	i, ok := p.objectHandles.Load(cleanPath)
+	if !ok {
+		return nil
+	}
+	h := i.(*objectHandle)
+	p.downloadsMu.Lock()
+	defer p.downloadsMu.Unlock()
+	if !p.downloads[h] {
+		return nil
+	}
+	return h
+}
+
+// serveDownload serves r from the download of h in progress, and reports
+// whether it did.
+func (p *CachingReverseProxy) serveDownload(w http.ResponseWriter, r *http.Request, h *objectHandle, cachePath string) bool {
+	rd, err := h.open(cachePath)
+	if err != nil {
+		return false
+	}
+	defer rd.Close()
+	p.logger().Debug("joining download", "path", h.cleanPath)
+	p.count(r, &p.stats.misses)
+	w.Header().Set("ETag", makeETag(h.trackingWriter.size, h.modTime))
+	if h.contentType != "" {
+		w.Header().Set("Content-Type", h.contentType)
+	}
+	if p.forwardRange(w, r, h) {
+		return true
+	}
+	http.ServeContent(w, r, path.Base(h.cleanPath), h.modTime, rd)
+	return true
+}
+
+// coalesce serves r, a request for the uncached object at cleanPath, from its
+// download if one is in progress or started by a concurrent request, and
+// reports whether it did. Otherwise the caller requests the object from the
+// upstream, and must call finish once it started downloading it, or gave up,
+// to let the requests waiting for it proceed.
+func (p *CachingReverseProxy) coalesce(w http.ResponseWriter, r *http.Request, cleanPath, cachePath string) (served bool, finish func()) {
+	if h := p.activeDownload(cleanPath); h != nil && p.serveDownload(w, r, h, cachePath) {
+		return true, func() {}
+	}
+	f := &fetch{done: make(chan struct{})}
+	i, loaded := p.fetches.LoadOrStore(cleanPath, f)
+	if !loaded {
+		return false, func() {
+			f.once.Do(func() {
+				p.fetches.CompareAndDelete(cleanPath, f)
+				close(f.done)
+			})
+		}
+	}
+	select {
+	case <-i.(*fetch).done:
+	case <-r.Context().Done():
+		return true, func() {}
+	}
+	if h := p.activeDownload(cleanPath); h != nil && p.serveDownload(w, r, h, cachePath) {
+		return true, func() {}
+	}
+	// the object was not cachable, or its download already completed
+	return false, func() {}
+}
@@ -0,0 +1,141 @@
+package single
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// minCompressSize is the size below which cached objects are not worth
+// compressing.
+const minCompressSize = 1 << 10
+
+// contentEncoded reports whether the body of resp is encoded, as with gzip,
+// so that it is not the object itself and cannot be cached.
+func contentEncoded(resp *http.Response) bool {
+	encoding := resp.Header.Get("Content-Encoding")
+	return encoding != "" && encoding != "identity"
+}
+
+// acceptsGzip reports whether the client of r accepts gzip encoded
+// responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			name = strings.TrimSpace(name)
+			if name != "gzip" && name != "x-gzip" {
+				continue
+			}
+			q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+			if !ok {
+				return true
+			}
+			weight, err := strconv.ParseFloat(q, 64)
+			return err == nil && weight > 0
+		}
+	}
+	return false
+}
+
+// compressible reports whether objects of contentType, such as text, JSON or
+// XML, are worth compressing.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/x-sh":
+		return true
+	}
+	return false
+}
+
+// varyOnEncoding adds Vary: Accept-Encoding to responses for cached
+// objects of contentType and size bytes that compressCached would compress,
+// so that caches downstream keep their forms apart, and reports whether it
+// did.
+func (p *CachingReverseProxy) varyOnEncoding(w http.ResponseWriter, contentType string, size int64) bool {
+	if !p.CompressCached || size < minCompressSize || !compressible(contentType) {
+		return false
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	return true
+}
+
+// compressCached returns the writer to serve the cached object of
+// contentType and size bytes to r with, compressing it with gzip if
+// CompressCached is set and it is worth it, and a function to call once
+// served.
+func (p *CachingReverseProxy) compressCached(w http.ResponseWriter, r *http.Request, contentType string, size int64) (http.ResponseWriter, func()) {
+	if !p.varyOnEncoding(w, contentType, size) {
+		return w, func() {}
+	}
+	// ranges are of the object, not of its compressed form
+	if r.Header.Get("Range") != "" || !acceptsGzip(r) {
+		return w, func() {}
+	}
+	gw := &gzipResponseWriter{ResponseWriter: w, head: r.Method == http.MethodHead}
+	return gw, gw.close
+}
+
+// gzipResponseWriter compresses a successful response with gzip.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	// head is whether the response has no body to compress
+	head        bool
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if status == http.StatusOK {
+		h := w.Header()
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		// the compressed form is not byte for byte the object
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		if !w.head {
+			w.gz = gzip.NewWriter(w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz == nil {
+		return w.ResponseWriter.Write(p)
+	}
+	return w.gz.Write(p)
+}
+
+// close writes the end of the compressed response.
+func (w *gzipResponseWriter) close() {
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
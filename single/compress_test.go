@@ -0,0 +1,34 @@
+package single
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	for _, test := range []struct {
+		acceptEncoding []string
+		want           bool
+	}{
+		{nil, false},
+		{[]string{"gzip"}, true},
+		{[]string{"x-gzip"}, true},
+		{[]string{"br, gzip, deflate"}, true},
+		{[]string{"br", "gzip"}, true},
+		{[]string{"gzip;q=0.5"}, true},
+		{[]string{"gzip; q=0"}, false},
+		{[]string{"gzip;q=0.0"}, false},
+		{[]string{"gzip;q=invalid"}, false},
+		{[]string{"identity, br"}, false},
+		{[]string{"gzipped"}, false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, value := range test.acceptEncoding {
+			r.Header.Add("Accept-Encoding", value)
+		}
+		if got := acceptsGzip(r); got != test.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", test.acceptEncoding, got, test.want)
+		}
+	}
+}
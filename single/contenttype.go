@@ -0,0 +1,34 @@
+package single
+
+import "os"
+
+// recordContentType records contentType, as sent by the upstream, in an
+// extended attribute of the cached file at cachePath, where the xattr
+// metadata store keeps it too, so that it is served on cache hits without a
+// MetadataStore. On filesystems without extended attributes, cache hits get
+// the type guessed from the extension instead.
+func (p *CachingReverseProxy) recordContentType(cachePath, contentType string) {
+	if contentType == "" {
+		return
+	}
+	if err := setxattr(cachePath, xattrContentType, []byte(contentType)); err != nil && !os.IsNotExist(err) {
+		p.logger().Debug("cannot record content type", "file", cachePath, "err", err)
+	}
+}
+
+// cachedContentType returns the content type sent by the upstream for the
+// object cached at cachePath, with metadata meta, or an empty string if it
+// is unknown.
+func (p *CachingReverseProxy) cachedContentType(cachePath string, meta *Metadata) string {
+	if meta != nil {
+		return meta.ContentType
+	}
+	if p.Metadata != nil {
+		return ""
+	}
+	value, err := getxattr(cachePath, xattrContentType)
+	if err != nil {
+		return ""
+	}
+	return string(value)
+}
@@ -0,0 +1,64 @@
+package single
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// Credentials authenticate requests to the upstream.
+type Credentials struct {
+	// Username and Password are sent with basic auth if Username is set.
+	Username string
+	Password string
+	// BearerToken is sent in the Authorization header if set. It takes
+	// precedence over basic auth.
+	BearerToken string
+}
+
+func (c *Credentials) apply(req *http.Request) {
+	switch {
+	case c.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+c.BearerToken)
+	case c.Username != "":
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+}
+
+// splitUserinfo removes the userinfo from rawurl and returns it as
+// Credentials, or nil if rawurl has none.
+func splitUserinfo(rawurl string) (string, *Credentials) {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.User == nil {
+		return rawurl, nil
+	}
+	c := &Credentials{Username: u.User.Username()}
+	c.Password, _ = u.User.Password()
+	u.User = nil
+	return u.String(), c
+}
+
+// newUpstreamRequest returns a request for cleanPath on the upstream,
+// authenticated with UpstreamCredentials and carrying UpstreamHeaders.
+func (p *CachingReverseProxy) newUpstreamRequest(method string, cleanPath string) (*http.Request, error) {
+	req, err := http.NewRequest(method, p.upstreamPrefix+escapePath(cleanPath), nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.UpstreamCredentials != nil {
+		p.UpstreamCredentials.apply(req)
+	}
+	addHeaders(req.Header, p.UpstreamHeaders)
+	if via := p.viaEntry(1, 1); via != "" {
+		req.Header.Set("Via", via)
+	}
+	return req, nil
+}
+
+// addHeaders adds the values of extra to h.
+func addHeaders(h http.Header, extra http.Header) {
+	for name, values := range extra {
+		for _, value := range values {
+			h.Add(name, value)
+		}
+	}
+}
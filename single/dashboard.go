@@ -0,0 +1,99 @@
+package single
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var dashboardTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"bytes": func(n int64) string {
+		units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+		f := float64(n)
+		i := 0
+		for f >= 1024 && i < len(units)-1 {
+			f /= 1024
+			i++
+		}
+		return fmt.Sprintf("%.1f%s", f, units[i])
+	},
+	"percent": func(f float64) string {
+		return fmt.Sprintf("%.1f%%", 100*f)
+	},
+	"ago": func(t *time.Time) string {
+		if t == nil {
+			return "-"
+		}
+		return time.Since(*t).Round(time.Second).String() + " ago"
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="5">
+<title>cachingreverseproxy status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { padding: 0.2em 1em; text-align: left; border-bottom: 1px solid #ddd; }
+progress { width: 10em; }
+</style>
+</head>
+<body>
+<h1>cachingreverseproxy</h1>
+<table>
+<tr><th>Requests</th><td>{{.Requests}} ({{.ActiveRequests}} active)</td></tr>
+<tr><th>Hit ratio</th><td>{{percent .HitRatio}} ({{.Hits}} hits, {{.Misses}} misses, {{.PassThrough}} pass-through)</td></tr>
+<tr><th>Cache</th><td>{{bytes .CacheBytes}} in {{.CacheObjects}} objects{{if ge .CacheFreeBytes 0}}, {{bytes .CacheFreeBytes}} free{{end}}</td></tr>
+<tr><th>Downloaded</th><td>{{bytes .DownloadedBytes}}</td></tr>
+<tr><th>Evicted</th><td>{{bytes .EvictedBytes}} in {{.Evictions}} objects</td></tr>
+</table>
+<h2>Downloads</h2>
+{{if .Downloads}}<table>
+<tr><th>Path</th><th>Progress</th><th>Size</th></tr>
+{{range .Downloads}}<tr><td>{{.Path}}</td><td><progress max="{{.Size}}" value="{{.Written}}"></progress> {{percent .Progress}}</td><td>{{bytes .Written}} / {{bytes .Size}}</td></tr>
+{{end}}</table>
+{{else}}<p>None.</p>
+{{end}}<h2>Upstreams</h2>
+<table>
+<tr><th>URL</th><th>Health</th><th>Latency</th><th>Last sync</th><th>Last check</th></tr>
+{{range .Upstreams}}<tr><td>{{.URL}}{{if .Preferred}} (preferred){{end}}</td><td>{{if .Healthy}}healthy{{else}}down{{end}}</td><td>{{if .Latency}}{{.Latency}}{{else}}-{{end}}</td><td>{{ago .LastSync}}</td><td>{{ago .LastCheck}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// StatusPage returns a handler serving the Status of p as an HTML page
+// refreshing itself every 5 seconds, or as JSON if requested with
+// ?format=json or an Accept header preferring application/json. Requests
+// are restricted and authenticated like those of AdminHandler.
+func (p *CachingReverseProxy) StatusPage() http.Handler {
+	return p.recoverPanics(p.requireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			statusError(w, r, http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		s := p.Status()
+		if wantsJSON(r) {
+			writeJSON(w, http.StatusOK, s)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := dashboardTemplate.Execute(w, s); err != nil {
+			p.logger().Warn("error writing response", "err", err)
+		}
+	})))
+}
+
+// wantsJSON reports whether r asks for a JSON response rather than HTML.
+func wantsJSON(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "json"
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
@@ -0,0 +1,94 @@
+package single
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// blobDir is the directory in cacheDir holding the content addressed blobs
+// shared by deduplicated objects.
+const blobDir = internalMarker + "blobs"
+
+func (p *CachingReverseProxy) blobPath(sha256Hex string) string {
+	return path.Join(p.cacheDir, blobDir, "sha256", sha256Hex[:2], sha256Hex)
+}
+
+// dedupe hard links the newly cached file at cachePath with the blob of the
+// same content, so that byte-identical objects cached for different paths or
+// namespaces are stored once. Since hard links share the modification time,
+// which the proxy uses for validation, files are only linked if their
+// modification times are equal. Files with another modification time are
+// cloned from the blob instead, sharing its storage while keeping their own
+// times, where the filesystem supports it.
+func (p *CachingReverseProxy) dedupe(cachePath string, sha256Hex string) {
+	blob := p.blobPath(sha256Hex)
+	if err := os.MkdirAll(path.Dir(blob), 0755); err != nil {
+		p.logger().Warn("dedupe failed", "file", cachePath, "err", err)
+		return
+	}
+	err := os.Link(cachePath, blob)
+	if err == nil || !os.IsExist(err) {
+		if err != nil {
+			p.logger().Warn("dedupe failed", "file", cachePath, "err", err)
+		}
+		return
+	}
+
+	cacheInfo, err := os.Stat(cachePath)
+	if err != nil {
+		p.logger().Warn("dedupe failed", "file", cachePath, "err", err)
+		return
+	}
+	blobInfo, err := os.Stat(blob)
+	if err != nil {
+		p.logger().Warn("dedupe failed", "file", cachePath, "err", err)
+		return
+	}
+	if os.SameFile(cacheInfo, blobInfo) || cacheInfo.Size() != blobInfo.Size() {
+		return
+	}
+	if !cacheInfo.ModTime().Equal(blobInfo.ModTime()) {
+		if err := reflink(cachePath, blob); err != nil {
+			// most filesystems cannot clone files
+			p.logger().Debug("cannot clone blob", "file", cachePath, "err", err)
+			return
+		}
+		p.logger().Debug("deduplicated by cloning", "file", cachePath, "sha256", sha256Hex)
+		return
+	}
+	temp := cachePath + ".part.dedupe"
+	os.Remove(temp)
+	if err := os.Link(blob, temp); err != nil {
+		p.logger().Warn("dedupe failed", "file", cachePath, "err", err)
+		return
+	}
+	if err := os.Rename(temp, cachePath); err != nil {
+		p.logger().Warn("dedupe failed", "file", cachePath, "err", err)
+		os.Remove(temp)
+		return
+	}
+	if linkCount(blobInfo) > 1 {
+		// the storage was already counted for another object
+		p.usage.bytes.Add(-cacheInfo.Size())
+	}
+	p.logger().Debug("deduplicated", "file", cachePath, "sha256", sha256Hex)
+}
+
+// pruneBlobs removes blobs no longer linked from any cached object.
+func (p *CachingReverseProxy) pruneBlobs() error {
+	root := path.Join(p.cacheDir, blobDir)
+	err := filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && linkCount(info) == 1 {
+			return os.Remove(name)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
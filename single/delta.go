@@ -0,0 +1,23 @@
+package single
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// errNoDelta is returned when the object cannot be updated with a delta,
+// such as when the upstream does not publish a .zsync control file for it.
+var errNoDelta = errors.New("no delta available")
+
+// deltaBody returns the content of the upstream response resp for cleanPath,
+// reconstructed from the cached version at cachePath and the parts of the new
+// version that changed, with zchunk for .zck files and zsync otherwise. The
+// returned digest must be verified once the body is read.
+func (p *CachingReverseProxy) deltaBody(cleanPath string, cachePath string, resp *http.Response) (io.ReadCloser, *expectedDigest, error) {
+	if strings.HasSuffix(cleanPath, ".zck") {
+		return p.zchunkBody(cleanPath, cachePath, resp)
+	}
+	return p.zsyncBody(cleanPath, cachePath, resp)
+}
@@ -0,0 +1,177 @@
+package single
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// appendZchunkInt appends v as a compressed integer of zchunk.
+func appendZchunkInt(b []byte, v int64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v&0x7f))
+		v >>= 7
+	}
+	return append(b, byte(v)|0x80)
+}
+
+// makeZchunk returns a zchunk file of chunks, stored as they are, with an
+// empty dictionary.
+func makeZchunk(chunks [][]byte) []byte {
+	data := sha256.New()
+	var index []byte
+	index = appendZchunkInt(index, 3)
+	index = appendZchunkInt(index, int64(len(chunks)+1))
+	// the empty dictionary
+	index = append(index, make([]byte, 16)...)
+	index = appendZchunkInt(index, 0)
+	index = appendZchunkInt(index, 0)
+	for _, c := range chunks {
+		data.Write(c)
+		sum := sha512.Sum512(c)
+		index = append(index, sum[:16]...)
+		index = appendZchunkInt(index, int64(len(c)))
+		index = appendZchunkInt(index, int64(len(c)))
+	}
+	header := append([]byte(nil), data.Sum(nil)...)
+	header = appendZchunkInt(header, 0) // flags
+	header = appendZchunkInt(header, 0) // compression type
+	header = appendZchunkInt(header, int64(len(index)))
+	header = append(header, index...)
+	header = appendZchunkInt(header, 0) // signatures
+	lead := appendZchunkInt([]byte(zchunkMagic), 1)
+	lead = appendZchunkInt(lead, int64(len(header)))
+	checksum := sha256.New()
+	checksum.Write(lead)
+	checksum.Write(header)
+	file := append(lead, checksum.Sum(nil)...)
+	file = append(file, header...)
+	for _, c := range chunks {
+		file = append(file, c...)
+	}
+	return file
+}
+
+// makeZsync returns the zsync control file of data.
+func makeZsync(data []byte, blockSize int) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "zsync: 0.6.2\nBlocksize: %d\nLength: %d\nHash-Lengths: 1,4,16\nSHA-1: %x\n\n", blockSize, len(data), sha1.Sum(data))
+	for off := 0; off < len(data); off += blockSize {
+		block := make([]byte, blockSize)
+		copy(block, data[off:])
+		binary.Write(&b, binary.BigEndian, newRollingSum(block).value())
+		sum := md4Sum(block)
+		b.Write(sum[:])
+	}
+	return b.Bytes()
+}
+
+// deltaUpstream serves files modified at modTime, counting the bytes sent
+// in response to range requests.
+type deltaUpstream struct {
+	files   map[string][]byte
+	modTime time.Time
+	sent    atomic.Int64
+}
+
+func (u *deltaUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data, ok := u.files[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Header.Get("Range") != "" {
+		w = &countingResponseWriter{w, &u.sent}
+	}
+	http.ServeContent(w, r, "", u.modTime, bytes.NewReader(data))
+}
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n *atomic.Int64
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	w.n.Add(int64(len(p)))
+	return w.ResponseWriter.Write(p)
+}
+
+func testDelta(t *testing.T, name string, old, new []byte, files map[string][]byte) int64 {
+	t.Helper()
+	upstream := &deltaUpstream{files: files, modTime: time.Now().Truncate(time.Second)}
+	upstream.files["/"+name] = new
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+	dir := t.TempDir()
+	p, err := NewCachingReverseProxy(server.URL, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.DeltaTransfer = true
+	cachePath := filepath.Join(dir, name)
+	if err := os.WriteFile(cachePath, old, 0644); err != nil {
+		t.Fatal(err)
+	}
+	past := upstream.modTime.Add(-time.Hour)
+	os.Chtimes(cachePath, past, past)
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+name, nil))
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), new) {
+		t.Fatalf("got %d, %d bytes, want the new version of %d bytes", w.Code, w.Body.Len(), len(new))
+	}
+	if err := p.WaitForDownloads(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	cached, err := os.ReadFile(cachePath)
+	if err != nil || !bytes.Equal(cached, new) {
+		t.Fatalf("cached %d bytes, %v, want the new version", len(cached), err)
+	}
+	return upstream.sent.Load()
+}
+
+func randomBytes(r *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	r.Read(b)
+	return b
+}
+
+func TestZchunkDelta(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	var chunks [][]byte
+	for i := 0; i < 16; i++ {
+		chunks = append(chunks, randomBytes(r, 64<<10))
+	}
+	old := makeZchunk(chunks)
+	chunks[3] = randomBytes(r, 10<<10)
+	chunks = append(chunks, randomBytes(r, 20<<10))
+	new := makeZchunk(chunks)
+	sent := testDelta(t, "primary.xml.zck", old, new, map[string][]byte{})
+	// the header and the two chunks that changed
+	if max := int64(zchunkLeadFetch + 30<<10 + 1024); sent > max {
+		t.Errorf("upstream sent %d bytes, want at most %d", sent, max)
+	}
+}
+
+func TestZsyncDelta(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	old := randomBytes(r, 3<<20)
+	new := append(append(append([]byte(nil), old[:1<<20]...), randomBytes(r, 5000)...), old[1<<20+100:]...)
+	files := map[string][]byte{"/image.iso.zsync": makeZsync(new, 2048)}
+	sent := testDelta(t, "image.iso", old, new, files)
+	// the blocks that changed
+	if max := int64(16 << 10); sent > max {
+		t.Errorf("upstream sent %d bytes, want at most %d", sent, max)
+	}
+}
@@ -0,0 +1,133 @@
+package single
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// PathDigest returns the SHA-256 digest the content of the object at
+// cleanPath must have, or nil if its path does not tell.
+type PathDigest func(cleanPath string) []byte
+
+// contentDigest returns the digest ContentDigest gives for the object at
+// cleanPath, or nil.
+func (p *CachingReverseProxy) contentDigest(cleanPath string) *expectedDigest {
+	if p.ContentDigest == nil {
+		return nil
+	}
+	want := p.ContentDigest(cleanPath)
+	if len(want) != sha256.Size {
+		return nil
+	}
+	return &expectedDigest{header: "path", alg: "sha256", want: want, hash: sha256.New()}
+}
+
+// expectedDigest is a digest of the content announced by the upstream.
+type expectedDigest struct {
+	header string
+	alg    string
+	want   []byte
+	hash   hash.Hash
+}
+
+// newDigestHash returns a hash for the digest algorithm alg, as named in the
+// Digest, Content-Digest and x-goog-hash headers, or nil if it is unknown.
+func newDigestHash(alg string) hash.Hash {
+	switch strings.ToLower(alg) {
+	case "sha-256":
+		return sha256.New()
+	case "sha-512":
+		return sha512.New()
+	case "sha":
+		return sha1.New()
+	case "md5":
+		return md5.New()
+	case "crc32c":
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	}
+	return nil
+}
+
+// expectedDigests parses the integrity headers of an upstream response:
+// Digest (RFC 3230), Content-Digest and Repr-Digest (RFC 9530), Content-MD5
+// and x-goog-hash. Unknown algorithms and malformed values are ignored.
+func expectedDigests(header http.Header) []*expectedDigest {
+	var digests []*expectedDigest
+	add := func(headerName, alg, value string) {
+		h := newDigestHash(alg)
+		if h == nil {
+			return
+		}
+		want, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(want) != h.Size() {
+			return
+		}
+		digests = append(digests, &expectedDigest{header: headerName, alg: alg, want: want, hash: h})
+	}
+	eachPair := func(headerName string, fn func(alg, value string)) {
+		for _, line := range header.Values(headerName) {
+			for _, pair := range strings.Split(line, ",") {
+				eq := strings.IndexByte(pair, '=')
+				if eq < 0 {
+					continue
+				}
+				fn(strings.TrimSpace(pair[:eq]), strings.TrimSpace(pair[eq+1:]))
+			}
+		}
+	}
+
+	eachPair("Digest", func(alg, value string) {
+		add("Digest", alg, value)
+	})
+	for _, name := range []string{"Content-Digest", "Repr-Digest"} {
+		name := name
+		eachPair(name, func(alg, value string) {
+			// structured field byte sequences are enclosed in colons
+			if len(value) >= 2 && value[0] == ':' && value[len(value)-1] == ':' {
+				add(name, alg, value[1:len(value)-1])
+			}
+		})
+	}
+	if value := header.Get("Content-MD5"); value != "" {
+		add("Content-MD5", "md5", strings.TrimSpace(value))
+	}
+	eachPair("X-Goog-Hash", func(alg, value string) {
+		add("X-Goog-Hash", alg, value)
+	})
+	return digests
+}
+
+// digestWriter returns a writer computing all of digests.
+func digestWriter(digests []*expectedDigest) io.Writer {
+	writers := make([]io.Writer, len(digests))
+	for i, d := range digests {
+		writers[i] = d.hash
+	}
+	return io.MultiWriter(writers...)
+}
+
+// verifyDigests returns an error if the content written to the hashes of
+// digests does not match any of them.
+func verifyDigests(digests []*expectedDigest) error {
+	for _, d := range digests {
+		got := d.hash.Sum(nil)
+		if !bytes.Equal(got, d.want) {
+			return fmt.Errorf("%s %s mismatch: want %s, got %s",
+				d.header, d.alg,
+				base64.StdEncoding.EncodeToString(d.want),
+				base64.StdEncoding.EncodeToString(got),
+			)
+		}
+	}
+	return nil
+}
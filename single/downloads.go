@@ -0,0 +1,88 @@
+package single
+
+import (
+	"context"
+	"time"
+)
+
+// addDownload records that h started downloading into its temporary file.
+func (p *CachingReverseProxy) addDownload(h *objectHandle) {
+	p.downloadsMu.Lock()
+	defer p.downloadsMu.Unlock()
+	if p.downloads == nil {
+		p.downloads = make(map[*objectHandle]bool)
+	}
+	p.downloads[h] = true
+}
+
+// removeDownload records that the download of h finished or failed.
+func (p *CachingReverseProxy) removeDownload(h *objectHandle) {
+	p.downloadsMu.Lock()
+	defer p.downloadsMu.Unlock()
+	delete(p.downloads, h)
+}
+
+func (p *CachingReverseProxy) activeDownloadCount() int {
+	p.downloadsMu.Lock()
+	defer p.downloadsMu.Unlock()
+	return len(p.downloads)
+}
+
+// WaitForDownloads waits until the downloads in progress are complete and
+// committed to the cache, or ctx is done, logging their progress meanwhile.
+// It is meant to be called after Shutdown, so that no new downloads start.
+func (p *CachingReverseProxy) WaitForDownloads(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	var lastLog time.Time
+	for p.activeDownloadCount() > 0 {
+		if time.Since(lastLog) >= 5*time.Second {
+			p.logDownloads()
+			lastLog = time.Now()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// AbortDownloads aborts the downloads in progress and waits until they are
+// cleaned up or ctx is done. Like downloads cut short by the upstream, the
+// data received so far is kept for the download to be resumed, except for
+// downloads in the StagingArea, whose temporary files are removed. It is
+// meant to be called after Shutdown, so that no new downloads start.
+func (p *CachingReverseProxy) AbortDownloads(ctx context.Context) error {
+	p.downloadsMu.Lock()
+	for h := range p.downloads {
+		p.logger().Info("aborting download", "path", h.cleanPath)
+		// closing the body fails the copy into the temporary file
+		h.body.Close()
+	}
+	p.downloadsMu.Unlock()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for p.activeDownloadCount() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// logDownloads logs the progress of each download in progress.
+func (p *CachingReverseProxy) logDownloads() {
+	p.downloadsMu.Lock()
+	defer p.downloadsMu.Unlock()
+	for h := range p.downloads {
+		var written int64
+		if info, err := h.tempFS().Stat(h.tempPath); err == nil {
+			written = info.Size()
+		}
+		p.logger().Info("waiting for download", "path", h.cleanPath, "written", written, "size", h.trackingWriter.size)
+	}
+}
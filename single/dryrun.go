@@ -0,0 +1,138 @@
+package single
+
+import (
+	"net/http"
+	"time"
+)
+
+// Decisions recorded in dry runs.
+const (
+	// decisionHit is serving the cached copy without asking the upstream.
+	decisionHit = "hit"
+	// decisionRevalidate is serving the cached copy after the upstream
+	// confirmed it is current.
+	decisionRevalidate = "revalidate"
+	// decisionRefetch is downloading an object changed upstream again.
+	decisionRefetch = "refetch"
+	// decisionCache is downloading an object into the cache.
+	decisionCache = "cache"
+	// decisionBypass is relaying the response without caching it.
+	decisionBypass = "bypass"
+	// decisionEvict is removing an object to keep the cache within its
+	// size limit or a group within its quota.
+	decisionEvict = "evict"
+)
+
+// DecisionLog records what a proxy in DryRun would have done, to an
+// append-only file, one JSON object per line.
+type DecisionLog struct {
+	jsonLines
+}
+
+// OpenDecisionLog opens the decision log at name, creating it if needed.
+func OpenDecisionLog(name string) (*DecisionLog, error) {
+	f, err := openJSONLines(name)
+	if err != nil {
+		return nil, err
+	}
+	return &DecisionLog{jsonLines{file: f}}, nil
+}
+
+// decisionEntry is a line of the decision log.
+type decisionEntry struct {
+	Time     time.Time `json:"time"`
+	Path     string    `json:"path"`
+	Decision string    `json:"decision"`
+	Reason   string    `json:"reason,omitempty"`
+	// Size is the size of the object, if known.
+	Size int64 `json:"size,omitempty"`
+	// Status is the status of the upstream response, if the upstream was
+	// asked.
+	Status int `json:"status,omitempty"`
+}
+
+// decide records that the proxy would have made decision about the object
+// at cleanPath for reason, to DecisionLog if set, or else to the log.
+func (p *CachingReverseProxy) decide(cleanPath, decision, reason string, size int64, status int) {
+	if p.DecisionLog == nil {
+		p.logger().Info("dry run decision", "path", cleanPath, "decision", decision, "reason", reason, "size", size, "status", status)
+		return
+	}
+	e := &decisionEntry{
+		Time:     p.now().UTC(),
+		Path:     cleanPath,
+		Decision: decision,
+		Reason:   reason,
+		Size:     max(size, 0),
+		Status:   status,
+	}
+	if err := p.DecisionLog.write(e); err != nil {
+		p.logger().Error("cannot write decision log", "err", err)
+	}
+}
+
+// cachedCopy describes the cached copy of an object.
+type cachedCopy struct {
+	meta      *Metadata
+	modTime   time.Time
+	size      int64
+	validated time.Time
+}
+
+// serveDryRun serves r, for the object at cleanPath cached with policy as
+// cached, or not cached if nil, by relaying the response of the upstream to
+// upstreamReq, and records what the proxy would have done outside DryRun.
+func (p *CachingReverseProxy) serveDryRun(w http.ResponseWriter, r *http.Request, upstreamReq *http.Request, cleanPath string, policy CachePolicy, cached *cachedCopy) {
+	// the cached copy is not served, so the upstream must send the object
+	upstreamReq.Header.Del("If-Modified-Since")
+	upstreamReq.Header.Del("If-None-Match")
+	var decision, reason string
+	if cached != nil {
+		switch {
+		case policy == CacheForever:
+			decision, reason = decisionHit, "cached forever"
+		case p.headFromCache(r, policy):
+			decision, reason = decisionHit, "HEAD answered from the cache"
+		case policy == CacheDefault && p.fresh(cleanPath, cached.meta, cached.validated):
+			decision, reason = decisionHit, "fresh"
+		case p.serveStaleWhileRevalidate(r, policy, cached.validated):
+			decision, reason = decisionHit, "stale while revalidating"
+		}
+	}
+	upstreamResp, err := p.doUpstream(upstreamReq)
+	if err != nil {
+		statusError(w, r, http.StatusBadGateway)
+		p.logger().Error("upstream request failed", "url", upstreamReq.URL, "err", err)
+		return
+	}
+	if decision == "" {
+		reason = p.uncacheable(r, policy, cleanPath, upstreamResp)
+		switch {
+		case cached != nil && p.sameVersion(cleanPath, upstreamResp, cached, policy):
+			decision, reason = decisionRevalidate, "unchanged upstream"
+		case reason != "":
+			decision = decisionBypass
+		case cached != nil:
+			decision, reason = decisionRefetch, "changed upstream"
+		default:
+			decision = decisionCache
+		}
+	}
+	p.decide(cleanPath, decision, reason, upstreamResp.ContentLength, upstreamResp.StatusCode)
+	p.count(r, &p.stats.passThrough)
+	p.relay(w, r, upstreamResp, cleanPath)
+}
+
+// sameVersion reports whether upstreamResp, the response of the upstream to
+// an unconditional request for the object at cleanPath, is for the version
+// cached as cached, as the upstream would have told in response to a
+// conditional request.
+func (p *CachingReverseProxy) sameVersion(cleanPath string, upstreamResp *http.Response, cached *cachedCopy, policy CachePolicy) bool {
+	if upstreamResp.StatusCode != http.StatusOK || upstreamResp.ContentLength != cached.size {
+		return false
+	}
+	if lastModified, err := http.ParseTime(upstreamResp.Header.Get("Last-Modified")); err == nil && !lastModified.After(cached.modTime.Truncate(time.Second)) {
+		return true
+	}
+	return policy != CacheRevalidate && p.upstreamUnchanged(cleanPath, upstreamResp, cached.modTime, cached.size)
+}
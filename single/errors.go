@@ -0,0 +1,65 @@
+package single
+
+import (
+	"net/http"
+	"runtime/debug"
+)
+
+// errorResponse is the body of error responses to clients asking for JSON.
+type errorResponse struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+// httpError replies to r with code and message, as JSON if r asks for it
+// and as plain text otherwise.
+func httpError(w http.ResponseWriter, r *http.Request, code int, message string) {
+	if !wantsJSON(r) {
+		http.Error(w, message, code)
+		return
+	}
+	// drop the headers set for the response that could not be sent
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	h.Del("ETag")
+	h.Del("Last-Modified")
+	h.Set("X-Content-Type-Options", "nosniff")
+	writeJSON(w, code, errorResponse{Status: code, Error: message})
+}
+
+// statusError replies to r with code and its status text.
+func statusError(w http.ResponseWriter, r *http.Request, code int) {
+	httpError(w, r, code, http.StatusText(code))
+}
+
+// recoverPanic, deferred by a handler serving r with w, recovers from a
+// panic of the handler, logging it and replying with 500 if the response was
+// not started, so that the connection keeps serving requests. Panics with
+// http.ErrAbortHandler, which abort the response on purpose, are left
+// alone.
+func (p *CachingReverseProxy) recoverPanic(w *accessLogWriter, r *http.Request) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if v == http.ErrAbortHandler {
+		panic(v)
+	}
+	p.logger().Error("panic serving request", "method", r.Method, "path", r.URL.Path, "panic", v, "stack", string(debug.Stack()))
+	if w.status != 0 {
+		// the client cannot be told, so cut the response short
+		panic(http.ErrAbortHandler)
+	}
+	statusError(w, r, http.StatusInternalServerError)
+}
+
+// recoverPanics returns a handler serving requests with h, recovering from
+// its panics like recoverPanic.
+func (p *CachingReverseProxy) recoverPanics(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &accessLogWriter{ResponseWriter: w}
+		defer p.recoverPanic(rw, r)
+		h.ServeHTTP(rw, r)
+	})
+}
@@ -0,0 +1,51 @@
+package single
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// makeETag returns a strong entity tag for an object of the given size and
+// modification time. The modification time is truncated to seconds so that
+// the tag derived from upstream headers equals the tag of the cached file.
+func makeETag(size int64, modTime time.Time) string {
+	return fmt.Sprintf(`"%x-%x"`, modTime.Unix(), size)
+}
+
+// cachedETag returns the entity tag of a cached object with metadata meta,
+// which may be nil. It is derived from the recorded digest if available, and
+// from size and modTime otherwise.
+func cachedETag(meta *Metadata, size int64, modTime time.Time) string {
+	if meta != nil && meta.SHA256 != "" {
+		return `"sha256-` + meta.SHA256 + `"`
+	}
+	return makeETag(size, modTime)
+}
+
+// etagMatches reports whether the If-None-Match header value ifNoneMatch
+// matches etag, using the weak comparison function as required by RFC 7232.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeNotModified responds 304 if the request's If-None-Match matches etag.
+// It reports whether a response was written.
+func writeNotModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifNoneMatch == "" || !etagMatches(ifNoneMatch, etag) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
@@ -0,0 +1,73 @@
+package single
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestETagMatches(t *testing.T) {
+	etag := makeETag(10, time.Unix(1e9, 0))
+	for _, test := range []struct {
+		ifNoneMatch string
+		want        bool
+	}{
+		{etag, true},
+		{"W/" + etag, true},
+		{"*", true},
+		{`"other", ` + etag, true},
+		{`"other"`, false},
+		{makeETag(11, time.Unix(1e9, 0)), false},
+		{makeETag(10, time.Unix(1e9+1, 0)), false},
+	} {
+		if got := etagMatches(test.ifNoneMatch, etag); got != test.want {
+			t.Errorf("etagMatches(%q, %q) = %v, want %v", test.ifNoneMatch, etag, got, test.want)
+		}
+	}
+	if makeETag(10, time.Unix(1e9, 0)) != makeETag(10, time.Unix(1e9, 5e8)) {
+		t.Errorf("entity tags differ below a second")
+	}
+}
+
+func TestIfNoneMatch(t *testing.T) {
+	var requests atomic.Int64
+	upstream := countingUpstream(100, &requests)
+	defer upstream.Close()
+	p, _ := newMemProxy(t, upstream.URL)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/object", nil))
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("got %d with ETag %q, want %d with an ETag", w.Code, etag, http.StatusOK)
+	}
+	for _, test := range []struct {
+		method      string
+		ifNoneMatch string
+		status      int
+	}{
+		{http.MethodGet, "", http.StatusOK},
+		{http.MethodGet, etag, http.StatusNotModified},
+		{http.MethodGet, "W/" + etag, http.StatusNotModified},
+		{http.MethodGet, "*", http.StatusNotModified},
+		{http.MethodGet, `"other"`, http.StatusOK},
+		{http.MethodHead, etag, http.StatusNotModified},
+	} {
+		r := httptest.NewRequest(test.method, "/object", nil)
+		if test.ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", test.ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s with If-None-Match %q: got %d, want %d", test.method, test.ifNoneMatch, w.Code, test.status)
+		}
+		if got := w.Header().Get("ETag"); got != etag {
+			t.Errorf("%s with If-None-Match %q: got ETag %q, want %q", test.method, test.ifNoneMatch, got, etag)
+		}
+		if w.Code == http.StatusNotModified && w.Body.Len() != 0 {
+			t.Errorf("%s with If-None-Match %q: got a body with %d", test.method, test.ifNoneMatch, w.Code)
+		}
+	}
+}
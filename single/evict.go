@@ -0,0 +1,312 @@
+package single
+
+import (
+	"context"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// evictionTarget is the fraction of MaxCacheSize the disk cache is reduced
+// to when it exceeds MaxCacheSize, so that not every download triggers an
+// eviction.
+const evictionTarget = 0.9
+
+// evictionCandidate is a cached file that may be evicted to keep the disk
+// cache within its size limit, with the objects sharing it as hard links
+// made by Dedupe, which are evicted together since only then is its space
+// freed.
+type evictionCandidate struct {
+	links      []evictionLink
+	size       int64
+	accessTime int64
+	// downloading is whether one of the objects is being downloaded, in
+	// which case the file is kept.
+	downloading bool
+}
+
+// evictionLink is a cached object of an evictionCandidate.
+type evictionLink struct {
+	proxy     *CachingReverseProxy
+	cleanPath string
+}
+
+// fileID identifies a file of the operating system across its hard links.
+type fileID struct {
+	dev, ino uint64
+}
+
+// evictionScan collects the eviction candidates of the disk caches of one
+// or more proxies, and their size, counting each file once however many
+// objects are linked to it.
+type evictionScan struct {
+	candidates []*evictionCandidate
+	linked     map[fileID]*evictionCandidate
+	used       int64
+}
+
+func newEvictionScan() *evictionScan {
+	return &evictionScan{linked: make(map[fileID]*evictionCandidate)}
+}
+
+// add adds the object at cleanPath of p, cached in the file described by
+// info.
+func (s *evictionScan) add(p *CachingReverseProxy, cleanPath string, info os.FileInfo) {
+	link := evictionLink{proxy: p, cleanPath: cleanPath}
+	_, downloading := p.objectHandles.Load(cleanPath)
+	id, linked := linkedFile(info)
+	if c := s.linked[id]; linked && c != nil {
+		c.links = append(c.links, link)
+		c.downloading = c.downloading || downloading
+		return
+	}
+	c := &evictionCandidate{
+		links:       []evictionLink{link},
+		size:        info.Size(),
+		accessTime:  accessTime(info).UnixNano(),
+		downloading: downloading,
+	}
+	s.candidates = append(s.candidates, c)
+	s.used += c.size
+	if linked {
+		s.linked[id] = c
+	}
+}
+
+// EvictLRU evicts the least recently accessed objects from the disk cache
+// until it is within evictionTarget of MaxCacheSize, if it exceeds
+// MaxCacheSize. Objects being downloaded are kept. It also corrects the
+// cache usage reported by Status.
+func (p *CachingReverseProxy) EvictLRU() error {
+	scan := newEvictionScan()
+	if err := p.scanEviction(scan); err != nil {
+		return err
+	}
+	if p.MaxCacheSize <= 0 || scan.used <= p.MaxCacheSize {
+		return nil
+	}
+	evictLRU(scan.candidates, scan.used, p.MaxCacheSize)
+	if p.Dedupe && !p.EvictionDryRun {
+		return p.pruneBlobs()
+	}
+	return nil
+}
+
+// scanEviction walks the disk cache, adding its objects to scan, and
+// corrects the cache usage reported by Status. The blobs of Dedupe, which
+// are internal files, are not walked.
+func (p *CachingReverseProxy) scanEviction(scan *evictionScan) error {
+	var used fileSizes
+	var objects int64
+	err := p.walkCache(func(cleanPath, cachePath string, info os.FileInfo) error {
+		used.add(info)
+		objects++
+		scan.add(p, cleanPath, info)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	p.usage.bytes.Store(used.total)
+	p.usage.objects.Store(objects)
+	return nil
+}
+
+// fileSizes sums the sizes of cached files, counting files hard linked to
+// several objects once.
+type fileSizes struct {
+	total  int64
+	linked map[fileID]bool
+}
+
+func (s *fileSizes) add(info os.FileInfo) {
+	if id, ok := linkedFile(info); ok {
+		if s.linked[id] {
+			return
+		}
+		if s.linked == nil {
+			s.linked = make(map[fileID]bool)
+		}
+		s.linked[id] = true
+	}
+	s.total += info.Size()
+}
+
+// evictLRU evicts the least recently accessed of candidates, of caches
+// using used bytes, until they are within evictionTarget of max.
+func evictLRU(candidates []*evictionCandidate, used int64, max int64) {
+	target := int64(float64(max) * evictionTarget)
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].accessTime < candidates[j].accessTime
+	})
+	for _, c := range candidates {
+		if used <= target {
+			break
+		}
+		if c.downloading {
+			continue
+		}
+		evicted := true
+		for _, link := range c.links {
+			p := link.proxy
+			if p.EvictionDryRun {
+				p.logger().Info("would evict to keep the cache within its size limit", "path", link.cleanPath, "size", c.size)
+				if p.DecisionLog != nil {
+					p.decide(link.cleanPath, decisionEvict, "cache size limit", c.size, 0)
+				}
+				continue
+			}
+			if err := p.evictObject(link.cleanPath); err != nil {
+				p.logger().Error("evict failed", "path", link.cleanPath, "err", err)
+				evicted = false
+				continue
+			}
+			p.logger().Info("evicted to keep the cache within its size limit", "path", link.cleanPath, "size", c.size)
+		}
+		if evicted {
+			used -= c.size
+		}
+	}
+}
+
+// RunEviction calls EvictLRU whenever a download takes the disk cache over
+// MaxCacheSize, and every interval if the cache usage measured by
+// RunUsageScan exceeds it, until ctx is done.
+func (p *CachingReverseProxy) RunEviction(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if p.usage.bytes.Load() <= p.MaxCacheSize {
+				continue
+			}
+		case <-p.evictNow:
+		}
+		if err := p.EvictLRU(); err != nil {
+			p.logger().Error("evict failed", "err", err)
+		}
+	}
+}
+
+// checkCacheSize wakes up RunEviction, or that of the CacheBudget of the
+// proxy, if the disk cache exceeds its size limit.
+func (p *CachingReverseProxy) checkCacheSize() {
+	if p.budget != nil {
+		p.budget.check()
+		return
+	}
+	if p.MaxCacheSize <= 0 || p.usage.bytes.Load() <= p.MaxCacheSize {
+		return
+	}
+	select {
+	case p.evictNow <- struct{}{}:
+	default:
+	}
+}
+
+// CacheBudget limits the size of the disk caches of several proxies, such
+// as those of the routes of a server sharing a disk, together: the least
+// recently accessed objects of any of them are evicted when their total
+// size exceeds the budget. MaxCacheSize of the proxies is not used.
+type CacheBudget struct {
+	max      int64
+	evictNow chan struct{}
+
+	mu      sync.Mutex
+	proxies []*CachingReverseProxy
+}
+
+// NewCacheBudget returns a CacheBudget of max bytes.
+func NewCacheBudget(max int64) *CacheBudget {
+	return &CacheBudget{
+		max:      max,
+		evictNow: make(chan struct{}, 1),
+	}
+}
+
+// Add makes p share the budget. It must be called before p serves requests.
+func (b *CacheBudget) Add(p *CachingReverseProxy) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.proxies = append(b.proxies, p)
+	p.budget = b
+}
+
+// members returns the proxies sharing the budget.
+func (b *CacheBudget) members() []*CachingReverseProxy {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*CachingReverseProxy(nil), b.proxies...)
+}
+
+// used returns the size of the disk caches sharing the budget, as measured
+// by RunUsageScan and updated by downloads.
+func (b *CacheBudget) used() int64 {
+	var used int64
+	for _, p := range b.members() {
+		used += p.usage.bytes.Load()
+	}
+	return used
+}
+
+// Evict evicts the least recently accessed objects of the proxies sharing
+// the budget until they are within evictionTarget of it, if they exceed it.
+// Objects being downloaded are kept.
+func (b *CacheBudget) Evict() error {
+	proxies := b.members()
+	scan := newEvictionScan()
+	for _, p := range proxies {
+		if err := p.scanEviction(scan); err != nil {
+			return err
+		}
+	}
+	if scan.used <= b.max {
+		return nil
+	}
+	evictLRU(scan.candidates, scan.used, b.max)
+	for _, p := range proxies {
+		if p.Dedupe && !p.EvictionDryRun {
+			if err := p.pruneBlobs(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RunEviction calls Evict whenever a download takes the disk caches over
+// the budget, and every interval if their usage exceeds it, until ctx is
+// done.
+func (b *CacheBudget) RunEviction(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if b.used() <= b.max {
+				continue
+			}
+		case <-b.evictNow:
+		}
+		if err := b.Evict(); err != nil {
+			b.members()[0].logger().Error("evict failed", "err", err)
+		}
+	}
+}
+
+// check wakes up RunEviction if the disk caches exceed the budget.
+func (b *CacheBudget) check() {
+	if b.used() <= b.max {
+		return
+	}
+	select {
+	case b.evictNow <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,154 @@
+package single
+
+import (
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvictLRU(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		max         int64
+		dryRun      bool
+		downloading string
+		evicted     []string
+	}{
+		{name: "within the limit", max: 500},
+		{name: "over the limit", max: 400, evicted: []string{"/1", "/dir/2"}},
+		{name: "dry run", max: 400, dryRun: true},
+		{name: "downloading", max: 400, downloading: "/1", evicted: []string{"/dir/2", "/3"}},
+		{name: "no limit", max: 0},
+	} {
+		p, fsys := newMemProxy(t, "http://upstream.example")
+		p.MaxCacheSize = test.max
+		p.EvictionDryRun = test.dryRun
+		objects := []string{"/5", "/dir/2", "/1", "/4", "/3"}
+		for _, cleanPath := range objects {
+			putObject(t, p, fsys, cleanPath, 100)
+		}
+		// the objects were last accessed in the order of their names
+		for i, cleanPath := range []string{"/1", "/dir/2", "/3", "/4", "/5"} {
+			if err := fsys.Chtimes(path.Join(p.cacheRoot(), cleanPath), time.Unix(int64(i+1), 0), time.Unix(0, 0)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if test.downloading != "" {
+			p.objectHandles.Store(test.downloading, &objectHandle{})
+		}
+		if err := p.EvictLRU(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		evicted := make(map[string]bool)
+		for _, cleanPath := range test.evicted {
+			evicted[cleanPath] = true
+		}
+		for _, cleanPath := range objects {
+			_, err := fsys.Stat(path.Join(p.cacheRoot(), cleanPath))
+			if cached := err == nil; cached == evicted[cleanPath] {
+				t.Errorf("%s: %s cached %v, want %v", test.name, cleanPath, cached, !evicted[cleanPath])
+			}
+		}
+		if used, want := p.usage.bytes.Load(), int64(500-100*len(test.evicted)); used != want {
+			t.Errorf("%s: usage %d, want %d", test.name, used, want)
+		}
+	}
+}
+
+func TestCacheBudget(t *testing.T) {
+	p1, fsys1 := newMemProxy(t, "http://upstream1.example")
+	p2, fsys2 := newMemProxy(t, "http://upstream2.example")
+	budget := NewCacheBudget(300)
+	budget.Add(p1)
+	budget.Add(p2)
+	// the least recently accessed objects are evicted from either cache
+	for i, object := range []struct {
+		p    *CachingReverseProxy
+		fsys *MemFS
+	}{{p1, fsys1}, {p2, fsys2}, {p1, fsys1}, {p2, fsys2}} {
+		cleanPath := "/" + string(rune('a'+i))
+		putObject(t, object.p, object.fsys, cleanPath, 100)
+		if err := object.fsys.Chtimes(path.Join(object.p.cacheRoot(), cleanPath), time.Unix(int64(i+1), 0), time.Unix(0, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := budget.Evict(); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		fsys      *MemFS
+		cleanPath string
+		cached    bool
+	}{
+		{fsys1, "/a", false},
+		{fsys2, "/b", false},
+		{fsys1, "/c", true},
+		{fsys2, "/d", true},
+	} {
+		_, err := test.fsys.Stat(path.Join("/cache", test.cleanPath))
+		if cached := err == nil; cached != test.cached {
+			t.Errorf("%s cached %v, want %v", test.cleanPath, cached, test.cached)
+		}
+	}
+}
+
+func TestEvictLinked(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("hard links are only counted on linux")
+	}
+	cacheDir := t.TempDir()
+	p, err := NewCachingReverseProxy("http://upstream.example", cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Dedupe = true
+	p.MaxCacheSize = 250
+	for _, cleanPath := range []string{"/a", "/c", "/d"} {
+		putObject(t, p, osFS{}, cleanPath, 100)
+	}
+	// /a and /b share their storage with a blob, as linked by Dedupe
+	blob := p.blobPath(strings.Repeat("0", 64))
+	if err := os.MkdirAll(path.Dir(blob), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{path.Join(cacheDir, "b"), blob} {
+		if err := os.Link(path.Join(cacheDir, "a"), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.ScanUsage(); err != nil {
+		t.Fatal(err)
+	}
+	if used := p.usage.bytes.Load(); used != 300 {
+		t.Errorf("usage %d before eviction, want 300", used)
+	}
+	for i, cleanPath := range []string{"/a", "/b", "/c", "/d"} {
+		if err := os.Chtimes(path.Join(cacheDir, cleanPath), time.Unix(int64(i+1), 0), time.Unix(0, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.EvictLRU(); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name   string
+		cached bool
+	}{
+		{path.Join(cacheDir, "a"), false},
+		{path.Join(cacheDir, "b"), false},
+		{path.Join(cacheDir, "c"), true},
+		{path.Join(cacheDir, "d"), true},
+		{blob, false},
+	} {
+		_, err := os.Stat(test.name)
+		if cached := err == nil; cached != test.cached {
+			t.Errorf("%s cached %v, want %v", test.name, cached, test.cached)
+		}
+	}
+	if used := p.usage.bytes.Load(); used != 200 {
+		t.Errorf("usage %d after eviction, want 200", used)
+	}
+}
@@ -0,0 +1,67 @@
+package single
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Export copies every cached object whose cleaned request path is matched by
+// match to the same path under dir, preserving modification times, so that dir
+// can be served as a plain mirror. Files already exported with the same size
+// and modification time are skipped. Export returns the matched paths.
+func (p *CachingReverseProxy) Export(match PathMatcher, dir string) ([]string, error) {
+	exported := []string{}
+	err := p.walkCache(func(cleanPath, cachePath string, info os.FileInfo) error {
+		if !match(cleanPath) {
+			return nil
+		}
+		dest := filepath.Join(dir, filepath.FromSlash(cleanPath))
+		if destInfo, err := os.Stat(dest); err == nil && destInfo.Size() == info.Size() && destInfo.ModTime().Equal(info.ModTime()) {
+			exported = append(exported, cleanPath)
+			return nil
+		}
+		if err := copyFile(p.cacheFS(), cachePath, dest, info.ModTime()); err != nil {
+			return err
+		}
+		exported = append(exported, cleanPath)
+		return nil
+	})
+	return exported, err
+}
+
+// copyFile copies the file src of fsys to dest with the modification time
+// modTime, creating the parent directories of dest.
+func copyFile(fsys CacheFS, src, dest string, modTime time.Time) error {
+	in, err := openFS(fsys, src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	out, err := ioutil.TempFile(filepath.Dir(dest), filepath.Base(dest)+".part.*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(out.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Chtimes(out.Name(), time.Now(), modTime)
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), dest)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+	}
+	return err
+}
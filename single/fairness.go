@@ -0,0 +1,158 @@
+package single
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// fairChunk is the most bytes a client may write per turn of the scheduler.
+const fairChunk = 32 << 10
+
+// ShareBandwidth returns a handler limiting the responses of h to rate bytes
+// per second in total, shared fairly between client IP addresses: clients
+// waiting to write take turns, so a client with many connections or a fast
+// link does not starve others.
+//
+// It should wrap the handler before LimitSlowClients, so that the time
+// waiting for a turn does not count against the client.
+func ShareBandwidth(h http.Handler, rate int64) http.Handler {
+	s := &bandwidthScheduler{
+		rate:    rate,
+		burst:   max(rate/20, fairChunk),
+		clients: make(map[string]*clientQueue),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	go s.run()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(&fairWriter{ResponseWriter: w, scheduler: s, ctx: r.Context(), client: clientHost(r)}, r)
+	})
+}
+
+// bandwidthScheduler grants clients turns to write in round robin, at the
+// pace allowed by a token bucket.
+type bandwidthScheduler struct {
+	rate  int64
+	burst int64
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	clients map[string]*clientQueue
+	// ring holds the clients waiting for a turn, in turn order.
+	ring []*clientQueue
+	next int
+}
+
+type clientQueue struct {
+	client  string
+	pending []*turn
+}
+
+type turn struct {
+	n        int
+	granted  chan struct{}
+	canceled bool
+}
+
+// wait blocks until client may write n bytes, or ctx is done.
+func (s *bandwidthScheduler) wait(ctx context.Context, client string, n int) error {
+	t := &turn{n: n, granted: make(chan struct{})}
+	s.mu.Lock()
+	q, ok := s.clients[client]
+	if !ok {
+		q = &clientQueue{client: client}
+		s.clients[client] = q
+		s.ring = append(s.ring, q)
+	}
+	q.pending = append(q.pending, t)
+	s.cond.Signal()
+	s.mu.Unlock()
+
+	select {
+	case <-t.granted:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		t.canceled = true
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// nextTurn removes and returns the turn of the next client, waiting for one
+// if no client is waiting.
+func (s *bandwidthScheduler) nextTurn() *turn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		for len(s.ring) == 0 {
+			s.cond.Wait()
+		}
+		if s.next >= len(s.ring) {
+			s.next = 0
+		}
+		q := s.ring[s.next]
+		t := q.pending[0]
+		q.pending = q.pending[1:]
+		if len(q.pending) == 0 {
+			s.ring = append(s.ring[:s.next], s.ring[s.next+1:]...)
+			delete(s.clients, q.client)
+		} else {
+			s.next++
+		}
+		if !t.canceled {
+			return t
+		}
+	}
+}
+
+func (s *bandwidthScheduler) run() {
+	tokens := s.burst
+	last := time.Now()
+	for {
+		t := s.nextTurn()
+		for {
+			now := time.Now()
+			tokens = min(tokens+int64(now.Sub(last))*s.rate/int64(time.Second), s.burst)
+			last = now
+			if tokens >= int64(t.n) {
+				break
+			}
+			time.Sleep(time.Duration(int64(t.n)-tokens) * time.Second / time.Duration(s.rate))
+		}
+		tokens -= int64(t.n)
+		close(t.granted)
+	}
+}
+
+// fairWriter writes in chunks of at most fairChunk, each waiting for the
+// client's turn.
+type fairWriter struct {
+	http.ResponseWriter
+	scheduler *bandwidthScheduler
+	ctx       context.Context
+	client    string
+}
+
+func (w *fairWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := min(len(p), fairChunk)
+		if err := w.scheduler.wait(w.ctx, w.client, chunk); err != nil {
+			return written, err
+		}
+		n, err := w.ResponseWriter.Write(p[:chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[chunk:]
+	}
+	return written, nil
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *fairWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
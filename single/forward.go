@@ -0,0 +1,237 @@
+package single
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// maxForwardOrigins is how many origins a ForwardProxy caches. Requests for
+// further origins are relayed without caching them, since patterns such as
+// *.example.org match any number of hosts.
+const maxForwardOrigins = 256
+
+// ForwardProxy is an HTTP forward proxy, for clients configured with
+// http_proxy rather than pointed at the proxy. Requests for http URLs on
+// hosts matching its patterns are served through a CachingReverseProxy for
+// their origin, so that they are cached, and CONNECT requests to those hosts
+// on port 443, used for https URLs, are tunneled. Other requests are
+// refused, as are connections to loopback, link-local, private and shared
+// addresses, so that clients cannot reach the network of the proxy through
+// it.
+type ForwardProxy struct {
+	hosts    []string
+	newProxy func(origin string) *CachingReverseProxy
+	start    func(p *CachingReverseProxy)
+	dialer   *net.Dialer
+	relay    *httputil.ReverseProxy
+
+	mu      sync.Mutex
+	proxies map[string]*CachingReverseProxy
+}
+
+// NewForwardProxy returns a forward proxy for the hosts matching hosts,
+// path.Match patterns such as *.archlinux.org, caching http URLs with a proxy
+// returned by newProxy for each origin, such as http://example.org. start is
+// called with the proxy once it is restricted to public addresses, to start
+// its background work.
+func NewForwardProxy(hosts []string, newProxy func(origin string) *CachingReverseProxy, start func(p *CachingReverseProxy)) *ForwardProxy {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: defaultKeepAlive, Control: publicOnly}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	return &ForwardProxy{
+		hosts:    hosts,
+		newProxy: newProxy,
+		start:    start,
+		dialer:   dialer,
+		relay: &httputil.ReverseProxy{
+			Rewrite:   func(r *httputil.ProxyRequest) {},
+			Transport: transport,
+		},
+		proxies: make(map[string]*CachingReverseProxy),
+	}
+}
+
+// publicOnly is the Control of the dialers of forward proxies, refusing to
+// connect to loopback, link-local, private, shared, multicast and
+// unspecified addresses. It checks the address resolved, so that host names
+// resolving to such addresses are refused too.
+func publicOnly(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !publicIP(ip) {
+		return fmt.Errorf("refusing to connect to non-public address %s", address)
+	}
+	return nil
+}
+
+// nonPublicNetworks are the networks refused by publicOnly besides those
+// recognized by the methods of net.IP: the shared address space of carrier
+// grade NATs, common in cloud networks, NAT64 prefixes for local use, and
+// the deprecated IPv4-compatible IPv6 addresses.
+var nonPublicNetworks = []*net.IPNet{
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("64:ff9b:1::/48"),
+	mustParseCIDR("::/96"),
+}
+
+var (
+	// nat64Prefix is the well-known NAT64 prefix, followed by IPv4
+	// addresses translated to IPv6.
+	nat64Prefix = mustParseCIDR("64:ff9b::/96")
+	// sixToFourPrefix is the 6to4 prefix, followed by the IPv4 address of
+	// the relay.
+	sixToFourPrefix = mustParseCIDR("2002::/16")
+)
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// publicIP reports whether ip is a public address, and IPv4 addresses
+// embedded in it, as by NAT64 or 6to4, are public too. IPv4-mapped IPv6
+// addresses are checked as IPv4 addresses.
+func publicIP(ip net.IP) bool {
+	if ip.To4() == nil {
+		switch {
+		case nat64Prefix.Contains(ip):
+			return publicIP(ip[12:16])
+		case sixToFourPrefix.Contains(ip):
+			return publicIP(ip[2:6])
+		}
+	}
+	return !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsPrivate() && !ip.IsMulticast() && !ip.IsUnspecified() && !containsIP(nonPublicNetworks, ip)
+}
+
+// IsProxyRequest reports whether r is addressed to a forward proxy: a
+// CONNECT request or a request for an absolute URL.
+func IsProxyRequest(r *http.Request) bool {
+	return r.Method == http.MethodConnect || r.URL.IsAbs()
+}
+
+// allowed reports whether requests for host are forwarded.
+func (f *ForwardProxy) allowed(host string) bool {
+	for _, pattern := range f.hosts {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// proxy returns the proxy for origin, creating it if needed, or nil if
+// maxForwardOrigins are already cached.
+func (f *ForwardProxy) proxy(origin string) *CachingReverseProxy {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.proxies[origin]
+	if !ok {
+		if len(f.proxies) >= maxForwardOrigins {
+			return nil
+		}
+		p = f.newProxy(origin)
+		if p.dialer != nil {
+			p.dialer.Control = publicOnly
+		}
+		f.start(p)
+		f.proxies[origin] = p
+		p.logger().Info("forwarding to new origin", "url", origin)
+	}
+	return p
+}
+
+// Proxies returns the proxies created for the origins requested so far.
+func (f *ForwardProxy) Proxies() []*CachingReverseProxy {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	proxies := make([]*CachingReverseProxy, 0, len(f.proxies))
+	for _, p := range f.proxies {
+		proxies = append(proxies, p)
+	}
+	return proxies
+}
+
+func (f *ForwardProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodConnect:
+		host, port, err := net.SplitHostPort(r.Host)
+		if err != nil || port != "443" || !f.allowed(host) {
+			statusError(w, r, http.StatusForbidden)
+			slog.Warn("refusing to tunnel", "host", r.Host, "remote", r.RemoteAddr)
+			return
+		}
+		f.tunnel(w, r)
+	case r.URL.IsAbs() && r.URL.Scheme == "http":
+		if port := r.URL.Port(); port != "" && port != "80" || !f.allowed(r.URL.Hostname()) {
+			statusError(w, r, http.StatusForbidden)
+			slog.Warn("refusing to forward", "url", r.URL.String(), "remote", r.RemoteAddr)
+			return
+		}
+		p := f.proxy("http://" + strings.TrimSuffix(r.URL.Host, ":80"))
+		if p == nil {
+			slog.Warn("too many origins, relaying", "url", r.URL.String())
+			f.relay.ServeHTTP(w, r)
+			return
+		}
+		r2 := r.Clone(r.Context())
+		r2.URL = &url.URL{Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery}
+		r2.RequestURI = r2.URL.RequestURI()
+		r2.Header.Del("Proxy-Authorization")
+		r2.Header.Del("Proxy-Connection")
+		p.ServeHTTP(w, r2)
+	case r.URL.IsAbs():
+		statusError(w, r, http.StatusForbidden)
+		slog.Warn("refusing to forward", "url", r.URL.String(), "remote", r.RemoteAddr)
+	default:
+		statusError(w, r, http.StatusBadRequest)
+	}
+}
+
+// tunnel connects the client of the CONNECT request r to the address it
+// asks for and copies data both ways until either side closes.
+func (f *ForwardProxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	upstream, err := f.dialer.DialContext(r.Context(), "tcp", r.Host)
+	if err != nil {
+		statusError(w, r, http.StatusBadGateway)
+		slog.Warn("cannot connect", "host", r.Host, "err", err)
+		return
+	}
+	defer upstream.Close()
+	client, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		statusError(w, r, http.StatusNotImplemented)
+		slog.Warn("cannot tunnel", "host", r.Host, "err", err)
+		return
+	}
+	defer client.Close()
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	slog.Debug("tunneling", "host", r.Host)
+	done := make(chan struct{})
+	go func() {
+		// bytes the client sent after the request may already be buffered
+		io.Copy(upstream, buf.Reader)
+		upstream.(*net.TCPConn).CloseWrite()
+		close(done)
+	}()
+	io.Copy(client, upstream)
+	client.Close()
+	<-done
+}
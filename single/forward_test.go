@@ -0,0 +1,101 @@
+package single
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPublicOnly(t *testing.T) {
+	for _, test := range []struct {
+		address string
+		allowed bool
+	}{
+		{"8.8.8.8:80", true},
+		{"[2001:4860:4860::8888]:443", true},
+		{"127.0.0.1:80", false},
+		{"[::1]:80", false},
+		{"10.0.0.1:80", false},
+		{"192.168.1.1:80", false},
+		{"[fd00::1]:80", false},
+		{"169.254.169.254:80", false},
+		{"[fe80::1]:80", false},
+		{"0.0.0.0:80", false},
+		{"224.0.0.1:80", false},
+		{"example.org:80", false},
+		{"100.64.0.1:80", false},
+		{"100.127.255.254:80", false},
+		{"100.128.0.1:80", true},
+		{"[::ffff:10.0.0.1]:80", false},
+		{"[::ffff:100.64.0.1]:80", false},
+		{"[::ffff:127.0.0.1]:80", false},
+		{"[::ffff:8.8.8.8]:80", true},
+		{"[64:ff9b::a00:1]:80", false},
+		{"[64:ff9b::7f00:1]:80", false},
+		{"[64:ff9b::6440:1]:80", false},
+		{"[64:ff9b::808:808]:80", true},
+		{"[64:ff9b:1::808:808]:80", false},
+		{"[2002:a00:1::1]:80", false},
+		{"[2002:808:808::1]:80", true},
+		{"[::a00:1]:80", false},
+	} {
+		if err := publicOnly("tcp", test.address, nil); (err == nil) != test.allowed {
+			t.Errorf("publicOnly(%q) = %v, want allowed %v", test.address, err, test.allowed)
+		}
+	}
+}
+
+func TestForwardProxyRefused(t *testing.T) {
+	f := NewForwardProxy([]string{"*.example.org"}, func(origin string) *CachingReverseProxy {
+		t.Errorf("proxy created for %s", origin)
+		return nil
+	}, func(*CachingReverseProxy) {})
+	for _, test := range []struct {
+		method string
+		target string
+		status int
+	}{
+		{http.MethodConnect, "mirror.example.org:22", http.StatusForbidden},
+		{http.MethodConnect, "example.com:443", http.StatusForbidden},
+		{http.MethodConnect, "mirror.example.org", http.StatusForbidden},
+		{http.MethodGet, "http://mirror.example.org:8080/core.db", http.StatusForbidden},
+		{http.MethodGet, "http://example.com/core.db", http.StatusForbidden},
+		{http.MethodGet, "https://mirror.example.org/core.db", http.StatusForbidden},
+		{http.MethodGet, "/core.db", http.StatusBadRequest},
+	} {
+		r := httptest.NewRequest(test.method, test.target, nil)
+		if test.method == http.MethodConnect {
+			r.Host = test.target
+		}
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s %s: got %d, want %d", test.method, test.target, w.Code, test.status)
+		}
+	}
+}
+
+func TestForwardProxyLoopbackOrigin(t *testing.T) {
+	var requests atomic.Int64
+	upstream := countingUpstream(100, &requests)
+	defer upstream.Close()
+	f := NewForwardProxy([]string{"127.0.0.1"}, func(origin string) *CachingReverseProxy {
+		p, err := NewCachingReverseProxy(origin, "/cache", WithCacheFS(NewMemFS()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}, func(*CachingReverseProxy) {})
+	// ServeHTTP refuses the port of the test server, so request through the
+	// proxy it would use for the origin
+	p := f.proxy(upstream.URL)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/core.db", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("got %d, want %d", w.Code, http.StatusBadGateway)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("upstream received %d requests, want 0", n)
+	}
+}
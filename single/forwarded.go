@@ -0,0 +1,96 @@
+package single
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// TrustProxies returns a handler serving requests with h, taking the
+// address of the client of requests from proxies in networks, such as a
+// load balancer in front of the proxy, from their X-Forwarded-For header, so
+// that it is logged, allowed, grouped and limited instead of the address of
+// the proxy. The address is the last one of X-Forwarded-For not in networks,
+// and the addresses after it, of proxies in networks, are removed from the
+// header.
+func TrustProxies(h http.Handler, networks []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if inNetworks(r, networks) {
+			if client, chain, ok := forwardedClient(r.Header.Values("X-Forwarded-For"), networks); ok {
+				r = r.WithContext(r.Context())
+				r.RemoteAddr = client
+				r.Header = r.Header.Clone()
+				if len(chain) > 0 {
+					r.Header.Set("X-Forwarded-For", strings.Join(chain, ", "))
+				} else {
+					r.Header.Del("X-Forwarded-For")
+				}
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// forwardedClient returns the last address of the X-Forwarded-For values
+// not in trusted, or the first one if all are, and the addresses before it.
+func forwardedClient(values []string, trusted []*net.IPNet) (string, []string, bool) {
+	var addrs []string
+	for _, value := range values {
+		for _, addr := range strings.Split(value, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	for i := len(addrs) - 1; i >= 0; i-- {
+		ip := net.ParseIP(addrs[i])
+		if ip == nil {
+			// not an address this proxy can trust beyond
+			return "", nil, false
+		}
+		if i == 0 || !containsIP(trusted, ip) {
+			return ip.String(), addrs[:i], true
+		}
+	}
+	return "", nil, false
+}
+
+// containsIP reports whether ip is in one of networks.
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the X-Forwarded-For header of upstream requests made
+// for r: that of r followed by the address of its client.
+func forwardedFor(r *http.Request) string {
+	chain := r.Header.Values("X-Forwarded-For")
+	return strings.Join(append(chain, clientHost(r)), ", ")
+}
+
+// viaEntry returns the entry of the proxy in a Via header of a message
+// received with the protocol version major.minor, or "" without Via.
+func (p *CachingReverseProxy) viaEntry(major, minor int) string {
+	if p.Via == "" {
+		return ""
+	}
+	protocol := strconv.Itoa(major)
+	if major < 2 {
+		protocol += "." + strconv.Itoa(minor)
+	}
+	return protocol + " " + p.Via
+}
+
+// appendVia sets the Via header of h to the entries of received, the
+// headers of the message forwarded, followed by entry.
+func appendVia(h http.Header, received http.Header, entry string) {
+	if entry == "" {
+		return
+	}
+	h.Set("Via", strings.Join(append(received.Values("Via"), entry), ", "))
+}
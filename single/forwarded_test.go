@@ -0,0 +1,36 @@
+package single
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestForwardedClient(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("10.0.0.0/8")
+	trusted := []*net.IPNet{lan}
+	for _, test := range []struct {
+		values []string
+		client string
+		chain  []string
+		ok     bool
+	}{
+		{nil, "", nil, false},
+		{[]string{"192.0.2.1"}, "192.0.2.1", []string{}, true},
+		{[]string{"192.0.2.1, 10.0.0.2"}, "192.0.2.1", []string{}, true},
+		{[]string{"198.51.100.7, 192.0.2.1, 10.0.0.2"}, "192.0.2.1", []string{"198.51.100.7"}, true},
+		// values of several headers are joined
+		{[]string{"198.51.100.7", "192.0.2.1", "10.0.0.2"}, "192.0.2.1", []string{"198.51.100.7"}, true},
+		// the first address is taken if all are trusted
+		{[]string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3", []string{}, true},
+		// addresses before an untrusted one are not looked at
+		{[]string{"garbage, 192.0.2.1"}, "192.0.2.1", []string{"garbage"}, true},
+		{[]string{"192.0.2.1, garbage, 10.0.0.2"}, "", nil, false},
+		{[]string{" , 2001:db8::1 "}, "2001:db8::1", []string{}, true},
+	} {
+		client, chain, ok := forwardedClient(test.values, trusted)
+		if client != test.client || ok != test.ok || ok && !reflect.DeepEqual(chain, test.chain) {
+			t.Errorf("forwardedClient(%q) = %q, %q, %v, want %q, %q, %v", test.values, client, chain, ok, test.client, test.chain, test.ok)
+		}
+	}
+}
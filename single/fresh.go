@@ -0,0 +1,70 @@
+package single
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// freshUntil returns until when a response with header, received at now, may
+// be served without validating it, according to its Cache-Control and
+// Expires headers, or the zero time if it must always be validated or does
+// not say.
+func freshUntil(header http.Header, now time.Time) time.Time {
+	var maxAge, sMaxAge = -1, -1
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-cache", "no-store", "must-revalidate", "proxy-revalidate":
+			return time.Time{}
+		case "max-age":
+			maxAge, _ = strconv.Atoi(strings.Trim(value, `"`))
+		case "s-maxage":
+			sMaxAge, _ = strconv.Atoi(strings.Trim(value, `"`))
+		}
+	}
+	if sMaxAge >= 0 {
+		maxAge = sMaxAge
+	}
+	if maxAge > 0 {
+		age, _ := strconv.Atoi(header.Get("Age"))
+		return now.Add(time.Duration(maxAge-age) * time.Second)
+	}
+	if maxAge == 0 {
+		return time.Time{}
+	}
+	expires, err := http.ParseTime(header.Get("Expires"))
+	if err != nil {
+		return time.Time{}
+	}
+	// Expires is relative to the clock of the upstream
+	if date, err := http.ParseTime(header.Get("Date")); err == nil {
+		return now.Add(expires.Sub(date))
+	}
+	return expires
+}
+
+// fresh reports whether the object cached at cleanPath, with metadata meta
+// and last validated at validated, may be served without validating it: it
+// was validated within the MaxAge of its cache rule, or, with
+// HonorCacheControl and no MaxAge, before the upstream said it expires.
+func (p *CachingReverseProxy) fresh(cleanPath string, meta *Metadata, validated time.Time) bool {
+	if maxAge := p.cacheMaxAge(cleanPath); maxAge > 0 {
+		return !validated.IsZero() && p.now().Sub(validated) < maxAge
+	}
+	return p.HonorCacheControl && meta != nil && p.now().Before(meta.Expires)
+}
+
+// checksFreshness reports whether fresh may be true for some objects.
+func (p *CachingReverseProxy) checksFreshness() bool {
+	if p.HonorCacheControl {
+		return true
+	}
+	for _, rule := range p.CacheRules {
+		if rule.MaxAge > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package single
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// upstreamUnchanged reports whether resp, a response to a conditional request
+// for the object cached at cleanPath with modTime and size, carries the cached
+// object even though the upstream did not reply 304. This happens when nodes
+// of a CDN disagree on the modification time by a small skew, or serve an
+// older view of the file, and would otherwise cause a full re-download.
+//
+// The object is taken to be unchanged if the size is the same and either the
+// upstream sends the strong ETag recorded in the metadata, or its
+// Last-Modified is earlier than modTime plus ClockSkewTolerance.
+func (p *CachingReverseProxy) upstreamUnchanged(cleanPath string, resp *http.Response, modTime time.Time, size int64) bool {
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != size {
+		return false
+	}
+	etag := resp.Header.Get("ETag")
+	if etag != "" && !strings.HasPrefix(etag, "W/") && p.Metadata != nil {
+		meta, err := p.Metadata.Get(p.objectKey(cleanPath))
+		if err == nil && meta != nil && meta.ETag == etag {
+			p.logger().Debug("upstream sent the recorded ETag, keeping cached object", "path", cleanPath)
+			return true
+		}
+	}
+	if p.ClockSkewTolerance <= 0 {
+		return false
+	}
+	upstreamModTime, err := time.Parse(http.TimeFormat, resp.Header.Get("Last-Modified"))
+	if err != nil || upstreamModTime.After(modTime.Add(p.ClockSkewTolerance)) {
+		return false
+	}
+	p.logger().Debug("upstream Last-Modified is within tolerance, keeping cached object",
+		"path", cleanPath, "upstream", upstreamModTime.Format(http.TimeFormat), "cached", modTime.Format(http.TimeFormat))
+	return true
+}
@@ -0,0 +1,149 @@
+package single
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tempFileMaxAge is how long a temporary file may go unmodified before it is
+// considered left behind by an interrupted download.
+const tempFileMaxAge = time.Hour
+
+// GCOptions configures GC.
+type GCOptions struct {
+	// MaxIdle evicts objects not accessed for longer than it from the disk
+	// cache. Zero keeps objects regardless of their last access.
+	MaxIdle time.Duration
+	// DryRun reports what would be removed without removing anything.
+	DryRun bool
+}
+
+// GCItem is a file removed by GC.
+type GCItem struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Reason string `json:"reason"`
+}
+
+// GCReport lists the files removed by GC and the space reclaimed.
+type GCReport struct {
+	DryRun  bool     `json:"dry_run"`
+	Removed []GCItem `json:"removed"`
+	Bytes   int64    `json:"bytes"`
+}
+
+// GC removes files the cache no longer needs: temporary files of interrupted
+// downloads, stale lock files, metadata of missing objects, objects idle for
+// longer than opts.MaxIdle and blobs no longer linked from any object. Space
+// shared through hard links is counted once, when its last link is removed.
+// With opts.DryRun, it reports the same files without removing them.
+func (p *CachingReverseProxy) GC(opts GCOptions) (*GCReport, error) {
+	report := &GCReport{DryRun: opts.DryRun, Removed: []GCItem{}}
+	// evicted holds the evicted objects sharing their content with a blob
+	evicted := []os.FileInfo{}
+	evictedPaths := make(map[string]bool)
+	remove := func(name string, info os.FileInfo, reason string, evict func() error) error {
+		size := info.Size()
+		if linkCount(info) > 1 {
+			size = 0
+		}
+		report.Removed = append(report.Removed, GCItem{Path: name, Size: size, Reason: reason})
+		report.Bytes += size
+		if opts.DryRun {
+			return nil
+		}
+		if evict != nil {
+			return evict()
+		}
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	root := p.cacheRoot()
+	now := p.now()
+	err := filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// removed together with an evicted object
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if name != root && isInternalFile(info.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch {
+		case isTempFile(info.Name()):
+			if now.Sub(info.ModTime()) > tempFileMaxAge {
+				return remove(name, info, "abandoned download", nil)
+			}
+		case strings.HasSuffix(info.Name(), lockSuffix):
+			if now.Sub(info.ModTime()) > lockStaleAfter {
+				return remove(name, info, "stale lock", nil)
+			}
+		case strings.HasSuffix(info.Name(), sidecarSuffix):
+			object := strings.TrimSuffix(name, sidecarSuffix)
+			if _, err := os.Lstat(object); os.IsNotExist(err) && !evictedPaths[object] {
+				return remove(name, info, "metadata of missing object", nil)
+			}
+		case isInternalFile(info.Name()):
+		case opts.MaxIdle > 0 && now.Sub(accessTime(info)) > opts.MaxIdle:
+			rel, err := filepath.Rel(root, name)
+			if err != nil {
+				return err
+			}
+			cleanPath := "/" + filepath.ToSlash(rel)
+			if linkCount(info) > 1 {
+				evicted = append(evicted, info)
+			}
+			evictedPaths[name] = true
+			if sidecar, err := os.Lstat(name + sidecarSuffix); err == nil {
+				report.Removed = append(report.Removed, GCItem{Path: name + sidecarSuffix, Size: sidecar.Size(), Reason: "metadata of idle object"})
+				report.Bytes += sidecar.Size()
+			}
+			return remove(name, info, "idle", func() error {
+				return p.evictObject(cleanPath)
+			})
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return report, err
+	}
+
+	blobRoot := path.Join(p.cacheDir, blobDir)
+	err = filepath.Walk(blobRoot, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		links := linkCount(info)
+		for _, e := range evicted {
+			if links > 1 && os.SameFile(info, e) {
+				links--
+			}
+		}
+		if links == 1 {
+			report.Removed = append(report.Removed, GCItem{Path: name, Size: info.Size(), Reason: "unreferenced blob"})
+			report.Bytes += info.Size()
+			if !opts.DryRun {
+				return os.Remove(name)
+			}
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return report, err
+}
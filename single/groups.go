@@ -0,0 +1,219 @@
+package single
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+)
+
+// ClientGroup is a set of clients, identified by their networks, whose
+// cached objects are accounted together against Quota. When the objects of a
+// group exceed its quota, the group's least recently accessed objects are
+// evicted, so one group cannot evict the working set of another.
+//
+// An object belongs to the group of the client that last accessed it, so that
+// objects shared between groups are charged to the group still using them.
+type ClientGroup struct {
+	Name     string
+	Networks []*net.IPNet
+	// Quota is the most bytes the group's objects may use. Zero means no
+	// limit.
+	Quota int64
+}
+
+// groupUsage is the accounting of the objects of the client groups.
+type groupUsage struct {
+	// objects maps group names to the sizes of their objects by path.
+	objects map[string]map[string]int64
+	// owners maps paths to the name of the group they belong to.
+	owners map[string]string
+}
+
+// clientGroup returns the name of the group of the client of r, or an empty
+// string if it is in no group.
+func (p *CachingReverseProxy) clientGroup(r *http.Request) string {
+	if len(p.ClientGroups) == 0 {
+		return ""
+	}
+	ip := net.ParseIP(clientHost(r))
+	if ip == nil {
+		return ""
+	}
+	for _, g := range p.ClientGroups {
+		for _, network := range g.Networks {
+			if network.Contains(ip) {
+				return g.Name
+			}
+		}
+	}
+	return ""
+}
+
+func (p *CachingReverseProxy) findClientGroup(name string) *ClientGroup {
+	for _, g := range p.ClientGroups {
+		if g.Name == name {
+			return g
+		}
+	}
+	return nil
+}
+
+// LoadGroupUsage reads which cached objects belong to which ClientGroups
+// from the metadata, which is required to use client groups. It must be
+// called before serving.
+func (p *CachingReverseProxy) LoadGroupUsage() error {
+	p.groupsMu.Lock()
+	defer p.groupsMu.Unlock()
+	p.groups = groupUsage{
+		objects: make(map[string]map[string]int64),
+		owners:  make(map[string]string),
+	}
+	return p.walkCache(func(cleanPath, cachePath string, info os.FileInfo) error {
+		meta, err := p.Metadata.Get(p.objectKey(cleanPath))
+		if err != nil {
+			return err
+		}
+		if meta != nil && p.findClientGroup(meta.Group) != nil {
+			p.groups.set(meta.Group, cleanPath, info.Size())
+		}
+		return nil
+	})
+}
+
+func (u *groupUsage) set(group, cleanPath string, size int64) {
+	u.remove(cleanPath)
+	if u.objects[group] == nil {
+		u.objects[group] = make(map[string]int64)
+	}
+	u.objects[group][cleanPath] = size
+	u.owners[cleanPath] = group
+}
+
+func (u *groupUsage) remove(cleanPath string) {
+	if group, ok := u.owners[cleanPath]; ok {
+		delete(u.objects[group], cleanPath)
+		delete(u.owners, cleanPath)
+	}
+}
+
+// chargeGroup records that the object at cleanPath of size bytes belongs to
+// group, and enforces the quota of the group. If the object belonged to
+// another group, the metadata is updated unless updateMetadata is false.
+func (p *CachingReverseProxy) chargeGroup(group string, cleanPath string, size int64, updateMetadata bool) {
+	if p.groups.owners == nil {
+		return
+	}
+	p.groupsMu.Lock()
+	owner, owned := p.groups.owners[cleanPath]
+	if group == "" || owned && owner == group {
+		p.groupsMu.Unlock()
+		return
+	}
+	p.groups.set(group, cleanPath, size)
+	p.groupsMu.Unlock()
+
+	if updateMetadata {
+		key := p.objectKey(cleanPath)
+		meta, err := p.Metadata.Get(key)
+		if err == nil {
+			if meta == nil {
+				meta = &Metadata{}
+			}
+			meta.Group = group
+			err = p.Metadata.Put(key, meta)
+		}
+		if err != nil {
+			p.logger().Warn("cannot record group", "path", cleanPath, "err", err)
+		}
+	}
+	p.enforceQuota(group, cleanPath)
+}
+
+// forgetGroup removes the object at cleanPath from the group accounting.
+func (p *CachingReverseProxy) forgetGroup(cleanPath string) {
+	if p.groups.owners == nil {
+		return
+	}
+	p.groupsMu.Lock()
+	defer p.groupsMu.Unlock()
+	p.groups.remove(cleanPath)
+}
+
+// enforceQuota evicts the least recently accessed objects of group, other
+// than keep, until the group is within its quota.
+func (p *CachingReverseProxy) enforceQuota(group string, keep string) {
+	g := p.findClientGroup(group)
+	if g == nil || g.Quota <= 0 {
+		return
+	}
+	type candidate struct {
+		cleanPath  string
+		size       int64
+		accessTime int64
+	}
+	var candidates []candidate
+	var used int64
+	p.groupsMu.Lock()
+	for cleanPath, size := range p.groups.objects[group] {
+		used += size
+		if cleanPath != keep {
+			candidates = append(candidates, candidate{cleanPath: cleanPath, size: size})
+		}
+	}
+	p.groupsMu.Unlock()
+	if used <= g.Quota {
+		return
+	}
+
+	for i := range candidates {
+		info, err := p.cacheFS().Stat(path.Join(p.cacheRoot(), candidates[i].cleanPath))
+		if err == nil {
+			candidates[i].accessTime = accessTime(info).UnixNano()
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].accessTime < candidates[j].accessTime
+	})
+	for _, c := range candidates {
+		if used <= g.Quota {
+			break
+		}
+		if p.EvictionDryRun {
+			p.logger().Info("would evict to keep group within its quota", "path", c.cleanPath, "size", c.size, "group", group)
+			if p.DecisionLog != nil {
+				p.decide(c.cleanPath, decisionEvict, "quota of group "+group, c.size, 0)
+			}
+			used -= c.size
+			continue
+		}
+		if err := p.evictObject(c.cleanPath); err != nil {
+			p.logger().Error("evict failed", "path", c.cleanPath, "err", err)
+			continue
+		}
+		p.logger().Info("evicted to keep group within its quota", "path", c.cleanPath, "group", group)
+		used -= c.size
+	}
+}
+
+// evictObject removes the object at cleanPath from the disk and memory tiers,
+// along with its metadata. Unlike purging, a copy in the cold tier is kept.
+func (p *CachingReverseProxy) evictObject(cleanPath string) error {
+	cachePath := path.Join(p.cacheRoot(), cleanPath)
+	if p.Memory != nil {
+		p.Memory.remove(p.objectKey(cleanPath))
+	}
+	p.forgetOpenFile(cachePath)
+	p.forgetGroup(cleanPath)
+	p.objectStats.forget(cleanPath)
+	size := p.recordRemove(cachePath)
+	if err := p.cacheFS().Remove(cachePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	p.recordEviction(size)
+	if p.Metadata != nil {
+		return p.Metadata.Delete(p.objectKey(cleanPath))
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package single
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientGroupQuota(t *testing.T) {
+	var requests atomic.Int64
+	upstream := countingUpstream(100, &requests)
+	defer upstream.Close()
+	cacheDir := t.TempDir()
+	p, err := NewCachingReverseProxy(upstream.URL, cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Metadata, err = OpenMetadataStore("sidecar", cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, networkA, _ := net.ParseCIDR("192.0.2.0/24")
+	_, networkB, _ := net.ParseCIDR("198.51.100.0/24")
+	p.ClientGroups = []*ClientGroup{
+		{Name: "a", Networks: []*net.IPNet{networkA}, Quota: 250},
+		{Name: "b", Networks: []*net.IPNet{networkB}},
+	}
+	if err := p.LoadGroupUsage(); err != nil {
+		t.Fatal(err)
+	}
+	var accessed int64
+	get := func(cleanPath, remote string) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, cleanPath, nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s from %s: got %d, want %d", cleanPath, remote, w.Code, http.StatusOK)
+		}
+		// order the accesses regardless of the atime behavior of the
+		// filesystem
+		accessed++
+		if err := os.Chtimes(filepath.Join(cacheDir, cleanPath), time.Unix(accessed, 0), time.Unix(1e9, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cached := func(cleanPath string) bool {
+		_, err := os.Stat(filepath.Join(cacheDir, cleanPath))
+		return err == nil
+	}
+
+	get("/1", "192.0.2.1:1234")
+	get("/2", "192.0.2.1:1234")
+	get("/3", "192.0.2.2:1234")
+	// group a is over its quota, so its least recently accessed object is
+	// evicted
+	for cleanPath, want := range map[string]bool{"/1": false, "/2": true, "/3": true} {
+		if got := cached(cleanPath); got != want {
+			t.Errorf("%s cached %v, want %v", cleanPath, got, want)
+		}
+	}
+	// /2 is charged to group b once it accesses it, and no longer evicted
+	// for group a
+	get("/2", "198.51.100.1:1234")
+	if m, err := p.Metadata.Get("/2"); err != nil || m == nil || m.Group != "b" {
+		t.Errorf("metadata of /2 = %+v, %v, want group b", m, err)
+	}
+	get("/4", "192.0.2.1:1234")
+	get("/5", "192.0.2.1:1234")
+	for cleanPath, want := range map[string]bool{"/2": true, "/3": false, "/4": true, "/5": true} {
+		if got := cached(cleanPath); got != want {
+			t.Errorf("%s cached %v, want %v", cleanPath, got, want)
+		}
+	}
+	// clients in no group are not limited
+	for _, cleanPath := range []string{"/6", "/7", "/8"} {
+		get(cleanPath, "203.0.113.1:1234")
+	}
+	for _, cleanPath := range []string{"/2", "/4", "/5", "/6", "/7", "/8"} {
+		if !cached(cleanPath) {
+			t.Errorf("%s evicted", cleanPath)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package single
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+)
+
+// headFromCache reports whether the request r for an object with policy is
+// answered from the cache without asking the upstream, as HeadFromCache
+// allows.
+func (p *CachingReverseProxy) headFromCache(r *http.Request, policy CachePolicy) bool {
+	return r.Method == http.MethodHead && p.HeadFromCache && policy != CacheBypass && policy != CacheRevalidate
+}
+
+// serveHeadFromMetadata answers the HEAD request r for the object at
+// cleanPath, which is not on disk, from its size, modification time and
+// content type recorded in Metadata, and reports whether it could.
+func (p *CachingReverseProxy) serveHeadFromMetadata(w http.ResponseWriter, r *http.Request, cleanPath string) bool {
+	meta := p.cachedMetadata(cleanPath)
+	if meta == nil || meta.Size <= 0 {
+		return false
+	}
+	modTime, err := http.ParseTime(meta.LastModified)
+	if err != nil {
+		return false
+	}
+	contentType := meta.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(path.Ext(cleanPath))
+	}
+	if contentType == "" {
+		// http.ServeContent would read the content to sniff its type
+		return false
+	}
+	p.logger().Debug("serving HEAD from metadata", "path", cleanPath)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", cachedETag(meta, meta.Size, modTime))
+	http.ServeContent(w, r, path.Base(cleanPath), modTime, io.NewSectionReader(noContent{}, 0, meta.Size))
+	return true
+}
+
+// noContent stands in for the content of objects whose headers are served
+// without it.
+type noContent struct{}
+
+func (noContent) ReadAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("content not available")
+}
@@ -0,0 +1,150 @@
+package single
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxSyncLag is how far behind the most recently synced upstream another
+	// may be and still be selected by RunHealthChecks.
+	maxSyncLag = time.Hour
+
+	// switchRatio is how much lower the latency of another upstream must be
+	// than that of the selected one for RunHealthChecks to switch to it, so
+	// that small variations do not make the selection flap.
+	switchRatio = 1.5
+)
+
+// endpointHealth is what is known about the health of the upstream or a
+// mirror.
+type endpointHealth struct {
+	// downUntil is when the endpoint is tried again after a failure, in Unix
+	// nanoseconds.
+	downUntil atomic.Int64
+	// failing is whether the last health check failed.
+	failing atomic.Bool
+	// latency is a moving average of the time health checks took to receive
+	// the response headers, in nanoseconds, or 0 if none succeeded yet.
+	latency atomic.Int64
+	// lastSync is when the endpoint last synced, in Unix nanoseconds, or 0
+	// if unknown.
+	lastSync atomic.Int64
+	// checked is when the endpoint was last checked, in Unix nanoseconds.
+	checked atomic.Int64
+}
+
+// down reports whether the endpoint should be tried only after the others at
+// now, in Unix nanoseconds.
+func (h *endpointHealth) down(now int64) bool {
+	return h.failing.Load() || h.downUntil.Load() > now
+}
+
+// RunHealthChecks requests HealthCheckPath from the upstream and each mirror
+// now and every interval until ctx is done, measuring their latency and when
+// they last synced, and selects the upstream requests are sent to first: the
+// fastest among those that respond and are synced within an hour of the most
+// recently synced one. The selection only changes when the selected upstream
+// fails or another is clearly faster.
+func (p *CachingReverseProxy) RunHealthChecks(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, interval)
+		upstreams := p.upstreams()
+		var wg sync.WaitGroup
+		for _, m := range upstreams {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				p.checkHealth(checkCtx, m)
+			}()
+		}
+		wg.Wait()
+		cancel()
+		p.selectUpstream(upstreams)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkHealth requests HealthCheckPath from m and records the result.
+func (p *CachingReverseProxy) checkHealth(ctx context.Context, m *mirror) {
+	req, err := p.newUpstreamRequest(http.MethodHead, p.HealthCheckPath)
+	if err != nil {
+		p.logger().Error("health check failed", "err", err)
+		return
+	}
+	start := time.Now()
+	resp, err := p.tryMirror(req.WithContext(ctx), m, m.prefix+escapePath(p.HealthCheckPath))
+	latency := time.Since(start)
+	h := m.health
+	h.checked.Store(p.now().UnixNano())
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			err = fmt.Errorf("health check returned %s", resp.Status)
+		}
+	}
+	if err != nil {
+		if !h.failing.Swap(true) {
+			p.logger().Warn("upstream unhealthy", "mirror", m.prefix, "err", err)
+		}
+		return
+	}
+	if h.failing.Swap(false) {
+		p.logger().Info("upstream healthy again", "mirror", m.prefix)
+	}
+	h.downUntil.Store(0)
+	if old := time.Duration(h.latency.Load()); old > 0 {
+		latency = (3*old + latency) / 4
+	}
+	h.latency.Store(int64(latency))
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		h.lastSync.Store(t.UnixNano())
+	}
+	p.logger().Debug("health check", "mirror", m.prefix, "latency", latency, "status", resp.StatusCode)
+}
+
+// selectUpstream sets preferredUpstream to the best of upstreams, as
+// described in RunHealthChecks.
+func (p *CachingReverseProxy) selectUpstream(upstreams []*mirror) {
+	var newest int64
+	for _, m := range upstreams {
+		if !m.health.failing.Load() {
+			newest = max(newest, m.health.lastSync.Load())
+		}
+	}
+	usable := func(h *endpointHealth) bool {
+		if h.failing.Load() || h.latency.Load() == 0 {
+			return false
+		}
+		lastSync := h.lastSync.Load()
+		return lastSync == 0 || time.Duration(newest-lastSync) <= maxSyncLag
+	}
+	best := -1
+	for i, m := range upstreams {
+		if usable(m.health) && (best < 0 || m.health.latency.Load() < upstreams[best].health.latency.Load()) {
+			best = i
+		}
+	}
+	preferred := p.preferred()
+	current := slices.IndexFunc(upstreams, func(m *mirror) bool { return m.health == preferred })
+	if best < 0 || best == current {
+		return
+	}
+	if current >= 0 && usable(upstreams[current].health) &&
+		float64(upstreams[best].health.latency.Load())*switchRatio > float64(upstreams[current].health.latency.Load()) {
+		return
+	}
+	p.preferredUpstream.Store(upstreams[best].health)
+	p.logger().Info("selected upstream", "mirror", upstreams[best].prefix, "latency", time.Duration(upstreams[best].health.latency.Load()))
+}
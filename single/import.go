@@ -0,0 +1,173 @@
+package single
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// importCandidate is a request path a file may be imported as.
+type importCandidate struct {
+	cleanPath string
+	sha256    string
+}
+
+// Import copies the package files under dir, such as a pacman package cache,
+// into the cache. File names are mapped to request paths with the pacman
+// databases in the cache; the databases at dbPaths are fetched from the
+// upstream first. A file is imported only if its SHA-256 matches the database
+// and the upstream still serves it, which provides the Last-Modified time to
+// record. Import returns the request paths of the imported files.
+func (p *CachingReverseProxy) Import(dir string, dbPaths []string) ([]string, error) {
+	for _, dbPath := range dbPaths {
+		p.prefetchOne(path.Clean("/" + dbPath))
+	}
+	candidates := make(map[string][]importCandidate)
+	err := p.walkCache(func(cleanPath, cachePath string, info os.FileInfo) error {
+		if !isPacmanDB(cleanPath) {
+			return nil
+		}
+		packages, err := readPacmanDB(p.cacheFS(), cachePath)
+		if err != nil {
+			p.logger().Warn("import: cannot read", "path", cleanPath, "err", err)
+			return nil
+		}
+		for _, pkg := range packages {
+			if pkg.SHA256 == "" || pkg.Filename != path.Base(pkg.Filename) || isInternalFile(pkg.Filename) {
+				continue
+			}
+			candidates[pkg.Filename] = append(candidates[pkg.Filename], importCandidate{
+				cleanPath: path.Join(path.Dir(cleanPath), pkg.Filename),
+				sha256:    pkg.SHA256,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	imported := []string{}
+	err = filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		var sum string
+		for _, c := range candidates[info.Name()] {
+			cachePath := path.Join(p.cacheRoot(), c.cleanPath)
+			if _, err := p.cacheFS().Stat(cachePath); err == nil {
+				continue
+			}
+			if sum == "" {
+				if sum, err = sha256File(osFS{}, name); err != nil {
+					return err
+				}
+			}
+			if sum != c.sha256 {
+				p.logger().Warn("import: file does not match the upstream", "file", name, "path", c.cleanPath)
+				continue
+			}
+			if err := p.importFile(name, info.Size(), c.cleanPath, cachePath, sum); err != nil {
+				p.logger().Error("import failed", "file", name, "path", c.cleanPath, "err", err)
+				continue
+			}
+			imported = append(imported, c.cleanPath)
+		}
+		return nil
+	})
+	return imported, err
+}
+
+// importFile copies the file at name into the cache as cleanPath, with the
+// modification time reported by the upstream.
+func (p *CachingReverseProxy) importFile(name string, size int64, cleanPath, cachePath, sha256Hex string) error {
+	req, err := p.newUpstreamRequest(http.MethodHead, cleanPath)
+	if err != nil {
+		return err
+	}
+	resp, err := p.doUpstream(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upstream returned %s", resp.Status)
+	}
+	modTime, err := time.Parse(http.TimeFormat, resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return fmt.Errorf("upstream does not provide Last-Modified: %v", err)
+	}
+	if resp.ContentLength != size {
+		return fmt.Errorf("upstream has %d bytes, file has %d", resp.ContentLength, size)
+	}
+
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fsys := p.cacheFS()
+	if err := fsys.MkdirAll(path.Dir(cachePath), 0755); err != nil {
+		return err
+	}
+	tempFile, err := createTemp(fsys, path.Dir(cachePath), path.Base(cachePath)+".part.*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tempFile, src)
+	if cerr := tempFile.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = fsys.Chtimes(tempFile.Name(), p.now(), modTime)
+	}
+	if err == nil {
+		p.recordReplace(cachePath, size)
+		err = fsys.Rename(tempFile.Name(), cachePath)
+		p.forgetOpenFile(cachePath)
+	}
+	if err != nil {
+		fsys.Remove(tempFile.Name())
+		return err
+	}
+	p.logger().Info("imported", "file", name, "path", cleanPath)
+
+	if p.Dedupe {
+		p.dedupe(cachePath, sha256Hex)
+	}
+	if p.Metadata != nil {
+		return p.Metadata.Put(p.objectKey(cleanPath), &Metadata{
+			SHA256:       sha256Hex,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+			URL:          resp.Request.URL.String(),
+			ContentType:  resp.Header.Get("Content-Type"),
+			Size:         resp.ContentLength,
+			Downloaded:   p.now().UTC(),
+		})
+	}
+	return nil
+}
+
+// sha256File returns the hex encoded SHA-256 of the file name of fsys.
+func sha256File(fsys CacheFS, name string) (string, error) {
+	f, err := openFS(fsys, name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,116 @@
+package single
+
+import (
+	"bytes"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxListingSize is the size beyond which directory listings are relayed
+// without rewriting their links.
+const maxListingSize = 8 << 20
+
+// linkAttr matches the href and src attributes of HTML elements, capturing
+// the attribute up to its quoted value, and the quoted value.
+var linkAttr = regexp.MustCompile(`(?i)(\s(?:href|src)\s*=\s*)("[^"]*"|'[^']*')`)
+
+// isDirectoryRequest reports whether r is for a directory, by a path ending
+// with a slash. Directories are relayed from the upstream, such as its HTML
+// index, without caching them.
+func isDirectoryRequest(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, "/")
+}
+
+// upstreamPath returns the path requested from the upstream for cleanPath:
+// the path of a directory keeps its trailing slash, which upstreams require
+// to list it rather than redirect.
+func upstreamPath(cleanPath string, directory bool) string {
+	if directory && cleanPath != "/" {
+		return cleanPath + "/"
+	}
+	return cleanPath
+}
+
+// directoryRedirect returns where to redirect the client requesting the
+// non-directory cleanPath when the upstream responded with resp only after
+// redirecting to a directory, as from /os/x86_64 to /os/x86_64/, so that
+// relative links of its listing resolve, or "" if it did not.
+func (p *CachingReverseProxy) directoryRedirect(cleanPath string, resp *http.Response) string {
+	if !strings.HasSuffix(resp.Request.URL.Path, "/") || cleanPath == "/" {
+		return ""
+	}
+	if rel := p.upstreamRelative(resp.Request.URL.String()); rel != "" {
+		return p.MountPrefix + rel
+	}
+	return p.MountPrefix + escapePath(cleanPath) + "/"
+}
+
+// rewritesListing reports whether the listing of the directory requested
+// by r has its links rewritten, as set by RewriteListings.
+func (p *CachingReverseProxy) rewritesListing(r *http.Request) bool {
+	return p.RewriteListings && r.Method == http.MethodGet && isDirectoryRequest(r)
+}
+
+// rewriteListing replaces the body of resp, the HTML listing of a
+// directory, with one whose links into the upstream, as absolute URLs or
+// absolute paths, point through the proxy. Listings of other types, or too
+// large, are left alone.
+func (p *CachingReverseProxy) rewriteListing(resp *http.Response) error {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if resp.StatusCode != http.StatusOK || mediaType != "text/html" || contentEncoded(resp) {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxListingSize+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxListingSize {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+	base := resp.Request.URL
+	body = linkAttr.ReplaceAllFunc(body, func(attr []byte) []byte {
+		m := linkAttr.FindSubmatch(attr)
+		quote := m[2][0]
+		link := html.UnescapeString(string(m[2][1 : len(m[2])-1]))
+		rewritten, ok := p.rewriteLink(base, link)
+		if !ok {
+			return attr
+		}
+		return []byte(string(m[1]) + string(quote) + html.EscapeString(rewritten) + string(quote))
+	})
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// rewriteLink returns link, found in the listing at base, pointing through
+// the proxy if it is an absolute URL or path into the upstream. Relative
+// links resolve through the proxy already and are left alone, as are links
+// elsewhere, except absolute paths, which are made absolute URLs on the
+// host of base.
+func (p *CachingReverseProxy) rewriteLink(base *url.URL, link string) (string, bool) {
+	u, err := url.Parse(link)
+	if err != nil || !u.IsAbs() && !strings.HasPrefix(u.Path, "/") {
+		return "", false
+	}
+	resolved := base.ResolveReference(u)
+	if rel := p.upstreamRelative(resolved.String()); rel != "" {
+		return p.MountPrefix + rel, true
+	}
+	if u.IsAbs() {
+		return "", false
+	}
+	return resolved.String(), true
+}
@@ -0,0 +1,375 @@
+package single
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// MemFS is a CacheFS keeping its files in memory, for tests and for caches
+// that need not outlive the process.
+type MemFS struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode
+}
+
+// memNode is a file or directory of a MemFS. Open files keep their node
+// when it is renamed or removed, as on Unix.
+type memNode struct {
+	dir     bool
+	data    []byte
+	perm    os.FileMode
+	modTime time.Time
+	atime   time.Time
+}
+
+// NewMemFS returns an empty MemFS, with only its root directory.
+func NewMemFS() *MemFS {
+	now := time.Now()
+	return &MemFS{
+		nodes: map[string]*memNode{"/": {dir: true, perm: 0755, modTime: now, atime: now}},
+	}
+}
+
+// cleanName returns the key of name in the nodes of a MemFS.
+func cleanName(name string) string {
+	return path.Clean("/" + name)
+}
+
+func memError(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// parentDir returns an error unless the parent of the cleaned name is an
+// existing directory. fs.mu must be held.
+func (fs *MemFS) parentDir(op, name string) error {
+	parent, ok := fs.nodes[path.Dir(name)]
+	if !ok {
+		return memError(op, name, os.ErrNotExist)
+	}
+	if !parent.dir {
+		return memError(op, name, syscall.ENOTDIR)
+	}
+	return nil
+}
+
+func (fs *MemFS) OpenFile(name string, flag int, perm os.FileMode) (CacheFile, error) {
+	key := cleanName(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n, ok := fs.nodes[key]
+	switch {
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, memError("open", name, os.ErrNotExist)
+	case !ok:
+		if err := fs.parentDir("open", key); err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		n = &memNode{perm: perm.Perm(), modTime: now, atime: now}
+		fs.nodes[key] = n
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, memError("open", name, os.ErrExist)
+	}
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if n.dir && writable {
+		return nil, memError("open", name, syscall.EISDIR)
+	}
+	if flag&os.O_TRUNC != 0 && writable {
+		n.data = nil
+	}
+	return &memFile{
+		fs:       fs,
+		name:     name,
+		node:     n,
+		readable: flag&os.O_WRONLY == 0,
+		writable: writable,
+		append:   flag&os.O_APPEND != 0,
+	}, nil
+}
+
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	key := cleanName(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n, ok := fs.nodes[key]
+	if !ok {
+		return nil, memError("stat", name, os.ErrNotExist)
+	}
+	return n.info(key), nil
+}
+
+// Lstat is Stat, since a MemFS has no symbolic links.
+func (fs *MemFS) Lstat(name string) (os.FileInfo, error) {
+	return fs.Stat(name)
+}
+
+func (fs *MemFS) ReadDir(name string) ([]os.FileInfo, error) {
+	key := cleanName(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n, ok := fs.nodes[key]
+	if !ok {
+		return nil, memError("readdir", name, os.ErrNotExist)
+	}
+	if !n.dir {
+		return nil, memError("readdir", name, syscall.ENOTDIR)
+	}
+	var entries []os.FileInfo
+	for k, child := range fs.nodes {
+		if k != "/" && path.Dir(k) == key {
+			entries = append(entries, child.info(k))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func (fs *MemFS) MkdirAll(name string, perm os.FileMode) error {
+	key := cleanName(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	var dirs []string
+	for dir := key; dir != "/"; dir = path.Dir(dir) {
+		dirs = append(dirs, dir)
+	}
+	now := time.Now()
+	for i := len(dirs) - 1; i >= 0; i-- {
+		n, ok := fs.nodes[dirs[i]]
+		if !ok {
+			fs.nodes[dirs[i]] = &memNode{dir: true, perm: perm.Perm(), modTime: now, atime: now}
+		} else if !n.dir {
+			return memError("mkdir", dirs[i], syscall.ENOTDIR)
+		}
+	}
+	return nil
+}
+
+func (fs *MemFS) Rename(oldname, newname string) error {
+	oldKey, newKey := cleanName(oldname), cleanName(newname)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n, ok := fs.nodes[oldKey]
+	if !ok {
+		return memError("rename", oldname, os.ErrNotExist)
+	}
+	if err := fs.parentDir("rename", newKey); err != nil {
+		return err
+	}
+	if target, ok := fs.nodes[newKey]; ok && (target.dir || n.dir) {
+		return memError("rename", newname, os.ErrExist)
+	}
+	if oldKey == newKey {
+		return nil
+	}
+	delete(fs.nodes, oldKey)
+	fs.nodes[newKey] = n
+	if n.dir {
+		for k, child := range fs.nodes {
+			if strings.HasPrefix(k, oldKey+"/") {
+				delete(fs.nodes, k)
+				fs.nodes[newKey+strings.TrimPrefix(k, oldKey)] = child
+			}
+		}
+	}
+	return nil
+}
+
+func (fs *MemFS) Remove(name string) error {
+	key := cleanName(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n, ok := fs.nodes[key]
+	if !ok {
+		return memError("remove", name, os.ErrNotExist)
+	}
+	if n.dir {
+		for k := range fs.nodes {
+			if strings.HasPrefix(k, key+"/") || key == "/" && k != "/" {
+				return memError("remove", name, syscall.ENOTEMPTY)
+			}
+		}
+	}
+	delete(fs.nodes, key)
+	return nil
+}
+
+func (fs *MemFS) Chtimes(name string, atime, mtime time.Time) error {
+	key := cleanName(name)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n, ok := fs.nodes[key]
+	if !ok {
+		return memError("chtimes", name, os.ErrNotExist)
+	}
+	if !atime.IsZero() {
+		n.atime = atime
+	}
+	if !mtime.IsZero() {
+		n.modTime = mtime
+	}
+	return nil
+}
+
+// info describes n, named key. The MemFS must be locked.
+func (n *memNode) info(key string) *memFileInfo {
+	mode := n.perm
+	if n.dir {
+		mode |= os.ModeDir
+	}
+	return &memFileInfo{
+		name:    path.Base(key),
+		size:    int64(len(n.data)),
+		mode:    mode,
+		modTime: n.modTime,
+		atime:   n.atime,
+		node:    n,
+	}
+}
+
+// memFileInfo describes a file of a MemFS.
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	atime   time.Time
+	node    *memNode
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *memFileInfo) Sys() any           { return nil }
+
+// errClosed is returned by the methods of closed files of a MemFS.
+var errClosed = errors.New("file already closed")
+
+// memFile is a file open in a MemFS.
+type memFile struct {
+	fs       *MemFS
+	name     string
+	node     *memNode
+	off      int64
+	readable bool
+	writable bool
+	append   bool
+	closed   bool
+}
+
+func (f *memFile) Name() string { return f.name }
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, memError("read", f.name, errClosed)
+	}
+	if !f.readable || f.node.dir {
+		return 0, memError("read", f.name, syscall.EBADF)
+	}
+	if off < 0 {
+		return 0, memError("read", f.name, syscall.EINVAL)
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, memError("write", f.name, errClosed)
+	}
+	if !f.writable {
+		return 0, memError("write", f.name, syscall.EBADF)
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	n := f.node
+	if f.append {
+		f.off = int64(len(n.data))
+	}
+	if end := f.off + int64(len(p)); end > int64(len(n.data)) {
+		if end > int64(cap(n.data)) {
+			data := make([]byte, len(n.data), max(end, 2*int64(cap(n.data))))
+			copy(data, n.data)
+			n.data = data
+		}
+		n.data = n.data[:end]
+	}
+	copy(n.data[f.off:], p)
+	f.off += int64(len(p))
+	n.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, memError("seek", f.name, errClosed)
+	}
+	var off int64
+	switch whence {
+	case io.SeekStart:
+		off = offset
+	case io.SeekCurrent:
+		off = f.off + offset
+	case io.SeekEnd:
+		f.fs.mu.Lock()
+		off = int64(len(f.node.data)) + offset
+		f.fs.mu.Unlock()
+	default:
+		return 0, memError("seek", f.name, syscall.EINVAL)
+	}
+	if off < 0 {
+		return 0, memError("seek", f.name, syscall.EINVAL)
+	}
+	f.off = off
+	return off, nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	if f.closed {
+		return nil, memError("stat", f.name, errClosed)
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return f.node.info(cleanName(f.name)), nil
+}
+
+func (f *memFile) Sync() error {
+	return nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return memError("close", f.name, errClosed)
+	}
+	f.closed = true
+	return nil
+}
+
+var _ CacheFS = &MemFS{}
@@ -0,0 +1,98 @@
+package single
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Metadata is the information recorded about a cached object.
+type Metadata struct {
+	// SHA256 is the hex encoded SHA-256 digest of the content.
+	SHA256 string `json:"sha256,omitempty"`
+	// ETag and LastModified are the validators sent by the upstream.
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	// Group is the name of the ClientGroup the object is charged to.
+	Group string `json:"group,omitempty"`
+	// URL is the upstream URL the object was downloaded from.
+	URL string `json:"url,omitempty"`
+	// ContentType is the Content-Type sent by the upstream, served on
+	// cache hits.
+	ContentType string `json:"content_type,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	// Downloaded is when the download completed.
+	Downloaded time.Time `json:"downloaded,omitzero"`
+	// Validated is when the upstream last confirmed the object is current,
+	// if it did since the download.
+	Validated time.Time `json:"validated,omitzero"`
+	// Expires is until when the object may be served without validating
+	// it, according to the upstream.
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+// MetadataStore persists Metadata of cached objects, keyed by the cleaned
+// request path.
+type MetadataStore interface {
+	// Get returns the metadata recorded for cleanPath, or nil if there is none.
+	Get(cleanPath string) (*Metadata, error)
+	// Put records m for cleanPath. It is called after the object is
+	// committed to the cache.
+	Put(cleanPath string, m *Metadata) error
+	// Delete removes the metadata recorded for cleanPath, if any.
+	Delete(cleanPath string) error
+	Close() error
+}
+
+// internalMarker is part of the name of every file the proxy keeps in the
+// cache directory for its own use.
+const internalMarker = ".crp-"
+
+// isInternalFile reports whether name is a file the proxy keeps in the cache
+// directory, rather than a cached object.
+func isInternalFile(name string) bool {
+	return isTempFile(name) || strings.Contains(name, internalMarker)
+}
+
+// isInternalPath reports whether a segment of cleanPath is named like a file
+// the proxy keeps in the cache directory. Such objects cannot be cached, nor
+// served, since they would be taken for, or be, files of the proxy.
+func isInternalPath(cleanPath string) bool {
+	for _, segment := range strings.Split(cleanPath, "/") {
+		if isInternalFile(segment) {
+			return true
+		}
+	}
+	return false
+}
+
+// cachedMetadata returns the metadata recorded for the object at cleanPath, or
+// nil if there is none or Metadata is not set.
+func (p *CachingReverseProxy) cachedMetadata(cleanPath string) *Metadata {
+	if p.Metadata == nil {
+		return nil
+	}
+	meta, err := p.Metadata.Get(p.objectKey(cleanPath))
+	if err != nil {
+		p.logger().Warn("cannot read metadata", "path", cleanPath, "err", err)
+		return nil
+	}
+	return meta
+}
+
+// OpenMetadataStore opens the metadata store of the given kind for cacheDir.
+// kind is one of "sidecar", "xattr" or "bolt". An empty kind disables
+// metadata and returns a nil store.
+func OpenMetadataStore(kind string, cacheDir string) (MetadataStore, error) {
+	switch kind {
+	case "":
+		return nil, nil
+	case "sidecar":
+		return &sidecarStore{cacheDir: cacheDir}, nil
+	case "xattr":
+		return &xattrStore{cacheDir: cacheDir}, nil
+	case "bolt":
+		return openBoltStore(cacheDir)
+	}
+	return nil, fmt.Errorf("unknown metadata store %q", kind)
+}
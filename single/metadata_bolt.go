@@ -0,0 +1,78 @@
+package single
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltBucket = []byte("objects")
+
+// boltStore keeps metadata in a bbolt database in the cache directory, which
+// scales to many objects without adding files to the cache directory.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(cacheDir string) (*boltStore, error) {
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(
+		filepath.Join(cacheDir, internalMarker+"metadata.db"),
+		0644,
+		&bolt.Options{Timeout: time.Second},
+	)
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("the metadata database in %s is locked; is another instance using the cache directory?", cacheDir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Get(cleanPath string) (*Metadata, error) {
+	var m *Metadata
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltBucket).Get([]byte(cleanPath))
+		if data == nil {
+			return nil
+		}
+		m = &Metadata{}
+		return json.Unmarshal(data, m)
+	})
+	return m, err
+}
+
+func (s *boltStore) Put(cleanPath string, m *Metadata) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(cleanPath), data)
+	})
+}
+
+func (s *boltStore) Delete(cleanPath string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(cleanPath))
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
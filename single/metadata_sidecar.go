@@ -0,0 +1,71 @@
+package single
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// sidecarSuffix is appended to the name of a cached file to get the name of
+// its sidecar metadata file.
+const sidecarSuffix = ".crp-meta"
+
+// sidecarStore keeps metadata in JSON files next to the cached files.
+type sidecarStore struct {
+	cacheDir string
+}
+
+func (s *sidecarStore) sidecarPath(cleanPath string) string {
+	return path.Join(s.cacheDir, cleanPath) + sidecarSuffix
+}
+
+func (s *sidecarStore) Get(cleanPath string) (*Metadata, error) {
+	data, err := ioutil.ReadFile(s.sidecarPath(cleanPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := &Metadata{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (s *sidecarStore) Put(cleanPath string, m *Metadata) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	name := s.sidecarPath(cleanPath)
+	tempFile, err := ioutil.TempFile(path.Dir(name), path.Base(name)+".part.*")
+	if err != nil {
+		return err
+	}
+	_, err = tempFile.Write(data)
+	if cerr := tempFile.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tempFile.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+	}
+	return err
+}
+
+func (s *sidecarStore) Delete(cleanPath string) error {
+	err := os.Remove(s.sidecarPath(cleanPath))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *sidecarStore) Close() error {
+	return nil
+}
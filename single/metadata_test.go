@@ -0,0 +1,115 @@
+package single
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMetadataStores(t *testing.T) {
+	want := &Metadata{
+		SHA256:       "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+		ETag:         `"abc"`,
+		LastModified: "Sun, 09 Sep 2001 01:46:40 GMT",
+		Group:        "builders",
+		URL:          "https://upstream.example/core/os/x86_64/core.db",
+		ContentType:  "application/octet-stream",
+		Size:         100,
+		Downloaded:   time.Unix(1e9, 5).UTC(),
+		Validated:    time.Unix(1e9+60, 0).UTC(),
+		Expires:      time.Unix(1e9+3600, 0).UTC(),
+	}
+	for _, kind := range []string{"sidecar", "xattr", "bolt"} {
+		cacheDir := t.TempDir()
+		store, err := OpenMetadataStore(kind, cacheDir)
+		if err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+		const cleanPath = "/core/os/x86_64/core.db"
+		name := filepath.Join(cacheDir, filepath.FromSlash(cleanPath))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, make([]byte, 100), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if m, err := store.Get(cleanPath); m != nil || err != nil {
+			t.Errorf("%s: Get before Put = %+v, %v, want nil", kind, m, err)
+		}
+		if err := store.Put(cleanPath, want); err != nil {
+			if kind == "xattr" && (errors.Is(err, syscall.ENOTSUP) || errors.Is(err, errXattrUnsupported)) {
+				t.Logf("%s: %v, skipping", kind, err)
+				store.Close()
+				continue
+			}
+			t.Fatalf("%s: Put: %v", kind, err)
+		}
+		got, err := store.Get(cleanPath)
+		if err != nil {
+			t.Fatalf("%s: Get: %v", kind, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Get = %+v, want %+v", kind, got, want)
+		}
+		// cleared fields are not kept
+		if err := store.Put(cleanPath, &Metadata{Size: 100}); err != nil {
+			t.Fatalf("%s: Put: %v", kind, err)
+		}
+		if got, err := store.Get(cleanPath); err != nil || !reflect.DeepEqual(got, &Metadata{Size: 100}) {
+			t.Errorf("%s: Get after overwriting = %+v, %v, want %+v", kind, got, err, &Metadata{Size: 100})
+		}
+		if err := store.Delete(cleanPath); err != nil {
+			t.Fatalf("%s: Delete: %v", kind, err)
+		}
+		// as when evicted, the object is removed after its metadata
+		if err := os.Remove(name); err != nil {
+			t.Fatal(err)
+		}
+		if m, err := store.Get(cleanPath); m != nil || err != nil {
+			t.Errorf("%s: Get after Delete = %+v, %v, want nil", kind, m, err)
+		}
+		if err := store.Close(); err != nil {
+			t.Errorf("%s: Close: %v", kind, err)
+		}
+	}
+}
+
+func TestMetadataRecorded(t *testing.T) {
+	var requests atomic.Int64
+	upstream := countingUpstream(100, &requests)
+	defer upstream.Close()
+	cacheDir := t.TempDir()
+	p, err := NewCachingReverseProxy(upstream.URL, cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Metadata, err = OpenMetadataStore("sidecar", cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/core.db", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d, want %d", w.Code, http.StatusOK)
+	}
+	m, err := p.Metadata.Get("/core.db")
+	if err != nil || m == nil {
+		t.Fatalf("Get = %+v, %v, want metadata", m, err)
+	}
+	if m.Size != 100 || m.LastModified != time.Unix(1e9, 0).UTC().Format(http.TimeFormat) || m.URL != upstream.URL+"/core.db" || m.Downloaded.IsZero() {
+		t.Errorf("recorded %+v", m)
+	}
+	// the sidecar file is not served as an object
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/core.db"+sidecarSuffix, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got %d for the sidecar file, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,133 @@
+package single
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// Extended attribute names used to record metadata on cached files.
+const (
+	xattrSHA256       = "user.cachingreverseproxy.sha256"
+	xattrETag         = "user.cachingreverseproxy.etag"
+	xattrLastModified = "user.cachingreverseproxy.last_modified"
+	xattrGroup        = "user.cachingreverseproxy.group"
+	xattrURL          = "user.cachingreverseproxy.url"
+	xattrContentType  = "user.cachingreverseproxy.content_type"
+	xattrSize         = "user.cachingreverseproxy.size"
+	xattrDownloaded   = "user.cachingreverseproxy.downloaded"
+	xattrExpires      = "user.cachingreverseproxy.expires"
+	xattrValidated    = "user.cachingreverseproxy.validated"
+)
+
+var errXattrUnsupported = errors.New("extended attributes are not supported on this platform")
+
+// xattrStore keeps metadata in extended attributes of the cached files, so
+// that it travels with the files across copies that preserve xattrs.
+type xattrStore struct {
+	cacheDir string
+}
+
+// xattrField is a Metadata field recorded in an extended attribute, as text.
+type xattrField struct {
+	name string
+	get  func(m *Metadata) string
+	set  func(m *Metadata, value string)
+}
+
+func stringField(name string, field func(m *Metadata) *string) xattrField {
+	return xattrField{
+		name: name,
+		get:  func(m *Metadata) string { return *field(m) },
+		set:  func(m *Metadata, value string) { *field(m) = value },
+	}
+}
+
+func intField(name string, field func(m *Metadata) *int64) xattrField {
+	return xattrField{
+		name: name,
+		get: func(m *Metadata) string {
+			if *field(m) == 0 {
+				return ""
+			}
+			return strconv.FormatInt(*field(m), 10)
+		},
+		set: func(m *Metadata, value string) { *field(m), _ = strconv.ParseInt(value, 10, 64) },
+	}
+}
+
+func timeField(name string, field func(m *Metadata) *time.Time) xattrField {
+	return xattrField{
+		name: name,
+		get: func(m *Metadata) string {
+			if field(m).IsZero() {
+				return ""
+			}
+			return field(m).Format(time.RFC3339Nano)
+		},
+		set: func(m *Metadata, value string) { *field(m), _ = time.Parse(time.RFC3339Nano, value) },
+	}
+}
+
+var xattrFields = []xattrField{
+	stringField(xattrSHA256, func(m *Metadata) *string { return &m.SHA256 }),
+	stringField(xattrETag, func(m *Metadata) *string { return &m.ETag }),
+	stringField(xattrLastModified, func(m *Metadata) *string { return &m.LastModified }),
+	stringField(xattrGroup, func(m *Metadata) *string { return &m.Group }),
+	stringField(xattrURL, func(m *Metadata) *string { return &m.URL }),
+	stringField(xattrContentType, func(m *Metadata) *string { return &m.ContentType }),
+	intField(xattrSize, func(m *Metadata) *int64 { return &m.Size }),
+	timeField(xattrDownloaded, func(m *Metadata) *time.Time { return &m.Downloaded }),
+	timeField(xattrExpires, func(m *Metadata) *time.Time { return &m.Expires }),
+	timeField(xattrValidated, func(m *Metadata) *time.Time { return &m.Validated }),
+}
+
+func (s *xattrStore) Get(cleanPath string) (*Metadata, error) {
+	name := path.Join(s.cacheDir, cleanPath)
+	m := &Metadata{}
+	found := false
+	for _, attr := range xattrFields {
+		value, err := getxattr(name, attr.name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return nil, &os.PathError{Op: "getxattr", Path: name, Err: err}
+		}
+		if value != nil {
+			found = true
+		}
+		attr.set(m, string(value))
+	}
+	if !found {
+		return nil, nil
+	}
+	return m, nil
+}
+
+func (s *xattrStore) Put(cleanPath string, m *Metadata) error {
+	name := path.Join(s.cacheDir, cleanPath)
+	for _, attr := range xattrFields {
+		var err error
+		if value := attr.get(m); value == "" {
+			err = removexattr(name, attr.name)
+		} else {
+			err = setxattr(name, attr.name, []byte(value))
+		}
+		if err != nil {
+			return &os.PathError{Op: "setxattr", Path: name, Err: err}
+		}
+	}
+	return nil
+}
+
+// Delete is a no-op: the attributes are removed together with the file.
+func (s *xattrStore) Delete(cleanPath string) error {
+	return nil
+}
+
+func (s *xattrStore) Close() error {
+	return nil
+}
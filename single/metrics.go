@@ -0,0 +1,67 @@
+package single
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// handleMetrics serves the Status of the proxy in the Prometheus text
+// exposition format.
+func (p *CachingReverseProxy) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w, p.Status())
+}
+
+func writeMetrics(w io.Writer, s *Status) {
+	metric := func(name, typ, help string, samples ...interface{}) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		// samples are pairs of labels and values
+		for i := 0; i < len(samples); i += 2 {
+			fmt.Fprintf(w, "%s%s %d\n", name, samples[i], samples[i+1])
+		}
+	}
+	metric("cachingreverseproxy_requests_total", "counter",
+		"Requests served, by whether they were served from the cache.",
+		`{result="hit"}`, s.Hits,
+		`{result="miss"}`, s.Misses,
+		`{result="pass_through"}`, s.PassThrough,
+	)
+	metric("cachingreverseproxy_downloaded_bytes_total", "counter",
+		"Bytes downloaded from the upstream into the cache.",
+		"", s.DownloadedBytes)
+	metric("cachingreverseproxy_active_requests", "gauge",
+		"Requests being served.",
+		"", s.ActiveRequests)
+	metric("cachingreverseproxy_active_downloads", "gauge",
+		"Downloads into the cache in progress.",
+		"", int64(len(s.Downloads)))
+	metric("cachingreverseproxy_cache_bytes", "gauge",
+		"Size of the objects in the disk cache.",
+		"", s.CacheBytes)
+	metric("cachingreverseproxy_cache_objects", "gauge",
+		"Number of objects in the disk cache.",
+		"", s.CacheObjects)
+	if s.CacheFreeBytes >= 0 {
+		metric("cachingreverseproxy_cache_free_bytes", "gauge",
+			"Space available on the filesystem of the cache directory.",
+			"", s.CacheFreeBytes)
+	}
+	metric("cachingreverseproxy_evictions_total", "counter",
+		"Objects removed from the disk cache to free space.",
+		"", s.Evictions)
+	metric("cachingreverseproxy_evicted_bytes_total", "counter",
+		"Size of the objects removed from the disk cache to free space.",
+		"", s.EvictedBytes)
+	var up []interface{}
+	for _, u := range s.Upstreams {
+		var v int64
+		if u.Healthy {
+			v = 1
+		}
+		up = append(up, fmt.Sprintf("{upstream=%q}", u.URL), v)
+	}
+	metric("cachingreverseproxy_upstream_up", "gauge",
+		"Whether the upstream or mirror is healthy.",
+		up...)
+}
@@ -0,0 +1,256 @@
+package single
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// MirrorList is where RunMirrorList loads mirrors from: a pacman mirrorlist
+// or the JSON of the Arch Linux mirror status, such as
+// https://archlinux.org/mirrors/status/json/, read from a file or an http or
+// https URL.
+type MirrorList struct {
+	// Location is the file name or URL of the list.
+	Location string
+	// Countries, if not empty, keeps only the mirrors in these countries,
+	// given as names or ISO 3166 codes, such as Germany or DE. Mirrors of a
+	// mirrorlist are in the country of the "## Country" comment above them.
+	Countries []string
+	// Protocols, if not empty, keeps only the mirrors with URLs of these
+	// schemes, such as https.
+	Protocols []string
+	// Max, if positive, keeps only the first Max mirrors.
+	Max int
+}
+
+// listedMirror is a mirror found in a MirrorList.
+type listedMirror struct {
+	url         string
+	country     string
+	countryCode string
+}
+
+// mirrorStatus is the part of the Arch Linux mirror status used.
+type mirrorStatus struct {
+	URLs []struct {
+		URL           string   `json:"url"`
+		Country       string   `json:"country"`
+		CountryCode   string   `json:"country_code"`
+		Active        bool     `json:"active"`
+		CompletionPct *float64 `json:"completion_pct"`
+		Score         *float64 `json:"score"`
+	} `json:"urls"`
+}
+
+// Load returns the URLs of the mirrors in l, read with client for URLs,
+// that pass its filters. Mirrors of a mirror status are those active and
+// fully synced, best scored first.
+func (l *MirrorList) Load(ctx context.Context, client *http.Client) ([]string, error) {
+	data, err := l.read(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	var mirrors []listedMirror
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		mirrors, err = parseMirrorStatus(data)
+	} else {
+		mirrors, err = parseMirrorlist(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", l.Location, err)
+	}
+	var urls []string
+	for _, m := range mirrors {
+		if l.Max > 0 && len(urls) >= l.Max {
+			break
+		}
+		if l.keep(m) && !slices.Contains(urls, m.url) {
+			urls = append(urls, m.url)
+		}
+	}
+	return urls, nil
+}
+
+func (l *MirrorList) read(ctx context.Context, client *http.Client) ([]byte, error) {
+	if !strings.HasPrefix(l.Location, "http://") && !strings.HasPrefix(l.Location, "https://") {
+		return os.ReadFile(l.Location)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.Location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", l.Location, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// keep reports whether m passes the filters of l.
+func (l *MirrorList) keep(m listedMirror) bool {
+	if len(l.Countries) > 0 && !slices.ContainsFunc(l.Countries, func(c string) bool {
+		return strings.EqualFold(c, m.country) || strings.EqualFold(c, m.countryCode)
+	}) {
+		return false
+	}
+	if len(l.Protocols) > 0 {
+		u, err := url.Parse(m.url)
+		if err != nil || !slices.Contains(l.Protocols, u.Scheme) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseMirrorlist parses a pacman mirrorlist. Server URLs are cut before
+// $repo, since the proxy maps request paths to the same layout. If all the
+// servers are commented out, as in the lists generated by
+// https://archlinux.org/mirrorlist/, the commented ones are used.
+func parseMirrorlist(data []byte) ([]listedMirror, error) {
+	var servers, commented []listedMirror
+	var country string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if name, ok := strings.CutPrefix(line, "##"); ok {
+			country = strings.TrimSpace(name)
+			continue
+		}
+		uncommented := strings.TrimSpace(strings.TrimLeft(line, "#"))
+		key, value, ok := strings.Cut(uncommented, "=")
+		if !ok || strings.TrimSpace(key) != "Server" {
+			continue
+		}
+		server, _, _ := strings.Cut(strings.TrimSpace(value), "$repo")
+		m := listedMirror{url: strings.TrimSuffix(server, "/"), country: country}
+		if _, err := url.Parse(m.url); err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(line, "#") {
+			commented = append(commented, m)
+		} else {
+			servers = append(servers, m)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(servers) == 0 {
+		return commented, nil
+	}
+	return servers, nil
+}
+
+// parseMirrorStatus parses the Arch Linux mirror status.
+func parseMirrorStatus(data []byte) ([]listedMirror, error) {
+	var status mirrorStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, err
+	}
+	type scored struct {
+		listedMirror
+		score float64
+	}
+	var mirrors []scored
+	for _, u := range status.URLs {
+		if !u.Active || u.CompletionPct == nil || *u.CompletionPct < 1 || u.Score == nil {
+			continue
+		}
+		mirrors = append(mirrors, scored{
+			listedMirror: listedMirror{url: strings.TrimSuffix(u.URL, "/"), country: u.Country, countryCode: u.CountryCode},
+			score:        *u.Score,
+		})
+	}
+	// lower scores are better
+	slices.SortStableFunc(mirrors, func(a, b scored) int {
+		switch {
+		case a.score < b.score:
+			return -1
+		case a.score > b.score:
+			return 1
+		}
+		return 0
+	})
+	listed := make([]listedMirror, len(mirrors))
+	for i, m := range mirrors {
+		listed[i] = m.listedMirror
+	}
+	return listed, nil
+}
+
+// RunMirrorList loads the mirrors in list now and every interval until ctx
+// is done, and uses them as mirrors after those added with AddMirror. Each
+// time, mirrors no longer listed are dropped and new ones added, keeping
+// what RunHealthChecks learned about the others. If the list cannot be
+// loaded, the mirrors loaded before are kept.
+func (p *CachingReverseProxy) RunMirrorList(ctx context.Context, list *MirrorList, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		loadCtx, cancel := context.WithTimeout(ctx, time.Minute)
+		urls, err := list.Load(loadCtx, p.client)
+		cancel()
+		if err != nil {
+			p.logger().Error("cannot load mirror list", "url", list.Location, "err", err)
+		} else {
+			p.setListedMirrors(urls)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// setListedMirrors replaces the mirrors loaded by RunMirrorList with those
+// at urls.
+func (p *CachingReverseProxy) setListedMirrors(urls []string) {
+	p.mirrorsMu.Lock()
+	defer p.mirrorsMu.Unlock()
+	old := make(map[string]*mirror)
+	seen := map[string]bool{strings.TrimSuffix(p.upstreamPrefix, "/"): true}
+	var mirrors []*mirror
+	for _, m := range p.mirrors {
+		if m.listed {
+			old[m.prefix] = m
+		} else {
+			mirrors = append(mirrors, m)
+			seen[m.prefix] = true
+		}
+	}
+	added := 0
+	for _, u := range urls {
+		m := newMirror(u)
+		if seen[m.prefix] {
+			continue
+		}
+		seen[m.prefix] = true
+		if known, ok := old[m.prefix]; ok {
+			m = known
+			delete(old, m.prefix)
+		} else {
+			m.listed = true
+			added++
+		}
+		mirrors = append(mirrors, m)
+	}
+	p.mirrors = mirrors
+	if added > 0 || len(old) > 0 {
+		p.logger().Info("updated mirrors from list", "count", len(urls), "added", added, "removed", len(old))
+	}
+}
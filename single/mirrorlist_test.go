@@ -0,0 +1,58 @@
+package single
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMirrorlist(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		data string
+		want []listedMirror
+	}{
+		{
+			name: "servers",
+			data: `## Germany
+Server = https://de.example.org/archlinux/$repo/os/$arch
+#Server = https://commented.example.org/$repo/os/$arch
+
+## France
+Server=http://fr.example.org/$repo/os/$arch
+`,
+			want: []listedMirror{
+				{url: "https://de.example.org/archlinux", country: "Germany"},
+				{url: "http://fr.example.org", country: "France"},
+			},
+		},
+		{
+			name: "all commented",
+			data: `##
+## Arch Linux repository mirrorlist
+##
+
+## Germany
+#Server = https://de.example.org/archlinux/$repo/os/$arch
+#Server = https://mirror.example.de/$repo/os/$arch
+`,
+			want: []listedMirror{
+				{url: "https://de.example.org/archlinux", country: "Germany"},
+				{url: "https://mirror.example.de", country: "Germany"},
+			},
+		},
+		{
+			name: "no servers",
+			data: "# nothing here\nInclude = /etc/pacman.d/other\n",
+			want: nil,
+		},
+	} {
+		got, err := parseMirrorlist([]byte(test.data))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package single
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// mirrorRetryInterval is how long a mirror that failed is skipped for,
+// unless all mirrors failed.
+const mirrorRetryInterval = 30 * time.Second
+
+// mirror is a fallback upstream.
+type mirror struct {
+	prefix      string
+	credentials *Credentials
+	// headers are added to requests to the mirror.
+	headers http.Header
+	health  *endpointHealth
+	// listed is whether the mirror was loaded by RunMirrorList.
+	listed bool
+}
+
+// AddMirror adds upstreamPrefix as a fallback for the upstream. When the
+// upstream fails to respond, or responds with a server error, requests are
+// retried against the mirrors in the order they were added. A username and
+// password in upstreamPrefix authenticate requests to the mirror;
+// UpstreamCredentials only apply to the upstream.
+func (p *CachingReverseProxy) AddMirror(upstreamPrefix string) {
+	p.mirrorsMu.Lock()
+	defer p.mirrorsMu.Unlock()
+	p.mirrors = append(p.mirrors, newMirror(upstreamPrefix))
+}
+
+func newMirror(upstreamPrefix string) *mirror {
+	prefix, credentials := splitUserinfo(upstreamPrefix)
+	return &mirror{
+		prefix:      strings.TrimSuffix(prefix, "/"),
+		credentials: credentials,
+		health:      &endpointHealth{},
+	}
+}
+
+// upstreams returns the upstream followed by the mirrors.
+func (p *CachingReverseProxy) upstreams() []*mirror {
+	upstreams := []*mirror{{prefix: p.upstreamPrefix, credentials: p.UpstreamCredentials, headers: p.UpstreamHeaders, health: &p.upstreamHealth}}
+	p.mirrorsMu.Lock()
+	defer p.mirrorsMu.Unlock()
+	return append(upstreams, p.mirrors...)
+}
+
+// preferred returns the health of the upstream tried first.
+func (p *CachingReverseProxy) preferred() *endpointHealth {
+	if h := p.preferredUpstream.Load(); h != nil {
+		return h
+	}
+	return &p.upstreamHealth
+}
+
+// doUpstreamOnce sends req, a request made by newUpstreamRequest, to the
+// upstream, failing over to the mirrors in order. The upstream selected by
+// RunHealthChecks, if any, is tried first, and mirrors that failed recently
+// are tried last. Once req is canceled, no other mirror is tried, and the
+// failure is not held against the mirror.
+func (p *CachingReverseProxy) doUpstreamOnce(req *http.Request) (*http.Response, error) {
+	upstreams := p.upstreams()
+	if len(upstreams) == 1 {
+		return p.client.Do(req)
+	}
+	var healthy, down []*mirror
+	now := p.now().UnixNano()
+	preferred := p.preferred()
+	for _, m := range upstreams {
+		switch {
+		case m.health.down(now):
+			down = append(down, m)
+		case m.health == preferred:
+			healthy = append([]*mirror{m}, healthy...)
+		default:
+			healthy = append(healthy, m)
+		}
+	}
+
+	rel := strings.TrimPrefix(req.URL.String(), p.upstreamPrefix)
+	var resp *http.Response
+	var err error
+	for i, c := range append(healthy, down...) {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		resp, err = p.tryMirror(req, c, c.prefix+rel)
+		if err == nil && resp.StatusCode < 500 {
+			if i > 0 {
+				p.logger().Info("served by mirror", "path", rel, "mirror", c.prefix)
+			}
+			return resp, nil
+		}
+		if req.Context().Err() != nil {
+			// the request was canceled, which tells nothing about the
+			// mirrors
+			if err == nil {
+				resp.Body.Close()
+				err = req.Context().Err()
+			}
+			return nil, err
+		}
+		c.health.downUntil.Store(p.now().Add(mirrorRetryInterval).UnixNano())
+		if err != nil {
+			p.logger().Warn("mirror failed", "mirror", c.prefix, "err", err)
+		} else {
+			p.logger().Warn("mirror failed", "mirror", c.prefix, "status", resp.Status)
+		}
+	}
+	return resp, err
+}
+
+// tryMirror sends req to rawurl on m with its credentials and headers,
+// giving up if the response headers do not arrive within MirrorTimeout.
+func (p *CachingReverseProxy) tryMirror(req *http.Request, m *mirror, rawurl string) (*http.Response, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.URL = u
+	req.Host = ""
+	req.Header.Del("Authorization")
+	for name := range p.UpstreamHeaders {
+		req.Header.Del(name)
+	}
+	if m.credentials != nil {
+		m.credentials.apply(req)
+	}
+	addHeaders(req.Header, m.headers)
+	if p.MirrorTimeout <= 0 {
+		return p.client.Do(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(p.MirrorTimeout, cancel)
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		if !timer.Stop() {
+			return nil, fmt.Errorf("no response within %v", p.MirrorTimeout)
+		}
+		return nil, err
+	}
+	timer.Stop()
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose cancels the context of a request when its response body is
+// closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
@@ -0,0 +1,87 @@
+package single
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMirrorFailover(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// upstream responds with status, or blocks until the request is
+		// canceled if status is 0, or is down if status is -1
+		upstream     int
+		cancel       bool
+		status       int
+		upstreamDown bool
+		mirrored     bool
+	}{
+		{name: "ok", upstream: http.StatusOK, status: http.StatusOK},
+		{name: "not found", upstream: http.StatusNotFound, status: http.StatusNotFound},
+		{name: "server error", upstream: http.StatusBadGateway, status: http.StatusOK, upstreamDown: true, mirrored: true},
+		{name: "unreachable", upstream: -1, status: http.StatusOK, upstreamDown: true, mirrored: true},
+		// a client going away tells nothing about the upstream
+		{name: "canceled", upstream: 0, cancel: true},
+	} {
+		received := make(chan struct{}, 1)
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received <- struct{}{}
+			if test.upstream == 0 {
+				<-r.Context().Done()
+				return
+			}
+			w.WriteHeader(test.upstream)
+		}))
+		var mirrorRequests atomic.Int64
+		mirror := countingUpstream(100, &mirrorRequests)
+		upstreamURL := upstream.URL
+		if test.upstream == -1 {
+			upstream.Close()
+		}
+		p, _ := newMemProxy(t, upstreamURL)
+		p.AddMirror(mirror.URL)
+		req, err := p.newUpstreamRequest(http.MethodGet, "/object")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		if test.cancel {
+			go func() {
+				<-received
+				cancel()
+			}()
+		}
+		resp, err := p.doUpstreamOnce(req.WithContext(ctx))
+		cancel()
+		if test.status == 0 {
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("%s: got %d, want an error", test.name, resp.StatusCode)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else {
+			resp.Body.Close()
+			if resp.StatusCode != test.status {
+				t.Errorf("%s: got %d, want %d", test.name, resp.StatusCode, test.status)
+			}
+		}
+		now := p.now().UnixNano()
+		if down := p.upstreamHealth.down(now); down != test.upstreamDown {
+			t.Errorf("%s: upstream down %v, want %v", test.name, down, test.upstreamDown)
+		}
+		for _, m := range p.upstreams()[1:] {
+			if m.health.down(now) {
+				t.Errorf("%s: mirror down", test.name)
+			}
+		}
+		if mirrored := mirrorRequests.Load() > 0; mirrored != test.mirrored {
+			t.Errorf("%s: mirror requested %v, want %v", test.name, mirrored, test.mirrored)
+		}
+		upstream.Close()
+		mirror.Close()
+	}
+}
@@ -0,0 +1,58 @@
+package single
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+// UpstreamNamespace returns a cache namespace identifying upstream, suitable
+// as a directory name. Objects from different upstreams are kept apart when
+// each proxy uses the namespace of its upstream.
+func UpstreamNamespace(upstream string) string {
+	u, err := url.Parse(upstream)
+	name := upstream
+	if err == nil && u.Host != "" {
+		name = u.Host + u.Path
+	}
+	name = strings.Trim(name, "/")
+	var b strings.Builder
+	for _, c := range name {
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '.' || c == '-' {
+			b.WriteRune(c)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+// cacheRoot returns the directory holding the objects of p's namespace.
+func (p *CachingReverseProxy) cacheRoot() string {
+	return path.Join(p.cacheDir, p.Namespace)
+}
+
+// objectKey returns the key identifying the object for cleanPath across
+// namespaces, used for metadata. It is the path of the cached file relative to
+// cacheDir.
+func (p *CachingReverseProxy) objectKey(cleanPath string) string {
+	return path.Join("/", p.Namespace, cleanPath)
+}
+
+// storageKey returns the ObjectStorage key for cleanPath.
+func (p *CachingReverseProxy) storageKey(cleanPath string) string {
+	return strings.TrimPrefix(p.objectKey(cleanPath), "/")
+}
+
+// cleanPathOfStorageKey returns the cleaned request path for an ObjectStorage
+// key, and whether the key belongs to p's namespace.
+func (p *CachingReverseProxy) cleanPathOfStorageKey(key string) (string, bool) {
+	if p.Namespace == "" {
+		return "/" + key, true
+	}
+	prefix := p.Namespace + "/"
+	if !strings.HasPrefix(key, prefix) {
+		return "", false
+	}
+	return "/" + strings.TrimPrefix(key, prefix), true
+}
@@ -0,0 +1,81 @@
+package single
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxNegativeEntries bounds the number of paths remembered as missing.
+const maxNegativeEntries = 10000
+
+// negativeCache remembers the paths the upstream reported missing, so that
+// repeated requests for them are answered without asking the upstream.
+type negativeCache struct {
+	mu      sync.Mutex
+	entries map[string]negativeEntry
+}
+
+type negativeEntry struct {
+	status  int
+	expires time.Time
+}
+
+// isNegativeStatus reports whether responses with status are cached as
+// missing.
+func isNegativeStatus(status int) bool {
+	return status == http.StatusNotFound || status == http.StatusGone
+}
+
+// get returns the status the upstream responded for cleanPath, or 0 if it is
+// not known to be missing at now. Expired entries are removed.
+func (c *negativeCache) get(cleanPath string, now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[cleanPath]
+	if !ok {
+		return 0
+	}
+	if now.After(e.expires) {
+		delete(c.entries, cleanPath)
+		return 0
+	}
+	return e.status
+}
+
+// add remembers that the upstream responded status for cleanPath, until
+// expires. When full, entries expired before now are dropped first, and
+// the path is not remembered if none expired.
+func (c *negativeCache) add(cleanPath string, status int, now, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]negativeEntry)
+	}
+	if len(c.entries) >= maxNegativeEntries {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxNegativeEntries {
+			return
+		}
+	}
+	c.entries[cleanPath] = negativeEntry{status: status, expires: expires}
+}
+
+// remove forgets the paths matched by match, and reports whether any was
+// remembered.
+func (c *negativeCache) remove(match PathMatcher) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := false
+	for k := range c.entries {
+		if match(k) {
+			delete(c.entries, k)
+			removed = true
+		}
+	}
+	return removed
+}
@@ -0,0 +1,111 @@
+package single
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+)
+
+// LookupNetrc returns the credentials for host from the netrc file at name,
+// or nil if it has no entry for host. The "default" entry is used if there is
+// no entry for host.
+func LookupNetrc(name string, host string) (*Credentials, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseNetrc(f, host)
+}
+
+func parseNetrc(r io.Reader, host string) (*Credentials, error) {
+	tokens, err := netrcTokens(r)
+	if err != nil {
+		return nil, err
+	}
+	var found, fallback *Credentials
+	var current *Credentials
+	for i := 0; i < len(tokens); i++ {
+		next := func() string {
+			if i+1 < len(tokens) {
+				i++
+				return tokens[i]
+			}
+			return ""
+		}
+		switch tokens[i] {
+		case "machine":
+			current = &Credentials{}
+			if next() == host && found == nil {
+				found = current
+			}
+		case "default":
+			current = &Credentials{}
+			if fallback == nil {
+				fallback = current
+			}
+		case "login":
+			if current != nil {
+				current.Username = next()
+			}
+		case "password":
+			if current != nil {
+				current.Password = next()
+			}
+		case "account":
+			next()
+		}
+	}
+	if found != nil {
+		return found, nil
+	}
+	return fallback, nil
+}
+
+// netrcTokens splits a netrc file into tokens, skipping comments and macro
+// definitions. Tokens may be double quoted.
+func netrcTokens(r io.Reader) ([]string, error) {
+	var tokens []string
+	scanner := bufio.NewScanner(r)
+	inMacro := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		if inMacro {
+			// a macro definition ends with an empty line
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		for line != "" {
+			line = strings.TrimLeft(line, " \t\r")
+			if line == "" || line[0] == '#' {
+				break
+			}
+			var token string
+			if line[0] == '"' {
+				var b strings.Builder
+				i := 1
+				for ; i < len(line) && line[i] != '"'; i++ {
+					if line[i] == '\\' && i+1 < len(line) {
+						i++
+					}
+					b.WriteByte(line[i])
+				}
+				token = b.String()
+				line = line[min(i+1, len(line)):]
+			} else {
+				end := strings.IndexAny(line, " \t\r")
+				if end < 0 {
+					end = len(line)
+				}
+				token, line = line[:end], line[end:]
+			}
+			tokens = append(tokens, token)
+			if token == "macdef" {
+				inMacro = true
+				break
+			}
+		}
+	}
+	return tokens, scanner.Err()
+}
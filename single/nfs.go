@@ -0,0 +1,111 @@
+package single
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"syscall"
+	"time"
+)
+
+// lockSuffix is appended to the name of a cached file to get the name of the
+// lock file held while it is downloaded in NFS safe mode.
+const lockSuffix = ".crp-lock"
+
+// errCacheLocked is returned when another process, possibly on another host,
+// is downloading the object.
+var errCacheLocked = errors.New("object is being downloaded by another process")
+
+// lockStaleAfter is how long a lock file may go without being refreshed
+// before it is considered abandoned by a crashed holder.
+const lockStaleAfter = 5 * time.Minute
+
+// lockFile is held by exclusively creating a file. Unlike fcntl locks, this
+// works across hosts sharing a cache directory over NFS.
+type lockFile struct {
+	path string
+	stop chan struct{}
+	done chan struct{}
+}
+
+// acquireLock creates the lock file at path, breaking it if it is stale.
+// It returns errCacheLocked if the lock is held by someone else.
+func acquireLock(path string) (*lockFile, error) {
+	hostname, _ := os.Hostname()
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			fmt.Fprintf(f, "%s %d\n", hostname, os.Getpid())
+			if err := f.Close(); err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+			l := &lockFile{path: path, stop: make(chan struct{}), done: make(chan struct{})}
+			go l.refresh()
+			return l, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if time.Since(info.ModTime()) < lockStaleAfter {
+			return nil, errCacheLocked
+		}
+		slog.Warn("breaking stale lock", "file", path)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return nil, errCacheLocked
+}
+
+// refresh keeps the lock from becoming stale until it is released.
+func (l *lockFile) refresh() {
+	defer close(l.done)
+	ticker := time.NewTicker(lockStaleAfter / 5)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			if err := os.Chtimes(l.path, now, now); err != nil {
+				slog.Error("cannot refresh lock", "err", err)
+			}
+		}
+	}
+}
+
+func (l *lockFile) release() {
+	close(l.stop)
+	<-l.done
+	if err := os.Remove(l.path); err != nil {
+		slog.Error("cannot release lock", "err", err)
+	}
+}
+
+// openCached opens the cached file at cachePath. In NFS safe mode, opening is
+// retried once if the client holds a stale file handle, which happens when
+// another host replaced the file.
+func (p *CachingReverseProxy) openCached(cachePath string) (CacheFile, error) {
+	f, err := openFS(p.cacheFS(), cachePath)
+	if p.NFSSafe && isStaleHandle(err) {
+		f, err = openFS(p.cacheFS(), cachePath)
+	}
+	return f, err
+}
+
+func isStaleHandle(err error) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		err = pathErr.Err
+	}
+	return err == syscall.ESTALE
+}
@@ -0,0 +1,83 @@
+package single
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// PathRewrite maps the request paths under Prefix to the same paths under
+// Replacement, such as /archlinux to /, for upstreams serving the same
+// objects under several paths.
+type PathRewrite struct {
+	Prefix      string
+	Replacement string
+}
+
+// rewrite returns cleanPath with the prefix of r replaced, and whether
+// cleanPath is under it. Prefixes match whole path segments.
+func (r PathRewrite) rewrite(cleanPath string) (string, bool) {
+	prefix := path.Clean("/" + r.Prefix)
+	rest, ok := strings.CutPrefix(cleanPath, prefix)
+	if !ok || rest != "" && !strings.HasPrefix(rest, "/") && prefix != "/" {
+		return "", false
+	}
+	return path.Clean("/" + r.Replacement + "/" + rest), true
+}
+
+// cleanRequestPath returns the path identifying the object requested by r. It
+// is the cache key, and the upstream URL is built from it, so that equivalent
+// URLs map to the same object both in the cache and upstream: the path is
+// percent-decoded, dot segments are resolved and duplicate slashes are
+// collapsed. With FoldCase, it is also lowercased, and the first of
+// PathRewrites matching it is then applied. The query is never part of it,
+// and is not sent to the upstream.
+//
+// Requests made by the proxy itself with internalRequest are for a path that
+// is already clean, which is returned as is, since rewrites may not apply
+// cleanly twice.
+func (p *CachingReverseProxy) cleanRequestPath(r *http.Request) string {
+	if cleanPath, ok := r.Context().Value(cleanPathKey{}).(string); ok {
+		return cleanPath
+	}
+	return p.cleanPath(r.URL.Path)
+}
+
+// cleanPathKey is the context key of the clean path of requests made by
+// internalRequest.
+type cleanPathKey struct{}
+
+// internalRequest returns a GET request for the object at cleanPath, made by
+// the proxy itself, such as to prefetch it, to be served by ServeHTTP.
+func internalRequest(ctx context.Context, cleanPath string) (*http.Request, error) {
+	return http.NewRequestWithContext(context.WithValue(ctx, cleanPathKey{}, cleanPath), http.MethodGet, escapePath(cleanPath), nil)
+}
+
+// isInternalRequest reports whether r was made by internalRequest, and is
+// left out of the access log and request statistics.
+func isInternalRequest(r *http.Request) bool {
+	_, ok := r.Context().Value(cleanPathKey{}).(string)
+	return ok
+}
+
+// cleanPath returns the path identifying the object at the decoded request
+// path requestPath, as cleanRequestPath.
+func (p *CachingReverseProxy) cleanPath(requestPath string) string {
+	cleanPath := path.Clean("/" + requestPath)
+	if p.FoldCase {
+		cleanPath = strings.ToLower(cleanPath)
+	}
+	for _, rewrite := range p.PathRewrites {
+		if rewritten, ok := rewrite.rewrite(cleanPath); ok {
+			return rewritten
+		}
+	}
+	return cleanPath
+}
+
+// escapePath returns cleanPath percent-encoded for use in a URL.
+func escapePath(cleanPath string) string {
+	return (&url.URL{Path: cleanPath}).EscapedPath()
+}
@@ -0,0 +1,54 @@
+package single
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPathRewrite(t *testing.T) {
+	for _, test := range []struct {
+		rewrite   PathRewrite
+		cleanPath string
+		want      string
+		ok        bool
+	}{
+		{PathRewrite{"/archlinux", "/arch"}, "/archlinux/core/os/core.db", "/arch/core/os/core.db", true},
+		{PathRewrite{"/archlinux", "/arch"}, "/archlinux", "/arch", true},
+		// prefixes match whole segments
+		{PathRewrite{"/archlinux", "/arch"}, "/archlinuxarm/core.db", "", false},
+		{PathRewrite{"/archlinux", "/arch"}, "/other/archlinux/core.db", "", false},
+		{PathRewrite{"archlinux/", "arch/"}, "/archlinux/core.db", "/arch/core.db", true},
+		{PathRewrite{"/", "/mirror"}, "/core.db", "/mirror/core.db", true},
+		{PathRewrite{"/archlinux", "/"}, "/archlinux/core.db", "/core.db", true},
+	} {
+		got, ok := test.rewrite.rewrite(test.cleanPath)
+		if got != test.want || ok != test.ok {
+			t.Errorf("%+v.rewrite(%q) = %q, %v, want %q, %v", test.rewrite, test.cleanPath, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestCleanRequestPath(t *testing.T) {
+	for _, test := range []struct {
+		target   string
+		foldCase bool
+		want     string
+	}{
+		{"/core/os/x86_64/core.db", false, "/core/os/x86_64/core.db"},
+		{"/core//os/./x86_64/../x86_64/core.db", false, "/core/os/x86_64/core.db"},
+		{"/core/os/x86_64/core%2edb", false, "/core/os/x86_64/core.db"},
+		{"/core/os/x86_64/core.db?ignored=1", false, "/core/os/x86_64/core.db"},
+		{"/../../etc/passwd", false, "/etc/passwd"},
+		{"/%2e%2e/etc/passwd", false, "/etc/passwd"},
+		{"/dir/", false, "/dir"},
+		{"/Core/OS/core.DB", false, "/Core/OS/core.DB"},
+		{"/Core/OS/core.DB", true, "/core/os/core.db"},
+	} {
+		p := &CachingReverseProxy{FoldCase: test.foldCase}
+		r := httptest.NewRequest(http.MethodGet, test.target, nil)
+		if got := p.cleanRequestPath(r); got != test.want {
+			t.Errorf("cleanRequestPath(%q) with FoldCase %v = %q, want %q", test.target, test.foldCase, got, test.want)
+		}
+	}
+}
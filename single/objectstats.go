@@ -0,0 +1,229 @@
+package single
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultObjectStatsLimit is how many objects ObjectStatsHandler lists
+// without a limit parameter.
+const defaultObjectStatsLimit = 100
+
+// objectStatsFile is the file in the cache directory the ObjectStats are
+// saved to, so that they survive restarts.
+const objectStatsFile = internalMarker + "object-stats.json"
+
+// ObjectStats is what the proxy served of a cached object since it was
+// cached.
+type ObjectStats struct {
+	Path string `json:"path"`
+	// Hits counts the requests served from the cache, and Misses those
+	// served from a download into the cache.
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	// Bytes is the size of the responses.
+	Bytes      int64     `json:"bytes"`
+	LastAccess time.Time `json:"last_access"`
+}
+
+// objectStatsTable holds the ObjectStats of the objects served, by cleaned
+// request path.
+type objectStatsTable struct {
+	mu      sync.Mutex
+	entries map[string]*ObjectStats
+}
+
+// record accounts a request for cleanPath served in cacheState with bytes
+// at now. Requests relayed without caching are not accounted.
+func (t *objectStatsTable) record(cleanPath string, cacheState string, bytes int64, now time.Time) {
+	var hit bool
+	switch cacheState {
+	case cacheHit, cacheRevalidated, cacheStale:
+		hit = true
+	case cacheMiss:
+	default:
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.entries == nil {
+		t.entries = make(map[string]*ObjectStats)
+	}
+	s, ok := t.entries[cleanPath]
+	if !ok {
+		s = &ObjectStats{Path: cleanPath}
+		t.entries[cleanPath] = s
+	}
+	if hit {
+		s.Hits++
+	} else {
+		s.Misses++
+	}
+	s.Bytes += bytes
+	s.LastAccess = now
+}
+
+// forget drops the stats of cleanPath, once removed from the cache.
+func (t *objectStatsTable) forget(cleanPath string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, cleanPath)
+}
+
+// LoadObjectStats reads the ObjectStats saved by SaveObjectStats, of the
+// objects still cached, to add to those recorded since.
+func (p *CachingReverseProxy) LoadObjectStats() error {
+	data, err := readFileFS(p.cacheFS(), path.Join(p.cacheRoot(), objectStatsFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []*ObjectStats
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("%s: %v", objectStatsFile, err)
+	}
+	t := &p.objectStats
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.entries == nil {
+		t.entries = make(map[string]*ObjectStats)
+	}
+	for _, s := range saved {
+		// objects removed by commands while the proxy was not running
+		if _, err := p.cacheFS().Stat(path.Join(p.cacheRoot(), s.Path)); err != nil {
+			continue
+		}
+		if cur, ok := t.entries[s.Path]; ok {
+			cur.Hits += s.Hits
+			cur.Misses += s.Misses
+			cur.Bytes += s.Bytes
+			if s.LastAccess.After(cur.LastAccess) {
+				cur.LastAccess = s.LastAccess
+			}
+			continue
+		}
+		t.entries[s.Path] = s
+	}
+	return nil
+}
+
+// SaveObjectStats saves the ObjectStats in the cache directory, for
+// LoadObjectStats.
+func (p *CachingReverseProxy) SaveObjectStats() error {
+	all, err := p.TopObjects("last_access", 0)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	return writeFileFS(p.cacheFS(), path.Join(p.cacheRoot(), objectStatsFile), data)
+}
+
+// RunObjectStats calls SaveObjectStats every interval until ctx is done.
+func (p *CachingReverseProxy) RunObjectStats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := p.SaveObjectStats(); err != nil {
+			p.logger().Error("save object stats failed", "err", err)
+		}
+	}
+}
+
+// objectStatsOrders are the orders of TopObjects by name, comparing objects
+// so that those with the most come first.
+var objectStatsOrders = map[string]func(a, b *ObjectStats) int{
+	"bytes":       func(a, b *ObjectStats) int { return cmp.Compare(b.Bytes, a.Bytes) },
+	"hits":        func(a, b *ObjectStats) int { return cmp.Compare(b.Hits, a.Hits) },
+	"misses":      func(a, b *ObjectStats) int { return cmp.Compare(b.Misses, a.Misses) },
+	"requests":    func(a, b *ObjectStats) int { return cmp.Compare(b.Hits+b.Misses, a.Hits+a.Misses) },
+	"last_access": func(a, b *ObjectStats) int { return b.LastAccess.Compare(a.LastAccess) },
+}
+
+// TopObjects returns the stats of up to limit objects, all if limit is not
+// positive, with the most of sortBy first: "bytes", "hits", "misses",
+// "requests" or "last_access" for the most recently accessed.
+func (p *CachingReverseProxy) TopObjects(sortBy string, limit int) ([]ObjectStats, error) {
+	order, ok := objectStatsOrders[sortBy]
+	if !ok {
+		return nil, fmt.Errorf("unknown sort order %q", sortBy)
+	}
+	p.objectStats.mu.Lock()
+	all := make([]*ObjectStats, 0, len(p.objectStats.entries))
+	for _, s := range p.objectStats.entries {
+		all = append(all, s)
+	}
+	slices.SortFunc(all, func(a, b *ObjectStats) int {
+		if c := order(a, b); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Path, b.Path)
+	})
+	if limit > 0 && len(all) > limit {
+		all = all[:limit]
+	}
+	top := make([]ObjectStats, len(all))
+	for i, s := range all {
+		top[i] = *s
+	}
+	p.objectStats.mu.Unlock()
+	return top, nil
+}
+
+// ObjectStatsHandler returns a handler responding to
+//
+//	GET ?sort=<order>&limit=<n>
+//
+// with the stats of the limit objects, 100 by default or all with 0, served
+// the most since they were cached according to sort, bytes by default, as
+// JSON. See TopObjects for the orders. Requests are restricted and
+// authenticated like those of AdminHandler.
+func (p *CachingReverseProxy) ObjectStatsHandler() http.Handler {
+	return p.recoverPanics(p.requireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			statusError(w, r, http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		sortBy := query.Get("sort")
+		if sortBy == "" {
+			sortBy = "bytes"
+		}
+		limit := defaultObjectStatsLimit
+		if value := query.Get("limit"); value != "" {
+			var err error
+			limit, err = strconv.Atoi(value)
+			if err != nil || limit < 0 {
+				httpError(w, r, http.StatusBadRequest, "invalid limit")
+				return
+			}
+		}
+		top, err := p.TopObjects(sortBy, limit)
+		if err != nil {
+			httpError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, top)
+	})))
+}
@@ -0,0 +1,104 @@
+package single
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Option configures a CachingReverseProxy created by NewCachingReverseProxy.
+type Option func(*CachingReverseProxy)
+
+// HeaderFilter edits the headers of an upstream request made for the client
+// request r, such as to forward some of its headers.
+type HeaderFilter func(upstream http.Header, r *http.Request)
+
+// WithHTTPClient sends upstream requests with client instead of a client
+// owned by the proxy. Redirects are handled as set by Redirects unless
+// client has its own CheckRedirect. SetUpstreamProtocol and
+// SetUpstreamTimeouts cannot be used with it.
+func WithHTTPClient(client *http.Client) Option {
+	return func(p *CachingReverseProxy) {
+		c := *client
+		if c.CheckRedirect == nil {
+			c.CheckRedirect = p.checkRedirect
+		}
+		p.client = &c
+		p.externalClient = true
+	}
+}
+
+// WithLogger logs the messages of the proxy to logger instead of
+// slog.Default.
+func WithLogger(logger *slog.Logger) Option {
+	return func(p *CachingReverseProxy) {
+		p.log = logger
+	}
+}
+
+// WithClock uses now instead of time.Now to tell the age of cached objects,
+// negative cache entries and failed upstreams.
+func WithClock(now func() time.Time) Option {
+	return func(p *CachingReverseProxy) {
+		p.clock = now
+	}
+}
+
+// WithMetadataStore sets Metadata.
+func WithMetadataStore(store MetadataStore) Option {
+	return func(p *CachingReverseProxy) {
+		p.Metadata = store
+	}
+}
+
+// WithColdStorage sets ColdStorage.
+func WithColdStorage(storage ObjectStorage) Option {
+	return func(p *CachingReverseProxy) {
+		p.ColdStorage = storage
+	}
+}
+
+// WithCacheFS keeps the disk cache in fsys instead of the directory of the
+// operating system. See CacheFS for the features that need the latter.
+func WithCacheFS(fsys CacheFS) Option {
+	return func(p *CachingReverseProxy) {
+		p.fs = fsys
+	}
+}
+
+// WithHeaderFilter applies filter to upstream requests made for client
+// requests, after the proxy set its own headers. Filters apply in the order
+// they were given.
+func WithHeaderFilter(filter HeaderFilter) Option {
+	return func(p *CachingReverseProxy) {
+		p.headerFilters = append(p.headerFilters, filter)
+	}
+}
+
+// logger returns the logger of p.
+func (p *CachingReverseProxy) logger() *slog.Logger {
+	if p.log != nil {
+		return p.log
+	}
+	return slog.Default()
+}
+
+// now returns the current time according to the clock of p.
+func (p *CachingReverseProxy) now() time.Time {
+	if p.clock != nil {
+		return p.clock()
+	}
+	return time.Now()
+}
+
+// filterHeaders applies the header filters of p to upstream, a request made
+// for r.
+func (p *CachingReverseProxy) filterHeaders(upstream *http.Request, r *http.Request) {
+	if p.ForwardedFor {
+		upstream.Header.Set("X-Forwarded-For", forwardedFor(r))
+	}
+	appendVia(upstream.Header, r.Header, p.viaEntry(r.ProtoMajor, r.ProtoMinor))
+	for _, filter := range p.headerFilters {
+		filter(upstream.Header, r)
+	}
+}
@@ -0,0 +1,188 @@
+package single
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pacmanPackage is an entry of a pacman repository database.
+type pacmanPackage struct {
+	Name     string
+	Filename string
+	SHA256   string
+}
+
+// readPacmanDB returns the packages listed in the pacman repository database
+// name of fsys. Databases compressed with gzip or bzip2, or uncompressed, are
+// supported.
+func readPacmanDB(fsys CacheFS, name string) ([]pacmanPackage, error) {
+	f, err := openFS(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parsePacmanDB(f)
+}
+
+func parsePacmanDB(r io.Reader) ([]pacmanPackage, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(6)
+	var tr *tar.Reader
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		tr = tar.NewReader(zr)
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		tr = tar.NewReader(bzip2.NewReader(br))
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return nil, errors.New("zstd compressed databases are not supported")
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0}):
+		return nil, errors.New("xz compressed databases are not supported")
+	default:
+		tr = tar.NewReader(br)
+	}
+
+	var packages []pacmanPackage
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return packages, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if path.Base(hdr.Name) != "desc" {
+			continue
+		}
+		pkg, err := parsePacmanDesc(tr)
+		if err != nil {
+			return nil, err
+		}
+		if pkg.Name != "" && pkg.Filename != "" {
+			packages = append(packages, pkg)
+		}
+	}
+}
+
+// parsePacmanDesc parses the desc file of a database entry, made of %FIELD%
+// headers each followed by value lines and an empty line.
+func parsePacmanDesc(r io.Reader) (pacmanPackage, error) {
+	var pkg pacmanPackage
+	scanner := bufio.NewScanner(r)
+	var field string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			field = ""
+		case field == "" && strings.HasPrefix(line, "%") && strings.HasSuffix(line, "%"):
+			field = line
+		case field == "%NAME%":
+			pkg.Name = line
+		case field == "%FILENAME%":
+			pkg.Filename = line
+		case field == "%SHA256SUM%":
+			pkg.SHA256 = line
+		}
+	}
+	return pkg, scanner.Err()
+}
+
+// changedPackages returns the file names of packages in newer that are not in
+// older, that is new packages and new versions of existing packages.
+func changedPackages(older []pacmanPackage, newer []pacmanPackage) []string {
+	known := make(map[string]bool, len(older))
+	for _, pkg := range older {
+		known[pkg.Filename] = true
+	}
+	var changed []string
+	for _, pkg := range newer {
+		if !known[pkg.Filename] && pkg.Filename == path.Base(pkg.Filename) {
+			changed = append(changed, pkg.Filename)
+		}
+	}
+	return changed
+}
+
+// packageSums caches the SHA-256 digests of the packages listed in the cached
+// pacman databases, by database file.
+type packageSums struct {
+	mu  sync.Mutex
+	dbs map[string]*dbSums
+}
+
+// dbSums are the digests listed in a database file with modification time
+// modTime, by package file name.
+type dbSums struct {
+	modTime time.Time
+	sums    map[string]string
+}
+
+// lookup returns the SHA-256 digest of the package named filename listed in
+// the database dbPath of fsys, or an empty string.
+func (s *packageSums) lookup(fsys CacheFS, dbPath string, filename string) string {
+	info, err := fsys.Stat(dbPath)
+	if err != nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	db := s.dbs[dbPath]
+	if db == nil || !db.modTime.Equal(info.ModTime()) {
+		packages, err := readPacmanDB(fsys, dbPath)
+		if err != nil {
+			slog.Warn("cannot read pacman database", "file", dbPath, "err", err)
+			return ""
+		}
+		db = &dbSums{modTime: info.ModTime(), sums: make(map[string]string, len(packages))}
+		for _, pkg := range packages {
+			db.sums[pkg.Filename] = pkg.SHA256
+		}
+		if s.dbs == nil {
+			s.dbs = make(map[string]*dbSums)
+		}
+		s.dbs[dbPath] = db
+	}
+	return db.sums[filename]
+}
+
+// packageDigest returns the digest of the package at cleanPath listed in a
+// cached pacman database of the same directory, or nil if none lists it.
+func (p *CachingReverseProxy) packageDigest(cleanPath string) *expectedDigest {
+	if isPacmanDB(cleanPath) {
+		return nil
+	}
+	dir := path.Join(p.cacheRoot(), path.Dir(cleanPath))
+	entries, _ := p.cacheFS().ReadDir(dir)
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".db" {
+			continue
+		}
+		sum := p.packageSums.lookup(p.cacheFS(), path.Join(dir, entry.Name()), path.Base(cleanPath))
+		if sum == "" {
+			continue
+		}
+		want, err := hex.DecodeString(sum)
+		if err != nil || len(want) != sha256.Size {
+			continue
+		}
+		return &expectedDigest{header: entry.Name(), alg: "sha256", want: want, hash: sha256.New()}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package single
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// peerTimeout is how long to wait for the response headers of a peer before
+// asking the next one, or the upstream.
+const peerTimeout = 2 * time.Second
+
+// onlyIfCached reports whether r asks to be served only from the cache, as
+// peers do, with Cache-Control: only-if-cached.
+func onlyIfCached(r *http.Request) bool {
+	for _, value := range r.Header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(directive), "only-if-cached") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fromPeers returns the response of the first of Peers having the object at
+// cleanPath cached, or nil if none has. The response stands for that of
+// upstreamReq, the upstream request it saves, so that it is cached as if it
+// came from the upstream.
+func (p *CachingReverseProxy) fromPeers(upstreamReq *http.Request, cleanPath string) *http.Response {
+	for _, peer := range p.Peers {
+		resp, err := p.askPeer(upstreamReq.Context(), peer, cleanPath)
+		if err != nil {
+			p.logger().Warn("peer failed", "peer", peer, "path", cleanPath, "err", err)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK || resp.ContentLength < 0 {
+			resp.Body.Close()
+			continue
+		}
+		p.logger().Info("served by peer", "path", cleanPath, "peer", peer)
+		// the tag of the copy of the peer means nothing to the upstream
+		resp.Header.Del("ETag")
+		resp.Request = upstreamReq
+		return resp
+	}
+	return nil
+}
+
+// askPeer requests the object at cleanPath from peer if it has it cached,
+// giving up if the response headers do not arrive within peerTimeout.
+func (p *CachingReverseProxy) askPeer(ctx context.Context, peer string, cleanPath string) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(peer, "/")+escapePath(cleanPath), nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("Cache-Control", "only-if-cached")
+	// the object is cached as it is, not in the encoding of a transport
+	req.Header.Set("Accept-Encoding", "identity")
+	if via := p.viaEntry(1, 1); via != "" {
+		req.Header.Set("Via", via)
+	}
+	timer := time.AfterFunc(peerTimeout, cancel)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		cancel()
+		if !timer.Stop() {
+			return nil, fmt.Errorf("no response within %v", peerTimeout)
+		}
+		return nil, err
+	}
+	timer.Stop()
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// advertise queues the object at cleanPath, just downloaded into the cache,
+// for prefetch on each of Peers through their admin API, with PeerToken, so
+// that they copy it from this proxy rather than download it from the
+// upstream again.
+func (p *CachingReverseProxy) advertise(cleanPath string) {
+	for _, peer := range p.Peers {
+		ctx, cancel := context.WithTimeout(context.Background(), peerTimeout)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(peer, "/")+"/-/admin/prefetch", strings.NewReader(cleanPath+"\n"))
+		if err != nil {
+			cancel()
+			p.logger().Warn("cannot advertise to peer", "peer", peer, "err", err)
+			continue
+		}
+		if p.PeerToken != "" {
+			req.Header.Set("Authorization", "Bearer "+p.PeerToken)
+		}
+		resp, err := p.client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("status %s", resp.Status)
+			}
+		}
+		cancel()
+		if err != nil {
+			p.logger().Warn("cannot advertise to peer", "peer", peer, "path", cleanPath, "err", err)
+			continue
+		}
+		p.logger().Debug("advertised to peer", "peer", peer, "path", cleanPath)
+	}
+}
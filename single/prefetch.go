@@ -0,0 +1,173 @@
+package single
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+)
+
+// prefetchQueueSize is the number of paths that can wait to be prefetched.
+const prefetchQueueSize = 4096
+
+// Prefetch queues cleanPath to be downloaded into the cache in the background.
+// It reports whether the path was queued; paths already queued are ignored,
+// and so are paths exceeding the queue capacity.
+func (p *CachingReverseProxy) Prefetch(cleanPath string) bool {
+	p.prefetchOnce.Do(p.startPrefetchers)
+	p.prefetchMu.Lock()
+	defer p.prefetchMu.Unlock()
+	if p.prefetchPending[cleanPath] {
+		return false
+	}
+	select {
+	case p.prefetchQueue <- cleanPath:
+		p.prefetchPending[cleanPath] = true
+		return true
+	default:
+		p.logger().Warn("prefetch queue full, dropping", "path", cleanPath)
+		return false
+	}
+}
+
+func (p *CachingReverseProxy) startPrefetchers() {
+	p.prefetchQueue = make(chan string, prefetchQueueSize)
+	p.prefetchPending = make(map[string]bool)
+	workers := p.PrefetchConcurrency
+	if workers <= 0 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for cleanPath := range p.prefetchQueue {
+				p.prefetchOne(cleanPath)
+				p.prefetchMu.Lock()
+				delete(p.prefetchPending, cleanPath)
+				p.prefetchMu.Unlock()
+			}
+		}()
+	}
+}
+
+// prefetchOne requests cleanPath like a client would, discarding the
+// response, and returns the response status.
+func (p *CachingReverseProxy) prefetchOne(cleanPath string) int {
+	req, err := internalRequest(context.Background(), cleanPath)
+	if err != nil {
+		p.logger().Error("prefetch failed", "err", err)
+		return 0
+	}
+	w := &discardResponseWriter{header: make(http.Header)}
+	p.ServeHTTP(w, req)
+	p.logger().Info("prefetched", "path", cleanPath, "status", w.status)
+	return w.status
+}
+
+// ReadPathList reads a list of objects to prefetch from r, one per line, and
+// returns their paths. Lines are request paths, or URLs within the upstream
+// or a mirror. Empty lines and lines starting with # are ignored.
+func (p *CachingReverseProxy) ReadPathList(r io.Reader) ([]string, error) {
+	var paths []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, "/") {
+			rel := p.upstreamRelative(line)
+			if rel == "" {
+				return nil, fmt.Errorf("%s is not a path or a URL within the upstream", line)
+			}
+			u, err := url.Parse(rel)
+			if err != nil {
+				return nil, err
+			}
+			line = u.Path
+		}
+		paths = append(paths, p.cleanPath(line))
+	}
+	return paths, scanner.Err()
+}
+
+// Warm downloads the objects at paths into the cache, concurrency at a time,
+// and returns the paths that could not be fetched.
+func (p *CachingReverseProxy) Warm(paths []string, concurrency int) []string {
+	var mu sync.Mutex
+	var failed []string
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < max(concurrency, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for cleanPath := range queue {
+				if p.prefetchOne(cleanPath) != http.StatusOK {
+					mu.Lock()
+					failed = append(failed, cleanPath)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, cleanPath := range paths {
+		queue <- cleanPath
+	}
+	close(queue)
+	wg.Wait()
+	return failed
+}
+
+// prefetchDBUpdate queues the packages that are new in the pacman database
+// downloaded to newPath of newFS compared to the cached version at oldPath.
+func (p *CachingReverseProxy) prefetchDBUpdate(cleanPath string, oldPath string, newFS CacheFS, newPath string) {
+	older, err := readPacmanDB(p.cacheFS(), oldPath)
+	if err != nil {
+		// without a previous version, everything would be new
+		return
+	}
+	newer, err := readPacmanDB(newFS, newPath)
+	if err != nil {
+		p.logger().Warn("prefetch: cannot read", "path", cleanPath, "err", err)
+		return
+	}
+	changed := changedPackages(older, newer)
+	p.logger().Info("queueing new packages for prefetch", "path", cleanPath, "count", len(changed))
+	for _, filename := range changed {
+		p.Prefetch(path.Join(path.Dir(cleanPath), filename))
+	}
+}
+
+// isPacmanDB reports whether cleanPath is a pacman repository database.
+func isPacmanDB(cleanPath string) bool {
+	return strings.HasSuffix(cleanPath, ".db")
+}
+
+// discardResponseWriter is a ResponseWriter that discards the response.
+type discardResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return ioutil.Discard.Write(p)
+}
+
+func (w *discardResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
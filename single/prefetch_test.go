@@ -0,0 +1,215 @@
+package single
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingUpstream serves cacheable objects of size bytes at any path,
+// recording the paths requested.
+type recordingUpstream struct {
+	size int
+
+	mu    sync.Mutex
+	paths []string
+}
+
+func (u *recordingUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	u.paths = append(u.paths, r.URL.Path)
+	u.mu.Unlock()
+	http.ServeContent(w, r, "", time.Unix(1e9, 0), bytes.NewReader(make([]byte, u.size)))
+}
+
+// requested returns the paths requested so far, and forgets them.
+func (u *recordingUpstream) requested() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	paths := u.paths
+	u.paths = nil
+	return paths
+}
+
+func TestPrefetchRewritten(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		rewrites []PathRewrite
+		path     string
+		want     string
+	}{
+		{"prefix", []PathRewrite{{"/", "/mirror"}}, "/core.db", "/mirror/core.db"},
+		{"swap", []PathRewrite{{"/a", "/b"}, {"/b", "/a"}}, "/a/core.db", "/b/core.db"},
+		{"none", nil, "/core.db", "/core.db"},
+	} {
+		u := &recordingUpstream{size: 100}
+		upstream := httptest.NewServer(u)
+		p, fsys := newMemProxy(t, upstream.URL)
+		p.PathRewrites = test.rewrites
+		cleanPath := p.cleanPath(test.path)
+		if cleanPath != test.want {
+			t.Errorf("%s: cleanPath(%q) = %q, want %q", test.name, test.path, cleanPath, test.want)
+		}
+		// prefetching the clean path of a request caches the object the
+		// request is for
+		if status := p.prefetchOne(cleanPath); status != http.StatusOK {
+			t.Errorf("%s: prefetch got %d, want %d", test.name, status, http.StatusOK)
+		}
+		if got := u.requested(); !reflect.DeepEqual(got, []string{test.want}) {
+			t.Errorf("%s: upstream requested %q, want %q", test.name, got, []string{test.want})
+		}
+		if _, err := fsys.Stat(path.Join(p.cacheRoot(), test.want)); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		// and a client request is then served from the cache
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.path, nil))
+		if w.Code != http.StatusOK || p.stats.hits.Load() != 1 {
+			t.Errorf("%s: got %d with %d hits, want %d with a hit", test.name, w.Code, p.stats.hits.Load(), http.StatusOK)
+		}
+		upstream.Close()
+	}
+}
+
+func TestPrefetchNotCounted(t *testing.T) {
+	upstream := httptest.NewServer(&recordingUpstream{size: 100})
+	defer upstream.Close()
+	var log bytes.Buffer
+	p, err := NewCachingReverseProxy(upstream.URL, "/cache", WithCacheFS(NewMemFS()), WithLogger(slog.New(slog.NewTextHandler(&log, nil))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name           string
+		client         bool
+		requests, hits int64
+		objects        int
+		logged         bool
+	}{
+		// the proxy prefetching an object is not client traffic
+		{name: "prefetch"},
+		{name: "client", client: true, requests: 1, hits: 1, objects: 1, logged: true},
+	} {
+		log.Reset()
+		if test.client {
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/core.db", nil))
+		} else if status := p.prefetchOne("/core.db"); status != http.StatusOK {
+			t.Fatalf("%s: prefetch got %d, want %d", test.name, status, http.StatusOK)
+		}
+		status := p.Status()
+		if status.Requests != test.requests || status.Hits != test.hits || status.Misses != 0 {
+			t.Errorf("%s: %d requests, %d hits and %d misses, want %d, %d and 0", test.name, status.Requests, status.Hits, status.Misses, test.requests, test.hits)
+		}
+		top, err := p.TopObjects("requests", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(top) != test.objects {
+			t.Errorf("%s: stats of %d objects, want %d", test.name, len(top), test.objects)
+		}
+		if logged := strings.Contains(log.String(), "msg=request"); logged != test.logged {
+			t.Errorf("%s: access logged %v, want %v", test.name, logged, test.logged)
+		}
+	}
+}
+
+func TestReadPathList(t *testing.T) {
+	p, _ := newMemProxy(t, "http://upstream.example/archlinux")
+	p.AddMirror("https://mirror.example/arch")
+	p.PathRewrites = []PathRewrite{{"/old", "/core"}}
+	for _, test := range []struct {
+		name string
+		data string
+		want []string
+		err  bool
+	}{
+		{
+			name: "paths",
+			data: "# packages\n\n/core/os/x86_64/core.db\n  /extra//os/../os/x86_64/extra.db  \n",
+			want: []string{"/core/os/x86_64/core.db", "/extra/os/x86_64/extra.db"},
+		},
+		{
+			name: "urls",
+			data: "http://upstream.example/archlinux/core/os/x86_64/core.db\nhttps://mirror.example/arch/extra/os/x86_64/extra.db?x=1\n",
+			want: []string{"/core/os/x86_64/core.db", "/extra/os/x86_64/extra.db"},
+		},
+		{
+			name: "rewritten",
+			data: "/old/os/x86_64/core.db\n",
+			want: []string{"/core/os/x86_64/core.db"},
+		},
+		{
+			name: "outside the upstream",
+			data: "http://other.example/archlinux/core/os/x86_64/core.db\n",
+			err:  true,
+		},
+	} {
+		got, err := p.ReadPathList(strings.NewReader(test.data))
+		if (err != nil) != test.err {
+			t.Errorf("%s: got error %v, want error %v", test.name, err, test.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestWarmRewritten(t *testing.T) {
+	u := &recordingUpstream{size: 100}
+	upstream := httptest.NewServer(u)
+	defer upstream.Close()
+	p, fsys := newMemProxy(t, upstream.URL)
+	p.PathRewrites = []PathRewrite{{"/", "/mirror"}}
+	paths, err := p.ReadPathList(strings.NewReader("/core.db\n/extra.db\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed := p.Warm(paths, 2); len(failed) != 0 {
+		t.Errorf("failed to warm %q", failed)
+	}
+	got := u.requested()
+	sort.Strings(got)
+	if want := []string{"/mirror/core.db", "/mirror/extra.db"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("upstream requested %q, want %q", got, want)
+	}
+	for _, cleanPath := range []string{"/mirror/core.db", "/mirror/extra.db"} {
+		if _, err := fsys.Stat(path.Join(p.cacheRoot(), cleanPath)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestPrefetchHandler(t *testing.T) {
+	u := &recordingUpstream{size: 100}
+	upstream := httptest.NewServer(u)
+	defer upstream.Close()
+	p, _ := newMemProxy(t, upstream.URL)
+	p.AdminToken = "secret"
+	for _, test := range []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"paths", "/core.db\n/extra.db\n", http.StatusOK},
+		{"outside the upstream", "http://other.example/core.db\n", http.StatusBadRequest},
+		{"too large", strings.Repeat("/core/os/x86_64/core.db\n", maxPathListSize/23+1), http.StatusRequestEntityTooLarge},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/prefetch", strings.NewReader(test.body))
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		p.AdminHandler().ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: got %d, want %d", test.name, w.Code, test.status)
+		}
+	}
+}
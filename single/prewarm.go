@@ -0,0 +1,56 @@
+package single
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxIdleConnsPerHost is the default number of idle connections to each
+// upstream host kept open.
+const maxIdleConnsPerHost = 16
+
+// Prewarm opens up to conns connections to the upstream, including the TLS
+// handshake, and leaves them idle for later requests, up to the number of
+// idle connections kept open as set by SetUpstreamConnections. Connections already
+// idle are reused, which keeps them from timing out. It requests the root of
+// the upstream with HEAD; the response status does not matter.
+func (p *CachingReverseProxy) Prewarm(ctx context.Context, conns int) {
+	conns = min(conns, p.maxIdleConns())
+	var wg sync.WaitGroup
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := p.newUpstreamRequest(http.MethodHead, "/")
+			if err != nil {
+				p.logger().Warn("prewarm failed", "err", err)
+				return
+			}
+			resp, err := p.client.Do(req.WithContext(ctx))
+			if err != nil {
+				p.logger().Warn("prewarm failed", "err", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+}
+
+// RunPrewarming calls Prewarm with conns every interval until ctx is done.
+// interval should be shorter than the time the upstream keeps idle
+// connections open.
+func (p *CachingReverseProxy) RunPrewarming(ctx context.Context, interval time.Duration, conns int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.Prewarm(ctx, conns)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
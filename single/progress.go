@@ -0,0 +1,115 @@
+package single
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// progressInterval is how often ProgressEvents reports the progress of
+	// downloads.
+	progressInterval = time.Second
+	// progressKeepAlive is how long ProgressEvents waits without events
+	// before sending a comment, so that idle connections are not closed by
+	// intermediaries.
+	progressKeepAlive = 15 * time.Second
+)
+
+// ProgressEvent reports the progress of a download, with its speed in bytes
+// per second over the last interval.
+type ProgressEvent struct {
+	Path    string  `json:"path"`
+	Written int64   `json:"written"`
+	Size    int64   `json:"size"`
+	Speed   float64 `json:"speed"`
+}
+
+// ProgressEvents returns a handler streaming the progress of the downloads
+// in progress as Server-Sent Events. Every second, a progress event carries
+// a ProgressEvent as JSON for each download, and a done event carries the
+// path of each download that finished or failed since. Requests are
+// restricted and authenticated like those of AdminHandler.
+func (p *CachingReverseProxy) ProgressEvents() http.Handler {
+	return p.recoverPanics(p.requireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			statusError(w, r, http.StatusMethodNotAllowed)
+			return
+		}
+		rc := http.NewResponseController(w)
+		// the stream outlives the write timeout of the server
+		rc.SetWriteDeadline(time.Time{})
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			p.logger().Warn("cannot stream progress", "err", err)
+			return
+		}
+
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		prev := make(map[string]DownloadStatus)
+		prevTime := time.Now()
+		lastSent := prevTime
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case now := <-ticker.C:
+				elapsed := now.Sub(prevTime).Seconds()
+				prevTime = now
+				downloads := p.downloadStatuses()
+				current := make(map[string]DownloadStatus, len(downloads))
+				for _, d := range downloads {
+					current[d.Path] = d
+				}
+				sent := false
+				for path := range prev {
+					if _, ok := current[path]; !ok {
+						if err := writeEvent(w, "done", struct {
+							Path string `json:"path"`
+						}{path}); err != nil {
+							return
+						}
+						sent = true
+					}
+				}
+				for _, d := range downloads {
+					e := ProgressEvent{Path: d.Path, Written: d.Written, Size: d.Size}
+					if last, ok := prev[d.Path]; ok && elapsed > 0 {
+						e.Speed = float64(max(d.Written-last.Written, 0)) / elapsed
+					}
+					if err := writeEvent(w, "progress", e); err != nil {
+						return
+					}
+					sent = true
+				}
+				prev = current
+				if sent {
+					lastSent = now
+				} else if now.Sub(lastSent) >= progressKeepAlive {
+					if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+						return
+					}
+					lastSent = now
+				}
+				if err := rc.Flush(); err != nil {
+					return
+				}
+			}
+		}
+	})))
+}
+
+// writeEvent writes an event named event with v as JSON data.
+func writeEvent(w http.ResponseWriter, event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
@@ -2,154 +2,942 @@
 package single
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-func statusError(w http.ResponseWriter, code int) {
-	http.Error(w, http.StatusText(code), code)
-}
-
 type CachingReverseProxy struct {
+	// AdminToken, if non-empty, is accepted as a bearer token or basic auth
+	// password for administrative requests, which are refused without it
+	// or AdminUsers. DELETE requests on object paths
+	// purge the cached object and are only allowed when AdminToken or
+	// AdminUsers is set, unless NoDeletePurge is.
+	AdminToken string
+	// AdminUsers, if not empty, maps user names to bcrypt hashes of the
+	// passwords they may use as basic auth credentials for administrative
+	// requests instead of AdminToken, as read by ReadPasswordFile.
+	AdminUsers map[string][]byte
+	// AdminNetworks, if not empty, restricts administrative requests to
+	// clients with an IP address in these networks.
+	AdminNetworks []*net.IPNet
+	// AuditLog, if set, records administrative actions.
+	AuditLog *AuditLog
+	// NoDeletePurge refuses DELETE requests on object paths, for proxies
+	// whose administrative handlers are only served elsewhere, where
+	// objects are purged with DELETE /cache/<path> of AdminHandler.
+	NoDeletePurge bool
+
+	// Metadata, if not nil, records the SHA-256 digest and the upstream
+	// validators of downloaded objects.
+	Metadata MetadataStore
+
+	// Memory, if not nil, keeps small objects in memory in front of the
+	// disk cache.
+	Memory *MemoryCache
+
+	// ColdStorage, if not nil, is the tier behind the disk cache. Objects
+	// missing from the disk cache are promoted from ColdStorage when
+	// requested, and Demote moves idle objects to it.
+	ColdStorage ObjectStorage
+
+	// ColdWriteThrough uploads objects to ColdStorage while they are being
+	// downloaded, instead of only when they are demoted.
+	ColdWriteThrough bool
+
+	// NFSSafe allows several hosts to share cacheDir over NFS. Downloads are
+	// coordinated with lock files next to the cached files, completed files
+	// are synced before they are renamed into place, and stale file handles
+	// are retried. While another host downloads an object, it is served
+	// without caching.
+	NFSSafe bool
+
+	// Namespace, if not empty, is the subdirectory of cacheDir holding the
+	// objects of this proxy, so that proxies for different upstreams can share
+	// cacheDir without serving each other's objects. See UpstreamNamespace.
+	Namespace string
+
+	// Dedupe stores byte-identical objects once, by hard linking them with a
+	// blob in cacheDir named by their SHA-256 digest, or cloning the blob on
+	// filesystems supporting it for objects of another modification time.
+	Dedupe bool
+
+	// UpstreamCredentials, if not nil, authenticate requests to the upstream.
+	// The Authorization header is not forwarded when the upstream redirects
+	// to another domain.
+	UpstreamCredentials *Credentials
+	// UpstreamHeaders are added to requests to the upstream, such as the API
+	// key of an authenticated artifact server. Like UpstreamCredentials,
+	// they are not sent to mirrors, nor when the upstream redirects to
+	// another host, and only the response headers listed in the README are
+	// passed on to clients.
+	UpstreamHeaders http.Header
+
+	// IgnoreProxyEnvironment connects to the upstream directly, instead of
+	// through the proxy given by the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+	// environment variables.
+	IgnoreProxyEnvironment bool
+
+	// VerifyDigests checks downloads against the Digest, Content-Digest,
+	// Repr-Digest, Content-MD5 and x-goog-hash headers sent by the upstream.
+	// Mismatching downloads are discarded instead of cached, and clients
+	// receiving them are disconnected before the last byte.
+	VerifyDigests bool
+
+	// VerifyPackages checks downloaded packages against the SHA-256 digests
+	// listed in the pacman databases cached in the same directory, and
+	// discards mismatching downloads like VerifyDigests.
+	VerifyPackages bool
+
+	// ContentDigest, if set, gives the SHA-256 digests of objects whose
+	// paths name their content, such as the blobs of a registry, which are
+	// checked like those of VerifyDigests.
+	ContentDigest PathDigest
+
+	// Files, if set, keeps frequently served cached files open. It must not
+	// be used with NFSSafe, since files may be replaced by other hosts.
+	Files *FileCache
+
+	// Staging, if set, holds in-progress downloads of small objects outside
+	// the disk cache until they complete.
+	Staging *StagingArea
+
+	// MaxDownloads limits the number of objects downloaded into the cache at
+	// the same time. Requests that would start another download get 503 with
+	// a Retry-After header of RetryAfter; requests for objects already being
+	// downloaded are still served. Zero means no limit.
+	MaxDownloads int
+	RetryAfter   time.Duration
+
+	// MaxClientDownloads limits the number of objects downloaded into the
+	// cache at the same time for requests of a single client IP address.
+	// Requests that would start another get 429. Zero means no limit.
+	MaxClientDownloads int
+
+	// Redirects is how redirects sent by the upstream are handled. Relayed
+	// redirects to paths of the upstream have their Location rewritten to
+	// point through the proxy under MountPrefix, the path the proxy is served
+	// under without the trailing slash.
+	Redirects   RedirectMode
+	MountPrefix string
+
+	// ClientGroups partitions the cache accounting by client networks, with a
+	// quota for each group. It requires Metadata, and LoadGroupUsage must be
+	// called before serving.
+	ClientGroups []*ClientGroup
+	// EvictionDryRun logs the objects that would be evicted to keep groups
+	// within their quotas or the cache within MaxCacheSize, without evicting
+	// them.
+	EvictionDryRun bool
+
+	// DryRun relays every response of the upstream without serving or
+	// writing the cache, and records what the proxy would have done, such as
+	// caching, revalidating or bypassing, to DecisionLog, so that cache rules
+	// can be tried on production traffic. Background tasks are not changed:
+	// set EvictionDryRun, and VerifyOptions.DryRun, too.
+	DryRun bool
+	// DecisionLog, if set, records the decisions of DryRun and, with
+	// EvictionDryRun, the objects that would be evicted. They are logged
+	// otherwise.
+	DecisionLog *DecisionLog
+
+	// MaxCacheSize, if positive, limits the size of the disk cache. The least
+	// recently accessed objects are evicted when it is exceeded; see
+	// RunEviction. Proxies sharing a disk are limited together with a
+	// CacheBudget instead.
+	MaxCacheSize int64
+
+	// MaxObjectSize, if positive, is the size of the largest object cached.
+	// Larger objects are passed through without caching them.
+	MaxObjectSize int64
+
+	// MinFreeSpace is the space to keep free on the filesystem of the cache
+	// directory. Objects that would not fit, counting the rest of the
+	// downloads in progress, are passed through without caching them.
+	MinFreeSpace int64
+
+	// CacheRules override how objects are cached by path. The first
+	// matching rule applies; other paths use CacheDefault.
+	CacheRules []CacheRule
+
+	// HonorCacheControl serves objects without validating them until they
+	// expire according to the Cache-Control or Expires headers sent by the
+	// upstream, for paths without a MaxAge in CacheRules. The expiry is
+	// recorded in Metadata, which is therefore required.
+	HonorCacheControl bool
+
+	// FoldCase lowercases request paths, so that paths differing only in case
+	// are cached once. The upstream must be case insensitive.
+	FoldCase bool
+	// PathRewrites map request paths to those of the objects cached and
+	// requested from the upstream, so that equivalent paths are cached
+	// once. The first matching rewrite applies, after FoldCase.
+	PathRewrites []PathRewrite
+
+	// ClockSkewTolerance is how much later than the cached modification time
+	// the Last-Modified of an upstream response with the same size may be for
+	// the cached object to be kept, as may any earlier Last-Modified. It
+	// avoids re-downloading unchanged files when CDN nodes disagree on
+	// modification times. Zero disables the tolerance.
+	ClockSkewTolerance time.Duration
+
+	// DownloadLimiter, if not nil, limits the rate of downloads into the
+	// cache in total, and MaxObjectDownloadRate, if positive, the rate of each
+	// download, in bytes per second. Serving cached objects is not limited.
+	DownloadLimiter       *RateLimiter
+	MaxObjectDownloadRate int64
+
+	// NegativeTTL, if positive, is how long 404 and 410 responses of the
+	// upstream are remembered, in memory, to answer requests for the same
+	// path without asking the upstream. Purging a path forgets it.
+	NegativeTTL time.Duration
+
+	// MaxStale, if positive, is how long after it was last validated with
+	// the upstream a cached object may be served, marked stale, when the
+	// upstream fails to respond or responds with a server error.
+	MaxStale time.Duration
+
+	// StaleWhileRevalidate serves cached objects, marked stale, without
+	// waiting for the upstream, and validates them in the background. Objects
+	// last validated longer than MaxStale ago, if positive, are validated
+	// before they are served.
+	StaleWhileRevalidate bool
+
+	// DeltaTransfer updates stale cached files with zsync when the upstream
+	// publishes a control file next to them (the file name with .zsync
+	// appended), and zchunk files (*.zck) from the chunks listed in their
+	// header, downloading only the blocks or chunks that changed.
+	DeltaTransfer bool
+
+	// PrefetchDBUpdates prefetches the packages that are new in a pacman
+	// repository database (*.db) when a new version of it is downloaded, so
+	// that they are cached before clients updating from it request them.
+	PrefetchDBUpdates bool
+
+	// HeadFromCache answers HEAD requests for cached objects from the cache
+	// without asking the upstream, unless their CachePolicy is
+	// CacheRevalidate. Objects in ColdStorage are answered from their
+	// Metadata without promoting them.
+	HeadFromCache bool
+
+	// PrefetchOnHead prefetches objects that are not cached when they are
+	// requested with HEAD, expecting them to be requested with GET next.
+	PrefetchOnHead bool
+
+	// CompressCached compresses cached text, JSON and XML objects of at
+	// least 1 KiB with gzip for clients accepting it. Objects not cached are
+	// relayed in the encoding the upstream sent for the Accept-Encoding of
+	// the client.
+	CompressCached bool
+
+	// RewriteListings rewrites the links of HTML directory listings, relayed
+	// for paths ending with a slash, that point into the upstream as
+	// absolute URLs or paths, so that they point through the proxy under
+	// MountPrefix and the mirror can be browsed through it.
+	RewriteListings bool
+
+	// ForwardedFor sends the address of the client, after the
+	// X-Forwarded-For addresses of its request, in the X-Forwarded-For
+	// header of the upstream requests made for it.
+	ForwardedFor bool
+	// Peers are the URLs of sibling proxies of the same upstream, such as
+	// http://cache.site-b.lan:8000/, asked for objects missing from the
+	// cache with Cache-Control: only-if-cached before the upstream, so that
+	// sites share one download over the WAN. Peers validate their copies
+	// with the upstream as they do for their own clients.
+	Peers []string
+	// AdvertiseToPeers queues the objects downloaded into the cache for
+	// prefetch on Peers through their admin API, with PeerToken, so that
+	// they copy them from this proxy.
+	AdvertiseToPeers bool
+	// PeerToken, if non-empty, is sent by AdvertiseToPeers, and accepted as
+	// a bearer token for prefetch requests of AdminHandler only, so that
+	// peers do not hold admin credentials of each other.
+	PeerToken string
+	// Via is the pseudonym of the proxy in the Via header added to upstream
+	// requests and to responses, such as "crp". It is not sent if empty.
+	Via string
+
+	// PrefetchConcurrency is the number of objects prefetched at the same
+	// time. Values less than 1 mean 1.
+	PrefetchConcurrency int
+
+	// MaxPathLength and MaxPathDepth, if positive, limit the length in bytes
+	// and the number of segments of request paths. Longer or deeper paths
+	// are rejected with 414 before they reach the cache.
+	MaxPathLength int
+	MaxPathDepth  int
+
+	// MirrorTimeout, if positive, is how long to wait for the response
+	// headers of the upstream or a mirror before failing over to the next
+	// mirror. See AddMirror.
+	MirrorTimeout time.Duration
+
+	// HealthCheckPath is the path RunHealthChecks requests from the upstream
+	// and each mirror. It should exist on all of them; its Last-Modified
+	// header, if any, is taken as when they last synced.
+	HealthCheckPath string
+
+	// DownloadTimeout, if positive, limits the time to download an object
+	// into the cache, from its response headers, after which the download
+	// is aborted. Downloads into the cache continue when the client that
+	// started them goes away, while other upstream requests are canceled
+	// with the client request, and not limited by DownloadTimeout.
+	DownloadTimeout time.Duration
+
+	// UpstreamRetries is how many times upstream requests failing with a
+	// network error or a server error are retried, and how many times in a
+	// row downloads into the cache cut short are resumed with a range
+	// request. Retries wait RetryBackoff, 500ms if zero, doubled after each
+	// failed retry up to 30s, with jitter.
+	UpstreamRetries int
+	RetryBackoff    time.Duration
+
 	client         *http.Client
+	externalClient bool
+	// dialer connects the transport of client, unless externalClient
+	dialer         *net.Dialer
 	upstreamPrefix string
-	cacheDir       string
-	objectHandles  sync.Map
+	upstreamHealth endpointHealth
+	// mirrorsMu guards mirrors, which RunMirrorList replaces.
+	mirrorsMu sync.Mutex
+	mirrors   []*mirror
+	// preferredUpstream is the health of the upstream tried first, as
+	// selected by RunHealthChecks, or nil for the upstream.
+	preferredUpstream atomic.Pointer[endpointHealth]
+	evictNow          chan struct{}
+	cacheDir          string
+	objectHandles     sync.Map
+	// budget, if set, limits the size of the disk cache with those of other
+	// proxies, instead of MaxCacheSize.
+	budget *CacheBudget
+	// fetches holds a *fetch for each uncached path being requested from
+	// the upstream.
+	fetches sync.Map
+	// revalidating holds the paths being revalidated in the background.
+	revalidating sync.Map
+	negative     negativeCache
+	objectStats  objectStatsTable
+	// validated holds when each object was last validated with the
+	// upstream, by objectKey, without Metadata to record it in.
+	validated sync.Map
+
+	groupsMu sync.Mutex
+	groups   groupUsage
+
+	downloadsMu    sync.Mutex
+	downloads      map[*objectHandle]bool
+	downloadSlots  downloadSlots
+	activeRequests atomic.Int64
+	stats          stats
+	usage          cacheUsage
+	shuttingDown   atomic.Bool
+
+	prefetchOnce    sync.Once
+	prefetchMu      sync.Mutex
+	prefetchQueue   chan string
+	prefetchPending map[string]bool
+
+	packageSums packageSums
+
+	log           *slog.Logger
+	clock         func() time.Time
+	fs            CacheFS
+	headerFilters []HeaderFilter
 }
 
-func NewCachingReverseProxy(upstreamPrefix string, cacheDir string) *CachingReverseProxy {
-	return &CachingReverseProxy{
-		client:         &http.Client{},
-		upstreamPrefix: upstreamPrefix,
-		cacheDir:       cacheDir,
+// NewCachingReverseProxy returns a proxy for upstreamPrefix caching objects in
+// cacheDir, configured by opts. If upstreamPrefix contains a username and
+// password, they are removed from the URL and used as UpstreamCredentials.
+func NewCachingReverseProxy(upstreamPrefix string, cacheDir string, opts ...Option) (*CachingReverseProxy, error) {
+	u, err := url.Parse(upstreamPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream URL: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("upstream URL %q must be an http or https URL", upstreamPrefix)
+	}
+	upstreamPrefix, credentials := splitUserinfo(upstreamPrefix)
+	p := &CachingReverseProxy{
+		UpstreamCredentials: credentials,
+		upstreamPrefix:      upstreamPrefix,
+		cacheDir:            cacheDir,
+		evictNow:            make(chan struct{}, 1),
+	}
+	p.client = &http.Client{
+		Transport:     p.newTransport(),
+		CheckRedirect: p.checkRedirect,
 	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p, nil
 }
 
 var _ http.Handler = &CachingReverseProxy{}
 
 func (p *CachingReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	accessLog := &accessLogWriter{ResponseWriter: w}
+	w = accessLog
+	var cacheState string
+	defer func() {
+		// requests made by the proxy itself, such as prefetches, are not
+		// client traffic
+		if isInternalRequest(r) {
+			return
+		}
+		p.logAccess(r, accessLog, cacheState, start)
+		if cacheState != "" {
+			p.objectStats.record(p.cleanRequestPath(r), cacheState, accessLog.bytes, p.now())
+		}
+	}()
+	defer p.recoverPanic(accessLog, r)
+	appendVia(w.Header(), nil, p.viaEntry(1, 1))
+
+	if p.shuttingDown.Load() {
+		serviceUnavailable(w, r, p.RetryAfter)
+		return
+	}
+	p.activeRequests.Add(1)
+	defer p.activeRequests.Add(-1)
+	p.count(r, &p.stats.requests)
+
+	if !p.pathWithinLimits(r.URL.Path) {
+		statusError(w, r, http.StatusRequestURITooLong)
+		return
+	}
+	if isInternalPath(p.cleanRequestPath(r)) {
+		statusError(w, r, http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodDelete && p.deletePurges() {
+		p.requireAdmin(http.HandlerFunc(p.handleDelete)).ServeHTTP(w, r)
+		return
+	}
 	if r.Method != http.MethodHead && r.Method != http.MethodGet {
-		fmt.Fprintln(w, "Only HEAD or GET allowed")
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		if p.deletePurges() {
+			w.Header().Set("Allow", "GET, HEAD, DELETE")
+		} else {
+			w.Header().Set("Allow", "GET, HEAD")
+		}
+		httpError(w, r, http.StatusMethodNotAllowed, "only HEAD or GET allowed")
 		return
 	}
 
-	cleanPath := path.Clean("/" + r.URL.Path)
-	cachePath := path.Join(p.cacheDir, cleanPath)
-	upstreamReq, err := http.NewRequest(
-		r.Method,
-		p.upstreamPrefix+cleanPath,
-		nil,
-	)
+	cleanPath := p.cleanRequestPath(r)
+	cachePath := path.Join(p.cacheRoot(), cleanPath)
+	directory := isDirectoryRequest(r)
+	upstreamReq, err := p.newUpstreamRequest(r.Method, upstreamPath(cleanPath, directory))
 	if err != nil {
-		panic(err)
+		statusError(w, r, http.StatusInternalServerError)
+		p.logger().Error("cannot make upstream request", "path", cleanPath, "err", err)
+		return
 	}
+	p.filterHeaders(upstreamReq, r)
+	ctx, detach, cancel := p.upstreamContext(r)
+	detached := false
+	defer func() {
+		if !detached {
+			cancel()
+		}
+	}()
+	upstreamReq = upstreamReq.WithContext(ctx)
 
-	var cacheFile *os.File
-	cacheFile, err = os.Open(cachePath)
+	var cacheFile cachedFile
+	var memoryObj *memoryObject
+	var memoryMeta *Metadata
 	var cacheModTime time.Time
-	if err == nil {
-		defer cacheFile.Close()
-		var stat os.FileInfo
-		stat, err = cacheFile.Stat()
-		if err != nil {
-			panic(err)
+	var cacheSize int64
+	var cacheValidated time.Time
+	policy := p.cachePolicy(cleanPath)
+	if directory {
+		policy = CacheBypass
+	}
+	if policy != CacheBypass {
+		if p.Memory != nil {
+			memoryObj = p.Memory.get(p.objectKey(cleanPath))
+		}
+		if memoryObj != nil {
+			cacheModTime = memoryObj.modTime
+			cacheSize = int64(len(memoryObj.data))
+			memoryMeta, cacheValidated = memoryObj.state()
+			upstreamReq.Header.Set("If-Modified-Since", cacheModTime.Format(http.TimeFormat))
+		} else {
+			cacheFile, err = p.openCachedFile(cachePath)
+			// objects in cold storage are not promoted in dry runs
+			coldStorage := p.ColdStorage != nil && !p.DryRun
+			if os.IsNotExist(err) && coldStorage && p.headFromCache(r, policy) && p.serveHeadFromMetadata(w, r, cleanPath) {
+				cacheState = cacheHit
+				p.count(r, &p.stats.hits)
+				return
+			}
+			if os.IsNotExist(err) && coldStorage {
+				err = p.promote(r.Context(), cleanPath, cachePath)
+				if err == nil {
+					cacheFile, err = p.openCachedFile(cachePath)
+				} else if err != ErrObjectNotFound {
+					p.logger().Error("promote failed", "path", cleanPath, "err", err)
+				}
+			}
+			if err == nil {
+				defer cacheFile.Close()
+				var stat os.FileInfo
+				stat, err = cacheFile.Stat()
+				if err != nil {
+					statusError(w, r, http.StatusInternalServerError)
+					p.logger().Error("cannot stat cached file", "file", cachePath, "err", err)
+					return
+				}
+				cacheModTime = stat.ModTime().UTC()
+				cacheSize = stat.Size()
+				upstreamReq.Header.Set("If-Modified-Since", cacheModTime.Format(http.TimeFormat))
+			} else if !os.IsNotExist(err) && err != ErrObjectNotFound {
+				p.logger().Error("cannot open cached file", "file", cachePath, "err", err)
+			}
 		}
-		cacheModTime = stat.ModTime().UTC()
-		upstreamReq.Header.Set("If-Modified-Since", cacheModTime.Format(http.TimeFormat))
-	} else if !os.IsNotExist(err) {
-		log.Printf("open %s: %v", cachePath, err)
 	}
 
-	var upstreamResp *http.Response
-	upstreamResp, err = p.client.Do(upstreamReq)
-	if err != nil {
-		statusError(w, http.StatusBadGateway)
-		log.Printf("Error performing request %s: %v", upstreamReq.URL, err)
+	haveCached := memoryObj != nil || cacheFile != nil
+	if acceptEncoding := r.Header.Get("Accept-Encoding"); acceptEncoding != "" && !haveCached && !p.rewritesListing(r) {
+		// encoded responses are relayed rather than cached; cached objects
+		// are validated against their plain form
+		upstreamReq.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	if !haveCached && onlyIfCached(r) {
+		statusError(w, r, http.StatusGatewayTimeout)
 		return
 	}
-	if upstreamResp.StatusCode == http.StatusNotModified {
-		log.Printf("serving locally cached %s", cachePath)
-		http.ServeContent(w, r, path.Base(cachePath), cacheModTime, cacheFile)
+	if !haveCached && p.NegativeTTL > 0 && policy != CacheBypass && !p.DryRun {
+		if status := p.negative.get(cleanPath, p.now()); status != 0 {
+			p.logger().Debug("known to be missing", "path", cleanPath, "status", status)
+			cacheState = cacheHit
+			statusError(w, r, status)
+			return
+		}
+	}
+	var cacheMeta *Metadata
+	if memoryObj != nil {
+		cacheMeta = memoryMeta
+	} else if haveCached {
+		cacheMeta = p.cachedMetadata(cleanPath)
+	}
+	if memoryObj == nil && haveCached {
+		cacheValidated = p.lastValidated(cleanPath, cacheMeta)
+	}
+	if cacheMeta != nil && cacheMeta.ETag != "" {
+		upstreamReq.Header.Set("If-None-Match", cacheMeta.ETag)
+	}
+	if p.DryRun {
+		cacheState = cacheBypass
+		var cached *cachedCopy
+		if haveCached {
+			cached = &cachedCopy{meta: cacheMeta, modTime: cacheModTime, size: cacheSize, validated: cacheValidated}
+		}
+		p.serveDryRun(w, r, upstreamReq, cleanPath, policy, cached)
 		return
 	}
-
-	upstreamLastModified, modTimeErr := time.Parse(http.TimeFormat, upstreamResp.Header.Get("Last-Modified"))
-	if modTimeErr != nil {
-		// log.Println("upstream does not provide Last-Modified for", cleanPath)
+	finishFetch := func() {}
+	if !haveCached && r.Method == http.MethodGet && policy != CacheBypass {
+		var served bool
+		served, finishFetch = p.coalesce(w, r, cleanPath, cachePath)
+		if served {
+			cacheState = cacheMiss
+			return
+		}
+		defer finishFetch()
 	}
-
-	hasAcceptRangeBytes := false
-	for _, val := range upstreamResp.Header["Accept-Ranges"] {
-		if val == "bytes" {
-			hasAcceptRangeBytes = true
-			break
+	var upstreamResp *http.Response
+	// stale is the warning of a response served from the cache without
+	// validating it
+	var stale string
+	switch {
+	case haveCached && p.headFromCache(r, policy):
+		// served from the cache without validating it
+	case haveCached && policy == CacheDefault && p.fresh(cleanPath, cacheMeta, cacheValidated):
+		// served from the cache within its freshness lifetime
+	case haveCached && p.serveStaleWhileRevalidate(r, policy, cacheValidated):
+		stale = staleWarning
+		p.revalidate(cleanPath)
+	case !haveCached || policy != CacheForever:
+		if !haveCached && r.Method == http.MethodGet && policy != CacheBypass && len(p.Peers) > 0 {
+			upstreamResp = p.fromPeers(upstreamReq, cleanPath)
+		}
+		if upstreamResp == nil {
+			upstreamResp, err = p.doUpstream(upstreamReq)
+		} else {
+			err = nil
+		}
+		canServeStale := haveCached && p.MaxStale > 0 && p.staleUsable(cacheValidated)
+		if err == nil && upstreamResp.StatusCode >= 500 && canServeStale {
+			p.logger().Warn("upstream failed, serving stale cached copy", "path", cleanPath, "status", upstreamResp.Status)
+			upstreamResp.Body.Close()
+			upstreamResp = nil
+			stale = revalidationFailedWarning
+		} else if err != nil && canServeStale {
+			p.logger().Warn("upstream failed, serving stale cached copy", "url", upstreamReq.URL, "err", err)
+			stale = revalidationFailedWarning
+		} else if err != nil {
+			statusError(w, r, http.StatusBadGateway)
+			p.logger().Error("upstream request failed", "url", upstreamReq.URL, "err", err)
+			return
 		}
 	}
-	if !hasAcceptRangeBytes {
-		// log.Println("upstream does not provide Accept-Ranges: bytes for", cleanPath)
+	if upstreamResp != nil && !directory {
+		if location := p.directoryRedirect(cleanPath, upstreamResp); location != "" {
+			upstreamResp.Body.Close()
+			cacheState = cacheBypass
+			p.logger().Debug("redirecting to directory", "path", cleanPath, "location", location)
+			http.Redirect(w, r, location, http.StatusMovedPermanently)
+			return
+		}
+	}
+	if upstreamResp == nil || upstreamResp.StatusCode == http.StatusNotModified ||
+		haveCached && policy != CacheRevalidate && p.upstreamUnchanged(cleanPath, upstreamResp, cacheModTime, cacheSize) {
+		if upstreamResp != nil {
+			upstreamResp.Body.Close()
+		}
+		p.count(r, &p.stats.hits)
+		switch {
+		case stale != "":
+			cacheState = cacheStale
+		case upstreamResp == nil:
+			cacheState = cacheHit
+		default:
+			cacheState = cacheRevalidated
+		}
+		if p.Metadata != nil && cacheMeta == nil {
+			cacheMeta = &Metadata{}
+		}
+		validated := cacheValidated
+		if upstreamResp != nil {
+			validated = p.now()
+			// hits are counted in objectStats, so the metadata is only
+			// written when the upstream tells something new
+			if cacheMeta != nil {
+				cacheMeta.Expires = freshUntil(upstreamResp.Header, validated)
+			}
+			p.recordValidated(cleanPath, cacheMeta, validated)
+		}
+		defer p.chargeGroup(p.clientGroup(r), cleanPath, cacheSize, true)
+		if memoryObj != nil {
+			// hits from memory read neither from the disk
+			defer memoryObj.setState(cacheMeta, validated)
+		}
+		etag := cachedETag(cacheMeta, cacheSize, cacheModTime)
+		w.Header().Set("ETag", etag)
+		// clients that requested the object while it was downloaded got
+		// the tag derived from size and modification time
+		if etag != makeETag(cacheSize, cacheModTime) && writeNotModified(w, r, makeETag(cacheSize, cacheModTime)) {
+			return
+		}
+		var contentType string
+		if memoryObj != nil {
+			contentType = memoryObj.contentType
+		} else {
+			contentType = p.cachedContentType(cachePath, cacheMeta)
+		}
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		if stale != "" {
+			p.setStaleHeaders(w.Header(), stale, cacheValidated)
+		}
+		p.touch(cachePath, cacheModTime)
+		cw, finishCompress := p.compressCached(w, r, contentType, cacheSize)
+		defer finishCompress()
+		if memoryObj != nil {
+			p.logger().Debug("serving from memory", "path", cleanPath)
+			http.ServeContent(cw, r, path.Base(cachePath), cacheModTime, bytes.NewReader(memoryObj.data))
+			return
+		}
+		p.logger().Debug("serving locally cached", "file", cachePath)
+		if p.Memory != nil && p.Memory.accepts(cacheSize) {
+			var data []byte
+			data, err = ioutil.ReadAll(cacheFile)
+			if err == nil && int64(len(data)) == cacheSize {
+				memoryObj = &memoryObject{key: p.objectKey(cleanPath), data: data, modTime: cacheModTime, contentType: contentType}
+				memoryObj.setState(cacheMeta, validated)
+				p.Memory.add(memoryObj)
+			}
+			_, err = cacheFile.Seek(0, io.SeekStart)
+			if err != nil {
+				statusError(w, r, http.StatusInternalServerError)
+				p.logger().Error("seek failed", "file", cachePath, "err", err)
+				return
+			}
+		}
+		http.ServeContent(cw, r, path.Base(cachePath), cacheModTime, cacheFile)
+		return
+	}
+	if memoryObj != nil {
+		p.Memory.remove(p.objectKey(cleanPath))
 	}
 
-	if r.Method == http.MethodGet && upstreamResp.StatusCode == http.StatusOK && hasAcceptRangeBytes && upstreamResp.ContentLength != -1 && modTimeErr == nil {
-		log.Println(cleanPath, "is cachable")
-		i, _ := p.objectHandles.LoadOrStore(
-			cleanPath,
-			&objectHandle{proxy: p, cleanPath: cleanPath},
-		)
+	upstreamLastModified, modTimeErr := time.Parse(http.TimeFormat, upstreamResp.Header.Get("Last-Modified"))
+	if p.uncacheable(r, policy, cleanPath, upstreamResp) == "" {
+		p.logger().Debug("cachable", "path", cleanPath)
+		cacheLastModified := upstreamLastModified
+		if modTimeErr != nil {
+			cacheLastModified = p.now().UTC().Truncate(time.Second)
+		}
+		client := clientHost(r)
+		i, loaded := p.objectHandles.Load(cleanPath)
+		if !loaded {
+			release, status := p.reserveDownload(client)
+			switch status {
+			case http.StatusServiceUnavailable:
+				upstreamResp.Body.Close()
+				p.logger().Warn("too many downloads, rejecting", "path", cleanPath)
+				serviceUnavailable(w, r, p.RetryAfter)
+				return
+			case http.StatusTooManyRequests:
+				upstreamResp.Body.Close()
+				p.logger().Warn("too many downloads for client, rejecting", "path", cleanPath, "remote", client)
+				tooManyRequests(w, r, p.RetryAfter)
+				return
+			}
+			i, loaded = p.objectHandles.LoadOrStore(
+				cleanPath,
+				&objectHandle{proxy: p, cleanPath: cleanPath, client: client, release: release},
+			)
+			if loaded {
+				// another request started the download meanwhile
+				release()
+			}
+		}
 		handle := i.(*objectHandle)
 		var rd ReadSeekCloser
-		rd, err = handle.Get(upstreamResp.Body, upstreamLastModified, upstreamResp.ContentLength, cachePath)
-		if err != nil {
-			statusError(w, http.StatusInternalServerError)
-			log.Printf("Cannot get %s: %v", cleanPath, err)
+		meta := &Metadata{
+			ETag:         upstreamResp.Header.Get("ETag"),
+			LastModified: upstreamResp.Header.Get("Last-Modified"),
+			Group:        p.clientGroup(r),
+			// the target of any redirects followed
+			URL:         upstreamResp.Request.URL.String(),
+			ContentType: upstreamResp.Header.Get("Content-Type"),
+			Size:        upstreamResp.ContentLength,
+			Expires:     freshUntil(upstreamResp.Header, p.now()),
+		}
+		var digests []*expectedDigest
+		if p.VerifyDigests {
+			digests = expectedDigests(upstreamResp.Header)
+		}
+		if p.VerifyPackages {
+			if digest := p.packageDigest(cleanPath); digest != nil {
+				digests = append(digests, digest)
+			}
+		}
+		if digest := p.contentDigest(cleanPath); digest != nil {
+			digests = append(digests, digest)
+		}
+		body := upstreamResp.Body
+		if p.DeltaTransfer && cacheFile != nil {
+			delta, digest, err := p.deltaBody(cleanPath, cachePath, upstreamResp)
+			if err == nil {
+				upstreamResp.Body.Close()
+				body = delta
+				digests = append(digests, digest)
+			} else if err != errNoDelta {
+				p.logger().Warn("delta transfer failed", "path", cleanPath, "err", err)
+			}
+		}
+		// the download is canceled once complete, or after DownloadTimeout,
+		// rather than when the client goes away
+		detach()
+		body = &cancelOnClose{ReadCloser: body, cancel: cancel}
+		rd, err = handle.Get(body, cacheLastModified, upstreamResp.ContentLength, meta, digests, cachePath)
+		if err == errCacheLocked {
+			p.logger().Debug("being downloaded by another host", "path", cleanPath)
+		} else if err != nil {
+			statusError(w, r, http.StatusInternalServerError)
+			p.logger().Error("cannot get", "path", cleanPath, "err", err)
+			return
+		} else {
+			detached = true
+			cacheState = cacheMiss
+			finishFetch()
+			p.count(r, &p.stats.misses)
+			w.Header().Set("ETag", makeETag(upstreamResp.ContentLength, cacheLastModified))
+			if meta.ContentType != "" {
+				w.Header().Set("Content-Type", meta.ContentType)
+			}
+			p.varyOnEncoding(w, meta.ContentType, upstreamResp.ContentLength)
+			if !p.forwardRange(w, r, handle) {
+				http.ServeContent(w, r, path.Base(cleanPath), cacheLastModified, rd)
+			}
+			rd.Close()
 			return
 		}
-		http.ServeContent(w, r, path.Base(cleanPath), upstreamLastModified, rd)
-		rd.Close()
-		return
 	}
 
-	log.Println("not caching", cleanPath)
+	// requests waiting for this one ask the upstream themselves rather than
+	// wait for the relay to finish
+	finishFetch()
+	p.logger().Debug("not caching", "path", cleanPath)
+	cacheState = cacheBypass
+	if p.NegativeTTL > 0 && policy != CacheBypass && isNegativeStatus(upstreamResp.StatusCode) {
+		p.negative.add(cleanPath, upstreamResp.StatusCode, p.now(), p.now().Add(p.NegativeTTL))
+	}
+	p.count(r, &p.stats.passThrough)
+	if r.Method == http.MethodHead && p.PrefetchOnHead && policy != CacheBypass && upstreamResp.StatusCode == http.StatusOK {
+		p.Prefetch(cleanPath)
+	}
+	p.relay(w, r, upstreamResp, cleanPath)
+}
+
+// relay sends upstreamResp, the response of the upstream to the request for
+// the object at cleanPath made for r, to the client without caching it.
+func (p *CachingReverseProxy) relay(w http.ResponseWriter, r *http.Request, upstreamResp *http.Response, cleanPath string) {
+	upstreamLastModified, modTimeErr := time.Parse(http.TimeFormat, upstreamResp.Header.Get("Last-Modified"))
+	if p.rewritesListing(r) {
+		if err := p.rewriteListing(upstreamResp); err != nil {
+			upstreamResp.Body.Close()
+			statusError(w, r, http.StatusBadGateway)
+			p.logger().Error("cannot read listing", "path", cleanPath, "err", err)
+			return
+		}
+	}
+	if upstreamResp.StatusCode == http.StatusOK && upstreamResp.ContentLength != -1 && modTimeErr == nil && !contentEncoded(upstreamResp) {
+		etag := makeETag(upstreamResp.ContentLength, upstreamLastModified)
+		w.Header().Set("ETag", etag)
+		if writeNotModified(w, r, etag) {
+			upstreamResp.Body.Close()
+			return
+		}
+	}
 	if upstreamResp.ContentLength != -1 {
 		w.Header().Set("Content-Length", strconv.FormatInt(upstreamResp.ContentLength, 10))
 	}
 	if modTimeErr == nil {
 		w.Header().Set("Last-Modified", upstreamResp.Header.Get("Last-Modified"))
 	}
+	if _, ok := upstreamResp.Header["Location"]; ok {
+		w.Header().Set("Location", p.rewriteLocation(upstreamResp))
+	}
 	if contentType, ok := upstreamResp.Header["Content-Type"]; ok {
 		w.Header()["Content-Type"] = contentType
 	}
-	if hasAcceptRangeBytes {
+	if challenge, ok := upstreamResp.Header["Www-Authenticate"]; ok && upstreamResp.StatusCode == http.StatusUnauthorized {
+		// clients authenticating with the upstream need its challenge
+		w.Header()["Www-Authenticate"] = challenge
+	}
+	if contentEncoded(upstreamResp) {
+		w.Header()["Content-Encoding"] = upstreamResp.Header["Content-Encoding"]
+	}
+	if vary, ok := upstreamResp.Header["Vary"]; ok {
+		w.Header()["Vary"] = vary
+	}
+	appendVia(w.Header(), upstreamResp.Header, p.viaEntry(upstreamResp.ProtoMajor, upstreamResp.ProtoMinor))
+	if acceptsRanges(upstreamResp) {
 		w.Header().Set("Accept-Ranges", "bytes")
 	}
 	w.WriteHeader(upstreamResp.StatusCode)
 	if r.Method == http.MethodGet {
-		_, err = io.Copy(w, upstreamResp.Body)
+		_, err := io.Copy(w, upstreamResp.Body)
 		if err != nil {
-			log.Println("error copying response", err)
+			p.logger().Debug("error copying response", "path", cleanPath, "err", err)
 		}
 		upstreamResp.Body.Close()
 	}
 }
 
+// uncacheable returns why upstreamResp, the response of the upstream to the
+// request for the object at cleanPath made for r, cannot be cached with
+// policy, or "" if it can.
+func (p *CachingReverseProxy) uncacheable(r *http.Request, policy CachePolicy, cleanPath string, upstreamResp *http.Response) string {
+	_, modTimeErr := time.Parse(http.TimeFormat, upstreamResp.Header.Get("Last-Modified"))
+	switch {
+	case r.Method != http.MethodGet:
+		return "not a GET request"
+	case isDirectoryRequest(r):
+		return "directory"
+	case policy == CacheBypass:
+		return "bypassed by a cache rule"
+	case upstreamResp.StatusCode != http.StatusOK:
+		return "status " + strconv.Itoa(upstreamResp.StatusCode)
+	// objects cached forever are never revalidated or, once complete,
+	// requested in ranges, so they need neither
+	case (!acceptsRanges(upstreamResp) || modTimeErr != nil) && policy != CacheForever:
+		return "no Accept-Ranges or Last-Modified"
+	case upstreamResp.ContentLength == -1:
+		return "no Content-Length"
+	case contentEncoded(upstreamResp):
+		return "encoded"
+	case !p.fitsCache(cleanPath, upstreamResp.ContentLength):
+		return "too large"
+	}
+	return ""
+}
+
+// acceptsRanges reports whether the upstream sending resp accepts byte range
+// requests.
+func acceptsRanges(resp *http.Response) bool {
+	for _, val := range resp.Header["Accept-Ranges"] {
+		if val == "bytes" {
+			return true
+		}
+	}
+	return false
+}
+
+// pathWithinLimits reports whether urlPath is within MaxPathLength and
+// MaxPathDepth.
+func (p *CachingReverseProxy) pathWithinLimits(urlPath string) bool {
+	if p.MaxPathLength > 0 && len(urlPath) > p.MaxPathLength {
+		return false
+	}
+	if p.MaxPathDepth > 0 && strings.Count(path.Clean("/"+urlPath), "/") > p.MaxPathDepth {
+		return false
+	}
+	return true
+}
+
+// touch records an access to the cached file at cachePath in its access time.
+func (p *CachingReverseProxy) touch(cachePath string, modTime time.Time) {
+	if err := p.cacheFS().Chtimes(cachePath, p.now(), modTime); err != nil && !os.IsNotExist(err) {
+		p.logger().Warn("cannot update access time", "file", cachePath, "err", err)
+	}
+}
+
 type objectHandle struct {
-	proxy          *CachingReverseProxy
-	cleanPath      string
+	proxy     *CachingReverseProxy
+	cleanPath string
+	// client is the IP address of the client whose request started the
+	// download.
+	client string
+	// release releases the download reserved for the handle, once it is
+	// forgotten.
+	release        func()
 	once           sync.Once
+	err            error
 	tempPath       string
 	trackingWriter *trackingWriter
+	// staged is whether tempPath is in the StagingArea rather than in the
+	// CacheFS.
+	staged bool
+	// body is the upstream response being downloaded, of the version
+	// modified at modTime.
+	body    io.Closer
+	modTime time.Time
+	// contentType is the Content-Type sent by the upstream.
+	contentType string
 }
 
-func (h *objectHandle) Get(body io.ReadCloser, modTime time.Time, size int64, cachePath string) (ReadSeekCloser, error) {
-	var err error
+func (h *objectHandle) Get(body io.ReadCloser, modTime time.Time, size int64, meta *Metadata, digests []*expectedDigest, cachePath string) (ReadSeekCloser, error) {
 	shouldCloseBody := true
 	defer func() {
 		if shouldCloseBody {
@@ -157,72 +945,243 @@ func (h *objectHandle) Get(body io.ReadCloser, modTime time.Time, size int64, ca
 		}
 	}()
 	cacheDir := path.Dir(cachePath)
+	fsys := h.proxy.cacheFS()
 
 	h.once.Do(func() {
-		err = os.MkdirAll(cacheDir, 0755)
-		if err != nil {
-			log.Printf("Could not create directory %q for cached file: %v", cacheDir, err)
+		var lock *lockFile
+		defer func() {
+			if h.err != nil {
+				if lock != nil {
+					lock.release()
+				}
+				// let the next request try again
+				h.forget()
+			}
+		}()
+		h.err = fsys.MkdirAll(cacheDir, 0755)
+		if h.err != nil {
+			h.proxy.logger().Error("cannot create directory for cached file", "dir", cacheDir, "err", h.err)
 			return
 		}
-		var tempFile *os.File
-		tempFile, err = ioutil.TempFile(cacheDir, path.Base(cachePath)+".part.*")
-		if err != nil {
-			log.Println("Could not create tempfile:", err)
-			return
+		if h.proxy.NFSSafe {
+			lock, h.err = acquireLock(cachePath + lockSuffix)
+			if h.err != nil {
+				return
+			}
+		}
+		var tempFile CacheFile
+		tempFile, resumeFrom := claimPartial(fsys, cachePath, modTime, size)
+		if tempFile != nil {
+			rangeBody, err := h.proxy.resumeBody(h.cleanPath, resumeFrom, size, meta.LastModified)
+			if err == nil {
+				h.proxy.logger().Info("resuming download", "path", h.cleanPath, "offset", resumeFrom)
+				body.Close()
+				body = rangeBody
+			} else {
+				h.proxy.logger().Warn("cannot resume download", "path", h.cleanPath, "err", err)
+				tempFile.Close()
+				fsys.Remove(tempFile.Name())
+				tempFile, resumeFrom = nil, 0
+			}
+		}
+		staged := false
+		if tempFile == nil {
+			staged = h.proxy.Staging.reserve(size)
+			if staged {
+				// the staging area is a directory of the operating system
+				var f *os.File
+				f, h.err = ioutil.TempFile(h.proxy.Staging.dir, downloadTempPattern(cachePath, modTime))
+				if h.err == nil {
+					tempFile = f
+				}
+			} else {
+				tempFile, h.err = createTemp(fsys, cacheDir, downloadTempPattern(cachePath, modTime))
+			}
+			if h.err != nil {
+				if staged {
+					h.proxy.Staging.release(size)
+				}
+				h.proxy.logger().Error("cannot create temporary file", "err", h.err)
+				return
+			}
 		}
 		h.tempPath = tempFile.Name()
+		h.staged = staged
 		h.trackingWriter = newTrackingWriter(tempFile, size)
+		h.trackingWriter.written = resumeFrom
 		shouldCloseBody = false
+		if h.proxy.ColdStorage != nil && h.proxy.ColdWriteThrough {
+			upload, uerr := openFS(h.tempFS(), h.tempPath)
+			if uerr != nil {
+				h.proxy.logger().Error("cannot open for write-through", "err", uerr)
+			} else {
+				go h.proxy.writeThrough(h.cleanPath, &partiallyDownloadedFile{
+					wrapped:        upload,
+					trackingWriter: h.trackingWriter,
+				}, size, modTime)
+			}
+		}
+		body = h.proxy.resumable(body, h.cleanPath, resumeFrom, size, meta.LastModified)
+		h.body = body
+		h.modTime = modTime
+		h.contentType = meta.ContentType
+		h.proxy.addDownload(h)
 		go func() {
+			defer h.proxy.removeDownload(h)
 			defer body.Close()
-			log.Println("starting download:", h.tempPath)
+			if staged {
+				defer h.proxy.Staging.release(size)
+			}
+			h.proxy.logger().Info("starting download", "path", h.cleanPath, "file", h.tempPath)
+			var hashes []io.Writer
+			digest := sha256.New()
+			if h.proxy.Metadata != nil || h.proxy.Dedupe {
+				hashes = append(hashes, digest)
+			}
+			if len(digests) > 0 {
+				hashes = append(hashes, digestWriter(digests))
+			}
 			var err error
-			n, err := io.Copy(h.trackingWriter, body)
+			if resumeFrom > 0 {
+				err = hashPrefix(fsys, h.tempPath, resumeFrom, io.MultiWriter(hashes...))
+			}
+			n := resumeFrom
+			if err == nil {
+				w := io.MultiWriter(append([]io.Writer{h.trackingWriter}, hashes...)...)
+				var copied int64
+				copied, err = io.Copy(w, h.proxy.limitDownload(&countingReader{body, &h.proxy.stats.downloaded}))
+				n += copied
+			}
+			// downloads cut short are kept to be resumed
+			resumable := n > 0 && n < size
+			if err == nil && n != size {
+				err = fmt.Errorf("expected %d bytes, got %d", size, n)
+			}
+			if err == nil {
+				err = verifyDigests(digests)
+			}
 			if err != nil {
-				log.Println("Unexpected error downloading", h.tempPath)
+				h.proxy.logger().Error("download failed", "path", h.cleanPath, "file", h.tempPath, "err", err)
+				h.trackingWriter.err = err
 			} else {
-				log.Printf("Finished downloading %s, size: %d", h.tempPath, n)
+				h.proxy.logger().Info("finished download", "path", h.cleanPath, "file", h.tempPath, "size", n)
+				meta.SHA256 = hex.EncodeToString(digest.Sum(nil))
 
-				err = os.Chtimes(h.tempPath, time.Now(), modTime)
+				err = h.tempFS().Chtimes(h.tempPath, h.proxy.now(), modTime)
 				if err != nil {
-					log.Println("Cannot change modtime of", h.tempPath)
+					h.proxy.logger().Warn("cannot change modification time", "file", h.tempPath, "err", err)
 				}
 			}
 			logIfErr := func(msg string, err error) {
 				if err != nil {
-					log.Println(msg, h.tempPath, err)
+					h.proxy.logger().Error(msg+" failed", "file", h.tempPath, "err", err)
+				}
+			}
+			if err == nil && h.proxy.NFSSafe && !staged {
+				// make the content visible to other hosts before the rename
+				if f, ok := h.trackingWriter.wrapped.(CacheFile); ok {
+					err = f.Sync()
+					logIfErr("sync", err)
 				}
 			}
 			logIfErr("close", h.trackingWriter.Close())
 
+			if err == nil && h.proxy.PrefetchDBUpdates && isPacmanDB(h.cleanPath) {
+				h.proxy.prefetchDBUpdate(h.cleanPath, cachePath, h.tempFS(), h.tempPath)
+			}
+			if err == nil && staged {
+				err = h.proxy.spill(h.tempPath, cachePath, modTime)
+				h.proxy.forgetOpenFile(cachePath)
+				logIfErr("spill", err)
+				if err == nil {
+					// readers opening the staged file from now on find the
+					// cached one
+					logIfErr("remove", os.Remove(h.tempPath))
+				}
+			} else if err == nil {
+				h.proxy.recordReplace(cachePath, size)
+				err = fsys.Rename(h.tempPath, cachePath)
+				h.proxy.forgetOpenFile(cachePath)
+				logIfErr("rename", err)
+			}
 			if err == nil {
-				logIfErr("rename", os.Rename(h.tempPath, cachePath))
+				if h.proxy.Dedupe {
+					h.proxy.dedupe(cachePath, meta.SHA256)
+				}
+				if h.proxy.Metadata != nil {
+					meta.Downloaded = h.proxy.now().UTC()
+					logIfErr("record metadata", h.proxy.Metadata.Put(h.proxy.objectKey(h.cleanPath), meta))
+				} else {
+					h.proxy.recordContentType(cachePath, meta.ContentType)
+					h.proxy.validated.Store(h.proxy.objectKey(h.cleanPath), h.proxy.now())
+				}
+				h.proxy.forgetGroup(h.cleanPath)
+				h.proxy.chargeGroup(meta.Group, h.cleanPath, size, false)
+				h.proxy.checkCacheSize()
+				if h.proxy.AdvertiseToPeers {
+					go h.proxy.advertise(h.cleanPath)
+				}
+			} else if resumable && !staged && keepPartial(fsys, h.tempPath, cachePath, modTime) == nil {
+				h.proxy.logger().Info("kept partial download to resume", "path", h.cleanPath, "size", n)
 			} else {
-				logIfErr("remove", os.Remove(h.tempPath))
+				logIfErr("remove", h.tempFS().Remove(h.tempPath))
+			}
+			if lock != nil {
+				lock.release()
 			}
 
-			h.proxy.objectHandles.Delete(h.cleanPath)
+			h.forget()
 		}()
 	})
 
-	var rfile *os.File
-	rfile, err = os.Open(h.tempPath)
+	if h.err != nil {
+		if h.err == errCacheLocked {
+			// the caller serves the body without caching
+			shouldCloseBody = false
+		}
+		return nil, h.err
+	}
+	return h.open(cachePath)
+}
+
+// tempFS returns the filesystem of the temporary file of h.
+func (h *objectHandle) tempFS() CacheFS {
+	if h.staged {
+		return osFS{}
+	}
+	return h.proxy.cacheFS()
+}
+
+// forget removes h from the handles of the proxy, so that the next request
+// for its object opens the cached file or starts another download, and
+// releases the download reserved for it.
+func (h *objectHandle) forget() {
+	h.proxy.objectHandles.Delete(h.cleanPath)
+	if h.release != nil {
+		h.release()
+	}
+}
+
+// open returns a reader of the object downloaded by h, following the
+// download if it is in progress.
+func (h *objectHandle) open(cachePath string) (ReadSeekCloser, error) {
+	rfile, err := openFS(h.tempFS(), h.tempPath)
 	if err == nil {
-		log.Println("tracking", h.tempPath)
+		h.proxy.logger().Debug("tracking", "file", h.tempPath)
 		return &partiallyDownloadedFile{
 			wrapped:        rfile,
 			trackingWriter: h.trackingWriter,
 		}, nil
 	}
 	if os.IsNotExist(err) {
-		log.Println("using downloaded", cachePath)
-		rfile, err = os.Open(cachePath)
+		h.proxy.logger().Debug("using downloaded", "file", cachePath)
+		rfile, err = h.proxy.openCached(cachePath)
 		if err == nil {
 			return rfile, nil
 		}
-		log.Println("unexpected error opening", cachePath)
+		h.proxy.logger().Error("cannot open", "file", cachePath, "err", err)
 	} else {
-		log.Println("unexpected error opening", h.tempPath)
+		h.proxy.logger().Error("cannot open", "file", h.tempPath, "err", err)
 	}
 	return nil, err
 }
@@ -233,6 +1192,9 @@ type trackingWriter struct {
 	written       int64
 	updateWritten chan int64
 	done          chan struct{}
+	// err is the reason the download failed. It is set before done is
+	// closed.
+	err error
 }
 
 func newTrackingWriter(w io.WriteCloser, size int64) *trackingWriter {
@@ -277,23 +1239,40 @@ type partiallyDownloadedFile struct {
 	wrapped        ReadSeekCloser
 	trackingWriter *trackingWriter
 	readyPos       int64
+	finished       bool
 	pos            int64
 	seekBeforeRead bool
 }
 
+// available returns the position up to which data can be read. The last byte
+// is held back until the download finished successfully, so that readers of
+// a failed download get an error instead of a complete response.
+func (r *partiallyDownloadedFile) available() int64 {
+	if !r.finished && r.readyPos >= r.trackingWriter.size {
+		return r.trackingWriter.size - 1
+	}
+	return r.readyPos
+}
+
 func (r *partiallyDownloadedFile) Read(p []byte) (n int, err error) {
 	if r.pos >= r.trackingWriter.size {
 		return 0, io.EOF
 	}
-loop:
-	for r.pos >= r.readyPos {
+	for r.pos >= r.available() {
+		if r.finished {
+			// the download finished before reaching size
+			return 0, io.ErrUnexpectedEOF
+		}
 		select {
 		case r.readyPos = <-r.trackingWriter.updateWritten:
 		case <-r.trackingWriter.done:
 			r.readyPos = r.trackingWriter.written
-			break loop
+			r.finished = true
 		}
 	}
+	if r.finished && r.trackingWriter.err != nil {
+		return 0, r.trackingWriter.err
+	}
 	if r.seekBeforeRead {
 		r.pos, err = r.wrapped.Seek(r.pos, io.SeekStart)
 		if err != nil {
@@ -301,8 +1280,8 @@ loop:
 		}
 		r.seekBeforeRead = false
 	}
-	if r.readyPos-r.pos < int64(len(p)) {
-		p = p[:r.readyPos-r.pos]
+	if r.available()-r.pos < int64(len(p)) {
+		p = p[:r.available()-r.pos]
 	}
 	n, err = r.wrapped.Read(p)
 	r.pos += int64(n)
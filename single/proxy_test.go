@@ -0,0 +1,188 @@
+package single
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingUpstream serves cacheable objects of size bytes, answering
+// conditional and range requests, and counts the requests it receives.
+func countingUpstream(size int, requests *atomic.Int64) *httptest.Server {
+	return slowUpstream(size, 0, requests)
+}
+
+// slowUpstream is a countingUpstream pausing before each read of the
+// objects it serves, so that their downloads stay in progress.
+func slowUpstream(size int, pause time.Duration, requests *atomic.Int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.ServeContent(w, r, "", time.Unix(1e9, 0), pausingReader{bytes.NewReader(make([]byte, size)), pause})
+	}))
+}
+
+type pausingReader struct {
+	*bytes.Reader
+	pause time.Duration
+}
+
+func (r pausingReader) Read(b []byte) (int, error) {
+	time.Sleep(r.pause)
+	return r.Reader.Read(b)
+}
+
+// newMemProxy returns a proxy for upstream caching objects in memory, and
+// the filesystem holding them.
+func newMemProxy(t *testing.T, upstream string) (*CachingReverseProxy, *MemFS) {
+	t.Helper()
+	fsys := NewMemFS()
+	p, err := NewCachingReverseProxy(upstream, "/cache", WithCacheFS(fsys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, fsys
+}
+
+// putObject caches an object of size bytes at cleanPath in fsys, the cache
+// filesystem of p, modified at the Unix epoch.
+func putObject(t *testing.T, p *CachingReverseProxy, fsys CacheFS, cleanPath string, size int) {
+	t.Helper()
+	cachePath := path.Join(p.cacheRoot(), cleanPath)
+	if err := fsys.MkdirAll(path.Dir(cachePath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileFS(fsys, cachePath, make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Chtimes(cachePath, time.Unix(0, 0), time.Unix(0, 0)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	var requests atomic.Int64
+	upstream := slowUpstream(1<<20, 5*time.Millisecond, &requests)
+	defer upstream.Close()
+	p, _ := newMemProxy(t, upstream.URL)
+	const clients = 8
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/object", nil))
+			if w.Code != http.StatusOK || w.Body.Len() != 1<<20 {
+				t.Errorf("got %d with %d bytes, want %d with %d bytes", w.Code, w.Body.Len(), http.StatusOK, 1<<20)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := requests.Load(); n != 1 {
+		t.Errorf("upstream received %d requests, want 1", n)
+	}
+	// the object is then served from the cache after validating it
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/object", nil))
+	if w.Code != http.StatusOK || w.Body.Len() != 1<<20 {
+		t.Errorf("got %d with %d bytes, want %d with %d bytes", w.Code, w.Body.Len(), http.StatusOK, 1<<20)
+	}
+	if hits := p.stats.hits.Load(); hits != 1 {
+		t.Errorf("%d hits, want 1", hits)
+	}
+}
+
+func TestUncacheable(t *testing.T) {
+	p, _ := newMemProxy(t, "http://upstream.example")
+	p.MaxObjectSize = 1024
+	lastModified := time.Unix(0, 0).UTC().Format(http.TimeFormat)
+	for _, test := range []struct {
+		name     string
+		method   string
+		target   string
+		policy   CachePolicy
+		status   int
+		header   http.Header
+		size     int64
+		cachable bool
+	}{
+		{"cacheable", http.MethodGet, "/a", CacheDefault, http.StatusOK, http.Header{"Accept-Ranges": {"bytes"}, "Last-Modified": {lastModified}}, 10, true},
+		{"head", http.MethodHead, "/a", CacheDefault, http.StatusOK, http.Header{"Accept-Ranges": {"bytes"}, "Last-Modified": {lastModified}}, 10, false},
+		{"directory", http.MethodGet, "/a/", CacheDefault, http.StatusOK, http.Header{"Accept-Ranges": {"bytes"}, "Last-Modified": {lastModified}}, 10, false},
+		{"bypass", http.MethodGet, "/a", CacheBypass, http.StatusOK, http.Header{"Accept-Ranges": {"bytes"}, "Last-Modified": {lastModified}}, 10, false},
+		{"not found", http.MethodGet, "/a", CacheDefault, http.StatusNotFound, http.Header{"Accept-Ranges": {"bytes"}, "Last-Modified": {lastModified}}, 10, false},
+		{"no ranges", http.MethodGet, "/a", CacheDefault, http.StatusOK, http.Header{"Last-Modified": {lastModified}}, 10, false},
+		{"no last modified", http.MethodGet, "/a", CacheDefault, http.StatusOK, http.Header{"Accept-Ranges": {"bytes"}}, 10, false},
+		{"forever without validators", http.MethodGet, "/a", CacheForever, http.StatusOK, http.Header{}, 10, true},
+		{"no length", http.MethodGet, "/a", CacheDefault, http.StatusOK, http.Header{"Accept-Ranges": {"bytes"}, "Last-Modified": {lastModified}}, -1, false},
+		{"encoded", http.MethodGet, "/a", CacheDefault, http.StatusOK, http.Header{"Accept-Ranges": {"bytes"}, "Last-Modified": {lastModified}, "Content-Encoding": {"gzip"}}, 10, false},
+		{"identity", http.MethodGet, "/a", CacheDefault, http.StatusOK, http.Header{"Accept-Ranges": {"bytes"}, "Last-Modified": {lastModified}, "Content-Encoding": {"identity"}}, 10, true},
+		{"too large", http.MethodGet, "/a", CacheDefault, http.StatusOK, http.Header{"Accept-Ranges": {"bytes"}, "Last-Modified": {lastModified}}, 2048, false},
+	} {
+		r := httptest.NewRequest(test.method, test.target, nil)
+		resp := &http.Response{StatusCode: test.status, Header: test.header, ContentLength: test.size}
+		reason := p.uncacheable(r, test.policy, p.cleanRequestPath(r), resp)
+		if (reason == "") != test.cachable {
+			t.Errorf("%s: uncacheable = %q, want cachable %v", test.name, reason, test.cachable)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	var requests atomic.Int64
+	upstream := countingUpstream(100, &requests)
+	defer upstream.Close()
+	p, fsys := newMemProxy(t, upstream.URL)
+	p.DryRun = true
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/object", nil))
+		if w.Code != http.StatusOK || w.Body.Len() != 100 {
+			t.Fatalf("got %d with %d bytes, want %d with %d bytes", w.Code, w.Body.Len(), http.StatusOK, 100)
+		}
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("upstream received %d requests, want 2", n)
+	}
+	if _, err := fsys.Stat(path.Join(p.cacheRoot(), "object")); !os.IsNotExist(err) {
+		t.Errorf("object cached in a dry run: %v", err)
+	}
+}
+
+func TestInternalPathNotFound(t *testing.T) {
+	var requests atomic.Int64
+	upstream := countingUpstream(100, &requests)
+	defer upstream.Close()
+	p, fsys := newMemProxy(t, upstream.URL)
+	if err := fsys.MkdirAll(p.cacheRoot(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileFS(fsys, path.Join(p.cacheRoot(), objectStatsFile), []byte("[]")); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{
+		"/" + objectStatsFile,
+		"/dir/object.part.123",
+		"/dir/object" + sidecarSuffix,
+		"/dir/" + internalMarker + "blobs/ab",
+		"/a/../" + objectStatsFile,
+		"/%2E" + objectStatsFile[1:],
+	} {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		body, _ := io.ReadAll(w.Body)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("GET %s: got %d %q, want %d", target, w.Code, body, http.StatusNotFound)
+		}
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("upstream received %d requests, want 0", n)
+	}
+}
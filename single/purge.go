@@ -0,0 +1,167 @@
+package single
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// PathMatcher reports whether a cleaned request path matches.
+type PathMatcher func(cleanPath string) bool
+
+// RegexpMatcher returns a PathMatcher matching paths against the regular expression expr.
+func RegexpMatcher(expr string) (PathMatcher, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	return re.MatchString, nil
+}
+
+// GlobMatcher returns a PathMatcher matching paths against the shell pattern
+// pattern, as understood by path.Match.
+func GlobMatcher(pattern string) (PathMatcher, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	return func(cleanPath string) bool {
+		ok, _ := path.Match(pattern, cleanPath)
+		return ok
+	}, nil
+}
+
+// isTempFile reports whether name is an in-progress download created by objectHandle.
+func isTempFile(name string) bool {
+	return strings.Contains(name, ".part.")
+}
+
+// walkCache calls fn for every cached object with its cleaned request path and
+// its location on disk. In-progress downloads and internal files are skipped.
+func (p *CachingReverseProxy) walkCache(fn func(cleanPath, cachePath string, info os.FileInfo) error) error {
+	root := p.cacheRoot()
+	err := walkFS(p.cacheFS(), root, func(cachePath string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && cachePath != root {
+			// removed while walking, as the metadata of an evicted object
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if cachePath != root && isInternalFile(info.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isInternalFile(info.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, cachePath)
+		if err != nil {
+			return err
+		}
+		return fn("/"+filepath.ToSlash(rel), cachePath, info)
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Purge removes every cached object whose cleaned request path is matched by
+// match, and returns the matched paths. If dryRun is true, nothing is removed.
+func (p *CachingReverseProxy) Purge(match PathMatcher, dryRun bool) ([]string, error) {
+	purged := []string{}
+	if !dryRun {
+		p.negative.remove(match)
+	}
+	err := p.walkCache(func(cleanPath, cachePath string, info os.FileInfo) error {
+		if !match(cleanPath) {
+			return nil
+		}
+		if !dryRun {
+			if err := p.removeObject(cleanPath, cachePath); err != nil {
+				return err
+			}
+		}
+		purged = append(purged, cleanPath)
+		return nil
+	})
+	if err == nil && p.Dedupe && !dryRun {
+		err = p.pruneBlobs()
+	}
+	if err != nil || p.ColdStorage == nil {
+		return purged, err
+	}
+
+	purgedCold, err := p.purgeCold(context.Background(), match, dryRun)
+	seen := make(map[string]bool)
+	for _, cleanPath := range purged {
+		seen[cleanPath] = true
+	}
+	for _, cleanPath := range purgedCold {
+		if !seen[cleanPath] {
+			purged = append(purged, cleanPath)
+		}
+	}
+	return purged, err
+}
+
+// purgeObject removes the cached object for cleanPath from all tiers. It
+// reports whether the object was cached.
+func (p *CachingReverseProxy) purgeObject(cleanPath string) (bool, error) {
+	forgotten := p.negative.remove(func(k string) bool { return k == cleanPath })
+	cachePath := path.Join(p.cacheRoot(), cleanPath)
+	info, err := p.cacheFS().Lstat(cachePath)
+	if os.IsNotExist(err) {
+		if p.ColdStorage == nil {
+			return forgotten, nil
+		}
+		// the object may exist only in the cold tier
+		var body io.ReadCloser
+		body, _, err = p.ColdStorage.Open(context.Background(), p.storageKey(cleanPath))
+		if err == ErrObjectNotFound {
+			return forgotten, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		body.Close()
+		return true, p.removeObject(cleanPath, cachePath)
+	}
+	if err != nil {
+		return false, err
+	}
+	if info.IsDir() || isInternalFile(info.Name()) {
+		return false, nil
+	}
+	return true, p.removeObject(cleanPath, cachePath)
+}
+
+// removeObject removes the cached object at cleanPath from all tiers, along
+// with its metadata.
+func (p *CachingReverseProxy) removeObject(cleanPath, cachePath string) error {
+	if p.Memory != nil {
+		p.Memory.remove(p.objectKey(cleanPath))
+	}
+	p.forgetOpenFile(cachePath)
+	p.forgetGroup(cleanPath)
+	p.objectStats.forget(cleanPath)
+	p.recordRemove(cachePath)
+	if err := p.cacheFS().Remove(cachePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if p.ColdStorage != nil {
+		if err := p.ColdStorage.Delete(context.Background(), p.storageKey(cleanPath)); err != nil {
+			return err
+		}
+	}
+	if p.Metadata != nil {
+		return p.Metadata.Delete(p.objectKey(cleanPath))
+	}
+	return nil
+}
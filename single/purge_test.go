@@ -0,0 +1,174 @@
+package single
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPurge(t *testing.T) {
+	objects := []string{
+		"/core/os/x86_64/core.db",
+		"/core/os/x86_64/linux-6.1-1-x86_64.pkg.tar.zst",
+		"/extra/os/x86_64/extra.db",
+		"/extra/os/x86_64/vim-9.0-1-x86_64.pkg.tar.zst",
+	}
+	for _, test := range []struct {
+		name   string
+		regex  string
+		glob   string
+		dryRun bool
+		want   []string
+	}{
+		{name: "regex", regex: `\.db$`, want: []string{"/core/os/x86_64/core.db", "/extra/os/x86_64/extra.db"}},
+		{name: "regex dry run", regex: `\.db$`, dryRun: true, want: []string{"/core/os/x86_64/core.db", "/extra/os/x86_64/extra.db"}},
+		{name: "anchored regex", regex: `^/core/.*\.pkg\.tar\.zst$`, want: []string{"/core/os/x86_64/linux-6.1-1-x86_64.pkg.tar.zst"}},
+		{name: "glob", glob: "/extra/os/*/*", want: []string{"/extra/os/x86_64/extra.db", "/extra/os/x86_64/vim-9.0-1-x86_64.pkg.tar.zst"}},
+		{name: "no match", regex: `^/community/`, want: []string{}},
+	} {
+		p, fsys := newMemProxy(t, "http://upstream.example")
+		for _, cleanPath := range objects {
+			putObject(t, p, fsys, cleanPath, 10)
+		}
+		// internal files are never purged
+		putObject(t, p, fsys, "/core/os/x86_64/core.db"+sidecarSuffix, 10)
+		var match PathMatcher
+		var err error
+		if test.regex != "" {
+			match, err = RegexpMatcher(test.regex)
+		} else {
+			match, err = GlobMatcher(test.glob)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		purged, err := p.Purge(match, test.dryRun)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		sort.Strings(purged)
+		if !reflect.DeepEqual(purged, test.want) {
+			t.Errorf("%s: purged %q, want %q", test.name, purged, test.want)
+		}
+		for _, cleanPath := range append(objects, "/core/os/x86_64/core.db"+sidecarSuffix) {
+			_, err := fsys.Stat(path.Join(p.cacheRoot(), cleanPath))
+			removed := match(cleanPath) && !test.dryRun && !isInternalPath(cleanPath)
+			if cached := err == nil; cached == removed {
+				t.Errorf("%s: %s cached %v, want %v", test.name, cleanPath, cached, !removed)
+			}
+		}
+	}
+}
+
+func TestPurgeHandler(t *testing.T) {
+	p, fsys := newMemProxy(t, "http://upstream.example")
+	p.AdminToken = "secret"
+	putObject(t, p, fsys, "/core/os/x86_64/core.db", 10)
+	putObject(t, p, fsys, "/core/os/x86_64/linux-6.1-1-x86_64.pkg.tar.zst", 10)
+	h := p.AdminHandler()
+	for _, test := range []struct {
+		method string
+		target string
+		token  string
+		status int
+		purged []string
+	}{
+		{http.MethodPost, "/purge?regex=%5C.db%24", "", http.StatusUnauthorized, nil},
+		{http.MethodPost, "/purge?regex=%5C.db%24", "wrong", http.StatusUnauthorized, nil},
+		{http.MethodGet, "/purge?regex=%5C.db%24", "secret", http.StatusMethodNotAllowed, nil},
+		{http.MethodPost, "/purge", "secret", http.StatusBadRequest, nil},
+		{http.MethodPost, "/purge?regex=%28", "secret", http.StatusBadRequest, nil},
+		{http.MethodPost, "/purge?regex=%5C.db%24&dry_run=true", "secret", http.StatusOK, []string{"/core/os/x86_64/core.db"}},
+		{http.MethodPost, "/purge?regex=%5C.db%24", "secret", http.StatusOK, []string{"/core/os/x86_64/core.db"}},
+		{http.MethodPost, "/purge?regex=%5C.db%24", "secret", http.StatusOK, []string{}},
+	} {
+		r := httptest.NewRequest(test.method, test.target, nil)
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s %s: got %d, want %d", test.method, test.target, w.Code, test.status)
+			continue
+		}
+		if test.purged == nil {
+			continue
+		}
+		var resp purgeResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(resp.Purged, test.purged) {
+			t.Errorf("%s %s: purged %q, want %q", test.method, test.target, resp.Purged, test.purged)
+		}
+	}
+	if _, err := fsys.Stat(path.Join(p.cacheRoot(), "/core/os/x86_64/linux-6.1-1-x86_64.pkg.tar.zst")); err != nil {
+		t.Errorf("unmatched object purged: %v", err)
+	}
+}
+
+func TestDeletePurge(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, adminNetwork, _ := net.ParseCIDR("192.0.2.0/24")
+	_, otherNetwork, _ := net.ParseCIDR("198.51.100.0/24")
+	for _, test := range []struct {
+		name          string
+		token         string
+		users         map[string][]byte
+		networks      []*net.IPNet
+		noDeletePurge bool
+		auth          func(r *http.Request)
+		status        int
+	}{
+		{name: "no credentials configured", status: http.StatusMethodNotAllowed},
+		{name: "not deleting", token: "secret", noDeletePurge: true, auth: func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }, status: http.StatusMethodNotAllowed},
+		{name: "unauthenticated", token: "secret", status: http.StatusUnauthorized},
+		{name: "wrong token", token: "secret", auth: func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }, status: http.StatusUnauthorized},
+		{name: "token", token: "secret", auth: func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }, status: http.StatusOK},
+		{name: "token as password", token: "secret", auth: func(r *http.Request) { r.SetBasicAuth("any", "secret") }, status: http.StatusOK},
+		{name: "user", users: map[string][]byte{"admin": hash}, auth: func(r *http.Request) { r.SetBasicAuth("admin", "hunter2") }, status: http.StatusOK},
+		{name: "wrong password", users: map[string][]byte{"admin": hash}, auth: func(r *http.Request) { r.SetBasicAuth("admin", "hunter3") }, status: http.StatusUnauthorized},
+		{name: "admin network", token: "secret", networks: []*net.IPNet{adminNetwork}, auth: func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }, status: http.StatusOK},
+		{name: "outside the admin networks", token: "secret", networks: []*net.IPNet{otherNetwork}, auth: func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }, status: http.StatusForbidden},
+	} {
+		p, fsys := newMemProxy(t, "http://upstream.example")
+		p.AdminToken = test.token
+		p.AdminUsers = test.users
+		p.AdminNetworks = test.networks
+		p.NoDeletePurge = test.noDeletePurge
+		putObject(t, p, fsys, "/core/os/x86_64/core.db", 10)
+		r := httptest.NewRequest(http.MethodDelete, "/core/os/x86_64/core.db", nil)
+		if test.auth != nil {
+			test.auth(r)
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: got %d, want %d", test.name, w.Code, test.status)
+		}
+		_, err := fsys.Stat(path.Join(p.cacheRoot(), "/core/os/x86_64/core.db"))
+		if cached, purged := err == nil, test.status == http.StatusOK; cached == purged {
+			t.Errorf("%s: object cached %v, want %v", test.name, cached, !purged)
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		// the object is gone
+		w = httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: deleting again got %d, want %d", test.name, w.Code, http.StatusNotFound)
+		}
+	}
+}
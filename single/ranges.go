@@ -0,0 +1,79 @@
+package single
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// rangeAhead is how far beyond the downloaded part of an object a range
+// request must start to be forwarded to the upstream, instead of waiting for
+// the download to reach it.
+const rangeAhead = 4 << 20
+
+// rangeStart returns the first byte requested by the Range header value
+// header, or -1 if it does not request a single range from a given offset.
+func rangeStart(header string) int64 {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return -1
+	}
+	dash := strings.IndexByte(spec, '-')
+	if dash <= 0 {
+		return -1
+	}
+	start, err := strconv.ParseInt(strings.TrimSpace(spec[:dash]), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return start
+}
+
+// forwardRange serves r, a range request for the object being downloaded by
+// h, from the upstream if the range starts well beyond the downloaded part,
+// and reports whether it did. Conditional requests are left to
+// http.ServeContent.
+func (p *CachingReverseProxy) forwardRange(w http.ResponseWriter, r *http.Request, h *objectHandle) bool {
+	start := rangeStart(r.Header.Get("Range"))
+	if start < 0 || start >= h.trackingWriter.size || start < h.status().Written+rangeAhead {
+		return false
+	}
+	if r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+		return false
+	}
+	lastModified := h.modTime.UTC().Format(http.TimeFormat)
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" &&
+		ifRange != lastModified && ifRange != makeETag(h.trackingWriter.size, h.modTime) {
+		return false
+	}
+	req, err := p.newUpstreamRequest(http.MethodGet, h.cleanPath)
+	if err != nil {
+		return false
+	}
+	req = req.WithContext(r.Context())
+	p.filterHeaders(req, r)
+	req.Header.Set("Range", r.Header.Get("Range"))
+	// only the version being downloaded will do
+	req.Header.Set("If-Range", lastModified)
+	resp, err := p.doUpstream(req)
+	if err != nil {
+		p.logger().Warn("cannot forward range", "path", h.cleanPath, "err", err)
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return false
+	}
+	p.logger().Debug("forwarding range to the upstream", "path", h.cleanPath, "range", r.Header.Get("Range"))
+	for _, name := range []string{"Content-Range", "Content-Length", "Content-Type"} {
+		if value := resp.Header.Get(name); value != "" {
+			w.Header().Set(name, value)
+		}
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Last-Modified", lastModified)
+	w.WriteHeader(http.StatusPartialContent)
+	io.Copy(w, resp.Body)
+	return true
+}
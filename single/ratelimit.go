@@ -0,0 +1,73 @@
+package single
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the rate of downloads into the cache with a token bucket.
+// It may be shared by several proxies to limit their downloads in total.
+type RateLimiter struct {
+	rate  int64
+	burst int64
+
+	mu     sync.Mutex
+	tokens int64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter allowing rate bytes per second.
+func NewRateLimiter(rate int64) *RateLimiter {
+	burst := max(rate/20, fairChunk)
+	return &RateLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait blocks until n more bytes may be transferred. Callers queue up by
+// taking tokens ahead of time, so that concurrent transfers share the rate.
+func (l *RateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.tokens+int64(now.Sub(l.last))*l.rate/int64(time.Second), l.burst)
+	l.last = now
+	l.tokens -= int64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens * int64(time.Second) / l.rate)
+	}
+	l.mu.Unlock()
+	time.Sleep(delay)
+}
+
+// rateLimitedReader reads from r at the pace allowed by limiters.
+type rateLimitedReader struct {
+	r        io.Reader
+	limiters []*RateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > fairChunk {
+		p = p[:fairChunk]
+	}
+	n, err := r.r.Read(p)
+	for _, l := range r.limiters {
+		l.wait(n)
+	}
+	return n, err
+}
+
+// limitDownload returns r, the body of a download into the cache, limited by
+// DownloadLimiter and MaxObjectDownloadRate.
+func (p *CachingReverseProxy) limitDownload(r io.Reader) io.Reader {
+	var limiters []*RateLimiter
+	if p.DownloadLimiter != nil {
+		limiters = append(limiters, p.DownloadLimiter)
+	}
+	if p.MaxObjectDownloadRate > 0 {
+		limiters = append(limiters, NewRateLimiter(p.MaxObjectDownloadRate))
+	}
+	if len(limiters) == 0 {
+		return r
+	}
+	return &rateLimitedReader{r: r, limiters: limiters}
+}
@@ -0,0 +1,87 @@
+package single
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// RedirectMode is how redirects sent by the upstream are handled.
+type RedirectMode int
+
+const (
+	// FollowRedirects follows redirects, serving and caching the target under
+	// the requested path, with the headers of the target.
+	FollowRedirects RedirectMode = iota
+	// RelayUpstreamRedirects relays redirects to other paths of the upstream
+	// to clients, so that they request the target through the proxy and it
+	// is cached under its own path. Redirects to other origins are followed.
+	RelayUpstreamRedirects
+	// RelayAllRedirects relays all redirects to clients. Targets on other
+	// origins, such as CDNs, are then requested from them directly and not
+	// cached.
+	RelayAllRedirects
+)
+
+// ParseRedirectMode returns the RedirectMode named name: "follow",
+// "relay-upstream" or "relay".
+func ParseRedirectMode(name string) (RedirectMode, bool) {
+	switch name {
+	case "follow":
+		return FollowRedirects, true
+	case "relay-upstream":
+		return RelayUpstreamRedirects, true
+	case "relay":
+		return RelayAllRedirects, true
+	}
+	return FollowRedirects, false
+}
+
+// checkRedirect decides whether the upstream client follows a redirect, as
+// set by Redirects.
+func (p *CachingReverseProxy) checkRedirect(req *http.Request, via []*http.Request) error {
+	switch p.Redirects {
+	case RelayAllRedirects:
+		return http.ErrUseLastResponse
+	case RelayUpstreamRedirects:
+		if p.upstreamRelative(req.URL.String()) != "" {
+			return http.ErrUseLastResponse
+		}
+	}
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if req.URL.Host != via[0].URL.Host {
+		// like Authorization, which the client removes itself
+		for name := range p.UpstreamHeaders {
+			req.Header.Del(name)
+		}
+	}
+	p.logger().Debug("following redirect", "url", req.URL.String())
+	return nil
+}
+
+// upstreamRelative returns the path and query of the absolute URL u relative
+// to the upstream or a mirror, or an empty string if u is not within them.
+func (p *CachingReverseProxy) upstreamRelative(u string) string {
+	for _, m := range p.upstreams() {
+		rel := strings.TrimPrefix(u, m.prefix)
+		if rel != u && strings.HasPrefix(rel, "/") {
+			return rel
+		}
+	}
+	return ""
+}
+
+// rewriteLocation returns the Location header of the upstream response resp,
+// pointing back through the proxy if it points within the upstream.
+func (p *CachingReverseProxy) rewriteLocation(resp *http.Response) string {
+	location, err := resp.Location()
+	if err != nil {
+		return resp.Header.Get("Location")
+	}
+	if rel := p.upstreamRelative(location.String()); rel != "" {
+		return p.MountPrefix + rel
+	}
+	return location.String()
+}
@@ -0,0 +1,181 @@
+package single
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// partialPath returns where the partial download of the version of the object
+// at cachePath modified at modTime is kept to be resumed. Like other
+// temporary files, it is removed by GC once it goes unused for
+// tempFileMaxAge.
+func partialPath(cachePath string, modTime time.Time) string {
+	return cachePath + ".part." + strconv.FormatInt(modTime.Unix(), 10) + ".resume"
+}
+
+// downloadTempPattern returns the pattern of the temporary file names for
+// downloads of the version of the object at cachePath modified at modTime.
+// The modification time in the name lets RecoverPartials resume downloads
+// interrupted by a crash.
+func downloadTempPattern(cachePath string, modTime time.Time) string {
+	return path.Base(cachePath) + ".part." + strconv.FormatInt(modTime.Unix(), 10) + ".*"
+}
+
+// keepPartial keeps the failed download at tempPath of the object at
+// cachePath, modified at modTime, so that the next download resumes it.
+func keepPartial(fsys CacheFS, tempPath, cachePath string, modTime time.Time) error {
+	return fsys.Rename(tempPath, partialPath(cachePath, modTime))
+}
+
+// claimPartial returns the partial download of the version of the object at
+// cachePath modified at modTime, moved to a new temporary file opened for
+// appending, and its size. It returns a nil file if there is none to resume.
+func claimPartial(fsys CacheFS, cachePath string, modTime time.Time, size int64) (CacheFile, int64) {
+	partial := partialPath(cachePath, modTime)
+	info, err := fsys.Stat(partial)
+	if err != nil {
+		return nil, 0
+	}
+	if info.Size() == 0 || info.Size() >= size {
+		fsys.Remove(partial)
+		return nil, 0
+	}
+	tempFile, err := createTemp(fsys, path.Dir(cachePath), downloadTempPattern(cachePath, modTime))
+	if err != nil {
+		return nil, 0
+	}
+	tempFile.Close()
+	// renaming claims the partial download if several hosts race for it
+	if err := fsys.Rename(partial, tempFile.Name()); err != nil {
+		fsys.Remove(tempFile.Name())
+		return nil, 0
+	}
+	f, err := fsys.OpenFile(tempFile.Name(), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		fsys.Remove(tempFile.Name())
+		return nil, 0
+	}
+	return f, info.Size()
+}
+
+// errUnexpectedRange is returned by resumeBody when the upstream does not
+// respond with the requested range, as when the object changed.
+var errUnexpectedRange = errors.New("unexpected response to range request")
+
+// resumeBody returns the content of the object at cleanPath from offset on,
+// requested from the upstream with a Range request valid only if the object
+// is still the version with lastModified, of size bytes. Objects cached
+// forever may have no lastModified, and are resumed unconditionally. The
+// request is made once: callers retrying it count the attempts.
+func (p *CachingReverseProxy) resumeBody(cleanPath string, offset, size int64, lastModified string) (io.ReadCloser, error) {
+	req, err := p.newUpstreamRequest(http.MethodGet, cleanPath)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	if lastModified != "" {
+		req.Header.Set("If-Range", lastModified)
+	}
+	ctx, cancel := p.downloadContext()
+	resp, err := p.doUpstreamOnce(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if transient(resp.StatusCode, nil) {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("upstream returned %s", resp.Status)
+	}
+	want := fmt.Sprintf("bytes %d-%d/%d", offset, size-1, size)
+	if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Content-Range") != want {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("%w: %s %s", errUnexpectedRange, resp.Status, resp.Header.Get("Content-Range"))
+	}
+	return &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}, nil
+}
+
+// hashPrefix writes the first n bytes of the file at name to w.
+func hashPrefix(fsys CacheFS, name string, n int64, w io.Writer) error {
+	f, err := openFS(fsys, name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyN(w, f, n)
+	return err
+}
+
+// RecoverPartials cleans up the temporary files left in the cache by a crash.
+// Interrupted downloads are kept to be resumed, as if they were cut short by
+// the upstream, and other temporary files, including downloads in the
+// StagingArea, are removed. With NFSSafe, files modified within
+// tempFileMaxAge are left alone, since other hosts may be writing them;
+// otherwise the cache must not be in use by another process.
+func (p *CachingReverseProxy) RecoverPartials() error {
+	var recovered, removed int
+	// temporary files are modified at the time of the operating system
+	now := time.Now()
+	fsys := p.cacheFS()
+	clean := func(fsys CacheFS, name string, info os.FileInfo, resumable bool) {
+		base := info.Name()
+		if !isTempFile(base) || strings.HasSuffix(base, ".resume") {
+			return
+		}
+		if p.NFSSafe && now.Sub(info.ModTime()) < tempFileMaxAge {
+			return
+		}
+		i := strings.LastIndex(base, ".part.")
+		fields := strings.Split(base[i+len(".part."):], ".")
+		if resumable && len(fields) == 2 && info.Size() > 0 {
+			if unix, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+				cachePath := path.Join(path.Dir(name), base[:i])
+				partial := partialPath(cachePath, time.Unix(unix, 0))
+				if _, err := fsys.Stat(partial); os.IsNotExist(err) {
+					if err := fsys.Rename(name, partial); err == nil {
+						recovered++
+						return
+					}
+				}
+			}
+		}
+		if err := fsys.Remove(name); err == nil {
+			removed++
+		}
+	}
+	err := walkFS(fsys, p.cacheRoot(), func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			clean(fsys, name, info, !strings.Contains(name, internalMarker))
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	if err == nil && p.Staging != nil {
+		var entries []os.FileInfo
+		entries, err = ioutil.ReadDir(p.Staging.dir)
+		for _, info := range entries {
+			if !info.IsDir() {
+				clean(osFS{}, filepath.Join(p.Staging.dir, info.Name()), info, false)
+			}
+		}
+	}
+	if recovered > 0 || removed > 0 {
+		p.logger().Info("cleaned up after a crash", "recovered", recovered, "removed", removed)
+	}
+	return err
+}
@@ -0,0 +1,126 @@
+package single
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyUpstream serves content modified at modTime, cutting the first
+// response short after half of it, and records the Range and If-Range
+// headers of the requests it receives.
+type flakyUpstream struct {
+	content []byte
+	modTime time.Time
+
+	mu       sync.Mutex
+	requests []http.Header
+}
+
+// replace makes u serve content modified at modTime from now on.
+func (u *flakyUpstream) replace(content []byte, modTime time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.content = content
+	u.modTime = modTime
+}
+
+func (u *flakyUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	u.requests = append(u.requests, http.Header{"Range": r.Header["Range"], "If-Range": r.Header["If-Range"]})
+	first := len(u.requests) == 1
+	content, modTime := u.content, u.modTime
+	u.mu.Unlock()
+	if !first {
+		http.ServeContent(w, r, "", modTime, bytes.NewReader(content))
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Write(content[:len(content)/2])
+	w.(http.Flusher).Flush()
+	panic(http.ErrAbortHandler)
+}
+
+func TestResume(t *testing.T) {
+	content := make([]byte, 1<<16)
+	changed := make([]byte, 1<<16)
+	for i := range content {
+		content[i] = byte(i * 7)
+		changed[i] = byte(i * 11)
+	}
+	modTime := time.Unix(1e9, 0)
+	lastModified := modTime.UTC().Format(http.TimeFormat)
+	for _, test := range []struct {
+		name    string
+		retries int
+		// clients is how many requests the object takes to be cached
+		clients int
+		// change replaces the object after the first request
+		change  bool
+		resumed bool
+	}{
+		// the partial download is kept and resumed by the next request
+		{"next request", 0, 2, false, true},
+		// the download is resumed while the client waits
+		{"retry", 2, 1, false, true},
+		// the partial download of the old version is not resumed
+		{"changed", 0, 2, true, false},
+	} {
+		u := &flakyUpstream{content: content, modTime: modTime}
+		upstream := httptest.NewServer(u)
+		p, fsys := newMemProxy(t, upstream.URL)
+		p.UpstreamRetries = test.retries
+		p.RetryBackoff = time.Millisecond
+		for i := 0; i < test.clients; i++ {
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/object", nil))
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := p.WaitForDownloads(ctx); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			cancel()
+			if test.change {
+				u.replace(changed, modTime.Add(time.Hour))
+			}
+		}
+		upstream.Close()
+		want := content
+		if test.change {
+			want = changed
+		}
+		cached, err := readFileFS(fsys, path.Join(p.cacheRoot(), "object"))
+		if err != nil || !bytes.Equal(cached, want) {
+			t.Errorf("%s: cached %d bytes, %v, want the %d bytes of the object", test.name, len(cached), err, len(content))
+		}
+		// the client requests are sent upstream, then the remaining half is
+		// requested if the object is unchanged
+		requests := test.clients
+		if test.resumed {
+			requests++
+		}
+		if len(u.requests) != requests {
+			t.Errorf("%s: upstream received %d requests, want %d", test.name, len(u.requests), requests)
+			continue
+		}
+		for i, request := range u.requests {
+			want := http.Header{}
+			if test.resumed && i == len(u.requests)-1 {
+				want.Set("Range", "bytes="+strconv.Itoa(len(content)/2)+"-")
+				want.Set("If-Range", lastModified)
+			}
+			for _, name := range []string{"Range", "If-Range"} {
+				if got := request.Get(name); got != want.Get(name) {
+					t.Errorf("%s: request %d has %s %q, want %q", test.name, i, name, got, want.Get(name))
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package single
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultRetryBackoff is the delay before the first retry if
+	// RetryBackoff is not set.
+	defaultRetryBackoff = 500 * time.Millisecond
+	// maxRetryBackoff caps the delay between retries.
+	maxRetryBackoff = 30 * time.Second
+)
+
+// retryDelay returns how long to wait before the retry following attempt
+// failed ones: RetryBackoff doubled for each previous retry, up to
+// maxRetryBackoff, of which a random half is taken off so that clients
+// failing together do not retry together.
+func (p *CachingReverseProxy) retryDelay(attempt int) time.Duration {
+	delay := p.RetryBackoff
+	if delay <= 0 {
+		delay = defaultRetryBackoff
+	}
+	for i := 1; i < attempt && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxRetryBackoff)
+	return delay - rand.N(delay/2+1)
+}
+
+// sleepCtx waits for d, and reports whether it did before ctx was done.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// transient reports whether an upstream request failing with err, or a
+// response with status code, may succeed if retried.
+func transient(code int, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	return code >= 500 && code != http.StatusNotImplemented
+}
+
+// doUpstream sends req, a request made by newUpstreamRequest, to the
+// upstream or its mirrors like doUpstreamOnce, retrying requests failing with
+// a network error or a server error up to UpstreamRetries times.
+func (p *CachingReverseProxy) doUpstream(req *http.Request) (*http.Response, error) {
+	resp, err := p.doUpstreamOnce(req)
+	for attempt := 1; attempt <= p.UpstreamRetries; attempt++ {
+		if err == nil && !transient(resp.StatusCode, nil) || err != nil && !transient(0, err) {
+			break
+		}
+		delay := p.retryDelay(attempt)
+		if err != nil {
+			p.logger().Warn("upstream request failed, retrying", "url", req.URL, "err", err, "attempt", attempt, "delay", delay)
+		} else {
+			p.logger().Warn("upstream request failed, retrying", "url", req.URL, "status", resp.Status, "attempt", attempt, "delay", delay)
+			resp.Body.Close()
+		}
+		if !sleepCtx(req.Context(), delay) {
+			return nil, req.Context().Err()
+		}
+		resp, err = p.doUpstreamOnce(req)
+	}
+	return resp, err
+}
+
+// retryingBody is the body of a download into the cache, which resumes it
+// with a range request when the upstream connection fails, up to
+// UpstreamRetries times in a row.
+type retryingBody struct {
+	proxy        *CachingReverseProxy
+	cleanPath    string
+	offset, size int64
+	lastModified string
+	attempts     int
+
+	mu     sync.Mutex
+	body   io.ReadCloser
+	closed chan struct{}
+}
+
+// resumable returns body, the content of the object at cleanPath from offset
+// on, of size bytes and modified at lastModified, resuming it after
+// failures if UpstreamRetries is positive.
+func (p *CachingReverseProxy) resumable(body io.ReadCloser, cleanPath string, offset, size int64, lastModified string) io.ReadCloser {
+	if p.UpstreamRetries <= 0 {
+		return body
+	}
+	return &retryingBody{
+		proxy:        p,
+		cleanPath:    cleanPath,
+		offset:       offset,
+		size:         size,
+		lastModified: lastModified,
+		body:         body,
+		closed:       make(chan struct{}),
+	}
+}
+
+func (b *retryingBody) Read(p []byte) (int, error) {
+	for {
+		b.mu.Lock()
+		body := b.body
+		b.mu.Unlock()
+		n, err := body.Read(p)
+		b.offset += int64(n)
+		if n > 0 {
+			b.attempts = 0
+		}
+		if err == nil || err == io.EOF || !b.retry(err) {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// retry resumes the download after it failed with err, and reports whether
+// it did.
+func (b *retryingBody) retry(err error) bool {
+	p := b.proxy
+	for b.attempts < p.UpstreamRetries && b.offset < b.size && transient(0, err) && !errors.Is(err, errUnexpectedRange) {
+		select {
+		case <-b.closed:
+			return false
+		default:
+		}
+		b.attempts++
+		delay := p.retryDelay(b.attempts)
+		p.logger().Warn("download interrupted, resuming", "path", b.cleanPath, "offset", b.offset, "err", err, "attempt", b.attempts, "delay", delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-b.closed:
+			timer.Stop()
+			return false
+		}
+		var body io.ReadCloser
+		body, err = p.resumeBody(b.cleanPath, b.offset, b.size, b.lastModified)
+		if err != nil {
+			continue
+		}
+		b.mu.Lock()
+		select {
+		case <-b.closed:
+			b.mu.Unlock()
+			body.Close()
+			return false
+		default:
+		}
+		b.body.Close()
+		b.body = body
+		b.mu.Unlock()
+		return true
+	}
+	return false
+}
+
+// Close closes the body, and stops it from being resumed.
+func (b *retryingBody) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-b.closed:
+	default:
+		close(b.closed)
+	}
+	return b.body.Close()
+}
@@ -0,0 +1,33 @@
+package single
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestTransient(t *testing.T) {
+	for _, test := range []struct {
+		code int
+		err  error
+		want bool
+	}{
+		{http.StatusOK, nil, false},
+		{http.StatusNotFound, nil, false},
+		{http.StatusInternalServerError, nil, true},
+		{http.StatusBadGateway, nil, true},
+		{http.StatusServiceUnavailable, nil, true},
+		{http.StatusNotImplemented, nil, false},
+		{0, io.ErrUnexpectedEOF, true},
+		{0, context.Canceled, false},
+		{0, fmt.Errorf("get: %w", context.DeadlineExceeded), false},
+		{0, errors.New("connection reset by peer"), true},
+	} {
+		if got := transient(test.code, test.err); got != test.want {
+			t.Errorf("transient(%d, %v) = %v, want %v", test.code, test.err, got, test.want)
+		}
+	}
+}
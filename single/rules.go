@@ -0,0 +1,69 @@
+package single
+
+import "time"
+
+// CachePolicy is how the proxy caches the objects matched by a CacheRule.
+type CachePolicy int
+
+const (
+	// CacheDefault caches objects and revalidates them with the upstream on
+	// every request, with the leniency of ClockSkewTolerance and recorded
+	// ETags.
+	CacheDefault CachePolicy = iota
+	// CacheBypass never caches objects, relaying them from the upstream.
+	CacheBypass
+	// CacheRevalidate caches objects and revalidates them with the upstream
+	// on every request, replacing them unless the upstream replies 304 Not
+	// Modified.
+	CacheRevalidate
+	// CacheForever caches objects and serves them without contacting the
+	// upstream once cached, for immutable objects such as packages.
+	CacheForever
+)
+
+// ParseCachePolicy returns the CachePolicy named name: "default", "bypass",
+// "revalidate" or "forever".
+func ParseCachePolicy(name string) (CachePolicy, bool) {
+	switch name {
+	case "default":
+		return CacheDefault, true
+	case "bypass":
+		return CacheBypass, true
+	case "revalidate":
+		return CacheRevalidate, true
+	case "forever":
+		return CacheForever, true
+	}
+	return CacheDefault, false
+}
+
+// CacheRule applies Policy to the paths matched by Match. With
+// CacheDefault, objects validated within MaxAge, if positive, are served
+// without contacting the upstream.
+type CacheRule struct {
+	Match  PathMatcher
+	Policy CachePolicy
+	MaxAge time.Duration
+}
+
+// cachePolicy returns the policy of the first of CacheRules matching
+// cleanPath, or CacheDefault.
+func (p *CachingReverseProxy) cachePolicy(cleanPath string) CachePolicy {
+	for _, rule := range p.CacheRules {
+		if rule.Match(cleanPath) {
+			return rule.Policy
+		}
+	}
+	return CacheDefault
+}
+
+// cacheMaxAge returns the MaxAge of the first of CacheRules matching
+// cleanPath, or 0.
+func (p *CachingReverseProxy) cacheMaxAge(cleanPath string) time.Duration {
+	for _, rule := range p.CacheRules {
+		if rule.Match(cleanPath) {
+			return rule.MaxAge
+		}
+	}
+	return 0
+}
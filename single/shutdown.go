@@ -0,0 +1,32 @@
+package single
+
+import (
+	"context"
+	"time"
+)
+
+// Shutdown makes the proxy reply to new requests with 503 and a Retry-After
+// header of RetryAfter, so that load balancers and clients retry elsewhere or
+// later instead of having their connections reset, and waits until the
+// requests already being served complete or ctx is done.
+func (p *CachingReverseProxy) Shutdown(ctx context.Context) error {
+	p.shuttingDown.Store(true)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	lastLog := time.Now()
+	for {
+		n := p.activeRequests.Load()
+		if n == 0 {
+			return nil
+		}
+		if time.Since(lastLog) >= 5*time.Second {
+			p.logger().Info("waiting for requests to complete", "count", n)
+			lastLog = time.Now()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package single
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// LimitSlowClients returns a handler that disconnects clients reading
+// responses from h slower than minRate bytes per second. Each write to the
+// client must complete within grace plus the time needed to send it at
+// minRate, so a client may stall for at most grace at a time.
+func LimitSlowClients(h http.Handler, minRate int64, grace time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &slowClientWriter{
+			ResponseWriter: w,
+			rc:             http.NewResponseController(w),
+			minRate:        minRate,
+			grace:          grace,
+			remoteAddr:     r.RemoteAddr,
+		}
+		defer sw.rc.SetWriteDeadline(time.Time{})
+		h.ServeHTTP(sw, r)
+	})
+}
+
+type slowClientWriter struct {
+	http.ResponseWriter
+	rc         *http.ResponseController
+	minRate    int64
+	grace      time.Duration
+	remoteAddr string
+	logged     bool
+}
+
+func (w *slowClientWriter) Write(p []byte) (int, error) {
+	timeout := w.grace + time.Duration(int64(len(p))*int64(time.Second)/w.minRate)
+	if err := w.rc.SetWriteDeadline(time.Now().Add(timeout)); err != nil && err != http.ErrNotSupported {
+		return 0, err
+	}
+	n, err := w.ResponseWriter.Write(p)
+	if err != nil && !w.logged {
+		w.logged = true
+		slog.Info("disconnected slow client", "remote", w.remoteAddr, "err", err)
+	}
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (w *slowClientWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,58 @@
+package single
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+)
+
+// fitsCache reports whether an object of size bytes at cleanPath may be
+// downloaded into the cache, within MaxObjectSize and leaving MinFreeSpace
+// free once it and the other downloads in progress complete. Objects already
+// being downloaded always fit.
+func (p *CachingReverseProxy) fitsCache(cleanPath string, size int64) bool {
+	if _, ok := p.objectHandles.Load(cleanPath); ok {
+		return true
+	}
+	if p.MaxObjectSize > 0 && size > p.MaxObjectSize {
+		p.logger().Debug("too large to cache", "path", cleanPath, "size", size)
+		return false
+	}
+	free, err := p.cacheFreeSpace()
+	if err != nil {
+		return true
+	}
+	if free-p.pendingBytes()-size < p.MinFreeSpace {
+		p.logger().Warn("not enough free space to cache", "path", cleanPath, "size", size, "free", free)
+		return false
+	}
+	return true
+}
+
+// cacheFreeSpace returns the space available on the filesystem of the cache
+// directory, or of its closest existing parent before it is created.
+func (p *CachingReverseProxy) cacheFreeSpace() (int64, error) {
+	dir := p.cacheDir
+	for {
+		free, err := freeSpace(dir)
+		if !errors.Is(err, fs.ErrNotExist) || filepath.Dir(dir) == dir {
+			return free, err
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// pendingBytes returns the bytes left to write by the downloads in progress.
+func (p *CachingReverseProxy) pendingBytes() int64 {
+	p.downloadsMu.Lock()
+	defer p.downloadsMu.Unlock()
+	var pending int64
+	for h := range p.downloads {
+		if info, err := h.tempFS().Stat(h.tempPath); err == nil {
+			pending += max(h.trackingWriter.size-info.Size(), 0)
+		} else {
+			pending += h.trackingWriter.size
+		}
+	}
+	return pending
+}
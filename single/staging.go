@@ -0,0 +1,89 @@
+package single
+
+import (
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// StagingArea holds in-progress downloads of small objects in a directory on
+// a memory-backed filesystem such as tmpfs. Completed downloads are copied
+// to the disk cache in one sequential write, and failed ones never reach it,
+// which spares SSD-backed caches the writes of objects evicted soon after.
+type StagingArea struct {
+	dir        string
+	capacity   int64
+	objectSize int64
+
+	mu   sync.Mutex
+	used int64
+}
+
+// NewStagingArea returns a StagingArea in dir holding up to capacity bytes,
+// for objects of up to objectSize bytes. Larger objects, and objects
+// arriving while it is full, are downloaded to the disk cache directly.
+func NewStagingArea(dir string, capacity, objectSize int64) *StagingArea {
+	return &StagingArea{
+		dir:        dir,
+		capacity:   capacity,
+		objectSize: objectSize,
+	}
+}
+
+// reserve reserves space for an object of size bytes and reports whether it
+// should be staged.
+func (s *StagingArea) reserve(size int64) bool {
+	if s == nil || size > s.objectSize {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.used+size > s.capacity {
+		return false
+	}
+	s.used += size
+	return true
+}
+
+// release releases the space reserved for an object of size bytes.
+func (s *StagingArea) release(size int64) {
+	s.mu.Lock()
+	s.used -= size
+	s.mu.Unlock()
+}
+
+// spill copies the staged download at stagedPath to cachePath, with the
+// modification time modTime.
+func (p *CachingReverseProxy) spill(stagedPath, cachePath string, modTime time.Time) error {
+	in, err := os.Open(stagedPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fsys := p.cacheFS()
+	out, err := createTemp(fsys, path.Dir(cachePath), path.Base(cachePath)+".part.*")
+	if err != nil {
+		return err
+	}
+	size, err := io.Copy(out, in)
+	if err == nil && p.NFSSafe {
+		// make the content visible to other hosts before the rename
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = fsys.Chtimes(out.Name(), p.now(), modTime)
+	}
+	if err == nil {
+		p.recordReplace(cachePath, size)
+		err = fsys.Rename(out.Name(), cachePath)
+	}
+	if err != nil {
+		fsys.Remove(out.Name())
+	}
+	return err
+}
@@ -0,0 +1,91 @@
+package single
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Warnings (RFC 7234) added to responses served from the cache without
+// validating them with the upstream.
+const (
+	staleWarning              = `110 - "Response is Stale"`
+	revalidationFailedWarning = `111 - "Revalidation Failed"`
+)
+
+// revalidatingKey marks, in its context, a request made by revalidate.
+type revalidatingKey struct{}
+
+// lastValidated returns when the object at cleanPath, with the metadata meta,
+// was last downloaded or validated with the upstream, or the zero time if
+// unknown, as for objects cached before the proxy started without Metadata.
+func (p *CachingReverseProxy) lastValidated(cleanPath string, meta *Metadata) time.Time {
+	if meta != nil {
+		if meta.Validated.After(meta.Downloaded) {
+			return meta.Validated
+		}
+		return meta.Downloaded
+	}
+	if validated, ok := p.validated.Load(p.objectKey(cleanPath)); ok {
+		return validated.(time.Time)
+	}
+	return time.Time{}
+}
+
+// recordValidated records that the object at cleanPath, with the metadata
+// meta, was validated with the upstream at validated.
+func (p *CachingReverseProxy) recordValidated(cleanPath string, meta *Metadata, validated time.Time) {
+	if meta == nil || p.Metadata == nil {
+		p.validated.Store(p.objectKey(cleanPath), validated)
+		return
+	}
+	meta.Validated = validated.UTC()
+	if err := p.Metadata.Put(p.objectKey(cleanPath), meta); err != nil {
+		p.logger().Warn("cannot record metadata", "path", cleanPath, "err", err)
+	}
+}
+
+// staleUsable reports whether a cached object last validated at validated may
+// be served without validating it, that is within MaxStale if positive.
+func (p *CachingReverseProxy) staleUsable(validated time.Time) bool {
+	if validated.IsZero() {
+		return false
+	}
+	return p.MaxStale <= 0 || p.now().Sub(validated) <= p.MaxStale
+}
+
+// serveStaleWhileRevalidate reports whether the response to r may be served
+// from the cache right away, with StaleWhileRevalidate.
+func (p *CachingReverseProxy) serveStaleWhileRevalidate(r *http.Request, policy CachePolicy, validated time.Time) bool {
+	return p.StaleWhileRevalidate &&
+		policy == CacheDefault &&
+		r.Context().Value(revalidatingKey{}) == nil &&
+		p.staleUsable(validated)
+}
+
+// setStaleHeaders marks a response served from the cache, last validated at
+// validated, as stale with warning.
+func (p *CachingReverseProxy) setStaleHeaders(header http.Header, warning string, validated time.Time) {
+	header.Set("Age", strconv.FormatInt(int64(p.now().Sub(validated)/time.Second), 10))
+	header.Set("Warning", warning)
+}
+
+// revalidate validates the cached object at cleanPath with the upstream in the
+// background, downloading it again if it changed. Paths already being
+// revalidated are ignored.
+func (p *CachingReverseProxy) revalidate(cleanPath string) {
+	if _, loaded := p.revalidating.LoadOrStore(cleanPath, true); loaded {
+		return
+	}
+	go func() {
+		defer p.revalidating.Delete(cleanPath)
+		req, err := internalRequest(context.WithValue(context.Background(), revalidatingKey{}, true), cleanPath)
+		if err != nil {
+			p.logger().Error("revalidate failed", "err", err)
+			return
+		}
+		w := &discardResponseWriter{header: make(http.Header)}
+		p.ServeHTTP(w, req)
+	}()
+}
@@ -0,0 +1,49 @@
+package single
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRevalidateRewritten(t *testing.T) {
+	u := &recordingUpstream{size: 100}
+	upstream := httptest.NewServer(u)
+	defer upstream.Close()
+	p, fsys := newMemProxy(t, upstream.URL)
+	p.PathRewrites = []PathRewrite{{"/", "/mirror"}}
+	p.StaleWhileRevalidate = true
+	// an older version, validated an hour ago
+	putObject(t, p, fsys, "/mirror/core.db", 50)
+	p.validated.Store(p.objectKey("/mirror/core.db"), p.now().Add(-time.Hour))
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/core.db", nil))
+	if w.Code != http.StatusOK || w.Body.Len() != 50 || w.Header().Get("Warning") != staleWarning {
+		t.Fatalf("got %d with %d bytes and warning %q, want the stale object", w.Code, w.Body.Len(), w.Header().Get("Warning"))
+	}
+	// the object is revalidated in the background, and replaced
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		info, err := fsys.Stat(path.Join(p.cacheRoot(), "/mirror/core.db"))
+		if err == nil && info.Size() == 100 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("object not revalidated: %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if got, want := u.requested(), []string{"/mirror/core.db"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("upstream requested %q, want %q", got, want)
+	}
+	if _, err := fsys.Stat(path.Join(p.cacheRoot(), "/mirror/mirror/core.db")); err == nil {
+		t.Errorf("revalidated object cached under a path rewritten twice")
+	}
+}
@@ -0,0 +1,43 @@
+package single
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// systemAccessTime returns the last access time of the file of the operating
+// system described by info.
+func systemAccessTime(info os.FileInfo) time.Time {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(stat.Atim.Unix())
+	}
+	return info.ModTime()
+}
+
+// freeSpace returns the space available to unprivileged users on the
+// filesystem containing dir.
+func freeSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// linkCount returns the number of hard links to the file described by info.
+func linkCount(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Nlink)
+	}
+	return 0
+}
+
+// linkedFile returns the identity of the file of the operating system
+// described by info, and whether it has several hard links.
+func linkedFile(info os.FileInfo) (fileID, bool) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Nlink > 1 {
+		return fileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+	}
+	return fileID{}, false
+}
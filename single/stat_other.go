@@ -0,0 +1,34 @@
+//go:build !linux
+
+package single
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// systemAccessTime returns the modification time of the file of the
+// operating system described by info, since the access time is not
+// available portably.
+func systemAccessTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
+
+// freeSpace returns an error, since the free space of a filesystem is not
+// available portably.
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.New("free space is not available on this platform")
+}
+
+// linkCount returns 0, since the number of hard links is not available
+// portably.
+func linkCount(info os.FileInfo) uint64 {
+	return 0
+}
+
+// linkedFile reports that the file described by info has no other hard
+// links, since they cannot be found portably.
+func linkedFile(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
@@ -0,0 +1,263 @@
+package single
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// stats counts the requests served since startup.
+type stats struct {
+	requests    atomic.Int64
+	hits        atomic.Int64
+	misses      atomic.Int64
+	passThrough atomic.Int64
+	downloaded  atomic.Int64
+	// evictions and evictedBytes count the objects removed from the disk
+	// cache to free space: evicted, expired or demoted to cold storage.
+	evictions    atomic.Int64
+	evictedBytes atomic.Int64
+}
+
+// cacheUsage tracks the size and number of objects in the disk cache. It is
+// updated as objects are added and removed, and corrected by periodic scans
+// for changes made by other processes.
+type cacheUsage struct {
+	bytes   atomic.Int64
+	objects atomic.Int64
+}
+
+// countingReader adds the number of bytes read from r to n.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// Status is a snapshot of the state of the proxy, served by the admin API.
+type Status struct {
+	// Requests counts the client requests since startup, of which Hits were
+	// served from the cache, Misses downloaded into the cache and
+	// PassThrough relayed without caching. Prefetches, warming and
+	// background revalidation are not counted.
+	Requests    int64 `json:"requests"`
+	Hits        int64 `json:"hits"`
+	Misses      int64 `json:"misses"`
+	PassThrough int64 `json:"pass_through"`
+	// HitRatio is the fraction of Hits among Hits, Misses and PassThrough.
+	HitRatio float64 `json:"hit_ratio"`
+	// DownloadedBytes counts the bytes downloaded into the cache.
+	DownloadedBytes int64            `json:"downloaded_bytes"`
+	ActiveRequests  int64            `json:"active_requests"`
+	Downloads       []DownloadStatus `json:"downloads"`
+	CacheBytes      int64            `json:"cache_bytes"`
+	CacheObjects    int64            `json:"cache_objects"`
+	// CacheFreeBytes is the space available on the filesystem of the cache
+	// directory, or -1 if it is unknown.
+	CacheFreeBytes int64 `json:"cache_free_bytes"`
+	Evictions      int64 `json:"evictions"`
+	EvictedBytes   int64 `json:"evicted_bytes"`
+	// Upstreams lists the upstream followed by the mirrors.
+	Upstreams []UpstreamStatus `json:"upstreams"`
+}
+
+// UpstreamStatus is the health of the upstream or a mirror. Latency and
+// LastSync are measured by RunHealthChecks.
+type UpstreamStatus struct {
+	URL string `json:"url"`
+	// Preferred is whether requests are sent to it first.
+	Preferred bool `json:"preferred"`
+	Healthy   bool `json:"healthy"`
+	// Latency is a moving average of the time health checks took to
+	// receive the response headers.
+	Latency   time.Duration `json:"latency_ns,omitempty"`
+	LastSync  *time.Time    `json:"last_sync,omitempty"`
+	LastCheck *time.Time    `json:"last_check,omitempty"`
+}
+
+// DownloadStatus is the progress of a download into the cache.
+type DownloadStatus struct {
+	Path    string `json:"path"`
+	Written int64  `json:"written"`
+	Size    int64  `json:"size"`
+}
+
+// Progress returns the fraction of the object downloaded.
+func (d DownloadStatus) Progress() float64 {
+	if d.Size <= 0 {
+		return 0
+	}
+	return float64(d.Written) / float64(d.Size)
+}
+
+// Status returns a snapshot of the state of p.
+func (p *CachingReverseProxy) Status() *Status {
+	s := &Status{
+		Requests:        p.stats.requests.Load(),
+		Hits:            p.stats.hits.Load(),
+		Misses:          p.stats.misses.Load(),
+		PassThrough:     p.stats.passThrough.Load(),
+		DownloadedBytes: p.stats.downloaded.Load(),
+		ActiveRequests:  p.activeRequests.Load(),
+		CacheBytes:      p.usage.bytes.Load(),
+		CacheObjects:    p.usage.objects.Load(),
+		CacheFreeBytes:  -1,
+		Evictions:       p.stats.evictions.Load(),
+		EvictedBytes:    p.stats.evictedBytes.Load(),
+	}
+	if served := s.Hits + s.Misses + s.PassThrough; served > 0 {
+		s.HitRatio = float64(s.Hits) / float64(served)
+	}
+	if free, err := p.cacheFreeSpace(); err == nil {
+		s.CacheFreeBytes = free
+	}
+	now := p.now().UnixNano()
+	upstreams := p.upstreams()
+	preferred := p.preferred()
+	for _, m := range upstreams {
+		s.Upstreams = append(s.Upstreams, UpstreamStatus{
+			URL:       m.prefix,
+			Preferred: len(upstreams) > 1 && m.health == preferred,
+			Healthy:   !m.health.down(now),
+			Latency:   time.Duration(m.health.latency.Load()),
+			LastSync:  unixNanoTime(m.health.lastSync.Load()),
+			LastCheck: unixNanoTime(m.health.checked.Load()),
+		})
+	}
+	s.Downloads = p.downloadStatuses()
+	return s
+}
+
+// downloadStatuses returns the progress of the downloads in progress, sorted
+// by path.
+func (p *CachingReverseProxy) downloadStatuses() []DownloadStatus {
+	downloads := []DownloadStatus{}
+	p.downloadsMu.Lock()
+	for h := range p.downloads {
+		downloads = append(downloads, h.status())
+	}
+	p.downloadsMu.Unlock()
+	sort.Slice(downloads, func(i, j int) bool {
+		return downloads[i].Path < downloads[j].Path
+	})
+	return downloads
+}
+
+// unixNanoTime returns the time ns nanoseconds after the Unix epoch in UTC,
+// or nil if ns is 0.
+func unixNanoTime(ns int64) *time.Time {
+	if ns == 0 {
+		return nil
+	}
+	t := time.Unix(0, ns).UTC()
+	return &t
+}
+
+func (h *objectHandle) status() DownloadStatus {
+	d := DownloadStatus{Path: h.cleanPath, Size: h.trackingWriter.size}
+	if info, err := h.tempFS().Stat(h.tempPath); err == nil {
+		d.Written = info.Size()
+	}
+	return d
+}
+
+// downloadStatus returns the progress of the download of cleanPath, or nil if
+// it is not being downloaded.
+func (p *CachingReverseProxy) downloadStatus(cleanPath string) *DownloadStatus {
+	p.downloadsMu.Lock()
+	defer p.downloadsMu.Unlock()
+	for h := range p.downloads {
+		if h.cleanPath == cleanPath {
+			d := h.status()
+			return &d
+		}
+	}
+	return nil
+}
+
+func (p *CachingReverseProxy) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, p.Status())
+}
+
+// ScanUsage walks the disk cache to measure its usage. Files hard linked to
+// several objects by Dedupe are counted once.
+func (p *CachingReverseProxy) ScanUsage() error {
+	var bytes fileSizes
+	var objects int64
+	err := p.walkCache(func(cleanPath, cachePath string, info os.FileInfo) error {
+		bytes.add(info)
+		objects++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	p.usage.bytes.Store(bytes.total)
+	p.usage.objects.Store(objects)
+	return nil
+}
+
+// RunUsageScan calls ScanUsage now and every interval until ctx is done.
+func (p *CachingReverseProxy) RunUsageScan(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := p.ScanUsage(); err != nil {
+			p.logger().Error("scan usage failed", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// recordReplace accounts for the file at cachePath being replaced by an
+// object of size bytes. It must be called before the replacement.
+func (p *CachingReverseProxy) recordReplace(cachePath string, size int64) {
+	if info, err := p.cacheFS().Stat(cachePath); err == nil {
+		p.usage.bytes.Add(size - info.Size())
+		return
+	}
+	p.usage.bytes.Add(size)
+	p.usage.objects.Add(1)
+}
+
+// recordRemove accounts for the file at cachePath being removed and returns
+// its size. It must be called before the removal. The storage of a file
+// still linked from another object besides its blob is not freed.
+func (p *CachingReverseProxy) recordRemove(cachePath string) int64 {
+	info, err := p.cacheFS().Stat(cachePath)
+	if err != nil {
+		return 0
+	}
+	if linkCount(info) <= 2 {
+		p.usage.bytes.Add(-info.Size())
+	}
+	p.usage.objects.Add(-1)
+	return info.Size()
+}
+
+// count adds r to counter, one of the request counters of stats, unless r
+// is an internal request, which no client made.
+func (p *CachingReverseProxy) count(r *http.Request, counter *atomic.Int64) {
+	if !isInternalRequest(r) {
+		counter.Add(1)
+	}
+}
+
+// recordEviction counts an object of size bytes removed to free space.
+func (p *CachingReverseProxy) recordEviction(size int64) {
+	p.stats.evictions.Add(1)
+	p.stats.evictedBytes.Add(size)
+}
@@ -0,0 +1,73 @@
+package single
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrObjectNotFound is returned by ObjectStorage when an object does not exist.
+var ErrObjectNotFound = errors.New("object not found")
+
+// ObjectInfo describes an object in an ObjectStorage.
+type ObjectInfo struct {
+	Size int64
+	// ModTime is the modification time of the object as sent by the upstream.
+	ModTime time.Time
+}
+
+// ObjectStorage is a remote storage backend for cached objects, used as the
+// cold tier behind the disk cache. Keys are cleaned request paths without
+// the leading slash.
+type ObjectStorage interface {
+	// Open returns a reader for the object stored at key.
+	Open(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+	// Put stores info.Size bytes read from r at key.
+	Put(ctx context.Context, key string, r io.Reader, info ObjectInfo) error
+	// Delete removes the object stored at key. Deleting a missing object
+	// is not an error.
+	Delete(ctx context.Context, key string) error
+	// Walk calls fn for the key of every stored object.
+	Walk(ctx context.Context, fn func(key string) error) error
+}
+
+// OpenObjectStorage returns the ObjectStorage described by rawurl.
+// Supported schemes:
+//
+//	s3://bucket/prefix
+//	gs://bucket/prefix
+//
+// Credentials and options are read from the environment, as documented for
+// each backend.
+func OpenObjectStorage(rawurl string) (ObjectStorage, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.Trim(u.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	switch u.Scheme {
+	case "s3":
+		return newS3Storage(u.Host, prefix)
+	case "gs":
+		return newGCSStorage(u.Host, prefix)
+	}
+	return nil, fmt.Errorf("unsupported object storage %q", rawurl)
+}
+
+// getenv returns the first non-empty environment variable of names.
+func getenv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
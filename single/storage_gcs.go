@@ -0,0 +1,406 @@
+package single
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gcsChunkSize is the size of each request of a resumable upload. It must be
+// a multiple of 256 KiB.
+const gcsChunkSize = 8 << 20
+
+const gcsMetaModTime = "upstream-last-modified"
+
+// gcsStorage stores objects in a Google Cloud Storage bucket.
+//
+// Credentials are read from the service account key file named by
+// GOOGLE_APPLICATION_CREDENTIALS if set, and from the GCE metadata server
+// otherwise. STORAGE_EMULATOR_HOST overrides the API endpoint.
+type gcsStorage struct {
+	client   *http.Client
+	endpoint string
+	bucket   string
+	prefix   string
+	tokens   *gcsTokenSource
+}
+
+func newGCSStorage(bucket string, prefix string) (*gcsStorage, error) {
+	endpoint := "https://storage.googleapis.com"
+	if host := getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		endpoint = strings.TrimSuffix(host, "/")
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "http://" + endpoint
+		}
+	}
+	tokens, err := newGCSTokenSource(getenv("GOOGLE_APPLICATION_CREDENTIALS"))
+	if err != nil {
+		return nil, err
+	}
+	return &gcsStorage{
+		client:   &http.Client{},
+		endpoint: endpoint,
+		bucket:   bucket,
+		prefix:   prefix,
+		tokens:   tokens,
+	}, nil
+}
+
+func (s *gcsStorage) do(req *http.Request, okStatus ...int) (*http.Response, error) {
+	token, err := s.tokens.token(req.Context(), s.client)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrObjectNotFound
+	}
+	for _, code := range okStatus {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("gcs %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, msg)
+	}
+	return resp, nil
+}
+
+func (s *gcsStorage) objectURL(key string) string {
+	return s.endpoint + "/storage/v1/b/" + url.PathEscape(s.bucket) + "/o/" + url.PathEscape(s.prefix+key)
+}
+
+// Open streams the object content with an authenticated media download.
+func (s *gcsStorage) Open(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	req, err := http.NewRequest(http.MethodGet, s.objectURL(key), nil)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	resp, err := s.do(req.WithContext(ctx))
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	var object struct {
+		Size     string            `json:"size"`
+		Updated  time.Time         `json:"updated"`
+		Metadata map[string]string `json:"metadata"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&object)
+	resp.Body.Close()
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	info := ObjectInfo{ModTime: object.Updated}
+	if _, err := fmt.Sscan(object.Size, &info.Size); err != nil {
+		return nil, ObjectInfo{}, fmt.Errorf("gcs: invalid size %q of %s: %v", object.Size, key, err)
+	}
+	if modTime, err := http.ParseTime(object.Metadata[gcsMetaModTime]); err == nil {
+		info.ModTime = modTime
+	}
+
+	req, err = http.NewRequest(http.MethodGet, s.objectURL(key)+"?alt=media", nil)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	resp, err = s.do(req.WithContext(ctx))
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return resp.Body, info, nil
+}
+
+// Put uploads the object with a resumable upload, sending a chunk whenever
+// gcsChunkSize bytes are available from r. This allows r to be a download
+// that is still in progress.
+func (s *gcsStorage) Put(ctx context.Context, key string, r io.Reader, info ObjectInfo) error {
+	metadata, err := json.Marshal(map[string]interface{}{
+		"name":     s.prefix + key,
+		"metadata": map[string]string{gcsMetaModTime: info.ModTime.UTC().Format(http.TimeFormat)},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(
+		http.MethodPost,
+		s.endpoint+"/upload/storage/v1/b/"+url.PathEscape(s.bucket)+"/o?uploadType=resumable",
+		bytes.NewReader(metadata),
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Length", fmt.Sprint(info.Size))
+	resp, err := s.do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return errors.New("gcs: resumable upload session not created")
+	}
+
+	chunk := make([]byte, gcsChunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+		if offset+int64(n) > info.Size {
+			return fmt.Errorf("gcs: %s is larger than %d bytes", key, info.Size)
+		}
+		last := offset+int64(n) == info.Size
+		if n < len(chunk) && !last {
+			return fmt.Errorf("gcs: %s ended at %d of %d bytes", key, offset+int64(n), info.Size)
+		}
+		if err := s.putChunk(ctx, session, chunk[:n], offset, info.Size); err != nil {
+			return err
+		}
+		offset += int64(n)
+		if last {
+			return nil
+		}
+	}
+}
+
+// putChunk sends data at offset of a resumable upload session.
+func (s *gcsStorage) putChunk(ctx context.Context, session string, data []byte, offset int64, size int64) error {
+	var lastErr error
+	for attempt := 0; attempt < 3; attempt++ {
+		req, err := http.NewRequest(http.MethodPut, session, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		} else {
+			req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+int64(len(data))-1, size))
+		}
+		// 308 Resume Incomplete acknowledges an intermediate chunk
+		resp, err := s.do(req.WithContext(ctx), 308)
+		if err == nil {
+			resp.Body.Close()
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		lastErr = err
+		time.Sleep(time.Duration(attempt+1) * time.Second)
+	}
+	return lastErr
+}
+
+func (s *gcsStorage) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequest(http.MethodDelete, s.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req.WithContext(ctx))
+	if err == ErrObjectNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *gcsStorage) Walk(ctx context.Context, fn func(key string) error) error {
+	query := url.Values{"prefix": {s.prefix}, "fields": {"items(name),nextPageToken"}}
+	for {
+		req, err := http.NewRequest(
+			http.MethodGet,
+			s.endpoint+"/storage/v1/b/"+url.PathEscape(s.bucket)+"/o?"+query.Encode(),
+			nil,
+		)
+		if err != nil {
+			return err
+		}
+		resp, err := s.do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		var result struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, item := range result.Items {
+			if err := fn(strings.TrimPrefix(item.Name, s.prefix)); err != nil {
+				return err
+			}
+		}
+		if result.NextPageToken == "" {
+			return nil
+		}
+		query.Set("pageToken", result.NextPageToken)
+	}
+}
+
+// gcsTokenSource obtains OAuth2 access tokens for Cloud Storage.
+type gcsTokenSource struct {
+	// anonymous disables authentication, for use with emulators.
+	anonymous bool
+	// key is the parsed service account key, or nil to use the metadata server.
+	key *gcsServiceAccountKey
+
+	mu      sync.Mutex
+	current string
+	expiry  time.Time
+}
+
+type gcsServiceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+	rsaKey      *rsa.PrivateKey
+}
+
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+func newGCSTokenSource(keyFile string) (*gcsTokenSource, error) {
+	if getenv("STORAGE_EMULATOR_HOST") != "" {
+		return &gcsTokenSource{anonymous: true}, nil
+	}
+	if keyFile == "" {
+		return &gcsTokenSource{}, nil
+	}
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key := &gcsServiceAccountKey{}
+	if err := json.Unmarshal(data, key); err != nil {
+		return nil, fmt.Errorf("%s: %v", keyFile, err)
+	}
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("%s: no private key", keyFile)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", keyFile, err)
+	}
+	var ok bool
+	if key.rsaKey, ok = parsed.(*rsa.PrivateKey); !ok {
+		return nil, fmt.Errorf("%s: not an RSA private key", keyFile)
+	}
+	if key.TokenURI == "" {
+		key.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	return &gcsTokenSource{key: key}, nil
+}
+
+// token returns a valid access token, refreshing it if needed.
+func (ts *gcsTokenSource) token(ctx context.Context, client *http.Client) (string, error) {
+	if ts.anonymous {
+		return "", nil
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.current != "" && time.Now().Add(time.Minute).Before(ts.expiry) {
+		return ts.current, nil
+	}
+
+	var req *http.Request
+	var err error
+	if ts.key == nil {
+		req, err = http.NewRequest(
+			http.MethodGet,
+			"http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token",
+			nil,
+		)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+	} else {
+		var assertion string
+		assertion, err = ts.key.assertion()
+		if err != nil {
+			return "", err
+		}
+		req, err = http.NewRequest(http.MethodPost, ts.key.TokenURI, strings.NewReader(url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {assertion},
+		}.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("gcs: fetching access token: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("gcs: fetching access token: %s", resp.Status)
+	}
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	ts.current = result.AccessToken
+	ts.expiry = time.Now().Add(time.Duration(result.ExpiresIn) * time.Second)
+	return ts.current, nil
+}
+
+// assertion returns a signed JWT for the OAuth2 JWT bearer grant.
+func (k *gcsServiceAccountKey) assertion() (string, error) {
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   k.ClientEmail,
+		"scope": gcsScope,
+		"aud":   k.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	hashed := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(nil, k.rsaKey, crypto.SHA256, hashed[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(signature), nil
+}
@@ -0,0 +1,263 @@
+package single
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Storage stores objects in an S3 compatible bucket.
+//
+// It is configured with the environment variables AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN, AWS_REGION and, for S3
+// compatible services, AWS_ENDPOINT_URL.
+type s3Storage struct {
+	client       *http.Client
+	endpoint     *url.URL
+	bucket       string
+	prefix       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+const s3MetaModTime = "X-Amz-Meta-Upstream-Last-Modified"
+
+func newS3Storage(bucket string, prefix string) (*s3Storage, error) {
+	region := getenv("AWS_REGION", "AWS_DEFAULT_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := getenv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL")
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %v", err)
+	}
+	s := &s3Storage{
+		client:       &http.Client{},
+		endpoint:     u,
+		bucket:       bucket,
+		prefix:       prefix,
+		region:       region,
+		accessKey:    getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: getenv("AWS_SESSION_TOKEN"),
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required for S3")
+	}
+	return s, nil
+}
+
+// s3Escape escapes s as required by the SigV4 canonical request.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !escapeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func (s *s3Storage) newRequest(ctx context.Context, method string, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := *s.endpoint
+	u.Path = "/" + s.bucket + "/" + key
+	u.RawPath = "/" + s.bucket + "/" + s3Escape(key, false)
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var rawQuery []string
+	for _, k := range keys {
+		rawQuery = append(rawQuery, s3Escape(k, true)+"="+s3Escape(query.Get(k), true))
+	}
+	u.RawQuery = strings.Join(rawQuery, "&")
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	return req.WithContext(ctx), nil
+}
+
+// sign adds an AWS Signature Version 4 to req. The payload is not signed.
+func (s *s3Storage) sign(req *http.Request) {
+	now := time.Now().UTC()
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + req.Header.Get("X-Amz-Date") + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	hmacSHA256 := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature,
+	))
+}
+
+func (s *s3Storage) do(req *http.Request) (*http.Response, error) {
+	s.sign(req)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrObjectNotFound
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, msg)
+	}
+	return resp, nil
+}
+
+func (s *s3Storage) Open(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	req, err := s.newRequest(ctx, http.MethodGet, s.prefix+key, nil, nil)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	if resp.ContentLength < 0 {
+		resp.Body.Close()
+		return nil, ObjectInfo{}, fmt.Errorf("s3: unknown size of %s", key)
+	}
+	info := ObjectInfo{Size: resp.ContentLength}
+	modTime := resp.Header.Get(s3MetaModTime)
+	if modTime == "" {
+		modTime = resp.Header.Get("Last-Modified")
+	}
+	info.ModTime, _ = http.ParseTime(modTime)
+	return resp.Body, info, nil
+}
+
+func (s *s3Storage) Put(ctx context.Context, key string, r io.Reader, info ObjectInfo) error {
+	req, err := s.newRequest(ctx, http.MethodPut, s.prefix+key, nil, ioutil.NopCloser(r))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size
+	req.Header.Set(s3MetaModTime, info.ModTime.UTC().Format(http.TimeFormat))
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *s3Storage) Delete(ctx context.Context, key string) error {
+	req, err := s.newRequest(ctx, http.MethodDelete, s.prefix+key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err == ErrObjectNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *s3Storage) Walk(ctx context.Context, fn func(key string) error) error {
+	query := url.Values{"list-type": {"2"}, "prefix": {s.prefix}}
+	for {
+		req, err := s.newRequest(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := s.do(req)
+		if err != nil {
+			return err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, object := range result.Contents {
+			if err := fn(strings.TrimPrefix(object.Key, s.prefix)); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
@@ -0,0 +1,47 @@
+package single
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestS3OpenSize(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		chunked bool
+		ok      bool
+	}{
+		{"content length", false, true},
+		{"unknown size", true, false},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if test.chunked {
+				w.(http.Flusher).Flush()
+			} else {
+				w.Header().Set("Content-Length", "5")
+			}
+			io.WriteString(w, "hello")
+		}))
+		endpoint, _ := url.Parse(server.URL)
+		s := &s3Storage{client: server.Client(), endpoint: endpoint, bucket: "bucket", region: "us-east-1", accessKey: "key", secretKey: "secret"}
+		body, info, err := s.Open(context.Background(), "core.db")
+		if test.ok {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			} else {
+				body.Close()
+				if info.Size != 5 {
+					t.Errorf("%s: got size %d, want 5", test.name, info.Size)
+				}
+			}
+		} else if err == nil {
+			body.Close()
+			t.Errorf("%s: got size %d, want an error", test.name, info.Size)
+		}
+		server.Close()
+	}
+}
@@ -0,0 +1,153 @@
+package single
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// promote copies the object at cleanPath from ColdStorage to the disk cache.
+func (p *CachingReverseProxy) promote(ctx context.Context, cleanPath string, cachePath string) error {
+	body, info, err := p.ColdStorage.Open(ctx, p.storageKey(cleanPath))
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	fsys := p.cacheFS()
+	cacheDir := path.Dir(cachePath)
+	if err := fsys.MkdirAll(cacheDir, 0755); err != nil {
+		return err
+	}
+	tempFile, err := createTemp(fsys, cacheDir, path.Base(cachePath)+".part.*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tempFile, body)
+	if cerr := tempFile.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = fsys.Chtimes(tempFile.Name(), p.now(), info.ModTime)
+	}
+	if err == nil {
+		p.recordReplace(cachePath, info.Size)
+		err = fsys.Rename(tempFile.Name(), cachePath)
+	}
+	if err != nil {
+		fsys.Remove(tempFile.Name())
+		return err
+	}
+	p.logger().Info("promoted from cold storage", "path", cleanPath)
+	return nil
+}
+
+// writeThrough uploads r, an object being downloaded, to ColdStorage.
+func (p *CachingReverseProxy) writeThrough(cleanPath string, r ReadSeekCloser, size int64, modTime time.Time) {
+	defer r.Close()
+	err := p.ColdStorage.Put(context.Background(), p.storageKey(cleanPath), r, ObjectInfo{
+		Size:    size,
+		ModTime: modTime,
+	})
+	if err != nil {
+		p.logger().Error("write-through failed", "path", cleanPath, "err", err)
+		return
+	}
+	p.logger().Info("wrote through to cold storage", "path", cleanPath)
+}
+
+// Demote moves cached objects that were not accessed within idle from the
+// disk cache to ColdStorage.
+func (p *CachingReverseProxy) Demote(ctx context.Context, idle time.Duration) error {
+	deadline := p.now().Add(-idle)
+	fsys := p.cacheFS()
+	err := p.walkCache(func(cleanPath, cachePath string, info os.FileInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if accessTime(info).After(deadline) {
+			return nil
+		}
+		if _, ok := p.objectHandles.Load(cleanPath); ok {
+			return nil
+		}
+		f, err := openFS(fsys, cachePath)
+		if err != nil {
+			p.logger().Error("demote failed", "path", cleanPath, "err", err)
+			return nil
+		}
+		uploaded, err := f.Stat()
+		if err == nil {
+			err = p.ColdStorage.Put(ctx, p.storageKey(cleanPath), f, ObjectInfo{
+				Size:    uploaded.Size(),
+				ModTime: uploaded.ModTime(),
+			})
+		}
+		f.Close()
+		if err != nil {
+			p.logger().Error("demote failed", "path", cleanPath, "err", err)
+			return nil
+		}
+		// a download may have replaced the file during the upload
+		if current, err := fsys.Lstat(cachePath); err != nil || !sameFile(uploaded, current) {
+			p.logger().Debug("replaced while demoting, keeping", "path", cleanPath)
+			return nil
+		}
+		if p.Memory != nil {
+			p.Memory.remove(p.objectKey(cleanPath))
+		}
+		p.forgetOpenFile(cachePath)
+		p.forgetGroup(cleanPath)
+		p.recordRemove(cachePath)
+		if err := fsys.Remove(cachePath); err != nil {
+			p.logger().Error("demote failed", "path", cleanPath, "err", err)
+			return nil
+		}
+		p.recordEviction(uploaded.Size())
+		p.logger().Info("demoted to cold storage", "path", cleanPath)
+		return nil
+	})
+	if err == nil && p.Dedupe {
+		err = p.pruneBlobs()
+	}
+	return err
+}
+
+// RunDemotion calls Demote every interval until ctx is done.
+func (p *CachingReverseProxy) RunDemotion(ctx context.Context, interval time.Duration, idle time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.Demote(ctx, idle); err != nil {
+				p.logger().Error("demote failed", "err", err)
+			}
+		}
+	}
+}
+
+// purgeCold removes objects matched by match from ColdStorage and returns
+// their paths.
+func (p *CachingReverseProxy) purgeCold(ctx context.Context, match PathMatcher, dryRun bool) ([]string, error) {
+	var purged []string
+	err := p.ColdStorage.Walk(ctx, func(key string) error {
+		cleanPath, ok := p.cleanPathOfStorageKey(key)
+		if !ok || strings.HasSuffix(key, "/") || !match(cleanPath) {
+			return nil
+		}
+		if !dryRun {
+			if err := p.ColdStorage.Delete(ctx, key); err != nil {
+				return err
+			}
+		}
+		purged = append(purged, cleanPath)
+		return nil
+	})
+	return purged, err
+}
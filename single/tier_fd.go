@@ -0,0 +1,160 @@
+package single
+
+import (
+	"container/list"
+	"io"
+	"os"
+	"sync"
+)
+
+// cachedFile is an open cached file. It is a CacheFile, or a reader of a file
+// shared through a FileCache.
+type cachedFile interface {
+	io.ReadSeeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+// FileCache is an LRU of open cached files, so that frequently served objects
+// are read without opening and stating them for every request. Readers share
+// the file through ReadAt, so they do not interfere with each other.
+type FileCache struct {
+	capacity int
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type openFile struct {
+	cachePath string
+	file      CacheFile
+	info      os.FileInfo
+	// refs is the number of readers of file. The file is closed when it is
+	// evicted and has no readers.
+	refs    int
+	evicted bool
+}
+
+// NewFileCache returns a FileCache keeping up to capacity files open.
+func NewFileCache(capacity int) *FileCache {
+	return &FileCache{
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// open returns a reader of the file at cachePath, opening it with openFn
+// unless it is already open.
+func (c *FileCache) open(cachePath string, openFn func(string) (CacheFile, error)) (cachedFile, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[cachePath]; ok {
+		c.lru.MoveToFront(e)
+		f := e.Value.(*openFile)
+		f.refs++
+		c.mu.Unlock()
+		return newSharedFile(c, f), nil
+	}
+	c.mu.Unlock()
+
+	file, err := openFn(cachePath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	f := &openFile{cachePath: cachePath, file: file, info: info, refs: 1}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[cachePath]; ok {
+		// opened concurrently; this reader keeps its own file
+		f.evicted = true
+		return newSharedFile(c, f), nil
+	}
+	c.entries[cachePath] = c.lru.PushFront(f)
+	for c.lru.Len() > c.capacity {
+		c.evict(c.lru.Back())
+	}
+	return newSharedFile(c, f), nil
+}
+
+// remove closes the file at cachePath once its readers are done. It must be
+// called when the cached file is replaced or removed.
+func (c *FileCache) remove(cachePath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[cachePath]; ok {
+		c.evict(e)
+	}
+}
+
+func (c *FileCache) evict(e *list.Element) {
+	f := c.lru.Remove(e).(*openFile)
+	delete(c.entries, f.cachePath)
+	f.evicted = true
+	if f.refs == 0 {
+		f.file.Close()
+	}
+}
+
+func (c *FileCache) release(f *openFile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f.refs--
+	if f.refs == 0 && f.evicted {
+		f.file.Close()
+	}
+}
+
+// sharedFile is a reader of a file in a FileCache.
+type sharedFile struct {
+	*io.SectionReader
+	cache  *FileCache
+	f      *openFile
+	closed bool
+}
+
+func newSharedFile(c *FileCache, f *openFile) *sharedFile {
+	return &sharedFile{
+		SectionReader: io.NewSectionReader(f.file, 0, f.info.Size()),
+		cache:         c,
+		f:             f,
+	}
+}
+
+func (s *sharedFile) Stat() (os.FileInfo, error) {
+	return s.f.info, nil
+}
+
+func (s *sharedFile) Close() error {
+	if !s.closed {
+		s.closed = true
+		s.cache.release(s.f)
+	}
+	return nil
+}
+
+// openCachedFile opens the cached file at cachePath, through Files if set.
+func (p *CachingReverseProxy) openCachedFile(cachePath string) (cachedFile, error) {
+	if p.Files != nil {
+		return p.Files.open(cachePath, p.openCached)
+	}
+	f, err := p.openCached(cachePath)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// forgetOpenFile closes the file at cachePath kept open by Files, if any. It
+// must be called when the cached file is replaced or removed.
+func (p *CachingReverseProxy) forgetOpenFile(cachePath string) {
+	if p.Files != nil {
+		p.Files.remove(cachePath)
+	}
+}
@@ -0,0 +1,126 @@
+package single
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// MemoryCache is the hot tier: an LRU of small objects kept in memory in
+// front of the disk cache.
+type MemoryCache struct {
+	capacity      int64
+	maxObjectSize int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type memoryObject struct {
+	// key is the objectKey of the object, so that proxies for different
+	// namespaces can share a MemoryCache.
+	key     string
+	data    []byte
+	modTime time.Time
+	// contentType is the Content-Type served for the object.
+	contentType string
+
+	// mu guards meta, the Metadata of the object, and validated, when it
+	// was last validated with the upstream, so that hits do not read them
+	// from the disk.
+	mu        sync.Mutex
+	meta      *Metadata
+	validated time.Time
+}
+
+// state returns a copy of the metadata of o, or nil if it has none, and when
+// it was last validated.
+func (o *memoryObject) state() (*Metadata, time.Time) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.meta == nil {
+		return nil, o.validated
+	}
+	meta := *o.meta
+	return &meta, o.validated
+}
+
+// setState records a copy of meta and when o was last validated.
+func (o *memoryObject) setState(meta *Metadata, validated time.Time) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.meta = nil
+	if meta != nil {
+		m := *meta
+		o.meta = &m
+	}
+	o.validated = validated
+}
+
+// NewMemoryCache returns a MemoryCache holding up to capacity bytes of
+// objects no larger than maxObjectSize.
+func NewMemoryCache(capacity int64, maxObjectSize int64) *MemoryCache {
+	return &MemoryCache{
+		capacity:      capacity,
+		maxObjectSize: maxObjectSize,
+		lru:           list.New(),
+		entries:       make(map[string]*list.Element),
+	}
+}
+
+// accepts reports whether an object of the given size would be admitted.
+func (c *MemoryCache) accepts(size int64) bool {
+	return size <= c.maxObjectSize && size <= c.capacity
+}
+
+func (c *MemoryCache) get(key string) *memoryObject {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*memoryObject)
+}
+
+// contains reports whether the object for key is in c, without marking it
+// as used.
+func (c *MemoryCache) contains(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.entries[key]
+	return ok
+}
+
+func (c *MemoryCache) add(obj *memoryObject) {
+	if !c.accepts(int64(len(obj.data))) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[obj.key]; ok {
+		c.removeElement(e)
+	}
+	c.entries[obj.key] = c.lru.PushFront(obj)
+	c.size += int64(len(obj.data))
+	for c.size > c.capacity {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+func (c *MemoryCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.removeElement(e)
+	}
+}
+
+func (c *MemoryCache) removeElement(e *list.Element) {
+	obj := c.lru.Remove(e).(*memoryObject)
+	delete(c.entries, obj.key)
+	c.size -= int64(len(obj.data))
+}
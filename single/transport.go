@@ -0,0 +1,161 @@
+package single
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// defaultKeepAlive is the interval of TCP keep-alive probes on upstream
+// connections, as with http.DefaultTransport.
+const defaultKeepAlive = 30 * time.Second
+
+// newTransport returns the transport used for upstream requests.
+func (p *CachingReverseProxy) newTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = p.proxyForRequest
+	transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	p.dialer = &net.Dialer{Timeout: 30 * time.Second, KeepAlive: defaultKeepAlive}
+	transport.DialContext = p.dialer.DialContext
+	return transport
+}
+
+// ownTransport returns the transport of the upstream client, unless it was
+// given with WithHTTPClient.
+func (p *CachingReverseProxy) ownTransport() (*http.Transport, bool) {
+	if p.externalClient {
+		return nil, false
+	}
+	return p.client.Transport.(*http.Transport), true
+}
+
+// proxyForRequest returns the forward proxy for an upstream request, as
+// configured by the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment
+// variables unless IgnoreProxyEnvironment is set.
+func (p *CachingReverseProxy) proxyForRequest(req *http.Request) (*url.URL, error) {
+	if p.IgnoreProxyEnvironment {
+		return nil, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// SetUpstreamProtocol selects the HTTP versions used for upstream requests:
+//
+//   - "auto", the default, uses HTTP/2 when the upstream offers it over TLS,
+//     and HTTP/1.1 otherwise.
+//   - "http1" always uses HTTP/1.1.
+//   - "http2" always uses HTTP/2, over TLS for https upstreams and
+//     unencrypted with prior knowledge (h2c) for http upstreams.
+//
+// HTTP/3 is not supported.
+func (p *CachingReverseProxy) SetUpstreamProtocol(name string) error {
+	var protocols http.Protocols
+	switch name {
+	case "auto":
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(true)
+	case "http1":
+		protocols.SetHTTP1(true)
+	case "http2":
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+	default:
+		return fmt.Errorf("unknown upstream protocol %q", name)
+	}
+	transport, ok := p.ownTransport()
+	if !ok {
+		return errors.New("the upstream protocol cannot be set with WithHTTPClient")
+	}
+	transport.Protocols = &protocols
+	return nil
+}
+
+// SetUpstreamTimeouts limits the time to connect to the upstream, including
+// the TLS handshake, the time to wait for the response headers once the
+// request is sent, and the time idle upstream connections are kept open.
+// Zero means no limit. It has no effect with WithHTTPClient.
+func (p *CachingReverseProxy) SetUpstreamTimeouts(connect, header, idle time.Duration) {
+	transport, ok := p.ownTransport()
+	if !ok {
+		return
+	}
+	p.dialer.Timeout = connect
+	transport.TLSHandshakeTimeout = connect
+	transport.ResponseHeaderTimeout = header
+	transport.IdleConnTimeout = idle
+}
+
+// SetUpstreamConnections tunes the reuse of upstream connections, such as
+// for the many small signatures and databases requested by package managers:
+//
+//   - maxIdlePerHost idle connections to each upstream host are kept open
+//     for later requests, 16 if zero.
+//   - At most maxPerHost connections to each host are open at a time, with
+//     further requests waiting for one, or any number if zero.
+//   - Connections are probed every keepAlive, with TCP keep-alives, and with
+//     pings for idle HTTP/2 connections, so that connections dropped by the
+//     network are found before they are reused. The interval is 30s if zero,
+//     and negative values disable the probes.
+//
+// It has no effect with WithHTTPClient.
+func (p *CachingReverseProxy) SetUpstreamConnections(maxIdlePerHost, maxPerHost int, keepAlive time.Duration) {
+	transport, ok := p.ownTransport()
+	if !ok {
+		return
+	}
+	if maxIdlePerHost <= 0 {
+		maxIdlePerHost = maxIdleConnsPerHost
+	}
+	if keepAlive == 0 {
+		keepAlive = defaultKeepAlive
+	}
+	transport.MaxIdleConnsPerHost = maxIdlePerHost
+	transport.MaxIdleConns = max(transport.MaxIdleConns, maxIdlePerHost)
+	transport.MaxConnsPerHost = maxPerHost
+	p.dialer.KeepAlive = keepAlive
+	if keepAlive > 0 {
+		transport.HTTP2 = &http.HTTP2Config{SendPingTimeout: keepAlive}
+	} else {
+		transport.HTTP2 = nil
+	}
+}
+
+// maxIdleConns returns the number of idle connections to each upstream host
+// kept open.
+func (p *CachingReverseProxy) maxIdleConns() int {
+	if transport, ok := p.ownTransport(); ok {
+		return transport.MaxIdleConnsPerHost
+	}
+	return maxIdleConnsPerHost
+}
+
+// upstreamContext returns the context of the upstream request made for r.
+// It is canceled when the client of r goes away, until detach is called to
+// let a download into the cache outlive r, and then after DownloadTimeout.
+// Responses relayed to the client are not limited by DownloadTimeout. cancel
+// must be called once the response is no longer needed.
+func (p *CachingReverseProxy) upstreamContext(r *http.Request) (ctx context.Context, detach func(), cancel context.CancelFunc) {
+	ctx, cancel = context.WithCancel(context.Background())
+	stop := context.AfterFunc(r.Context(), cancel)
+	detach = func() {
+		stop()
+		if p.DownloadTimeout > 0 {
+			timer := time.AfterFunc(p.DownloadTimeout, cancel)
+			context.AfterFunc(ctx, func() { timer.Stop() })
+		}
+	}
+	return ctx, detach, cancel
+}
+
+// downloadContext returns the context of an upstream request downloading
+// an object into the cache, which is canceled after DownloadTimeout.
+func (p *CachingReverseProxy) downloadContext() (context.Context, context.CancelFunc) {
+	if p.DownloadTimeout > 0 {
+		return context.WithTimeout(context.Background(), p.DownloadTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
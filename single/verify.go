@@ -0,0 +1,188 @@
+package single
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+)
+
+// VerifyOptions configures Verify.
+type VerifyOptions struct {
+	// Delay is the pause before verifying each object, so that the cache
+	// is verified at a low rate.
+	Delay time.Duration
+	// Upstream also revalidates each object with the upstream in a
+	// conditional HEAD request, to find objects changed upstream, and
+	// compares its size with that of the same version upstream, to find
+	// objects truncated before any metadata recorded their size.
+	Upstream bool
+	// Refetch downloads the corrupt and changed objects again once removed.
+	Refetch bool
+	// DryRun reports corrupt objects without removing them.
+	DryRun bool
+}
+
+// VerifyItem is a corrupt object found by Verify.
+type VerifyItem struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Reason string `json:"reason"`
+}
+
+// VerifyReport lists the corrupt objects found by Verify.
+type VerifyReport struct {
+	DryRun  bool         `json:"dry_run"`
+	Checked int          `json:"checked"`
+	Corrupt []VerifyItem `json:"corrupt"`
+}
+
+// Verify walks the cache looking for corrupt objects, which would otherwise
+// be served as long as the upstream does not change them: objects whose size
+// or SHA-256 differs from their metadata, whose size differs from that of
+// the same version upstream, or which are empty without the metadata or the
+// upstream telling they should be. With opts.Upstream, objects changed
+// upstream, which may be served stale, are reported too. Reported objects
+// are removed, unless opts.DryRun is set. Verify stops early when ctx is
+// done.
+func (p *CachingReverseProxy) Verify(ctx context.Context, opts VerifyOptions) (*VerifyReport, error) {
+	report := &VerifyReport{DryRun: opts.DryRun, Corrupt: []VerifyItem{}}
+	err := p.walkCache(func(cleanPath, cachePath string, info os.FileInfo) error {
+		if !sleepCtx(ctx, opts.Delay) {
+			return ctx.Err()
+		}
+		report.Checked++
+		meta := p.cachedMetadata(cleanPath)
+		reason := p.verifyObject(ctx, cleanPath, cachePath, info, meta, opts.Upstream)
+		if reason == "" {
+			return nil
+		}
+		p.logger().Warn("corrupt cached object", "path", cleanPath, "reason", reason, "dry_run", opts.DryRun)
+		report.Corrupt = append(report.Corrupt, VerifyItem{Path: cleanPath, Size: info.Size(), Reason: reason})
+		if opts.DryRun {
+			return nil
+		}
+		if current, err := p.cacheFS().Stat(cachePath); err != nil || !sameFile(info, current) {
+			// replaced while verified
+			return nil
+		}
+		if p.Dedupe && meta != nil && meta.SHA256 != "" {
+			// the blob is the same file, and must not be linked again
+			blob := p.blobPath(meta.SHA256)
+			if blobInfo, err := os.Stat(blob); err == nil && os.SameFile(info, blobInfo) {
+				os.Remove(blob)
+			}
+		}
+		if err := p.evictObject(cleanPath); err != nil {
+			return err
+		}
+		if opts.Refetch {
+			p.Prefetch(cleanPath)
+		}
+		return nil
+	})
+	return report, err
+}
+
+// verifyObject returns why the object at cleanPath, cached at cachePath and
+// described by info and meta, is corrupt, or "" if it is not known to be.
+func (p *CachingReverseProxy) verifyObject(ctx context.Context, cleanPath, cachePath string, info os.FileInfo, meta *Metadata, upstream bool) string {
+	verified := false
+	if meta != nil && meta.Size > 0 {
+		if meta.Size != info.Size() {
+			return "size differs from metadata"
+		}
+		verified = true
+	}
+	if meta != nil && meta.SHA256 != "" {
+		sum, err := sha256File(p.cacheFS(), cachePath)
+		if err != nil {
+			p.logger().Warn("cannot verify", "path", cleanPath, "err", err)
+			return ""
+		}
+		// reading may have updated the access time, which records when
+		// the object was last accessed by clients
+		if current, err := p.cacheFS().Stat(cachePath); err == nil && sameFile(info, current) && !accessTime(current).Equal(accessTime(info)) {
+			p.cacheFS().Chtimes(cachePath, accessTime(info), info.ModTime())
+		}
+		if sum != meta.SHA256 {
+			return "digest differs from metadata"
+		}
+		verified = true
+	}
+	if upstream {
+		size, changed, ok := p.revalidateUpstream(ctx, cleanPath, info.ModTime(), meta)
+		if changed {
+			return "changed upstream"
+		}
+		if ok && !verified && size >= 0 && size != info.Size() {
+			return "size differs from upstream"
+		}
+		verified = verified || ok && size >= 0
+	}
+	if !verified && info.Size() == 0 {
+		return "empty"
+	}
+	return ""
+}
+
+// revalidateUpstream asks the upstream whether the object at cleanPath,
+// cached as the version modified at modTime and described by meta, changed,
+// with a conditional HEAD request. If it did not, ok is true and size is the
+// size of the version upstream, or -1 if the upstream did not tell.
+func (p *CachingReverseProxy) revalidateUpstream(ctx context.Context, cleanPath string, modTime time.Time, meta *Metadata) (size int64, changed bool, ok bool) {
+	req, err := p.newUpstreamRequest(http.MethodHead, cleanPath)
+	if err != nil {
+		return 0, false, false
+	}
+	req.Header.Set("If-Modified-Since", modTime.UTC().Format(http.TimeFormat))
+	if meta != nil && meta.ETag != "" {
+		req.Header.Set("If-None-Match", meta.ETag)
+	}
+	resp, err := p.doUpstream(req.WithContext(ctx))
+	if err != nil {
+		p.logger().Debug("cannot verify with the upstream", "path", cleanPath, "err", err)
+		return 0, false, false
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return -1, false, true
+	case http.StatusOK:
+	default:
+		return 0, false, false
+	}
+	if etag := resp.Header.Get("ETag"); meta != nil && meta.ETag != "" && etag != "" && etag != meta.ETag {
+		return 0, true, false
+	}
+	// objects cached forever may have no Last-Modified
+	if lastModified := resp.Header.Get("Last-Modified"); lastModified != "" {
+		upstreamModTime, err := time.Parse(http.TimeFormat, lastModified)
+		if err != nil {
+			return 0, false, false
+		}
+		if !upstreamModTime.Equal(modTime.Truncate(time.Second)) {
+			return 0, true, false
+		}
+	}
+	return resp.ContentLength, false, true
+}
+
+// RunVerification verifies the cache with opts every interval until ctx is
+// done.
+func (p *CachingReverseProxy) RunVerification(ctx context.Context, interval time.Duration, opts VerifyOptions) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		report, err := p.Verify(ctx, opts)
+		if err != nil && ctx.Err() == nil {
+			p.logger().Error("verify failed", "err", err)
+		}
+		p.logger().Info("verified cache", "checked", report.Checked, "corrupt", len(report.Corrupt))
+	}
+}
@@ -0,0 +1,190 @@
+package single
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mapStore is a MetadataStore keeping metadata in memory.
+type mapStore struct {
+	mu   sync.Mutex
+	meta map[string]*Metadata
+}
+
+func (s *mapStore) Get(cleanPath string) (*Metadata, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m, ok := s.meta[cleanPath]; ok {
+		c := *m
+		return &c, nil
+	}
+	return nil, nil
+}
+
+func (s *mapStore) Put(cleanPath string, m *Metadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := *m
+	s.meta[cleanPath] = &c
+	return nil
+}
+
+func (s *mapStore) Delete(cleanPath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.meta, cleanPath)
+	return nil
+}
+
+func (s *mapStore) Close() error {
+	return nil
+}
+
+func TestVerifyUpstream(t *testing.T) {
+	modTime := time.Unix(1e9, 0)
+	// upstreamObjects are the objects of the upstream, which answers
+	// conditional requests for those that are conditional
+	upstreamObjects := map[string]struct {
+		size        int
+		modTime     time.Time
+		etag        string
+		conditional bool
+	}{
+		"/unchanged":    {100, modTime, "", true},
+		"/changed":      {100, modTime.Add(time.Hour), "", true},
+		"/truncated":    {100, modTime, "", false},
+		"/etag-changed": {100, modTime, `"v2"`, false},
+		"/bad-size":     {100, modTime, "", true},
+	}
+	var mu sync.Mutex
+	requests := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		object, ok := upstreamObjects[r.URL.Path]
+		if !ok || r.Method != http.MethodHead {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Last-Modified", object.modTime.UTC().Format(http.TimeFormat))
+		if object.etag != "" {
+			w.Header().Set("ETag", object.etag)
+		}
+		if object.conditional {
+			since, err := time.Parse(http.TimeFormat, r.Header.Get("If-Modified-Since"))
+			if err == nil && !object.modTime.After(since) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(object.size))
+	}))
+	defer upstream.Close()
+
+	for _, test := range []struct {
+		name    string
+		opts    VerifyOptions
+		corrupt map[string]string
+	}{
+		{
+			name: "cache only",
+			opts: VerifyOptions{},
+			corrupt: map[string]string{
+				"/empty":    "empty",
+				"/bad-size": "size differs from metadata",
+			},
+		},
+		{
+			name: "upstream",
+			opts: VerifyOptions{Upstream: true},
+			corrupt: map[string]string{
+				"/empty":        "empty",
+				"/bad-size":     "size differs from metadata",
+				"/changed":      "changed upstream",
+				"/truncated":    "size differs from upstream",
+				"/etag-changed": "changed upstream",
+			},
+		},
+		{
+			name: "upstream dry run",
+			opts: VerifyOptions{Upstream: true, DryRun: true},
+			corrupt: map[string]string{
+				"/empty":        "empty",
+				"/bad-size":     "size differs from metadata",
+				"/changed":      "changed upstream",
+				"/truncated":    "size differs from upstream",
+				"/etag-changed": "changed upstream",
+			},
+		},
+	} {
+		p, fsys := newMemProxy(t, upstream.URL)
+		p.Metadata = &mapStore{meta: map[string]*Metadata{
+			"/etag-changed": {ETag: `"v1"`},
+			"/bad-size":     {Size: 200},
+		}}
+		cached := map[string]int{
+			"/unchanged":    100,
+			"/changed":      100,
+			"/truncated":    50,
+			"/etag-changed": 100,
+			"/bad-size":     100,
+			"/empty":        0,
+			// not found upstream, so not known to be corrupt
+			"/gone": 100,
+		}
+		for cleanPath, size := range cached {
+			putObject(t, p, fsys, cleanPath, size)
+			if err := fsys.Chtimes(path.Join(p.cacheRoot(), cleanPath), modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mu.Lock()
+		requests = 0
+		mu.Unlock()
+		report, err := p.Verify(context.Background(), test.opts)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if report.Checked != len(cached) || report.DryRun != test.opts.DryRun {
+			t.Errorf("%s: checked %d with dry run %v, want %d with %v", test.name, report.Checked, report.DryRun, len(cached), test.opts.DryRun)
+		}
+		corrupt := make(map[string]string)
+		for _, item := range report.Corrupt {
+			corrupt[item.Path] = item.Reason
+		}
+		if !reflect.DeepEqual(corrupt, test.corrupt) {
+			t.Errorf("%s: corrupt %v, want %v", test.name, corrupt, test.corrupt)
+		}
+		var kept []string
+		for cleanPath := range cached {
+			if _, err := fsys.Stat(path.Join(p.cacheRoot(), cleanPath)); err == nil {
+				kept = append(kept, cleanPath)
+			}
+		}
+		var want []string
+		for cleanPath := range cached {
+			if _, ok := test.corrupt[cleanPath]; !ok || test.opts.DryRun {
+				want = append(want, cleanPath)
+			}
+		}
+		sort.Strings(kept)
+		sort.Strings(want)
+		if !reflect.DeepEqual(kept, want) {
+			t.Errorf("%s: kept %q, want %q", test.name, kept, want)
+		}
+		mu.Lock()
+		if !test.opts.Upstream && requests != 0 {
+			t.Errorf("%s: upstream received %d requests, want 0", test.name, requests)
+		}
+		mu.Unlock()
+	}
+}
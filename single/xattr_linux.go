@@ -0,0 +1,40 @@
+package single
+
+import "syscall"
+
+func setxattr(path string, name string, value []byte) error {
+	return syscall.Setxattr(path, name, value, 0)
+}
+
+// getxattr returns the value of the extended attribute name of path,
+// or nil if the attribute does not exist.
+func getxattr(path string, name string) ([]byte, error) {
+	for {
+		size, err := syscall.Getxattr(path, name, nil)
+		if err == syscall.ENODATA {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		size, err = syscall.Getxattr(path, name, value)
+		if err == syscall.ERANGE {
+			// the attribute grew between the calls
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return value[:size], nil
+	}
+}
+
+// removexattr removes the extended attribute name of path if it exists.
+func removexattr(path string, name string) error {
+	err := syscall.Removexattr(path, name)
+	if err == syscall.ENODATA {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package single
+
+func setxattr(path string, name string, value []byte) error {
+	return errXattrUnsupported
+}
+
+func getxattr(path string, name string) ([]byte, error) {
+	return nil, errXattrUnsupported
+}
+
+func removexattr(path string, name string) error {
+	return errXattrUnsupported
+}
@@ -0,0 +1,411 @@
+package single
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+)
+
+// zchunkMagic starts every zchunk file.
+const zchunkMagic = "\x00ZCK1"
+
+// zchunkMaxHeaderSize is the largest zchunk header read, which is held in
+// memory.
+const zchunkMaxHeaderSize = 16 << 20
+
+// zchunkMaxChunks is the largest number of chunks of files updated with
+// zchunk.
+const zchunkMaxChunks = 1 << 20
+
+// zchunkLeadFetch is how much of a zchunk file is requested to read its
+// lead, which tells the size of the rest of the header.
+const zchunkLeadFetch = 4096
+
+// Flags of the preface of zchunk headers.
+const (
+	zchunkDataStreams          = 1 << 0
+	zchunkOptionalElements     = 1 << 1
+	zchunkUncompressedChecksum = 1 << 2
+)
+
+// zchunkHeader is the parsed header of a zchunk file. The file is the header
+// followed by its chunks, each compressed on its own and listed in the index
+// of the header with its checksum, so that chunks already present locally
+// need not be downloaded.
+type zchunkHeader struct {
+	// size is the size of the lead and the header, where the chunks start.
+	size int64
+	// leadSize is the size of the lead, which ends with the header
+	// checksum, of the type checksumType, over the rest of the header.
+	leadSize       int64
+	checksumType   int64
+	headerChecksum []byte
+	// dataChecksum is the checksum, of the type checksumType, of the chunks.
+	dataChecksum      []byte
+	chunkChecksumType int64
+	chunks            []zchunkEntry
+}
+
+// zchunkEntry is a chunk listed in the index of a zchunk header.
+type zchunkEntry struct {
+	checksum []byte
+	length   int64
+}
+
+// zchunkReader is what zchunk headers are parsed from.
+type zchunkReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// newZchunkHash returns a hash for the zchunk checksum type t.
+func newZchunkHash(t int64) (hash.Hash, error) {
+	switch t {
+	case 0:
+		return sha1.New(), nil
+	case 1:
+		return sha256.New(), nil
+	case 2:
+		return sha512.New(), nil
+	case 3:
+		return &truncatedHash{Hash: sha512.New(), size: 16}, nil
+	}
+	return nil, fmt.Errorf("unknown zchunk checksum type %d", t)
+}
+
+// truncatedHash is a hash whose sum is the first size bytes of that of Hash.
+type truncatedHash struct {
+	hash.Hash
+	size int
+}
+
+func (h *truncatedHash) Sum(b []byte) []byte {
+	return append(b, h.Hash.Sum(nil)[:h.size]...)
+}
+
+func (h *truncatedHash) Size() int {
+	return h.size
+}
+
+// skipHash is a hash of what is written to it after the first skip bytes.
+type skipHash struct {
+	hash.Hash
+	skip int64
+}
+
+func (h *skipHash) Write(p []byte) (int, error) {
+	n := len(p)
+	if h.skip >= int64(n) {
+		h.skip -= int64(n)
+		return n, nil
+	}
+	h.Hash.Write(p[h.skip:])
+	h.skip = 0
+	return n, nil
+}
+
+// readZchunkInt reads a compressed integer of zchunk: seven bits per byte,
+// least significant first, the last byte having its high bit set.
+func readZchunkInt(r io.ByteReader) (int64, error) {
+	var v int64
+	for shift := uint(0); shift < 63; shift += 7 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		v |= int64(b&0x7f) << shift
+		if b&0x80 != 0 {
+			return v, nil
+		}
+	}
+	return 0, errors.New("zchunk integer too large")
+}
+
+// readZchunkChecksum reads a checksum of the zchunk checksum type t.
+func readZchunkChecksum(r io.Reader, t int64) ([]byte, error) {
+	h, err := newZchunkHash(t)
+	if err != nil {
+		return nil, err
+	}
+	checksum := make([]byte, h.Size())
+	_, err = io.ReadFull(r, checksum)
+	return checksum, err
+}
+
+// countingZchunkReader counts the bytes read from r.
+type countingZchunkReader struct {
+	r zchunkReader
+	n int64
+}
+
+func (c *countingZchunkReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingZchunkReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// parseZchunkLead parses the lead of the zchunk file read by r, which tells
+// the size of the header, leaving r at the rest of the header.
+func parseZchunkLead(r zchunkReader) (*zchunkHeader, error) {
+	cr := &countingZchunkReader{r: r}
+	magic := make([]byte, len(zchunkMagic))
+	if _, err := io.ReadFull(cr, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != zchunkMagic {
+		return nil, errors.New("not a zchunk file")
+	}
+	h := &zchunkHeader{}
+	var err error
+	if h.checksumType, err = readZchunkInt(cr); err != nil {
+		return nil, err
+	}
+	headerSize, err := readZchunkInt(cr)
+	if err != nil {
+		return nil, err
+	}
+	if h.headerChecksum, err = readZchunkChecksum(cr, h.checksumType); err != nil {
+		return nil, err
+	}
+	h.leadSize = cr.n
+	h.size = h.leadSize + headerSize
+	if headerSize < 0 || h.size > zchunkMaxHeaderSize {
+		return nil, fmt.Errorf("invalid zchunk header size %d", headerSize)
+	}
+	return h, nil
+}
+
+// parseZchunk parses the lead and the header of the zchunk file read by r,
+// leaving r at the signatures.
+func parseZchunk(r zchunkReader) (*zchunkHeader, error) {
+	h, err := parseZchunkLead(r)
+	if err != nil {
+		return nil, err
+	}
+	headerSize := h.size - h.leadSize
+	// read reads the next compressed integer of the header
+	read := func() int64 {
+		var v int64
+		if err == nil {
+			v, err = readZchunkInt(r)
+		}
+		return v
+	}
+	if h.dataChecksum, err = readZchunkChecksum(r, h.checksumType); err != nil {
+		return nil, err
+	}
+	flags := read()
+	read() // compression type
+	if flags&zchunkOptionalElements != 0 {
+		for n := read(); err == nil && n > 0; n-- {
+			read() // element id
+			size := read()
+			if err == nil && (size < 0 || size > headerSize) {
+				err = fmt.Errorf("invalid zchunk optional element size %d", size)
+			}
+			if err == nil {
+				_, err = io.CopyN(io.Discard, r, size)
+			}
+		}
+	}
+	read() // index size
+	h.chunkChecksumType = read()
+	count := read()
+	if err != nil {
+		return nil, err
+	}
+	if count < 0 || count > zchunkMaxChunks {
+		return nil, fmt.Errorf("invalid zchunk chunk count %d", count)
+	}
+	// the first chunk is the dictionary, possibly empty
+	h.chunks = make([]zchunkEntry, count)
+	for i := range h.chunks {
+		if flags&zchunkDataStreams != 0 {
+			read() // stream
+		}
+		if err != nil {
+			return nil, err
+		}
+		c := &h.chunks[i]
+		if c.checksum, err = readZchunkChecksum(r, h.chunkChecksumType); err != nil {
+			return nil, err
+		}
+		if flags&zchunkUncompressedChecksum != 0 {
+			if _, err = readZchunkChecksum(r, h.chunkChecksumType); err != nil {
+				return nil, err
+			}
+		}
+		c.length = read()
+		read() // uncompressed length
+		if err == nil && c.length < 0 {
+			err = fmt.Errorf("invalid zchunk chunk length %d", c.length)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// verify checks raw, the lead and header parsed as h, against the header
+// checksum, which covers all of it but the checksum itself.
+func (h *zchunkHeader) verify(raw []byte) error {
+	sum, err := newZchunkHash(h.checksumType)
+	if err != nil {
+		return err
+	}
+	sum.Write(raw[:h.leadSize-int64(len(h.headerChecksum))])
+	sum.Write(raw[h.leadSize:h.size])
+	if got := sum.Sum(nil); !bytes.Equal(got, h.headerChecksum) {
+		return fmt.Errorf("zchunk header checksum mismatch: want %x, got %x", h.headerChecksum, got)
+	}
+	return nil
+}
+
+// dataSize returns the size of the chunks of the file.
+func (h *zchunkHeader) dataSize() int64 {
+	var size int64
+	for _, c := range h.chunks {
+		size += c.length
+	}
+	return size
+}
+
+// zchunkBody returns the content of the upstream response resp for the
+// zchunk file cleanPath, reconstructed from the chunks of the cached version
+// at cachePath that are still listed in the header of the new version and
+// ranges of the other chunks downloaded from the upstream. The returned
+// digest must be verified once the body is read.
+func (p *CachingReverseProxy) zchunkBody(cleanPath string, cachePath string, resp *http.Response) (io.ReadCloser, *expectedDigest, error) {
+	lastModified := resp.Header.Get("Last-Modified")
+	// the cached file is read after the request is served
+	old, err := openFS(p.cacheFS(), cachePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	oldHeader, err := parseZchunk(bufio.NewReader(old))
+	if err != nil {
+		old.Close()
+		return nil, nil, fmt.Errorf("cached version: %v", err)
+	}
+	header, raw, err := p.zchunkHeader(cleanPath, resp.ContentLength, lastModified)
+	if err != nil {
+		old.Close()
+		return nil, nil, err
+	}
+	if header.chunkChecksumType != oldHeader.chunkChecksumType {
+		old.Close()
+		return nil, nil, errNoDelta
+	}
+	cached := make(map[string]int64)
+	off := oldHeader.size
+	for _, c := range oldHeader.chunks {
+		cached[hex.EncodeToString(c.checksum)] = off
+		off += c.length
+	}
+	offsets := make([]int64, len(header.chunks))
+	reused := 0
+	for i, c := range header.chunks {
+		offsets[i] = -1
+		if off, ok := cached[hex.EncodeToString(c.checksum)]; ok && c.length > 0 {
+			offsets[i] = off
+			reused++
+		}
+	}
+	p.logger().Info("reusing chunks with zchunk", "path", cleanPath, "reused", reused, "chunks", len(offsets))
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer old.Close()
+		pw.CloseWithError(p.writeZchunk(pw, cleanPath, header, raw, offsets, old, lastModified))
+	}()
+	sum, err := newZchunkHash(header.checksumType)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the data checksum does not cover the header, checked already
+	digest := &expectedDigest{header: "zchunk", alg: "data checksum", want: header.dataChecksum, hash: &skipHash{Hash: sum, skip: header.size}}
+	return pr, digest, nil
+}
+
+// zchunkHeader downloads and checks the header of the zchunk file cleanPath
+// of size bytes, modified at lastModified, and returns it, parsed and raw.
+func (p *CachingReverseProxy) zchunkHeader(cleanPath string, size int64, lastModified string) (*zchunkHeader, []byte, error) {
+	var buf bytes.Buffer
+	fetched := min(size, zchunkLeadFetch)
+	if err := p.copyRange(&buf, cleanPath, 0, fetched, lastModified); err != nil {
+		return nil, nil, err
+	}
+	lead, err := parseZchunkLead(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return nil, nil, err
+	}
+	if lead.size > size {
+		return nil, nil, fmt.Errorf("zchunk header of %d bytes is larger than the file", lead.size)
+	}
+	if lead.size > fetched {
+		if err := p.copyRange(&buf, cleanPath, fetched, lead.size, lastModified); err != nil {
+			return nil, nil, err
+		}
+	}
+	header, err := parseZchunk(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return nil, nil, err
+	}
+	raw := buf.Bytes()[:header.size]
+	if err := header.verify(raw); err != nil {
+		return nil, nil, err
+	}
+	if header.size+header.dataSize() != size {
+		return nil, nil, fmt.Errorf("zchunk header is for a file of %d bytes, upstream has %d", header.size+header.dataSize(), size)
+	}
+	return header, raw, nil
+}
+
+// writeZchunk writes the new zchunk file to w: its header raw, parsed as
+// header, then its chunks, copying those at offsets in old and downloading
+// the others. lastModified ensures the ranges come from the same version as
+// the header.
+func (p *CachingReverseProxy) writeZchunk(w io.Writer, cleanPath string, header *zchunkHeader, raw []byte, offsets []int64, old io.ReaderAt, lastModified string) error {
+	if _, err := w.Write(raw); err != nil {
+		return err
+	}
+	start := header.size
+	for i := 0; i < len(offsets); {
+		if off := offsets[i]; off >= 0 {
+			if err := copyAt(w, old, off, header.chunks[i].length); err != nil {
+				return err
+			}
+			start += header.chunks[i].length
+			i++
+			continue
+		}
+		end := start
+		for ; i < len(offsets) && offsets[i] < 0; i++ {
+			end += header.chunks[i].length
+		}
+		if end > start {
+			if err := p.copyRange(w, cleanPath, start, end, lastModified); err != nil {
+				return err
+			}
+		}
+		start = end
+	}
+	return nil
+}
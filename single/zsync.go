@@ -0,0 +1,400 @@
+package single
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// zsyncMaxBlocks is the largest number of blocks of files updated with
+// zsync, whose checksums are held in memory.
+const zsyncMaxBlocks = 1 << 18
+
+// zsyncMaxControlSize is the largest zsync control file read.
+const zsyncMaxControlSize = 16 << 20
+
+// zsyncWindow is how much of the cached version is held in memory at a time,
+// besides a block, while looking for the blocks of the new version in it.
+const zsyncWindow = 1 << 20
+
+// zsyncControl is a parsed .zsync control file. It lists checksums of each
+// block of the file so that blocks already present locally need not be
+// downloaded.
+type zsyncControl struct {
+	blockSize     int
+	length        int64
+	rsumBytes     int
+	checksumBytes int
+	sha1          []byte
+	rsums         []uint32
+	// checksums are the strong checksums of the blocks, of checksumBytes
+	// each.
+	checksums []byte
+}
+
+func parseZsync(r io.Reader) (*zsyncControl, error) {
+	br := bufio.NewReader(r)
+	c := &zsyncControl{}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		colon := strings.Index(line, ": ")
+		if colon < 0 {
+			return nil, fmt.Errorf("malformed zsync header %q", line)
+		}
+		key, value := line[:colon], line[colon+2:]
+		switch key {
+		case "Blocksize":
+			c.blockSize, err = strconv.Atoi(value)
+		case "Length":
+			c.length, err = strconv.ParseInt(value, 10, 64)
+		case "Hash-Lengths":
+			var seqMatches int
+			_, err = fmt.Sscanf(value, "%d,%d,%d", &seqMatches, &c.rsumBytes, &c.checksumBytes)
+		case "SHA-1":
+			c.sha1, err = hex.DecodeString(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("zsync header %s: %v", key, err)
+		}
+	}
+	switch {
+	case c.blockSize <= 0 || c.blockSize > 1<<20:
+		return nil, fmt.Errorf("invalid zsync block size %d", c.blockSize)
+	case c.length < 0 || (c.length+int64(c.blockSize)-1)/int64(c.blockSize) > zsyncMaxBlocks:
+		return nil, fmt.Errorf("invalid zsync length %d", c.length)
+	case c.rsumBytes < 1 || c.rsumBytes > 4 || c.checksumBytes < 1 || c.checksumBytes > 16:
+		return nil, errors.New("invalid zsync hash lengths")
+	case len(c.sha1) != sha1.Size:
+		return nil, errors.New("missing zsync SHA-1")
+	}
+
+	blocks := int((c.length + int64(c.blockSize) - 1) / int64(c.blockSize))
+	c.rsums = make([]uint32, blocks)
+	c.checksums = make([]byte, 0, blocks*c.checksumBytes)
+	buf := make([]byte, c.rsumBytes+c.checksumBytes)
+	for i := 0; i < blocks; i++ {
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, err
+		}
+		var rsum [4]byte
+		copy(rsum[4-c.rsumBytes:], buf[:c.rsumBytes])
+		c.rsums[i] = binary.BigEndian.Uint32(rsum[:])
+		c.checksums = append(c.checksums, buf[c.rsumBytes:]...)
+	}
+	return c, nil
+}
+
+// checksum returns the strong checksum of block i.
+func (c *zsyncControl) checksum(i int) []byte {
+	return c.checksums[i*c.checksumBytes : (i+1)*c.checksumBytes]
+}
+
+// rsumMask returns the bits of the rolling checksum stored in the control
+// file.
+func (c *zsyncControl) rsumMask() uint32 {
+	if c.rsumBytes == 4 {
+		return 0xffffffff
+	}
+	return 1<<(8*uint(c.rsumBytes)) - 1
+}
+
+// blockLength returns the length of block i, the last block may be short.
+func (c *zsyncControl) blockLength(i int) int64 {
+	if rest := c.length - int64(i)*int64(c.blockSize); rest < int64(c.blockSize) {
+		return rest
+	}
+	return int64(c.blockSize)
+}
+
+// rollingSum is the weak checksum of zsync, which can be moved forward one
+// byte at a time.
+type rollingSum struct {
+	a, b uint16
+}
+
+func newRollingSum(block []byte) rollingSum {
+	var s rollingSum
+	for _, c := range block {
+		s.a += uint16(c)
+		s.b += s.a
+	}
+	return s
+}
+
+func (s *rollingSum) roll(out, in byte, blockSize int) {
+	s.a += uint16(in) - uint16(out)
+	s.b += s.a - uint16(blockSize)*uint16(out)
+}
+
+func (s rollingSum) value() uint32 {
+	return uint32(s.a)<<16 | uint32(s.b)
+}
+
+// match returns, for every block of the new file, its offset in old or -1 if
+// it has to be downloaded. old is read once, zsyncWindow at a time.
+func (c *zsyncControl) match(old io.Reader) ([]int64, error) {
+	offsets := make([]int64, len(c.rsums))
+	candidates := make(map[uint32][]int)
+	for i := range offsets {
+		offsets[i] = -1
+		// the short last block is zero padded and would rarely match
+		if c.blockLength(i) == int64(c.blockSize) {
+			candidates[c.rsums[i]] = append(candidates[c.rsums[i]], i)
+		}
+	}
+	bs := c.blockSize
+	mask := c.rsumMask()
+	buf := make([]byte, 0, zsyncWindow+bs)
+	// base is the offset in old of buf[0], and pos the position in buf of
+	// the block looked up
+	var base int64
+	pos := 0
+	eof := false
+	// fill reads old until buf holds the block at pos, or old ends
+	fill := func() error {
+		if pos+bs > cap(buf) {
+			buf = buf[:copy(buf, buf[pos:])]
+			base += int64(pos)
+			pos = 0
+		}
+		for !eof && len(buf) < pos+bs {
+			n, err := old.Read(buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+n]
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := fill(); err != nil {
+		return nil, err
+	}
+	var sum rollingSum
+	if len(buf) >= bs {
+		sum = newRollingSum(buf[:bs])
+	}
+	for pos+bs <= len(buf) {
+		matched := false
+		if blocks, ok := candidates[sum.value()&mask]; ok {
+			checksum := md4Sum(buf[pos : pos+bs])
+			for _, i := range blocks {
+				if offsets[i] < 0 && bytes.Equal(checksum[:c.checksumBytes], c.checksum(i)) {
+					offsets[i] = base + int64(pos)
+					matched = true
+				}
+			}
+		}
+		if matched {
+			pos += bs
+			if err := fill(); err != nil {
+				return nil, err
+			}
+			if pos+bs <= len(buf) {
+				sum = newRollingSum(buf[pos : pos+bs])
+			}
+			continue
+		}
+		out := buf[pos]
+		pos++
+		if err := fill(); err != nil {
+			return nil, err
+		}
+		if pos+bs <= len(buf) {
+			sum.roll(out, buf[pos+bs-1], bs)
+		}
+	}
+	return offsets, nil
+}
+
+// zsyncBody returns the content of the upstream response resp for cleanPath,
+// reconstructed from the blocks of the cached version at cachePath that are
+// still valid and ranges downloaded from the upstream. The returned digest
+// must be verified once the body is read.
+func (p *CachingReverseProxy) zsyncBody(cleanPath string, cachePath string, resp *http.Response) (io.ReadCloser, *expectedDigest, error) {
+	req, err := p.newUpstreamRequest(http.MethodGet, cleanPath+".zsync")
+	if err != nil {
+		return nil, nil, err
+	}
+	controlResp, err := p.doUpstream(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer controlResp.Body.Close()
+	if controlResp.StatusCode != http.StatusOK {
+		return nil, nil, errNoDelta
+	}
+	control, err := parseZsync(io.LimitReader(controlResp.Body, zsyncMaxControlSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	if control.length != resp.ContentLength {
+		return nil, nil, fmt.Errorf("zsync control file is for a file of %d bytes, upstream has %d", control.length, resp.ContentLength)
+	}
+	// the cached file is read after the request is served
+	old, err := openFS(p.cacheFS(), cachePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	offsets, err := control.match(bufio.NewReader(old))
+	if err != nil {
+		old.Close()
+		return nil, nil, err
+	}
+
+	reused := 0
+	for _, off := range offsets {
+		if off >= 0 {
+			reused++
+		}
+	}
+	p.logger().Info("reusing blocks with zsync", "path", cleanPath, "reused", reused, "blocks", len(offsets))
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer old.Close()
+		pw.CloseWithError(p.writeZsync(pw, cleanPath, control, offsets, old, resp.Header.Get("Last-Modified")))
+	}()
+	digest := &expectedDigest{header: "zsync", alg: "sha", want: control.sha1, hash: sha1.New()}
+	return pr, digest, nil
+}
+
+// writeZsync writes the new file to w, copying reused blocks from old and
+// downloading the others. lastModified ensures the ranges come from the same
+// version as the control file.
+func (p *CachingReverseProxy) writeZsync(w io.Writer, cleanPath string, control *zsyncControl, offsets []int64, old io.ReaderAt, lastModified string) error {
+	bs := int64(control.blockSize)
+	for i := 0; i < len(offsets); {
+		if off := offsets[i]; off >= 0 {
+			if err := copyAt(w, old, off, control.blockLength(i)); err != nil {
+				return err
+			}
+			i++
+			continue
+		}
+		j := i
+		for j < len(offsets) && offsets[j] < 0 {
+			j++
+		}
+		start, end := int64(i)*bs, int64(j-1)*bs+control.blockLength(j-1)
+		if err := p.copyRange(w, cleanPath, start, end, lastModified); err != nil {
+			return err
+		}
+		i = j
+	}
+	return nil
+}
+
+// copyAt copies the n bytes of r at off to w.
+func copyAt(w io.Writer, r io.ReaderAt, off int64, n int64) error {
+	copied, err := io.Copy(w, io.NewSectionReader(r, off, n))
+	if err == nil && copied != n {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// copyRange copies bytes start to end, exclusive, of cleanPath from the
+// upstream to w.
+func (p *CachingReverseProxy) copyRange(w io.Writer, cleanPath string, start, end int64, lastModified string) error {
+	req, err := p.newUpstreamRequest(http.MethodGet, cleanPath)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	req.Header.Set("If-Range", lastModified)
+	resp, err := p.doUpstream(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	want := fmt.Sprintf("bytes %d-%d/", start, end-1)
+	if resp.StatusCode != http.StatusPartialContent || !strings.HasPrefix(resp.Header.Get("Content-Range"), want) {
+		return fmt.Errorf("unexpected response to range request: %s %s", resp.Status, resp.Header.Get("Content-Range"))
+	}
+	n, err := io.Copy(w, resp.Body)
+	if err == nil && n != end-start {
+		err = fmt.Errorf("expected %d bytes, got %d", end-start, n)
+	}
+	return err
+}
+
+// md4Sum returns the MD4 (RFC 1320) checksum of data, used by zsync for
+// block checksums.
+func md4Sum(data []byte) [16]byte {
+	msg := make([]byte, 0, len(data)+72)
+	msg = append(msg, data...)
+	msg = append(msg, 0x80)
+	for len(msg)%64 != 56 {
+		msg = append(msg, 0)
+	}
+	msg = binary.LittleEndian.AppendUint64(msg, uint64(len(data))*8)
+
+	h := [4]uint32{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476}
+	rounds := []struct {
+		f      func(x, y, z uint32) uint32
+		k      uint32
+		order  [16]int
+		shifts [4]int
+	}{
+		{
+			func(x, y, z uint32) uint32 { return x&y | ^x&z },
+			0,
+			[16]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+			[4]int{3, 7, 11, 19},
+		},
+		{
+			func(x, y, z uint32) uint32 { return x&y | x&z | y&z },
+			0x5a827999,
+			[16]int{0, 4, 8, 12, 1, 5, 9, 13, 2, 6, 10, 14, 3, 7, 11, 15},
+			[4]int{3, 5, 9, 13},
+		},
+		{
+			func(x, y, z uint32) uint32 { return x ^ y ^ z },
+			0x6ed9eba1,
+			[16]int{0, 8, 4, 12, 2, 10, 6, 14, 1, 9, 5, 13, 3, 11, 7, 15},
+			[4]int{3, 9, 11, 15},
+		},
+	}
+	var x [16]uint32
+	for len(msg) > 0 {
+		for i := range x {
+			x[i] = binary.LittleEndian.Uint32(msg[4*i:])
+		}
+		msg = msg[64:]
+		s := h
+		for _, round := range rounds {
+			for i, k := range round.order {
+				// the updated register cycles a, d, c, b
+				j := (4 - i%4) % 4
+				f := round.f(s[(j+1)%4], s[(j+2)%4], s[(j+3)%4])
+				s[j] = bits.RotateLeft32(s[j]+f+x[k]+round.k, round.shifts[i%4])
+			}
+		}
+		for i := range h {
+			h[i] += s[i]
+		}
+	}
+	var sum [16]byte
+	for i, v := range h {
+		binary.LittleEndian.PutUint32(sum[4*i:], v)
+	}
+	return sum
+}
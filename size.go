@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// byteSize is a flag.Value for sizes in bytes, accepting K, M, G and T
+// suffixes with binary multiples.
+type byteSize int64
+
+func (s *byteSize) String() string {
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *byteSize) Set(value string) error {
+	multiplier := int64(1)
+	upper := strings.ToUpper(strings.TrimSuffix(strings.ToUpper(value), "B"))
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(upper, suffix) {
+			multiplier = 1 << (10 * uint(i+1))
+			upper = strings.TrimSuffix(upper, suffix)
+			break
+		}
+	}
+	n, err := strconv.ParseInt(upper, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	*s = byteSize(n * multiplier)
+	return nil
+}
+
+// formatBytes formats n bytes with a binary unit.
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%s", n, units[i])
+}
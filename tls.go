@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tlsConfig returns the TLS configuration for serving HTTPS, or nil to serve
+// plain HTTP. The certificate is loaded from certFile and keyFile, or, with
+// acmeHosts, obtained from the ACME server at acmeDirectory for those hosts
+// only, using the TLS-ALPN-01 challenge, and kept in acmeCacheDir.
+func tlsConfig(certFile, keyFile string, acmeHosts []string, acmeCacheDir, acmeDirectory, acmeEmail string) (*tls.Config, error) {
+	switch {
+	case certFile != "" && len(acmeHosts) > 0:
+		return nil, errors.New("--tls-cert cannot be used with --acme-host")
+	case (certFile == "") != (keyFile == ""):
+		return nil, errors.New("--tls-cert and --tls-key must be given together")
+	case certFile != "":
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	case len(acmeHosts) > 0:
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(acmeCacheDir),
+			HostPolicy: autocert.HostWhitelist(acmeHosts...),
+			Email:      acmeEmail,
+		}
+		if acmeDirectory != "" {
+			m.Client = &acme.Client{DirectoryURL: acmeDirectory}
+		}
+		return m.TLSConfig(), nil
+	}
+	return nil, nil
+}
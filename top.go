@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/afq984/cachingreverseproxy/single"
+)
+
+// runTop shows the status of a running instance, polled from its admin API,
+// until interrupted.
+func runTop(proxy *single.CachingReverseProxy, args []string) {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	url := fs.String("url", "http://localhost:8000/-/admin/", "admin API of the instance to monitor")
+	token := fs.String("token", proxy.AdminToken, "admin token of the instance")
+	interval := fs.Duration("interval", time.Second, "refresh interval")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s [flags] top [-url url] [-token token] [-interval duration]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	statusURL := strings.TrimSuffix(*url, "/") + "/status"
+	var prev *single.Status
+	var prevTime time.Time
+	for {
+		status, err := fetchStatus(statusURL, *token)
+		now := time.Now()
+		// move to the top left and clear the screen
+		fmt.Print("\033[H\033[2J")
+		if err != nil {
+			fmt.Println(statusURL)
+			fmt.Println("error:", err)
+		} else {
+			printStatus(status, prev, now.Sub(prevTime))
+			prev, prevTime = status, now
+		}
+		time.Sleep(*interval)
+	}
+}
+
+func fetchStatus(url, token string) (*single.Status, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	status := &single.Status{}
+	if err := json.NewDecoder(resp.Body).Decode(status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// printStatus prints status, with rates computed from the status prev taken
+// elapsed earlier, if any.
+func printStatus(status, prev *single.Status, elapsed time.Duration) {
+	if prev != nil && elapsed > 0 && status.Requests >= prev.Requests {
+		seconds := elapsed.Seconds()
+		fmt.Printf("requests: %7.1f/s  hit ratio: %s  download: %s/s\n",
+			float64(status.Requests-prev.Requests)/seconds,
+			hitRatio(status.Hits-prev.Hits, status.Misses-prev.Misses, status.PassThrough-prev.PassThrough),
+			formatBytes(float64(status.DownloadedBytes-prev.DownloadedBytes)/seconds),
+		)
+	} else {
+		fmt.Println("requests:       -/s  hit ratio:      -  download: -/s")
+	}
+	fmt.Printf("total:    %9d  hit ratio: %s  download: %s\n",
+		status.Requests,
+		hitRatio(status.Hits, status.Misses, status.PassThrough),
+		formatBytes(float64(status.DownloadedBytes)),
+	)
+	fmt.Printf("cache:    %s in %d objects", formatBytes(float64(status.CacheBytes)), status.CacheObjects)
+	if status.CacheFreeBytes >= 0 {
+		fmt.Printf(", %s free", formatBytes(float64(status.CacheFreeBytes)))
+	}
+	fmt.Printf(", %d evicted\n", status.Evictions)
+	fmt.Printf("active:   %d requests, %d downloads\n", status.ActiveRequests, len(status.Downloads))
+	fmt.Println()
+	for _, d := range status.Downloads {
+		fraction := 0.0
+		if d.Size > 0 {
+			fraction = float64(d.Written) / float64(d.Size)
+		}
+		const width = 20
+		bar := strings.Repeat("#", int(fraction*width)) + strings.Repeat(".", width-int(fraction*width))
+		fmt.Printf("[%s] %3.0f%% %10s  %s\n", bar, fraction*100, formatBytes(float64(d.Size)), d.Path)
+	}
+}
+
+// hitRatio formats the share of requests served from the cache.
+func hitRatio(hits, misses, passThrough int64) string {
+	total := hits + misses + passThrough
+	if total == 0 {
+		return "     -"
+	}
+	return fmt.Sprintf("%5.1f%%", float64(hits)/float64(total)*100)
+}